@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// credentials carries HTTP basic auth for private git smart-HTTP mirrors
+// and, with --nsec, the key for NIP-98 auth on private Blossom servers.
+type credentials struct {
+	// username and password are only sent to host.
+	username string
+	password string
+	host     string
+	// insecure allows basic auth over plain http:// (--allow-insecure-auth).
+	insecure bool
+	// hosts holds per-host entries read from a .netrc file; the empty key
+	// is the netrc "default" entry.
+	hosts map[string]netrcEntry
+	// nostrKey signs a NIP-98 event for requests without basic auth.
+	nostrKey *nostrkey.SecretKey
+}
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// loadCredentials combines the --username/--password pair, scoped to host,
+// with an optional .netrc file and an optional Nostr secret key (nsec1...
+// or hex). On host, explicit flags win over netrc entries. insecure lets
+// basic auth go out over plain http://.
+func loadCredentials(username, password, host, netrcPath, nsec string, insecure bool) (*credentials, error) {
+	c := &credentials{username: username, password: password, host: host, insecure: insecure}
+	if password != "" && username == "" {
+		return nil, fmt.Errorf("--password given without --username")
+	}
+	if nsec != "" {
+		var err error
+		if c.nostrKey, err = nostrkey.ParseSecretKey(nsec); err != nil {
+			return nil, fmt.Errorf("--nsec: %w", err)
+		}
+	}
+	if netrcPath != "" {
+		hosts, err := parseNetrc(netrcPath)
+		if err != nil {
+			return nil, err
+		}
+		c.hosts = hosts
+	}
+	return c, nil
+}
+
+// apply sets basic auth on req when credentials are known for its host,
+// or else a NIP-98 header when there is a Nostr key. Basic auth is withheld
+// from plain http:// unless --allow-insecure-auth, since anyone on the path
+// could read it. A URL that already embeds user:pass is left alone; net/http
+// uses it as-is.
+func (c *credentials) apply(req *http.Request) {
+	if c == nil || req.URL.User != nil {
+		return
+	}
+	if login, password, ok := c.basicAuth(req.URL.Hostname()); ok {
+		if req.URL.Scheme != "https" && !c.insecure {
+			log.Printf("⚠️ not sending basic auth to %s over plain http; use https or pass --allow-insecure-auth", req.URL.Host)
+			return
+		}
+		req.SetBasicAuth(login, password)
+		return
+	}
+	if c.nostrKey != nil {
+		if err := signNIP98(req, c.nostrKey, time.Now()); err != nil {
+			log.Printf("⚠️ NIP-98 auth for %s: %v; sending the request without it", redactURL(req.URL.String()), err)
+		}
+	}
+}
+
+// basicAuth returns the basic auth credentials for host: --username and
+// --password on their own host, else its netrc machine entry, else the
+// netrc default.
+func (c *credentials) basicAuth(host string) (login, password string, ok bool) {
+	if c.username != "" && strings.EqualFold(host, c.host) {
+		return c.username, c.password, true
+	}
+	if e, ok := c.hosts[host]; ok {
+		return e.login, e.password, true
+	}
+	if e, ok := c.hosts[""]; ok {
+		return e.login, e.password, true
+	}
+	return "", "", false
+}
+
+// parseNetrc reads the machine/login/password entries of a .netrc file.
+// macdef blocks and unknown tokens are skipped.
+func parseNetrc(path string) (map[string]netrcEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open netrc: %w", err)
+	}
+	defer f.Close()
+
+	hosts := make(map[string]netrcEntry)
+	var (
+		machine string
+		current *netrcEntry
+		inMacro bool
+	)
+	flush := func() {
+		if current != nil {
+			hosts[machine] = *current
+		}
+		current = nil
+	}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				flush()
+				machine = next()
+				current = &netrcEntry{}
+			case "default":
+				flush()
+				machine = ""
+				current = &netrcEntry{}
+			case "login":
+				if current != nil {
+					current.login = next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				}
+			case "macdef":
+				flush()
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read netrc: %w", err)
+	}
+	return hosts, nil
+}
+
+// redactURL hides any password embedded in raw so it never reaches logs or
+// the JSON summary. Strings that don't parse as URLs are returned unchanged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
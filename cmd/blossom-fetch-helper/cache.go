@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packCache is a content-addressed store of downloaded packs. Entries live
+// at <dir>/<digest>.pack, the digest being the --cache-hash of the
+// contents; <dir>/sources/<sha256 of URL> records which entry a source URL
+// produced so a later fetch of the same URL can skip the network.
+type packCache struct {
+	dir  string
+	hash cacheHash
+}
+
+// cacheHash is a content-addressing algorithm for the cache (--cache-hash).
+type cacheHash struct {
+	name string
+	new  func() hash.Hash
+}
+
+var cacheHashes = map[string]cacheHash{
+	"sha256": {"sha256", sha256.New},
+	"sha1":   {"sha1", sha1.New},
+}
+
+// cacheHashFile names the algorithm a cache directory is addressed with,
+// so one dir is never filled by two of them.
+const cacheHashFile = "hash"
+
+// openPackCache opens dir for entries addressed with h. A dir already
+// addressed with another algorithm is refused: its entries' names would
+// never match a lookup, and a mix can't be told apart reliably. Caches from
+// before the marker was written are sha256.
+func openPackCache(dir string, h cacheHash) (*packCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sources"), 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	marker := filepath.Join(dir, cacheHashFile)
+	raw, err := os.ReadFile(marker)
+	switch {
+	case err == nil:
+		if got := strings.TrimSpace(string(raw)); got != h.name {
+			log.Printf("⚠️ cache %s is addressed with %s, not %s", dir, got, h.name)
+			return nil, fmt.Errorf("cache dir %s holds %s entries; use --cache-hash %s or another --cache-dir", dir, got, got)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		entries, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+		if len(entries) > 0 && h.name != "sha256" {
+			log.Printf("⚠️ cache %s already holds sha256 entries", dir)
+			return nil, fmt.Errorf("cache dir %s holds sha256 entries; use --cache-hash sha256 or another --cache-dir", dir)
+		}
+		if err := writeFileAtomic(marker, []byte(h.name+"\n")); err != nil {
+			return nil, fmt.Errorf("cache dir: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("cache dir: %w", err)
+	}
+	return &packCache{dir: dir, hash: h}, nil
+}
+
+// key is the cache address of dl's contents. The SHA-256 is computed while
+// downloading; any other algorithm costs one more read of the file.
+func (c *packCache) key(dl *download) (string, error) {
+	if c.hash.name == "sha256" && dl.sha256 != "" {
+		return dl.sha256, nil
+	}
+	in, err := os.Open(dl.path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := c.hash.new()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *packCache) entryPath(sum string) string {
+	return filepath.Join(c.dir, sum+".pack")
+}
+
+// sourcePath is where the index records which entry u produced. The URL is
+// hashed without its credentials so they never land on disk.
+func (c *packCache) sourcePath(u *url.URL) string {
+	return filepath.Join(c.dir, "sources", sourceKey(u))
+}
+
+// lookup returns the cached entry for u, if one is recorded and still there.
+func (c *packCache) lookup(u *url.URL) (path, sum string, size int64, ok bool) {
+	raw, err := os.ReadFile(c.sourcePath(u))
+	if err != nil {
+		return "", "", 0, false
+	}
+	sum = strings.TrimSpace(string(raw))
+	if !isHexDigest(sum, c.hash.new().Size()) {
+		return "", "", 0, false
+	}
+	fi, err := os.Stat(c.entryPath(sum))
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", "", 0, false
+	}
+	return c.entryPath(sum), sum, fi.Size(), true
+}
+
+// store moves a finished download into the cache under its digest and
+// records u as its source. An existing entry with the same digest wins.
+// Either way dl.path points at the entry afterwards.
+func (c *packCache) store(u *url.URL, dl *download) error {
+	sum, err := c.key(dl)
+	if err != nil {
+		os.Remove(dl.path)
+		return fmt.Errorf("cache pack: %w", err)
+	}
+	entry := c.entryPath(sum)
+	if _, err := os.Stat(entry); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Rename(dl.path, entry); err != nil {
+			os.Remove(dl.path)
+			return fmt.Errorf("cache pack: %w", err)
+		}
+	} else {
+		os.Remove(dl.path)
+	}
+	dl.path = entry
+
+	if err := writeFileAtomic(c.sourcePath(u), []byte(sum+"\n")); err != nil {
+		return fmt.Errorf("cache index: %w", err)
+	}
+	return nil
+}
+
+// verify checks that a copy staged from entry still has the digest the
+// entry is named for, so a corrupted entry is dropped rather than placed.
+func (c *packCache) verify(u *url.URL, entry string, staged *download) error {
+	sum := strings.TrimSuffix(filepath.Base(entry), ".pack")
+	got, err := c.key(staged)
+	if err != nil {
+		return err
+	}
+	if got != sum {
+		os.Remove(c.entryPath(sum))
+		os.Remove(c.sourcePath(u))
+		return fmt.Errorf("cache entry %s.pack is corrupt (%s %s); removed it", sum, c.hash.name, got)
+	}
+	return nil
+}
+
+// cachedDownload returns the cache entry for u, downloading into the cache
+// first on a miss. The returned path is the entry itself and must not be
+// removed by the caller. A download whose SHA-256 isn't want (when set) is
+// discarded before it reaches the cache, and a sha256 entry recorded for u
+// under another digest is passed over for a fresh download.
+func (f *fetcher) cachedDownload(ctx context.Context, u *url.URL, want string) (*download, bool, error) {
+	path, sum, size, ok := f.cache.lookup(u)
+	if ok && want != "" && f.cache.hash.name == "sha256" && sum != want {
+		log.Printf("⚠️ cache entry %s for %s isn't the named %s; downloading again", sum, redactURL(u.String()), want)
+		ok = false
+	}
+	if ok {
+		log.Printf("🗃️ cache hit for %s (%s %s)", redactURL(u.String()), f.cache.hash.name, sum)
+		dl := &download{path: path, packDigests: packDigests{size: size}}
+		if f.cache.hash.name == "sha256" {
+			dl.sha256 = sum
+		}
+		return dl, true, nil
+	}
+	dl, err := f.download(ctx, u, f.cache.dir, want)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkDigest(dl, want); err != nil {
+		os.Remove(dl.path)
+		return nil, false, err
+	}
+	if err := f.cache.store(u, dl); err != nil {
+		return nil, false, err
+	}
+	return dl, false, nil
+}
+
+// prefetchResult is returned by /prefetch.
+type prefetchResult struct {
+	Source   string `json:"source"`
+	SHA256   string `json:"sha256"`
+	Bytes    int64  `json:"bytes"`
+	CacheHit bool   `json:"cache_hit"`
+}
+
+// prefetch warms the cache for source without touching any repository,
+// bounded by --timeout like a fetch.
+func (f *fetcher) prefetch(source string) (res *prefetchResult, err error) {
+	if f.cache == nil {
+		return nil, errors.New("prefetch needs --cache-dir")
+	}
+	ctx, cancel := f.fetchContext()
+	defer cancel()
+	defer func() { err = f.timeoutError(ctx, err) }()
+	u, _, err := f.resolveSource(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	dl, hit, err := f.cachedDownload(ctx, u, urlDigest(u))
+	if err != nil {
+		return nil, err
+	}
+	if dl.sha256 == "" {
+		d, err := digestFile(dl.path)
+		if err != nil {
+			return nil, err
+		}
+		dl.sha256 = d.sha256
+	}
+	return &prefetchResult{Source: redactURL(source), SHA256: dl.sha256, Bytes: dl.size, CacheHit: hit}, nil
+}
+
+// stageFromCache puts a copy of a cache entry into dir for placing. With
+// --hardlink and a local repository the copy is a hard link to the entry,
+// so forks of the same content share one file on disk; when that fails,
+// typically because the cache is on another filesystem, it falls back to
+// copying. linked reports which happened.
+func (f *fetcher) stageFromCache(entry, dir string, local bool) (dl *download, linked bool, err error) {
+	if f.hardlink && local {
+		dl, err := linkToTemp(entry, dir)
+		if err == nil {
+			return dl, true, nil
+		}
+		log.Printf("ℹ️ can't hardlink %s: %v; copying it instead", filepath.Base(entry), err)
+	}
+	dl, err = copyToTemp(entry, dir)
+	return dl, false, err
+}
+
+// linkToTemp hard-links src under a new temp name in dir. The file is
+// still read once to digest it, but nothing is written.
+func linkToTemp(src, dir string) (*download, error) {
+	tmp, err := os.CreateTemp(dir, ".fetch-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	tmp.Close()
+	// os.Link won't replace an existing file, so only the name is kept.
+	os.Remove(tmp.Name())
+	if err := os.Link(src, tmp.Name()); err != nil {
+		return nil, err
+	}
+	d, err := digestFile(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("digest linked pack: %w", err)
+	}
+	return &download{path: tmp.Name(), packDigests: d}, nil
+}
+
+// copyToTemp copies src into a new temp file in dir, digesting it during
+// the copy just like a download.
+func copyToTemp(src, dir string) (*download, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(dir, ".fetch-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	d := newPackDigester()
+	_, err = io.Copy(io.MultiWriter(tmp, d), in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("copy from cache: %w", err)
+	}
+	return &download{path: tmp.Name(), packDigests: d.digests()}, nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// over path, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// isHexDigest reports whether s is a lowercase hex string of n bytes.
+func isHexDigest(s string, n int) bool {
+	if len(s) != 2*n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
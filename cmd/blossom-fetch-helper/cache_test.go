@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// otherFilesystem returns a temp dir on a different filesystem than the
+// default temp dir, skipping the test when there is none.
+func otherFilesystem(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("/dev/shm", "hardlink-test-")
+	if err != nil {
+		t.Skipf("no second filesystem: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	a, errA := os.Stat(dir)
+	b, errB := os.Stat(t.TempDir())
+	if errA != nil || errB != nil || a.Sys().(*syscall.Stat_t).Dev == b.Sys().(*syscall.Stat_t).Dev {
+		t.Skip("/dev/shm is on the same filesystem as the temp dir")
+	}
+	return dir
+}
+
+// TestHardlinkFromCache fetches one pack into two repositories through
+// the cache. With --hardlink on one filesystem all three names are the
+// same file; otherwise each repository gets its own copy.
+func TestHardlinkFromCache(t *testing.T) {
+	pack, _ := gitPack(t, "hardlink", 2)
+	tests := []struct {
+		name     string
+		hardlink bool
+		// elsewhere puts the repositories on another filesystem than the
+		// cache.
+		elsewhere bool
+		linked    bool
+	}{
+		{name: "linked", hardlink: true, linked: true},
+		{name: "copied without --hardlink"},
+		{name: "copied across filesystems", hardlink: true, elsewhere: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := packServer(t, pack)
+			cache, err := openPackCache(t.TempDir(), cacheHashes["sha256"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := t.TempDir()
+			if tt.elsewhere {
+				root = otherFilesystem(t)
+			}
+			f := &fetcher{client: srv.Client(), cache: cache, hardlink: tt.hardlink}
+			source := srv.URL + "/x.pack"
+
+			var placed []string
+			for i, repo := range []string{"a.git", "b.git"} {
+				res, err := f.fetchToRepo(source, "", "", "", filepath.Join(root, repo))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 1 && (!res.CacheHit || res.Linked != tt.linked) {
+					t.Errorf("second fetch: cache hit %v, linked %v; want a hit, linked %v", res.CacheHit, res.Linked, tt.linked)
+				}
+				if got, err := os.ReadFile(res.Pack); err != nil || !bytes.Equal(got, pack) {
+					t.Fatalf("%s holds a different pack (%v)", res.Pack, err)
+				}
+				placed = append(placed, res.Pack)
+			}
+
+			u, _ := url.Parse(source)
+			entry, _, _, ok := cache.lookup(u)
+			if !ok {
+				t.Fatal("pack not cached")
+			}
+			entryInfo, err := os.Stat(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range placed {
+				info, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if same := os.SameFile(entryInfo, info); same != tt.linked {
+					t.Errorf("%s is the cache entry: %v, want %v", p, same, tt.linked)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheHashAddressing(t *testing.T) {
+	pack, _ := gitPack(t, "addressed", 2)
+	sum256 := sha256.Sum256(pack)
+	sum1 := sha1.Sum(pack)
+	tests := []struct {
+		hash string
+		want string
+	}{
+		{hash: "sha256", want: hex.EncodeToString(sum256[:])},
+		{hash: "sha1", want: hex.EncodeToString(sum1[:])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			srv := packServer(t, pack)
+			dir := t.TempDir()
+			cache, err := openPackCache(dir, cacheHashes[tt.hash])
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fetcher{client: srv.Client(), cache: cache}
+			source := srv.URL + "/x.pack"
+			fetch := func() *fetchResult {
+				t.Helper()
+				res, err := f.fetchToRepo(source, "", "", "", t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res
+			}
+			if res := fetch(); res.CacheHit {
+				t.Fatal("first fetch hit an empty cache")
+			}
+
+			// Named, indexed and looked up by the configured digest.
+			entries, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+			if want := filepath.Join(dir, tt.want+".pack"); len(entries) != 1 || entries[0] != want {
+				t.Fatalf("cache holds %v, want %s", entries, want)
+			}
+			u, _ := url.Parse(source)
+			if raw, err := os.ReadFile(cache.sourcePath(u)); err != nil || strings.TrimSpace(string(raw)) != tt.want {
+				t.Errorf("source index holds %q (%v), want %s", raw, err, tt.want)
+			}
+			if _, sum, _, ok := cache.lookup(u); !ok || sum != tt.want {
+				t.Errorf("lookup gave %q (found %v), want %s", sum, ok, tt.want)
+			}
+			if marker, _ := os.ReadFile(filepath.Join(dir, cacheHashFile)); strings.TrimSpace(string(marker)) != tt.hash {
+				t.Errorf("marker says %q", marker)
+			}
+			if res := fetch(); !res.CacheHit {
+				t.Error("second fetch missed the cache")
+			}
+
+			// A damaged entry no longer matches its name under the same
+			// algorithm, so it is dropped and fetched again.
+			if err := os.WriteFile(entries[0], bytes.ToUpper(pack), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.fetchToRepo(source, "", "", "", t.TempDir()); err == nil || !strings.Contains(err.Error(), tt.hash) {
+				t.Fatalf("fetch from a damaged entry: %v, want it reported corrupt", err)
+			}
+			if res := fetch(); res.CacheHit {
+				t.Error("damaged entry served again")
+			}
+		})
+	}
+}
+
+func TestOpenPackCacheMixing(t *testing.T) {
+	tests := []struct {
+		name string
+		// marker is the hash file's content, if any; legacy puts a pack
+		// entry in the dir.
+		marker string
+		legacy bool
+		open   string
+		ok     bool
+	}{
+		{name: "new dir, sha256", open: "sha256", ok: true},
+		{name: "new dir, sha1", open: "sha1", ok: true},
+		{name: "same algorithm", marker: "sha1\n", open: "sha1", ok: true},
+		{name: "sha1 dir opened as sha256", marker: "sha1\n", open: "sha256"},
+		{name: "sha256 dir opened as sha1", marker: "sha256\n", open: "sha1"},
+		{name: "unmarked entries are sha256", legacy: true, open: "sha256", ok: true},
+		{name: "unmarked entries opened as sha1", legacy: true, open: "sha1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.marker != "" {
+				if err := os.WriteFile(filepath.Join(dir, cacheHashFile), []byte(tt.marker), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.legacy {
+				if err := os.WriteFile(filepath.Join(dir, strings.Repeat("ab", 32)+".pack"), []byte("PACK"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := openPackCache(dir, cacheHashes[tt.open])
+			if (err == nil) != tt.ok {
+				t.Fatalf("open as %s: %v", tt.open, err)
+			}
+			marker, _ := os.ReadFile(filepath.Join(dir, cacheHashFile))
+			if tt.ok && strings.TrimSpace(string(marker)) != tt.open {
+				t.Errorf("marker says %q, want %s", marker, tt.open)
+			}
+			if !tt.ok && string(marker) != tt.marker {
+				t.Errorf("refused open rewrote the marker to %q", marker)
+			}
+		})
+	}
+}
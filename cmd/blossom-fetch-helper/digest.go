@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// packDigester is an io.Writer that computes everything we check about a
+// pack while it is being written: the SHA-256 content address and the git
+// pack trailer (SHA-1 of all bytes but the last 20, which must equal those
+// 20 bytes). Feeding it from the same io.Copy that writes the temp file
+// means large packs are read exactly once.
+type packDigester struct {
+	sha256 hash.Hash
+	sha1   hash.Hash
+	n      int64
+
+	header    [packHeaderLen]byte
+	headerLen int
+	// tail holds the most recent bytes not yet fed to sha1; once the
+	// stream ends it is the candidate trailer.
+	tail    [hashLen]byte
+	tailLen int
+}
+
+func newPackDigester() *packDigester {
+	return &packDigester{sha256: sha256.New(), sha1: sha1.New()}
+}
+
+func (d *packDigester) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.n += int64(len(p))
+
+	if d.headerLen < packHeaderLen {
+		d.headerLen += copy(d.header[d.headerLen:], p)
+	}
+
+	if len(p) >= hashLen {
+		d.sha1.Write(d.tail[:d.tailLen])
+		d.sha1.Write(p[:len(p)-hashLen])
+		d.tailLen = copy(d.tail[:], p[len(p)-hashLen:])
+		return len(p), nil
+	}
+	combined := append(d.tail[:d.tailLen:d.tailLen], p...)
+	if over := len(combined) - hashLen; over > 0 {
+		d.sha1.Write(combined[:over])
+		combined = combined[over:]
+	}
+	d.tailLen = copy(d.tail[:], combined)
+	return len(p), nil
+}
+
+// packDigests is the outcome of a single pass over a pack.
+type packDigests struct {
+	size   int64
+	sha256 string
+	// packSum is the verified pack trailer; nil when packErr is set.
+	packSum []byte
+	objects uint32
+	packErr error
+}
+
+var errNotPack = errors.New("not a valid git pack")
+
+func (d *packDigester) digests() packDigests {
+	out := packDigests{size: d.n, sha256: hex.EncodeToString(d.sha256.Sum(nil))}
+	switch {
+	case d.n < packHeaderLen+hashLen:
+		out.packErr = fmt.Errorf("%w: only %d bytes", errNotPack, d.n)
+	case string(d.header[:4]) != "PACK":
+		out.packErr = fmt.Errorf("%w: missing PACK signature", errNotPack)
+	case !bytes.Equal(d.tail[:], d.sha1.Sum(nil)):
+		out.packErr = fmt.Errorf("%w: trailer checksum mismatch", errNotPack)
+	default:
+		if v := binary.BigEndian.Uint32(d.header[4:8]); v != 2 && v != 3 {
+			out.packErr = fmt.Errorf("%w: unsupported version %d", errNotPack, v)
+			break
+		}
+		out.packSum = append([]byte(nil), d.tail[:]...)
+		out.objects = binary.BigEndian.Uint32(d.header[8:12])
+	}
+	return out
+}
+
+// digestFile runs a file on disk through a packDigester.
+func digestFile(path string) (packDigests, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return packDigests{}, err
+	}
+	defer in.Close()
+	d := newPackDigester()
+	if _, err := io.Copy(d, in); err != nil {
+		return packDigests{}, err
+	}
+	return d.digests(), nil
+}
+
+// errDigestMismatch is a download whose SHA-256 isn't the one its source
+// named.
+var errDigestMismatch = errors.New("sha256 mismatch")
+
+// urlDigest returns the SHA-256 a Blossom URL addresses its blob by: the
+// last path segment, less one extension, when that is 64 hex digits.
+// Other URLs name no digest and yield "".
+func urlDigest(u *url.URL) string {
+	name := path.Base(u.Path)
+	name = strings.ToLower(strings.TrimSuffix(name, path.Ext(name)))
+	if isHexDigest(name, sha256.Size) {
+		return name
+	}
+	return ""
+}
+
+// checkDigest fails when want is set and differs from dl's SHA-256.
+func checkDigest(dl *download, want string) error {
+	if want != "" && dl.sha256 != want {
+		return fmt.Errorf("%w: expected %s, got %s", errDigestMismatch, want, dl.sha256)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// writeInChunks feeds data to w in pieces of n bytes, the last one shorter.
+func writeInChunks(w io.Writer, data []byte, n int) {
+	for len(data) > 0 {
+		k := min(n, len(data))
+		w.Write(data[:k])
+		data = data[k:]
+	}
+}
+
+// TestPackDigesterChunking checks the digests don't depend on how the
+// stream is cut up, in particular around the 20-byte trailer held back
+// from SHA-1.
+func TestPackDigesterChunking(t *testing.T) {
+	pack, _ := gitPack(t, "digest", 2)
+	wantSHA := sha256.Sum256(pack)
+	wantSum := pack[len(pack)-sha1.Size:]
+	for _, n := range []int{1, 7, hashLen - 1, hashLen, hashLen + 1, packHeaderLen, 4096, len(pack) - 1, len(pack)} {
+		d := newPackDigester()
+		writeInChunks(d, pack, n)
+		got := d.digests()
+		if got.packErr != nil {
+			t.Fatalf("chunks of %d: %v", n, got.packErr)
+		}
+		if got.sha256 != hex.EncodeToString(wantSHA[:]) {
+			t.Errorf("chunks of %d: sha256 %s", n, got.sha256)
+		}
+		if !bytes.Equal(got.packSum, wantSum) {
+			t.Errorf("chunks of %d: pack trailer %x, want %x", n, got.packSum, wantSum)
+		}
+		if got.objects != 5 || got.size != int64(len(pack)) {
+			t.Errorf("chunks of %d: %d objects, %d bytes", n, got.objects, got.size)
+		}
+	}
+}
+
+func TestPackDigesterRejects(t *testing.T) {
+	pack, _ := gitPack(t, "reject", 2)
+	withTrailer := func(body []byte) []byte {
+		sum := sha1.Sum(body)
+		return append(body, sum[:]...)
+	}
+	v4 := append([]byte(nil), pack[:len(pack)-sha1.Size]...)
+	binary.BigEndian.PutUint32(v4[4:8], 4)
+	flipped := append([]byte(nil), pack...)
+	flipped[len(flipped)/2] ^= 0x40
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "only 0 bytes"},
+		{"header only", pack[:packHeaderLen], "only 12 bytes"},
+		{"no PACK signature", withTrailer(append([]byte("KCAP"), pack[4:len(pack)-sha1.Size]...)), "missing PACK signature"},
+		{"body changed under the trailer", flipped, "trailer checksum mismatch"},
+		{"version 4", withTrailer(v4), "unsupported version 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPackDigester()
+			writeInChunks(d, tt.data, 5)
+			got := d.digests()
+			if !errors.Is(got.packErr, errNotPack) || !bytes.Contains([]byte(got.packErr.Error()), []byte(tt.want)) {
+				t.Fatalf("packErr = %v, want %q", got.packErr, tt.want)
+			}
+			if got.packSum != nil {
+				t.Error("rejected pack has a trailer")
+			}
+			// The content address is still reported for non-packs.
+			if sum := sha256.Sum256(tt.data); got.sha256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("sha256 %s", got.sha256)
+			}
+		})
+	}
+}
+
+// countingReader records how many bytes were read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestSaveBodyDigestsInOnePass checks both checksums come out of the one
+// copy that writes the temp file, with the body read exactly once.
+func TestSaveBodyDigestsInOnePass(t *testing.T) {
+	pack, _ := gitPack(t, "one pass", 2)
+	body := &countingReader{r: bytes.NewReader(pack)}
+	f := &fetcher{}
+	dl, err := f.saveBody(body, int64(len(pack)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.n != len(pack) {
+		t.Errorf("read %d bytes of a %d-byte body", body.n, len(pack))
+	}
+	sum := sha256.Sum256(pack)
+	if dl.sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 %s", dl.sha256)
+	}
+	if dl.packErr != nil || !bytes.Equal(dl.packSum, pack[len(pack)-sha1.Size:]) {
+		t.Errorf("pack trailer %x (%v)", dl.packSum, dl.packErr)
+	}
+	if got, err := os.ReadFile(dl.path); err != nil || !bytes.Equal(got, pack) {
+		t.Errorf("temp file doesn't hold the body (%v)", err)
+	}
+}
+
+// benchPack is a pack-shaped blob of size bytes with a valid trailer.
+func benchPack(b *testing.B, size int) []byte {
+	b.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	copy(data, "PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+	sum := sha1.Sum(data[:size-sha1.Size])
+	copy(data[size-sha1.Size:], sum[:])
+	return data
+}
+
+func BenchmarkPackDigester(b *testing.B) {
+	data := benchPack(b, 16<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := newPackDigester()
+		io.CopyBuffer(d, bytes.NewReader(data), make([]byte, 32<<10))
+		if d.digests().packErr != nil {
+			b.Fatal("benchmark pack rejected")
+		}
+	}
+}
+
+// BenchmarkTwoPassDigests is the baseline the single pass replaced:
+// SHA-256 over the file, then SHA-1 over it again for the trailer.
+func BenchmarkTwoPassDigests(b *testing.B) {
+	data := benchPack(b, 16<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := sha256.New()
+		io.CopyBuffer(h, bytes.NewReader(data), make([]byte, 32<<10))
+		h.Sum(nil)
+		s := sha1.New()
+		io.CopyBuffer(s, bytes.NewReader(data[:len(data)-sha1.Size]), make([]byte, 32<<10))
+		if !bytes.Equal(s.Sum(nil), data[len(data)-sha1.Size:]) {
+			b.Fatal("benchmark pack rejected")
+		}
+	}
+}
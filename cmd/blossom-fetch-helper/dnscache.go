@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache remembers host lookups for the download client (--dns-cache-ttl).
+// Go's resolver doesn't expose record TTLs, so every entry lives for the
+// configured ttl, which acts as the cap a TTL-aware cache would apply. An
+// entry in the last quarter of its life is still served while a refresh
+// runs in the background, and if a lookup fails the expired entry keeps
+// being used rather than failing the fetch.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dialer net.Dialer
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs      []string
+	expires    time.Time
+	refreshing bool
+}
+
+// newDNSCache returns nil (no caching) when ttl <= 0.
+func newDNSCache(ttl time.Duration) *dnsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		dialer:  net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// resolve returns the addresses for host, from the cache when possible.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok && now.Before(e.expires) {
+		if !e.refreshing && e.expires.Sub(now) < c.ttl/4 {
+			e.refreshing = true
+			go c.refresh(host)
+		}
+		addrs := e.addrs
+		c.mu.Unlock()
+		return addrs, nil
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		if ok {
+			log.Printf("⚠️ resolve %s: %v; using the expired cache entry", host, err)
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	c.store(host, addrs)
+	return addrs, nil
+}
+
+// refresh looks host up again ahead of expiry. Failures leave the current
+// entry alone; resolve decides what to do once it expires.
+func (c *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		c.mu.Lock()
+		if e, ok := c.entries[host]; ok {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.store(host, addrs)
+}
+
+func (c *dnsCache) store(host string, addrs []string) {
+	c.mu.Lock()
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+// dialContext is an http.Transport DialContext that resolves through the
+// cache and tries each address in turn.
+func (c *dnsCache) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers every lookup with loopback and counts the calls per
+// host. Once down is set it fails instead.
+type fakeResolver struct {
+	mu    sync.Mutex
+	calls map[string]int
+	down  bool
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[host]++
+	if r.down {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	return []string{"127.0.0.1"}, nil
+}
+
+func (r *fakeResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[host]
+}
+
+func (r *fakeResolver) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func TestDNSCache(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	pack, _ := gitPack(t, "dns", 2)
+	srv := packServer(t, pack)
+	port := mustURL(t, srv.URL).Port()
+
+	type fetch struct {
+		host string
+		// after is how long to wait before this fetch.
+		after time.Duration
+		// down makes the resolver fail from this fetch on.
+		down bool
+	}
+	tests := []struct {
+		name    string
+		fetches []fetch
+		lookups map[string]int
+	}{
+		{
+			name:    "same host twice",
+			fetches: []fetch{{host: "blossom.test"}, {host: "blossom.test"}},
+			lookups: map[string]int{"blossom.test": 1},
+		},
+		{
+			name:    "two hosts",
+			fetches: []fetch{{host: "a.blossom.test"}, {host: "b.blossom.test"}, {host: "a.blossom.test"}},
+			lookups: map[string]int{"a.blossom.test": 1, "b.blossom.test": 1},
+		},
+		{
+			name:    "after the ttl",
+			fetches: []fetch{{host: "blossom.test"}, {host: "blossom.test", after: ttl + 50*time.Millisecond}},
+			lookups: map[string]int{"blossom.test": 2},
+		},
+		{
+			name:    "refreshed ahead of expiry",
+			fetches: []fetch{{host: "blossom.test"}, {host: "blossom.test", after: ttl * 4 / 5}},
+			lookups: map[string]int{"blossom.test": 2},
+		},
+		{
+			name:    "resolver down after the ttl",
+			fetches: []fetch{{host: "blossom.test"}, {host: "blossom.test", after: ttl + 50*time.Millisecond, down: true}},
+			lookups: map[string]int{"blossom.test": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{calls: make(map[string]int)}
+			dns := newDNSCache(ttl)
+			dns.lookup = resolver.LookupHost
+			// Without keep-alives every fetch dials, and so resolves.
+			client := &http.Client{Transport: &http.Transport{DialContext: dns.dialContext, DisableKeepAlives: true}}
+			f := &fetcher{client: client}
+
+			for i, fe := range tt.fetches {
+				time.Sleep(fe.after)
+				if fe.down {
+					resolver.setDown(true)
+				}
+				if _, err := f.fetchToRepo("http://"+fe.host+":"+port+"/x.pack", "", "", "", t.TempDir()); err != nil {
+					t.Fatalf("fetch %d: %v", i, err)
+				}
+			}
+			// A refresh ahead of expiry runs in the background.
+			deadline := time.Now().Add(time.Second)
+			for host, want := range tt.lookups {
+				for resolver.count(host) < want && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if got := resolver.count(host); got != want {
+					t.Errorf("%s resolved %d times, want %d", host, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSCacheUncachedFailure(t *testing.T) {
+	resolver := &fakeResolver{calls: make(map[string]int), down: true}
+	dns := newDNSCache(time.Minute)
+	dns.lookup = resolver.LookupHost
+	for i := 0; i < 2; i++ {
+		var dnsErr *net.DNSError
+		if _, err := dns.resolve(context.Background(), "blossom.test"); !errors.As(err, &dnsErr) {
+			t.Fatalf("resolve %d: err = %v, want the resolver's", i, err)
+		}
+	}
+	// Failures aren't cached.
+	if got := resolver.count("blossom.test"); got != 2 {
+		t.Errorf("resolved %d times, want 2", got)
+	}
+}
+
+func mustURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
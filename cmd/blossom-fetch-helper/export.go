@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// handleExport serves GET /repos/{repo_path}/export.tar: a tar of the
+// repository's packs and their indexes, for moving them to another node.
+// Entries are named objects/pack/<file>, so extracting the archive into a
+// bare repository puts them where git looks. The archive is written as it
+// is read; nothing is buffered beyond one copy chunk.
+func (s *fetchServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	rel, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/repos/"), "/export.tar")
+	if !ok || rel == "" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	repoPath, err := s.repoPath(rel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	files, err := exportFiles(packDir(repoPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no packs in %s", rel))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(repoPath)+".tar"))
+	if r.Method == http.MethodHead {
+		return
+	}
+	tw := tar.NewWriter(w)
+	for _, path := range files {
+		if err := addToTar(tw, path, "objects/pack/"+filepath.Base(path)); err != nil {
+			// The status is long gone; cutting the stream short leaves
+			// the client with a truncated archive tar will reject.
+			log.Printf("❌ export %s: %v", rel, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("❌ export %s: %v", rel, err)
+		return
+	}
+	log.Printf("📦 exported %d files from %s", len(files), repoPath)
+}
+
+// exportFiles lists the packs in dir and the indexes next to them, each
+// pack before its index so an archive extracted in order never has an
+// index without its pack. Temp files from fetches in progress are left out.
+func exportFiles(dir string) ([]string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	packs, err := filepath.Glob(filepath.Join(dir, "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(packs)
+	var files []string
+	for _, pack := range packs {
+		if strings.HasPrefix(filepath.Base(pack), ".") {
+			continue
+		}
+		files = append(files, pack)
+		if idx := idxPathFor(pack); fileExists(idx) {
+			files = append(files, idx)
+		}
+	}
+	return files, nil
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// addToTar writes the file at path into tw under name.
+func addToTar(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uname, hdr.Gname = "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
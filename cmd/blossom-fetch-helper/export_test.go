@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// placeFiles writes files, named relative to dir, creating directories
+// as needed.
+func placeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	packA, idxA := gitPack(t, "export a", 2)
+	packB, _ := gitPack(t, "export b", 2)
+	root := t.TempDir()
+	placeFiles(t, root, map[string][]byte{
+		"npub1a/two.git/objects/pack/pack-a.pack": packA,
+		"npub1a/two.git/objects/pack/pack-a.idx":  idxA,
+		// No index yet, and a fetch still writing.
+		"npub1a/two.git/objects/pack/pack-b.pack":        packB,
+		"npub1a/two.git/objects/pack/.pack-c.pack.1.tmp": []byte("partial"),
+		"npub1a/two.git/HEAD":                            []byte("ref: refs/heads/main\n"),
+		"npub1a/empty.git/objects/pack/.keep":            nil,
+	})
+	if err := os.MkdirAll(filepath.Join(root, "npub1a/bare.git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	placeFiles(t, outside, map[string][]byte{"objects/pack/pack-a.pack": packA})
+	if err := os.Symlink(outside, filepath.Join(root, "npub1a/escape.git")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer((&fetchServer{f: &fetcher{}, reposRoot: root, token: "t0ken", canonical: true}).routes())
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		repo   string
+		token  string
+		status int
+		// entries are the archive's names in order, content what each holds.
+		entries []string
+		content map[string][]byte
+	}{
+		{
+			name: "packs and indexes", repo: "npub1a/two.git", token: "t0ken", status: http.StatusOK,
+			entries: []string{"objects/pack/pack-a.pack", "objects/pack/pack-a.idx", "objects/pack/pack-b.pack"},
+			content: map[string][]byte{
+				"objects/pack/pack-a.pack": packA,
+				"objects/pack/pack-a.idx":  idxA,
+				"objects/pack/pack-b.pack": packB,
+			},
+		},
+		{name: "pack directory without packs", repo: "npub1a/empty.git", token: "t0ken", status: http.StatusOK},
+		{name: "HEAD sends no archive", method: http.MethodHead, repo: "npub1a/two.git", token: "t0ken", status: http.StatusOK},
+		{name: "no pack directory", repo: "npub1a/bare.git", token: "t0ken", status: http.StatusNotFound},
+		{name: "no such repo", repo: "npub1a/missing.git", token: "t0ken", status: http.StatusNotFound},
+		{name: "symlink out of the repos root", repo: "npub1a/escape.git", token: "t0ken", status: http.StatusBadRequest},
+		{name: "no token", repo: "npub1a/two.git", status: http.StatusUnauthorized},
+		{name: "wrong token", repo: "npub1a/two.git", token: "guess", status: http.StatusUnauthorized},
+		{name: "not GET", method: http.MethodPost, repo: "npub1a/two.git", token: "t0ken", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, srv.URL+"/repos/"+tt.repo+"/export.tar", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/x-tar" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if method == http.MethodHead {
+				return
+			}
+
+			var names []string
+			tr := tar.NewReader(resp.Body)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("archive after %q: %v", names, err)
+				}
+				names = append(names, hdr.Name)
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, tt.content[hdr.Name]) {
+					t.Errorf("%s holds %d bytes, not the file's %d", hdr.Name, len(data), len(tt.content[hdr.Name]))
+				}
+			}
+			if !slices.Equal(names, tt.entries) {
+				t.Errorf("archive holds %q, want %q", names, tt.entries)
+			}
+		})
+	}
+}
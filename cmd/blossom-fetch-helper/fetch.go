@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchResult is the JSON summary printed after a successful fetch.
+type fetchResult struct {
+	Source   string `json:"source"`
+	RepoPath string `json:"repo_path"`
+	Pack     string `json:"pack"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+	// CacheHit is true when the pack came from --cache-dir without a download.
+	CacheHit bool `json:"cache_hit,omitempty"`
+	// Resolution is set for nip96:// sources: "descriptor" or "rewrite".
+	Resolution string `json:"resolution,omitempty"`
+	// IndexVerified is true when --verify-idx cross-checked the .idx.
+	IndexVerified bool `json:"index_verified,omitempty"`
+	// PackSHA1 is the verified pack trailer, set with --verify-pack.
+	PackSHA1 string `json:"pack_sha1,omitempty"`
+	// Objects is the object count from the pack header, set with
+	// --verify-pack or --object-count.
+	Objects uint32 `json:"objects,omitempty"`
+	// Index is where the .idx was placed when an index source was given;
+	// IndexSource says whether it was "provided" or "generated".
+	Index       string `json:"index,omitempty"`
+	IndexSource string `json:"index_source,omitempty"`
+	// Protocol is "git" when --allow-git-protocol fetched over git://.
+	Protocol string `json:"protocol,omitempty"`
+	// Signed is true when the pack's minisign signature was verified.
+	Signed bool `json:"signed,omitempty"`
+	// Linked is true when --hardlink placed the pack as a hard link to its
+	// cache entry.
+	Linked bool `json:"linked,omitempty"`
+	// AlreadyPresent is true when the repository already held the pack
+	// with the expected SHA-256, so nothing was downloaded.
+	AlreadyPresent bool `json:"already_present,omitempty"`
+}
+
+// fetcher holds the HTTP client and credentials shared by every download.
+type fetcher struct {
+	client *http.Client
+	creds  *credentials
+	// cache, when set, content-addresses every download (--cache-dir).
+	cache *packCache
+	// verifyIdx cross-checks the .idx next to the destination against
+	// the downloaded pack before it is placed.
+	verifyIdx bool
+	// verifyPack rejects downloads whose git pack trailer doesn't match.
+	verifyPack bool
+	// resume keeps interrupted downloads as .part files so a later run
+	// can continue them (--resume). parts tracks the ones in flight.
+	resume bool
+	parts  sync.Map
+	// sink, when set, replaces the local repository as the destination
+	// of fetchToRepo; see packSink.
+	sink func(repoPath string) (packSink, error)
+	// gone remembers sources that answered 404/410 (--negative-ttl).
+	gone *negativeCache
+	// renameRetries bounds how often the final rename is retried before
+	// falling back to a copy.
+	renameRetries int
+	// requireRepo refuses to place packs unless the destination already
+	// looks like a bare repository; initRepo creates one instead.
+	requireRepo bool
+	initRepo    bool
+	// gitProtocol fetches git:// sources natively (--allow-git-protocol).
+	gitProtocol bool
+	// minObjectBytes is the per-object size floor for checkPackDensity
+	// (--min-object-bytes); 0 disables the check.
+	minObjectBytes int
+	// objectCount reports the pack header's object count (--object-count).
+	objectCount bool
+	// hardlink places cache entries into local repositories as hard links
+	// rather than copies (--hardlink).
+	hardlink bool
+	// sigKey, when set, requires every pack to carry a valid minisign
+	// signature (--pubkey).
+	sigKey *minisignKey
+	// maxRetries is how often a transient download failure is retried
+	// (--max-retries).
+	maxRetries int
+	// progress draws a progress line on stderr during downloads; off with
+	// --quiet or when stderr isn't a terminal.
+	progress bool
+	// parallel splits downloads into that many concurrent Range requests
+	// (--parallel); 1 streams them.
+	parallel int
+	// indexPacks validates every pack with git index-pack and places the
+	// resulting .idx with it; --no-verify turns it off.
+	indexPacks bool
+	// timeout bounds each fetch, retries included (--timeout); idleTimeout
+	// abandons a request that receives nothing for that long
+	// (--idle-timeout). 0 disables either.
+	timeout     time.Duration
+	idleTimeout time.Duration
+	// force downloads packs even when the repository already holds them
+	// (--force).
+	force bool
+	// localFiles accepts file: sources; off for --serve.
+	localFiles bool
+}
+
+// urlNormalizer rewrites one source form to an http(s) URL. ok is false
+// when raw isn't a form the normalizer handles, so the next one is tried.
+type urlNormalizer func(raw string) (normalized string, ok bool, err error)
+
+// normalizers are tried in order; the first that claims a source wins.
+// The built-ins come first and only claim their own prefixes.
+var normalizers = []urlNormalizer{
+	normalizeSSH,
+	prefixNormalizer("git://", "https://"),
+	prefixNormalizer("nip96://", "https://"),
+	normalizeHTTP,
+	normalizeFile,
+}
+
+// registerNormalizer adds a handler for a custom hosting scheme. Call it
+// before any fetch starts (e.g. from init); the list is not locked.
+func registerNormalizer(n urlNormalizer) {
+	normalizers = append(normalizers, n)
+}
+
+// normalizeGitURL rewrites the supported source forms to an https:// URL:
+//
+//	git@host:owner/repo  -> https://host/owner/repo
+//	git://host/path      -> https://host/path
+//	nip96://host/path    -> https://host/path
+//	file:rel/path        -> file:///abs/rel/path
+//
+// http:// and https:// URLs and file:///abs/path are returned unchanged,
+// and any registered normalizers are consulted after the built-ins.
+func normalizeGitURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	for _, n := range normalizers {
+		normalized, ok, err := n(raw)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return normalized, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported source scheme in %q", redactURL(raw))
+}
+
+func normalizeSSH(raw string) (string, bool, error) {
+	rest, ok := strings.CutPrefix(raw, "git@")
+	if !ok {
+		return "", false, nil
+	}
+	host, p, ok := strings.Cut(rest, ":")
+	if !ok || host == "" || p == "" {
+		return "", false, fmt.Errorf("malformed ssh source %q", raw)
+	}
+	return "https://" + host + "/" + strings.TrimPrefix(p, "/"), true, nil
+}
+
+func normalizeHTTP(raw string) (string, bool, error) {
+	if strings.HasPrefix(raw, "https://") || strings.HasPrefix(raw, "http://") {
+		return raw, true, nil
+	}
+	return "", false, nil
+}
+
+// prefixNormalizer swaps one scheme prefix for another.
+func prefixNormalizer(from, to string) urlNormalizer {
+	return func(raw string) (string, bool, error) {
+		rest, ok := strings.CutPrefix(raw, from)
+		if !ok {
+			return "", false, nil
+		}
+		return to + rest, true, nil
+	}
+}
+
+// packDir is where git looks for packfiles inside a bare repository.
+func packDir(repoPath string) string {
+	return filepath.Join(repoPath, "objects", "pack")
+}
+
+// packName derives the destination filename from the last path segment of
+// the source URL, making sure it carries a .pack extension.
+func packName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "." || name == "/" || name == "" {
+		name = "fetched"
+	}
+	if !strings.HasSuffix(name, ".pack") {
+		name += ".pack"
+	}
+	return name
+}
+
+// resolveSource turns a user-supplied source into the URL to download from.
+// resolution is only set for nip96:// sources.
+func (f *fetcher) resolveSource(ctx context.Context, source string) (u *url.URL, resolution string, err error) {
+	var normalized string
+	if strings.HasPrefix(source, "nip96://") {
+		normalized, resolution, err = f.resolveNIP96(ctx, source)
+	} else {
+		normalized, err = normalizeGitURL(source)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	u, err = url.Parse(normalized)
+	if err != nil {
+		return nil, "", fmt.Errorf("parse source: %w", err)
+	}
+	if u.Scheme == "file" && !f.localFiles {
+		return nil, "", errFileSourceRefused
+	}
+	return u, resolution, nil
+}
+
+// download is a fully written temp file together with the digests taken
+// while writing it. The caller removes it once it has been renamed into
+// place (or on failure).
+type download struct {
+	path string
+	packDigests
+}
+
+// newClient returns the HTTP client used for downloads, following at most
+// maxRedirects redirects. Past that the 3xx response itself is returned and
+// checkStatus reports it. A positive hostRate caps requests per second to
+// each upstream host, a positive dnsTTL caches host lookups, and
+// insecureHosts are exempt from TLS certificate verification.
+func newClient(maxRedirects int, hostRate float64, dnsTTL time.Duration, insecureHosts []string) *http.Client {
+	c := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	dns := newDNSCache(dnsTTL)
+	if dns != nil || len(insecureHosts) > 0 {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if dns != nil {
+			t.DialContext = dns.dialContext
+		}
+		if len(insecureHosts) > 0 {
+			t.TLSClientConfig = insecureTLSConfig(insecureHosts)
+		}
+		transport = t
+	}
+	if l := newHostLimiter(hostRate); l != nil {
+		transport = rateLimitedTransport{next: transport, limiter: l}
+	}
+	if transport != http.DefaultTransport {
+		c.Transport = transport
+	}
+	return c
+}
+
+// Classes of statusError, for errors.Is.
+var (
+	errRedirectStatus = errors.New("redirect not followed")
+	errClientStatus   = errors.New("client error")
+	errServerStatus   = errors.New("server error")
+)
+
+// statusError is a download answered with a status it can't use.
+type statusError struct {
+	url    string
+	code   int
+	status string
+	// location is the redirect target for 3xx answers.
+	location string
+	// retryAfter is the server's Retry-After, if it sent one.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	if e.location != "" {
+		return fmt.Sprintf("get %s: %s to %s not followed", e.url, e.status, redactURL(e.location))
+	}
+	return fmt.Sprintf("get %s: unexpected status %s", e.url, e.status)
+}
+
+func (e *statusError) Unwrap() error {
+	switch {
+	case e.code >= 500:
+		return errServerStatus
+	case e.code >= 400:
+		return errClientStatus
+	case e.code >= 300:
+		return errRedirectStatus
+	}
+	return nil
+}
+
+// checkStatus decides whether a download response carries a usable body.
+// Any 2xx is success, except that 206 is only meaningful when a range was
+// asked for. Redirects are followed by the client's redirect policy, so a
+// 3xx that still arrives here was refused by it.
+func checkStatus(resp *http.Response, ranged bool) error {
+	code := resp.StatusCode
+	if code >= 200 && code < 300 && (code != http.StatusPartialContent || ranged) {
+		return nil
+	}
+	e := &statusError{url: redactURL(resp.Request.URL.String()), code: code, status: resp.Status}
+	if code >= 300 && code < 400 {
+		e.location = resp.Header.Get("Location")
+	}
+	e.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return e
+}
+
+// download fetches u into dir, failing fast for sources the negative cache
+// knows are gone. want is the SHA-256 the body is expected to have, or "";
+// with --resume it lets a partial download continue without an ETag.
+// Transient failures are retried up to maxRetries times (see retryable),
+// and with --resume each retry continues where the last one stopped. Every
+// attempt runs under ctx, and so does the wait between them.
+func (f *fetcher) download(ctx context.Context, u *url.URL, dir, want string) (*download, error) {
+	if err := f.gone.check(u); err != nil {
+		return nil, err
+	}
+	wait := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		var (
+			dl  *download
+			err error
+		)
+		switch {
+		case u.Scheme == "file":
+			dl, err = f.fileDownload(u, dir)
+		case f.resume:
+			dl, err = f.resumableDownload(ctx, u, dir, want)
+		case f.parallel > 1:
+			dl, err = f.parallelDownload(ctx, u, dir)
+		default:
+			dl, err = f.streamDownload(ctx, u, dir)
+		}
+		f.gone.observe(u, err)
+		if err == nil || attempt > f.maxRetries || !retryable(err) {
+			return dl, err
+		}
+		delay := retryDelay(err, wait)
+		log.Printf("⚠️ %v; retry %d of %d in %s", err, attempt, f.maxRetries, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (waiting to retry)", err)
+		}
+		wait = min(2*wait, downloadMaxBackoff)
+	}
+}
+
+// streamDownload streams u into a new temp file in dir. The SHA-256 and the
+// pack trailer check are computed during the same copy, so the file is
+// never read back.
+func (f *fetcher) streamDownload(ctx context.Context, u *url.URL, dir string) (*download, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	f.creds.apply(req)
+
+	log.Printf("📥 fetching %s", redactURL(u.String()))
+	resp, err := f.send(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, false); err != nil {
+		return nil, err
+	}
+	return f.saveBody(resp.Body, resp.ContentLength, dir)
+}
+
+// saveBody writes body, of size bytes (-1 if unknown), to a new temp file in
+// dir, digesting it on the way.
+func (f *fetcher) saveBody(body io.Reader, size int64, dir string) (*download, error) {
+	tmp, err := os.CreateTemp(dir, ".fetch-*.tmp")
+	if err != nil {
+		return nil, &localError{fmt.Errorf("create temp file: %w", err)}
+	}
+	d := newPackDigester()
+	prog := f.newProgress(size, 0)
+	n, err := io.Copy(io.MultiWriter(tmp, d, prog), body)
+	prog.finish()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n == 0 {
+		err = fmt.Errorf("empty response body")
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	return &download{path: tmp.Name(), packDigests: d.digests()}, nil
+}
+
+// fetchToRepo downloads source into a temp file inside the repository's pack
+// directory and renames it into place once the body has been fully written.
+// With a cache configured the bytes come from (or go through) the cache.
+// The pack must have the SHA-256 wantSHA256, if given, or else the one the
+// source URL names, if any. The whole fetch is bounded by --timeout.
+func (f *fetcher) fetchToRepo(source, idxSource, sigSource, wantSHA256, repoPath string) (res *fetchResult, err error) {
+	ctx, cancel := f.fetchContext()
+	defer cancel()
+	defer func() { err = f.timeoutError(ctx, err) }()
+	if f.gitProtocol && strings.HasPrefix(strings.TrimSpace(source), "git://") {
+		if f.sigKey != nil {
+			return nil, errors.New("--pubkey can't verify packs fetched with --allow-git-protocol")
+		}
+		if wantSHA256 != "" {
+			return nil, errors.New("--expected-sha256 can't check packs fetched with --allow-git-protocol")
+		}
+		return f.fetchGitNative(ctx, strings.TrimSpace(source), repoPath)
+	}
+	u, resolution, err := f.resolveSource(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	want := strings.ToLower(wantSHA256)
+	if want == "" {
+		want = urlDigest(u)
+	}
+
+	if f.requireRepo || f.initRepo {
+		if err := ensureBareRepo(repoPath, f.initRepo); err != nil {
+			return nil, &localError{err}
+		}
+	}
+
+	// Downloads are staged next to their destination when it's the local
+	// repository, so placing them is a rename rather than a copy.
+	var sink packSink
+	dir := os.TempDir()
+	if f.sink != nil {
+		if sink, err = f.sink(repoPath); err != nil {
+			return nil, &localError{err}
+		}
+	} else {
+		local, err := newFSSink(repoPath, f.renameRetries)
+		if err != nil {
+			return nil, &localError{err}
+		}
+		sink, dir = local, local.dir
+	}
+	// A pack is only known to be the same by its digest, so without one
+	// it's always downloaded.
+	if local, ok := sink.(*fsSink); ok && want != "" && !f.force {
+		if res := f.presentPack(local, u, source, repoPath, want, idxSource != "" || f.indexPacks); res != nil {
+			return res, nil
+		}
+	}
+
+	var (
+		dl       *download
+		cacheHit bool
+		linked   bool
+	)
+	if f.cache != nil {
+		dl, cacheHit, err = f.cachedDownload(ctx, u, want)
+		if err == nil {
+			entry := dl.path
+			dl, linked, err = f.stageFromCache(entry, dir, f.sink == nil)
+			if err == nil && cacheHit {
+				if err = f.cache.verify(u, entry, dl); err != nil {
+					os.Remove(dl.path)
+				}
+			}
+		}
+	} else {
+		dl, err = f.download(ctx, u, dir, want)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dl.path)
+
+	if err := checkDigest(dl, want); err != nil {
+		return nil, err
+	}
+	if f.verifyPack && dl.packErr != nil {
+		return nil, dl.packErr
+	}
+	if err := checkPackDensity(dl.packDigests, f.minObjectBytes); err != nil {
+		return nil, err
+	}
+	if f.sigKey != nil {
+		if err := f.verifySignature(ctx, source, sigSource, dl, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	name := packName(u)
+	dest := name
+	fsDest, isFS := sink.(*fsSink)
+	if isFS {
+		dest = fsDest.path(name)
+	}
+	indexVerified := false
+	if f.verifyIdx && !isFS {
+		log.Printf("ℹ️ --verify-idx only applies when placing into a local repository")
+	} else if f.verifyIdx {
+		idx := idxPathFor(dest)
+		switch _, err := os.Stat(idx); {
+		case err == nil:
+			if err := verifyPackIndex(dl.packDigests, idx); err != nil {
+				return nil, fmt.Errorf("verify %s: %w", filepath.Base(idx), err)
+			}
+			indexVerified = true
+		case errors.Is(err, fs.ErrNotExist):
+			log.Printf("ℹ️ no %s alongside the pack, nothing to verify", filepath.Base(idx))
+		default:
+			return nil, err
+		}
+	}
+	var idxPath, idxFrom string
+	switch {
+	case idxSource != "":
+		if idxPath, idxFrom, err = f.fetchIndex(ctx, idxSource, dl, dir); err != nil {
+			return nil, err
+		}
+		defer os.Remove(idxPath)
+	case f.indexPacks:
+		// index-pack inflates every object and checks every delta, so
+		// a pack it indexes is sound; one it rejects is never placed.
+		if idxPath, err = indexToTemp(dl.path, dir); err != nil {
+			return nil, fmt.Errorf("verify pack: %w", err)
+		}
+		idxFrom = "generated"
+		defer os.Remove(idxPath)
+	}
+	if err := placeInSink(sink, dl.path, name); err != nil {
+		return nil, &localError{fmt.Errorf("place pack: %w", err)}
+	}
+	log.Printf("✅ placed %s (%d bytes)", dest, dl.size)
+	// The index goes in last: git only looks at packs that have one, so
+	// a pack without its index is never picked up half-placed.
+	var idxDest string
+	if idxPath != "" {
+		idxName := strings.TrimSuffix(name, ".pack") + ".idx"
+		if err := placeInSink(sink, idxPath, idxName); err != nil {
+			return nil, &localError{fmt.Errorf("place index: %w", err)}
+		}
+		idxDest = idxName
+		if isFS {
+			idxDest = fsDest.path(idxName)
+		}
+		log.Printf("✅ placed %s (%s)", idxDest, idxFrom)
+	}
+
+	res = &fetchResult{
+		Source:        redactURL(source),
+		RepoPath:      repoPath,
+		Pack:          dest,
+		Bytes:         dl.size,
+		SHA256:        dl.sha256,
+		CacheHit:      cacheHit,
+		Resolution:    resolution,
+		IndexVerified: indexVerified,
+		Index:         idxDest,
+		IndexSource:   idxFrom,
+		Signed:        f.sigKey != nil,
+		Linked:        linked,
+	}
+	if f.verifyPack {
+		res.PackSHA1 = hex.EncodeToString(dl.packSum)
+	}
+	if f.verifyPack || f.objectCount {
+		// --verify-pack has refused a download that isn't a pack.
+		res.Objects = dl.objects
+		if dl.packErr != nil {
+			log.Printf("⚠️ no object count for %s: %v", dest, dl.packErr)
+		}
+	}
+	return res, nil
+}
+
+// presentPack reports the pack an earlier fetch placed under u's name in
+// local, if it has the SHA-256 want and, when withIdx, the .idx built for
+// it. Anything less, including no pack at all, is nil and the fetch goes
+// ahead, replacing it.
+func (f *fetcher) presentPack(local *fsSink, u *url.URL, source, repoPath, want string, withIdx bool) *fetchResult {
+	dest := local.path(packName(u))
+	d, err := digestFile(dest)
+	if err != nil || d.sha256 != want {
+		return nil
+	}
+	res := &fetchResult{
+		Source:         redactURL(source),
+		RepoPath:       repoPath,
+		Pack:           dest,
+		Bytes:          d.size,
+		SHA256:         d.sha256,
+		AlreadyPresent: true,
+	}
+	if withIdx {
+		if verifyPackIndex(d, idxPathFor(dest)) != nil {
+			return nil
+		}
+		res.Index = idxPathFor(dest)
+	}
+	if f.objectCount {
+		res.Objects = d.objects
+	}
+	log.Printf("✅ %s is already present (sha256 %s), nothing to download", dest, want)
+	return res
+}
+
+// fetchIndex downloads the .idx for pack from idxSource into dir and checks
+// that it belongs to the pack. A matching index is used as is, which is
+// the point of publishing one: the pack isn't run through index-pack. A
+// missing or mismatched index isn't fatal: one is generated from the pack
+// instead, which validates the pack on the way. from reports which
+// happened.
+func (f *fetcher) fetchIndex(ctx context.Context, idxSource string, pack *download, dir string) (path, from string, err error) {
+	u, _, err := f.resolveSource(ctx, idxSource)
+	if err == nil {
+		var dl *download
+		if dl, err = f.download(ctx, u, dir, ""); err == nil {
+			if err = verifyPackIndex(pack.packDigests, dl.path); err == nil {
+				return dl.path, "provided", nil
+			}
+			os.Remove(dl.path)
+		}
+	}
+	log.Printf("⚠️ index %s: %v; generating it from the pack", redactURL(idxSource), err)
+	if path, err = indexToTemp(pack.path, dir); err != nil {
+		return "", "", fmt.Errorf("verify pack: %w", err)
+	}
+	return path, "generated", nil
+}
+
+// indexToTemp runs git index-pack over packPath, writing the index to a
+// new temp file in dir.
+func indexToTemp(packPath, dir string) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".fetch-*.idx")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	tmp.Close()
+	// index-pack refuses to overwrite, so only the name is reserved.
+	os.Remove(tmp.Name())
+	if err := generatePackIndex(packPath, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
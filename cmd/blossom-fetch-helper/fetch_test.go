@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packServer serves body at every path.
+func packServer(t *testing.T, body []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// gitPack builds a small pack of blobs whose contents start with salt and
+// returns it with the .idx git writes for it in the given index version.
+// The same salt always gives the same pack.
+func gitPack(t *testing.T, salt string, idxVersion int) (pack, idx []byte) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not on PATH")
+	}
+	dir := t.TempDir()
+	run := func(stdin []byte, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = bytes.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	run(nil, "init", "-q", "--bare", ".")
+	var ids bytes.Buffer
+	for i := 0; i < 5; i++ {
+		blob := salt + strings.Repeat(fmt.Sprintf("blob %d\n", i), 200)
+		ids.Write(run([]byte(blob), "hash-object", "-w", "--stdin"))
+	}
+	pack = run(ids.Bytes(), "pack-objects", "--stdout")
+	packPath := filepath.Join(dir, "p.pack")
+	if err := os.WriteFile(packPath, pack, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run(nil, "index-pack", fmt.Sprintf("--index-version=%d", idxVersion), "-o", "p.idx", packPath)
+	idx, err := os.ReadFile(filepath.Join(dir, "p.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack, idx
+}
+
+// corruptPack damages an object in pack and returns it with a fixed-up
+// trailer, plus idx rewritten to claim the damaged pack. The pair passes
+// verifyPackIndex; only index-pack can tell.
+func corruptPack(pack, idx []byte) ([]byte, []byte) {
+	bad := append([]byte(nil), pack[:len(pack)-sha1.Size]...)
+	bad[len(bad)/2] ^= 0xff
+	sum := sha1.Sum(bad)
+	bad = append(bad, sum[:]...)
+
+	lied := append([]byte(nil), idx[:len(idx)-2*sha1.Size]...)
+	lied = append(lied, sum[:]...)
+	own := sha1.Sum(lied)
+	return bad, append(lied, own[:]...)
+}
+
+// TestFetchIndexSource fetches a pack with --idx-source and checks which
+// index is placed, and that index-pack only runs without a matching one.
+func TestFetchIndexSource(t *testing.T) {
+	pack, idx := gitPack(t, "", 2)
+	_, idxV1 := gitPack(t, "", 1)
+	badPack, badIdx := corruptPack(pack, idx)
+	tests := []struct {
+		name       string
+		pack, idx  []byte
+		indexPacks bool
+		wantFrom   string
+		wantErr    string
+	}{
+		{name: "matching index", pack: pack, idx: idx, indexPacks: true, wantFrom: "provided"},
+		{name: "index of another version", pack: pack, idx: idxV1, indexPacks: true, wantFrom: "provided"},
+		{name: "index of another pack", pack: pack, idx: badIdx, indexPacks: true, wantFrom: "generated"},
+		{name: "no index published", pack: pack, indexPacks: true, wantFrom: "generated"},
+		// index-pack would reject this pack; a matching index means it
+		// never runs.
+		{name: "matching index skips index-pack", pack: badPack, idx: badIdx, indexPacks: true, wantFrom: "provided"},
+		{name: "corrupt pack without its index", pack: badPack, idx: idx, indexPacks: true, wantErr: "verify pack"},
+		{name: "--no-verify keeps the provided index", pack: pack, idx: idxV1, wantFrom: "provided"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/x.pack":
+					w.Write(tt.pack)
+				case "/x.idx":
+					if tt.idx == nil {
+						http.NotFound(w, r)
+						return
+					}
+					w.Write(tt.idx)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			f := &fetcher{client: srv.Client(), indexPacks: tt.indexPacks}
+			repo := t.TempDir()
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", srv.URL+"/x.idx", "", "", repo)
+			placed := filepath.Join(packDir(repo), "x.pack")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(placed); !os.IsNotExist(err) {
+					t.Errorf("rejected pack was placed (stat: %v)", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.IndexSource != tt.wantFrom {
+				t.Errorf("index_source = %q, want %q", res.IndexSource, tt.wantFrom)
+			}
+			got, err := os.ReadFile(idxPathFor(placed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantFrom == "provided" && !bytes.Equal(got, tt.idx) {
+				t.Error("placed index isn't the provided one")
+			}
+			if err := verifyPackIndex(mustDigest(t, placed), idxPathFor(placed)); err != nil {
+				t.Errorf("placed index doesn't match the pack: %v", err)
+			}
+		})
+	}
+}
+
+func mustDigest(t *testing.T, path string) packDigests {
+	t.Helper()
+	d, err := digestFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// withNormalizers registers ns for the rest of the test only.
+func withNormalizers(t *testing.T, ns ...urlNormalizer) {
+	t.Helper()
+	saved := normalizers
+	normalizers = append([]urlNormalizer(nil), normalizers...)
+	for _, n := range ns {
+		registerNormalizer(n)
+	}
+	t.Cleanup(func() { normalizers = saved })
+}
+
+// TestRegisteredNormalizer drives a custom scheme alongside the built-ins:
+// gittr://<npub>/<file> names a pack on one fixed mirror.
+func TestRegisteredNormalizer(t *testing.T) {
+	pack, _ := gitPack(t, "custom scheme", 2)
+	srv := packServer(t, pack)
+	gittr := func(raw string) (string, bool, error) {
+		rest, ok := strings.CutPrefix(raw, "gittr://")
+		if !ok {
+			return "", false, nil
+		}
+		npub, file, ok := strings.Cut(rest, "/")
+		if !ok || !strings.HasPrefix(npub, "npub1") {
+			return "", false, fmt.Errorf("gittr source %q names no npub", raw)
+		}
+		return srv.URL + "/" + npub + "/" + file, true, nil
+	}
+	// Claims everything; the built-ins and gittr must still win.
+	catchAll := func(raw string) (string, bool, error) {
+		return "https://fallback.example/" + raw, true, nil
+	}
+	withNormalizers(t, gittr, catchAll)
+
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{in: "gittr://npub1abc/x.pack", want: srv.URL + "/npub1abc/x.pack"},
+		{in: "gittr://bob/x.pack", wantErr: "names no npub"},
+		{in: "git@relay.example:npub1abc/repo.pack", want: "https://relay.example/npub1abc/repo.pack"},
+		{in: "git://relay.example/repo.pack", want: "https://relay.example/repo.pack"},
+		{in: "nip96://media.example/x.pack", want: "https://media.example/x.pack"},
+		{in: "  http://plain.example/x.pack ", want: "http://plain.example/x.pack"},
+		{in: "hyper://repo.pack", want: "https://fallback.example/hyper://repo.pack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := normalizeGitURL(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeGitURL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("fetch", func(t *testing.T) {
+		repo := t.TempDir()
+		f := &fetcher{client: srv.Client()}
+		res, err := f.fetchToRepo("gittr://npub1abc/x.pack", "", "", "", repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(res.Pack); err != nil || !bytes.Equal(got, pack) {
+			t.Errorf("placed pack differs (%v)", err)
+		}
+	})
+}
+
+func TestNormalizeUnregisteredScheme(t *testing.T) {
+	if _, err := normalizeGitURL("hyper://repo.pack"); err == nil || !strings.Contains(err.Error(), "unsupported source scheme") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		code   int
+		ranged bool
+		header http.Header
+		ok     bool
+		// class is the errors.Is class of a refusal; a 206 nobody asked
+		// for has none.
+		class    error
+		location string
+	}{
+		{code: http.StatusOK, ok: true},
+		{code: http.StatusOK, ranged: true, ok: true},
+		{code: http.StatusPartialContent, ranged: true, ok: true},
+		{code: http.StatusPartialContent},
+		{code: http.StatusFound, header: http.Header{"Location": {"https://user:pw@mirror.example/x.pack"}}, class: errRedirectStatus, location: "https://user:pw@mirror.example/x.pack"},
+		{code: http.StatusNotFound, class: errClientStatus},
+		{code: http.StatusInternalServerError, header: http.Header{"Retry-After": {"7"}}, class: errServerStatus},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d ranged=%v", tt.code, tt.ranged), func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://blossom.example/x.pack", nil)
+			resp := &http.Response{StatusCode: tt.code, Status: fmt.Sprintf("%d %s", tt.code, http.StatusText(tt.code)), Header: tt.header, Request: req}
+			err := checkStatus(resp, tt.ranged)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("checkStatus: %v", err)
+				}
+				return
+			}
+			var se *statusError
+			if !errors.As(err, &se) || se.code != tt.code {
+				t.Fatalf("err = %v, want a statusError for %d", err, tt.code)
+			}
+			if tt.class != nil && !errors.Is(err, tt.class) {
+				t.Errorf("err = %v, want %v", err, tt.class)
+			}
+			if se.location != tt.location {
+				t.Errorf("location = %q, want %q", se.location, tt.location)
+			}
+			if strings.Contains(err.Error(), "pw@") {
+				t.Errorf("error leaks the redirect's password: %v", err)
+			}
+			if tt.header.Get("Retry-After") != "" && se.retryAfter != 7*time.Second {
+				t.Errorf("retryAfter = %v", se.retryAfter)
+			}
+		})
+	}
+}
+
+// TestFetchStatuses fetches through newClient from a mirror answering
+// each path with one status.
+func TestFetchStatuses(t *testing.T) {
+	pack, _ := gitPack(t, "statuses", 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/200.pack", func(w http.ResponseWriter, r *http.Request) { w.Write(pack) })
+	mux.HandleFunc("/206.pack", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(pack)-1, len(pack)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(pack)
+	})
+	mux.Handle("/302.pack", http.RedirectHandler("/200.pack", http.StatusFound))
+	mux.HandleFunc("/404.pack", http.NotFound)
+	mux.HandleFunc("/500.pack", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path         string
+		maxRedirects int
+		ok           bool
+		class        error
+	}{
+		{path: "/200.pack", ok: true},
+		{path: "/302.pack", maxRedirects: 1, ok: true},
+		{path: "/302.pack", maxRedirects: 0, class: errRedirectStatus},
+		{path: "/206.pack"},
+		{path: "/404.pack", class: errClientStatus},
+		{path: "/500.pack", class: errServerStatus},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s max-redirects=%d", tt.path[1:], tt.maxRedirects), func(t *testing.T) {
+			f := &fetcher{client: newClient(tt.maxRedirects, 0, 0, nil)}
+			res, err := f.fetchToRepo(srv.URL+tt.path, "", "", "", t.TempDir())
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("fetch: %v", err)
+				}
+				if res.Bytes != int64(len(pack)) {
+					t.Errorf("placed %d bytes, want %d", res.Bytes, len(pack))
+				}
+				return
+			}
+			var se *statusError
+			if !errors.As(err, &se) {
+				t.Fatalf("err = %v, want a statusError", err)
+			}
+			if tt.class != nil && !errors.Is(err, tt.class) {
+				t.Errorf("err = %v, want %v", err, tt.class)
+			}
+		})
+	}
+}
+
+// TestFetchIndexPack checks a pack is only placed once index-pack accepted
+// it, with the index it wrote, and that --no-verify places it as is.
+func TestFetchIndexPack(t *testing.T) {
+	pack, idx := gitPack(t, "index-pack", 2)
+	badPack, _ := corruptPack(pack, idx)
+	tests := []struct {
+		name       string
+		pack       []byte
+		indexPacks bool
+		// noGit empties PATH.
+		noGit   bool
+		wantErr string
+	}{
+		{name: "valid", pack: pack, indexPacks: true},
+		{name: "corrupt", pack: badPack, indexPacks: true, wantErr: "verify pack: git index-pack"},
+		{name: "corrupt with --no-verify", pack: badPack},
+		{name: "git missing", pack: pack, indexPacks: true, noGit: true, wantErr: "indexing a pack needs git on PATH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := packServer(t, tt.pack)
+			if tt.noGit {
+				t.Setenv("PATH", "")
+			}
+			f := &fetcher{client: srv.Client(), indexPacks: tt.indexPacks}
+			repo := t.TempDir()
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one about %q", err, tt.wantErr)
+				}
+				if entries, _ := os.ReadDir(packDir(repo)); len(entries) != 0 {
+					t.Errorf("objects/pack holds %d files", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			placed, err := os.ReadFile(filepath.Join(packDir(repo), "x.pack"))
+			if err != nil || !bytes.Equal(placed, tt.pack) {
+				t.Fatalf("placed pack differs (read: %v)", err)
+			}
+			idxPath := filepath.Join(packDir(repo), "x.idx")
+			if !tt.indexPacks {
+				if _, err := os.Stat(idxPath); !os.IsNotExist(err) || res.Index != "" {
+					t.Errorf("index placed with --no-verify (stat: %v, result %q)", err, res.Index)
+				}
+				return
+			}
+			if res.IndexSource != "generated" || res.Index != idxPath {
+				t.Errorf("index %q (%s), want %s (generated)", res.Index, res.IndexSource, idxPath)
+			}
+			if out, err := exec.Command("git", "verify-pack", filepath.Join(packDir(repo), "x.pack")).CombinedOutput(); err != nil {
+				t.Errorf("git verify-pack: %v: %s", err, out)
+			}
+		})
+	}
+}
+
+// TestFetchAlreadyPresent fetches a pack into a repository that already
+// holds it and checks when the download is skipped.
+func TestFetchAlreadyPresent(t *testing.T) {
+	pack, _ := gitPack(t, "present", 2)
+	other, _ := gitPack(t, "not present", 2)
+	sum := sha256.Sum256(pack)
+	digest := hex.EncodeToString(sum[:])
+	h := &hitCounter{body: pack, hits: make(map[string]int)}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		path string
+		// want is passed as --expected-sha256.
+		want       string
+		force      bool
+		indexPacks bool
+		// prepare changes the placed pack before the second fetch.
+		prepare     func(t *testing.T, pack string)
+		wantPresent bool
+	}{
+		{name: "digest in the name", path: "/" + digest + ".pack", wantPresent: true},
+		{name: "expected digest", path: "/x.pack", want: digest, wantPresent: true},
+		{name: "no digest", path: "/x.pack"},
+		{name: "forced", path: "/" + digest + ".pack", force: true},
+		{
+			name: "different pack placed",
+			path: "/x.pack",
+			want: digest,
+			prepare: func(t *testing.T, dest string) {
+				if err := os.WriteFile(dest, other, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{name: "with its index", path: "/" + digest + ".pack", indexPacks: true, wantPresent: true},
+		{
+			name:       "index missing",
+			path:       "/" + digest + ".pack",
+			indexPacks: true,
+			prepare: func(t *testing.T, dest string) {
+				if err := os.Remove(idxPathFor(dest)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.mu.Lock()
+			clear(h.hits)
+			h.mu.Unlock()
+			repo := t.TempDir()
+			f := &fetcher{client: srv.Client(), indexPacks: true}
+			first, err := f.fetchToRepo(srv.URL+tt.path, "", "", tt.want, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.AlreadyPresent {
+				t.Fatal("first fetch found the pack present")
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, first.Pack)
+			}
+
+			f = &fetcher{client: srv.Client(), indexPacks: tt.indexPacks, force: tt.force}
+			res, err := f.fetchToRepo(srv.URL+tt.path, "", "", tt.want, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantHits := 2
+			if tt.wantPresent {
+				wantHits = 1
+			}
+			if got := h.count(tt.path); got != wantHits {
+				t.Errorf("server saw %d requests, want %d", got, wantHits)
+			}
+			if res.AlreadyPresent != tt.wantPresent {
+				t.Errorf("AlreadyPresent = %v, want %v", res.AlreadyPresent, tt.wantPresent)
+			}
+			if res.Pack != first.Pack || res.SHA256 != digest || res.Bytes != int64(len(pack)) {
+				t.Errorf("result %+v, want the pack at %s", res, first.Pack)
+			}
+			if placed, err := os.ReadFile(res.Pack); err != nil || !bytes.Equal(placed, pack) {
+				t.Errorf("placed pack differs from the served one (read: %v)", err)
+			}
+			if tt.indexPacks && res.Index != idxPathFor(res.Pack) {
+				t.Errorf("Index = %q, want %q", res.Index, idxPathFor(res.Pack))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errFileSourceRefused is a file: source in a --serve request, which would
+// let any client copy files of the helper's choosing into a repository.
+var errFileSourceRefused = errors.New("file: sources are only accepted on the command line and with --watch")
+
+// normalizeFile claims file: sources. file:///abs/path.pack is used as is;
+// file:rel/path.pack is resolved against the working directory, and the
+// result logged. A host is refused rather than taken for the first
+// directory, which is what file://rel/path.pack would otherwise mean.
+func normalizeFile(raw string) (string, bool, error) {
+	if !strings.HasPrefix(raw, "file:") {
+		return "", false, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false, fmt.Errorf("malformed file source %q: %w", raw, err)
+	}
+	if u.Host != "" {
+		return "", false, fmt.Errorf("file source %q names host %q; use file:///absolute/path or file:relative/path", raw, u.Host)
+	}
+	p := u.Path
+	if u.Opaque != "" {
+		if p, err = url.PathUnescape(u.Opaque); err != nil {
+			return "", false, fmt.Errorf("malformed file source %q: %w", raw, err)
+		}
+	}
+	if p == "" {
+		return "", false, fmt.Errorf("file source %q names no file", raw)
+	}
+	abs, err := filepath.Abs(filepath.FromSlash(p))
+	if err != nil {
+		return "", false, fmt.Errorf("file source %q: %w", raw, err)
+	}
+	if !filepath.IsAbs(filepath.FromSlash(p)) {
+		log.Printf("ℹ️ file source %s is relative, reading %s", raw, abs)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), true, nil
+}
+
+// fileDownload is download for file: sources. The file is copied into a
+// new temp file in dir exactly like a response body, so it is digested,
+// checked and placed the same way.
+func (f *fetcher) fileDownload(u *url.URL, dir string) (*download, error) {
+	in, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("download: %s is not a regular file", u.Path)
+	}
+	log.Printf("📥 copying %s", u.Path)
+	return f.saveBody(in, fi.Size(), dir)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		raw     string
+		want    string
+		claimed bool
+		wantErr string
+	}{
+		{raw: "file:///srv/packs/x.pack", want: "file:///srv/packs/x.pack", claimed: true},
+		{raw: "file:///srv/packs/../packs/x.pack", want: "file:///srv/packs/x.pack", claimed: true},
+		{raw: "file:///srv/my%20packs/x.pack", want: "file:///srv/my%20packs/x.pack", claimed: true},
+		{raw: "file:packs/x.pack", want: "file://" + filepath.ToSlash(filepath.Join(wd, "packs/x.pack")), claimed: true},
+		{raw: "file:./x.pack", want: "file://" + filepath.ToSlash(filepath.Join(wd, "x.pack")), claimed: true},
+		{raw: "file:../x.pack", want: "file://" + filepath.ToSlash(filepath.Join(filepath.Dir(wd), "x.pack")), claimed: true},
+		// Meant as a relative path, but packs would be the host.
+		{raw: "file://packs/x.pack", wantErr: `names host "packs"`},
+		{raw: "file://localhost/srv/x.pack", wantErr: `names host "localhost"`},
+		{raw: "file:", wantErr: "names no file"},
+		{raw: "file:///", want: "file:///", claimed: true},
+		{raw: "https://blossom.example/x.pack"},
+		{raw: "/srv/packs/x.pack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, claimed, err := normalizeFile(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("normalizeFile = %q, %v; want an error about %s", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || claimed != tt.claimed || got != tt.want {
+				t.Errorf("normalizeFile = %q, %v, %v; want %q, %v", got, claimed, err, tt.want, tt.claimed)
+			}
+		})
+	}
+}
+
+func TestFetchFileSource(t *testing.T) {
+	pack, _ := gitPack(t, "file source", 2)
+	sum := sha256.Sum256(pack)
+	digest := hex.EncodeToString(sum[:])
+	dir := t.TempDir()
+	packFile := filepath.Join(dir, digest+".pack")
+	if err := os.WriteFile(packFile, pack, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wrongFile := filepath.Join(dir, strings.Repeat("0", 64)+".pack")
+	if err := os.WriteFile(wrongFile, pack, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.pack"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fileURL := func(path string) string { return "file://" + filepath.ToSlash(path) }
+
+	tests := []struct {
+		name   string
+		source string
+		// refuse fetches as --serve does, without file: sources.
+		refuse  bool
+		wantErr error
+		// wantMsg is a substring of the error, for failures without a
+		// sentinel.
+		wantMsg string
+	}{
+		{name: "regular file", source: fileURL(packFile)},
+		{name: "relative", source: "file:" + filepath.ToSlash(mustRel(t, packFile))},
+		{name: "digest in the name mismatched", source: fileURL(wrongFile), wantErr: errDigestMismatch},
+		{name: "directory", source: fileURL(filepath.Join(dir, "dir.pack")), wantMsg: "is not a regular file"},
+		{name: "missing", source: fileURL(filepath.Join(dir, "nope.pack")), wantErr: os.ErrNotExist},
+		{name: "host", source: "file://mirror" + filepath.ToSlash(packFile), wantMsg: `names host "mirror"`},
+		{name: "refused in --serve", source: fileURL(packFile), refuse: true, wantErr: errFileSourceRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fetcher{localFiles: !tt.refuse}
+			repo := t.TempDir()
+			res, err := f.fetchToRepo(tt.source, "", "", "", repo)
+			if tt.wantErr == nil && tt.wantMsg == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Bytes != int64(len(pack)) || res.SHA256 != digest {
+					t.Errorf("placed %d bytes with SHA-256 %s, want %d and %s", res.Bytes, res.SHA256, len(pack), digest)
+				}
+				if placed, err := os.ReadFile(filepath.Join(packDir(repo), digest+".pack")); err != nil || string(placed) != string(pack) {
+					t.Errorf("placed pack differs from the file (read: %v)", err)
+				}
+				return
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want one wrapping %v", err, tt.wantErr)
+			}
+			if tt.wantMsg != "" && (err == nil || !strings.Contains(err.Error(), tt.wantMsg)) {
+				t.Fatalf("err = %v, want one about %s", err, tt.wantMsg)
+			}
+			if entries, _ := os.ReadDir(packDir(repo)); len(entries) != 0 {
+				t.Errorf("objects/pack holds %d files", len(entries))
+			}
+		})
+	}
+
+	// A --serve request can't name a file: source, nor a relative one.
+	t.Run("in a --serve request", func(t *testing.T) {
+		root := t.TempDir()
+		srv := httptest.NewServer((&fetchServer{f: &fetcher{}, reposRoot: root, token: "t0ken"}).routes())
+		defer srv.Close()
+		for _, source := range []string{fileURL(packFile), "file:" + filepath.ToSlash(mustRel(t, packFile))} {
+			var answer map[string]any
+			code := postJSON(t, srv.URL+"/fetch", "t0ken", `{"source":"`+source+`","repo_path":"r"}`, &answer)
+			if code != http.StatusBadGateway || answer["error"] != errFileSourceRefused.Error() {
+				t.Errorf("%s: status %d, answer %v", source, code, answer)
+			}
+		}
+		if entries, _ := os.ReadDir(packDir(filepath.Join(root, "r"))); len(entries) != 0 {
+			t.Errorf("objects/pack holds %d files", len(entries))
+		}
+	})
+}
+
+// mustRel is path relative to the working directory.
+func mustRel(t *testing.T, path string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fetchGitNative handles git:// sources under --allow-git-protocol: rather
+// than rewriting them to https, it lets `git fetch` speak the git daemon
+// protocol. The repository's own branches and tags are left alone: the
+// remote's are recorded under refs/fetched/, which also keeps the new
+// objects reachable. unpackLimit=1 makes git keep what it received as a
+// pack, which is then reported the same way a downloaded one would be.
+func (f *fetcher) fetchGitNative(ctx context.Context, source, repoPath string) (*fetchResult, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("--allow-git-protocol needs git on PATH: %w", err)
+	}
+	if err := ensureBareRepo(repoPath, f.initRepo); err != nil {
+		return nil, err
+	}
+	dir := packDir(repoPath)
+	before, err := filepath.Glob(filepath.Join(dir, "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("📥 fetching %s over the git protocol", redactURL(source))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "--git-dir", repoPath, "-c", "fetch.unpackLimit=1",
+		"fetch", "--quiet", "--no-tags", source,
+		"+refs/heads/*:refs/fetched/heads/*", "+refs/tags/*:refs/fetched/tags/*")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git fetch %s: %v: %s", redactURL(source), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	res := &fetchResult{Source: redactURL(source), RepoPath: repoPath, Protocol: "git"}
+	after, err := filepath.Glob(filepath.Join(dir, "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	pack := newPack(before, after)
+	if pack == "" {
+		log.Printf("✅ %s was already up to date", repoPath)
+		return res, nil
+	}
+	digests, err := digestFile(pack)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("✅ placed %s (%d bytes)", pack, digests.size)
+	res.Pack, res.Bytes, res.SHA256 = pack, digests.size, digests.sha256
+	if f.objectCount {
+		res.Objects = digests.objects
+	}
+	return res, nil
+}
+
+// newPack returns the pack in after that isn't in before, if any.
+func newPack(before, after []string) string {
+	seen := make(map[string]bool, len(before))
+	for _, p := range before {
+		seen[p] = true
+	}
+	for _, p := range after {
+		if !seen[p] && strings.HasSuffix(p, ".pack") {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitDaemon serves a repository with one commit on main over the git
+// daemon protocol and returns its git:// URL, skipping the test when
+// git daemon isn't available.
+func gitDaemon(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not on PATH")
+	}
+	base := t.TempDir()
+	src := filepath.Join(base, "src.git")
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet", "--bare", "--initial-branch=main", src},
+		{"-C", work, "init", "--quiet", "--initial-branch=main"},
+		{"-C", work, "-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "--quiet", "--allow-empty", "-m", "first"},
+		{"-C", work, "push", "--quiet", src, "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	daemon := exec.Command("git", "daemon", "--export-all", "--reuseaddr", "--base-path="+base, "--listen=127.0.0.1", "--port="+port, base)
+	if err := daemon.Start(); err != nil {
+		t.Skipf("git daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		daemon.Process.Kill()
+		daemon.Wait()
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Skipf("git daemon never listened: %v", err)
+		}
+	}
+	return "git://127.0.0.1:" + port + "/src.git"
+}
+
+func TestFetchGitNative(t *testing.T) {
+	source := gitDaemon(t)
+	tests := []struct {
+		name string
+		// fetches is how often the source is fetched into the same repo;
+		// only the first brings a pack.
+		fetches int
+	}{
+		{name: "into a new repo", fetches: 1},
+		{name: "again when up to date", fetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := filepath.Join(t.TempDir(), "repo.git")
+			f := &fetcher{gitProtocol: true, initRepo: true, objectCount: true}
+			var res *fetchResult
+			for i := 0; i < tt.fetches; i++ {
+				var err error
+				if res, err = f.fetchToRepo(source, "", "", "", repo); err != nil {
+					t.Fatalf("fetch %d: %v", i, err)
+				}
+				if res.Protocol != "git" {
+					t.Fatalf("fetch %d: protocol %q, want git", i, res.Protocol)
+				}
+			}
+			if tt.fetches > 1 {
+				if res.Pack != "" {
+					t.Errorf("an up to date fetch reported %s", res.Pack)
+				}
+			} else {
+				if filepath.Dir(res.Pack) != packDir(repo) || res.Objects == 0 || len(res.SHA256) != 64 {
+					t.Errorf("result %+v", res)
+				}
+				if _, err := os.Stat(strings.TrimSuffix(res.Pack, ".pack") + ".idx"); err != nil {
+					t.Errorf("pack has no index: %v", err)
+				}
+			}
+			// The remote's branch is kept apart from the repo's own.
+			out, err := exec.Command("git", "--git-dir", repo, "rev-parse", "--verify", "--quiet", "refs/fetched/heads/main").Output()
+			if err != nil || len(strings.TrimSpace(string(out))) != 40 {
+				t.Errorf("refs/fetched/heads/main: %v %q", err, out)
+			}
+			if err := exec.Command("git", "--git-dir", repo, "rev-parse", "--verify", "--quiet", "refs/heads/main").Run(); err == nil {
+				t.Error("the fetch wrote refs/heads/main")
+			}
+		})
+	}
+}
+
+func TestFetchGitNativeRefusals(t *testing.T) {
+	source := gitDaemon(t)
+	tests := []struct {
+		name    string
+		f       *fetcher
+		want    string
+		wantSHA string
+	}{
+		// Without the flag git:// is rewritten to https://, which the
+		// daemon's port doesn't speak.
+		{name: "rewritten by default", f: &fetcher{initRepo: true, client: newClient(10, 0, 0, nil)}, want: "https://127.0.0.1:"},
+		{name: "with --expected-sha256", f: &fetcher{gitProtocol: true, initRepo: true}, wantSHA: strings.Repeat("a", 64), want: "--expected-sha256 can't check"},
+		{name: "with --pubkey", f: &fetcher{gitProtocol: true, initRepo: true, sigKey: &minisignKey{}}, want: "--pubkey can't verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := filepath.Join(t.TempDir(), "repo.git")
+			_, err := tt.f.fetchToRepo(source, "", "", tt.wantSHA, repo)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestInsecureHosts fetches from a self-signed mirror under names its
+// certificate covers, so the only thing standing in the way is the
+// signature. Only the names listed in --insecure-hosts skip verification;
+// any other name, the server's own address included, still gets the full
+// check.
+func TestInsecureHosts(t *testing.T) {
+	pack, _ := gitPack(t, "self-signed", 2)
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pack)
+	}))
+	defer mirror.Close()
+
+	tests := []struct {
+		name     string
+		insecure []string
+		host     string
+		ok       bool
+	}{
+		{name: "listed", insecure: []string{"blossom.example.com"}, host: "blossom.example.com", ok: true},
+		{name: "listed in another case", insecure: []string{"Blossom.Example.com"}, host: "blossom.example.com", ok: true},
+		{name: "one of several", insecure: []string{"example.com", "blossom.example.com"}, host: "blossom.example.com", ok: true},
+		{name: "not listed", insecure: []string{"blossom.example.com"}, host: "cdn.example.com"},
+		{name: "parent of the listed host", insecure: []string{"blossom.example.com"}, host: "example.com"},
+		{name: "subdomain of a listed host", insecure: []string{"example.com"}, host: "blossom.example.com"},
+		{name: "address not listed", insecure: []string{"blossom.example.com"}, host: "127.0.0.1"},
+		{name: "nothing listed", host: "blossom.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClient(0, 0, 0, tt.insecure)
+			// Every name resolves to the mirror.
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			if c, ok := client.Transport.(*http.Transport); ok {
+				transport = c
+			}
+			transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, mirror.Listener.Addr().String())
+			}
+			client.Transport = transport
+
+			f := &fetcher{client: client}
+			res, err := f.fetchToRepo("https://"+tt.host+"/x.pack", "", "", "", filepath.Join(t.TempDir(), "r.git"))
+			if !tt.ok {
+				var unknown x509.UnknownAuthorityError
+				if !errors.As(err, &unknown) {
+					t.Fatalf("fetch from %s: %v, want an unknown authority error", tt.host, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Bytes != int64(len(pack)) {
+				t.Errorf("fetched %d bytes, want %d", res.Bytes, len(pack))
+			}
+		})
+	}
+}
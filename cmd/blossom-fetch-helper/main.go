@@ -0,0 +1,417 @@
+// Command blossom-fetch-helper downloads a git packfile from a Blossom (or any
+// HTTP) mirror and places it into a bare repository's pack directory.
+//
+// Usage:
+//
+//	blossom-fetch-helper --source <url> --repo-path <dir>
+//
+// The source may be an https:// URL, an SSH-style git@host:path, a git://
+// URL, or a nip96:// URL; the latter three are rewritten to https:// before
+// fetching. A JSON summary of the placed pack is printed to stdout.
+//
+// With --watch the helper instead follows a clone-events-sse /events stream
+// and fetches a pack for every repo_cloned event:
+//
+//	blossom-fetch-helper --watch https://events.example/events \
+//	    --source-template 'https://blossom.example/{repo}.pack' \
+//	    --repo-path-template '/srv/repos/{repo}.git'
+//
+// With --serve it runs as a daemon exposing POST /fetch and POST /prefetch:
+//
+//	blossom-fetch-helper --serve :8081 --repos-root /srv/repos --cache-dir /var/cache/packs
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type options struct {
+	sources       sourceList
+	repoPath      string
+	username      string
+	password      string
+	nsec          string
+	netrc         string
+	authHost      string
+	insecureAuth  bool
+	verifyIdx     bool
+	verifyPack    bool
+	noVerify      bool
+	objectCount   bool
+	minObjectSize int
+	resume        bool
+	parallel      int
+	quiet         bool
+	requireRepo   bool
+	initRepo      bool
+	renameRetries int
+	negativeTTL   time.Duration
+	maxRedirects  int
+	maxRetries    int
+	force         bool
+	timeout       time.Duration
+	idleTimeout   time.Duration
+	hostRate      float64
+	dnsCacheTTL   time.Duration
+	insecureHosts string
+	idxSource     string
+	sigURL        string
+	sha256        string
+	pubkey        string
+	gitProtocol   bool
+
+	watch        string
+	sourceTmpl   string
+	repoPathTmpl string
+	ledger       string
+
+	// canonicalRepoPath cleans repo paths, resolves their symlinks and
+	// keeps them under reposRoot when that is set.
+	canonicalRepoPath bool
+
+	serve      string
+	reposRoot  string
+	cacheDir   string
+	cacheHash  string
+	hardlink   bool
+	serveToken string
+	// warmFrom is an /events stream whose clone events warm the cache in
+	// serve mode.
+	warmFrom        string
+	warmConcurrency int
+	// eventsWebhook is the clone-events-sse webhook /restore publishes its
+	// progress to, signed with eventsSecret.
+	eventsWebhook string
+	eventsSecret  string
+
+	selftest bool
+}
+
+func main() {
+	var opts options
+	flag.Var(&opts.sources, "source", "pack source URL (https://, git@host:path, git://, nip96://); repeat it or separate mirrors with commas to fail over in order")
+	flag.StringVar(&opts.idxSource, "idx-source", "", "the pack's .idx as a separate source; placed after verification, generated with git index-pack if missing or mismatched")
+	flag.StringVar(&opts.sigURL, "sig-url", "", "detached minisign signature of the pack (defaults to the source URL + .minisig when --pubkey is set)")
+	flag.StringVar(&opts.sha256, "expected-sha256", "", "SHA-256 the pack must have, for sources whose URL doesn't end in it")
+	flag.StringVar(&opts.pubkey, "pubkey", "", "minisign public key, or a .pub file, that every pack must be signed with")
+	flag.StringVar(&opts.repoPath, "repo-path", "", "bare repository to place the pack into")
+	flag.StringVar(&opts.username, "username", "", "HTTP basic auth username for private mirrors")
+	flag.StringVar(&opts.password, "password", "", "HTTP basic auth password (defaults to $FETCH_PASSWORD)")
+	flag.StringVar(&opts.nsec, "nsec", "", "Nostr secret key (nsec1... or hex) to sign NIP-98 auth for private Blossom servers (defaults to $NOSTR_NSEC)")
+	flag.StringVar(&opts.authHost, "auth-host", "", "host --username/--password are sent to (defaults to the host of the first --source or of --source-template)")
+	flag.BoolVar(&opts.insecureAuth, "allow-insecure-auth", false, "send basic auth over plain http:// too")
+	flag.StringVar(&opts.netrc, "netrc", "", "read per-host basic auth credentials from this .netrc file")
+	flag.BoolVar(&opts.verifyIdx, "verify-idx", false, "cross-check the .idx next to the destination against the downloaded pack")
+	flag.BoolVar(&opts.noVerify, "no-verify", false, "place packs as downloaded, without validating them with git index-pack and placing the .idx it writes")
+	flag.BoolVar(&opts.verifyPack, "verify-pack", false, "reject downloads whose git pack trailer checksum doesn't match")
+	flag.IntVar(&opts.minObjectSize, "min-object-bytes", minObjectBytes, "reject packs whose header claims more objects than fit at this many bytes each (0 disables)")
+	flag.BoolVar(&opts.objectCount, "object-count", false, "report the pack's object count, read from its header, as objects")
+	flag.BoolVar(&opts.resume, "resume", false, "keep interrupted downloads as .part files and continue them on the next run")
+	flag.BoolVar(&opts.quiet, "quiet", false, "don't draw download progress on stderr (it is only drawn when stderr is a terminal)")
+	flag.IntVar(&opts.parallel, "parallel", 1, "download each pack as this many concurrent byte ranges when the server supports them")
+	flag.BoolVar(&opts.gitProtocol, "allow-git-protocol", false, "fetch git:// sources with git fetch over the git daemon protocol instead of rewriting them to https://")
+	flag.BoolVar(&opts.requireRepo, "require-repo", false, "refuse to place packs unless --repo-path is a bare git repository")
+	flag.BoolVar(&opts.initRepo, "init", false, "git init --bare --repo-path when it is missing or empty (implies --require-repo)")
+	flag.IntVar(&opts.renameRetries, "rename-retries", 3, "retries for the final rename (NFS/Windows) before copying the pack into place")
+	flag.IntVar(&opts.maxRedirects, "max-redirects", 10, "redirects to follow per download; 0 treats any 3xx as an error")
+	flag.IntVar(&opts.maxRetries, "max-retries", 3, "retries for a download failing with a connection error, 429 or 5xx, with exponential backoff")
+	flag.BoolVar(&opts.force, "force", false, "download packs even when the repository already has one with the expected SHA-256")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Minute, "give up on a fetch, retries included, after this long (0 disables)")
+	flag.DurationVar(&opts.idleTimeout, "idle-timeout", time.Minute, "abandon a request that receives no data for this long, retrying it like a dropped connection (0 disables)")
+	flag.Float64Var(&opts.hostRate, "host-rate", 0, "at most this many requests per second to each upstream host (0 = unlimited)")
+	flag.DurationVar(&opts.dnsCacheTTL, "dns-cache-ttl", 0, "cache host lookups for this long, refreshing in the background (0 disables)")
+	flag.StringVar(&opts.insecureHosts, "insecure-hosts", "", "comma-separated hosts whose TLS certificates aren't verified (self-signed internal mirrors)")
+	flag.DurationVar(&opts.negativeTTL, "negative-ttl", time.Minute, "fail fast for this long on sources that answered 404/410 (0 disables)")
+	flag.StringVar(&opts.watch, "watch", "", "follow this clone-events-sse /events URL and fetch on every repo_cloned event")
+	flag.StringVar(&opts.sourceTmpl, "source-template", "", "with --watch or --warm-from: source URL template, {repo} is substituted")
+	flag.StringVar(&opts.repoPathTmpl, "repo-path-template", "", "with --watch: repo path template, {repo} is substituted")
+	flag.StringVar(&opts.ledger, "ledger", "", "with --watch or --serve: JSON-lines file recording completed fetches across restarts")
+	flag.StringVar(&opts.serve, "serve", "", "run as a daemon on this address (e.g. :8081) exposing /fetch, /prefetch and /restore")
+	flag.StringVar(&opts.reposRoot, "repos-root", "", "with --serve or --canonical-repo-path: directory repo paths are relative to and may not leave")
+	flag.BoolVar(&opts.canonicalRepoPath, "canonical-repo-path", false, "clean repo paths and resolve their symlinks before placing packs, refusing any that resolve outside --repos-root")
+	flag.StringVar(&opts.cacheDir, "cache-dir", "", "content-addressed pack cache shared by all fetches")
+	flag.StringVar(&opts.cacheHash, "cache-hash", "sha256", "with --cache-dir: content address of cache entries, sha256 or sha1")
+	flag.BoolVar(&opts.hardlink, "hardlink", false, "with --cache-dir: hard-link cached packs into repositories instead of copying, where the filesystem allows")
+	flag.StringVar(&opts.serveToken, "serve-token", "", "with --serve: require this bearer token (defaults to $SERVE_TOKEN)")
+	flag.StringVar(&opts.warmFrom, "warm-from", "", "with --serve: follow this clone-events-sse /events URL and prefetch every cloned repo into --cache-dir")
+	flag.IntVar(&opts.warmConcurrency, "warm-concurrency", 2, "with --warm-from: most cache warms running at once")
+	flag.StringVar(&opts.eventsWebhook, "events-webhook", "", "with --serve: clone-events-sse webhook URL that /restore publishes progress events to")
+	flag.StringVar(&opts.eventsSecret, "events-secret", "", "with --events-webhook: webhook secret to sign with (defaults to $WEBHOOK_SECRET)")
+	flag.BoolVar(&opts.selftest, "selftest", false, "check the configuration and reachability of sources, print a report and exit")
+	flag.Parse()
+
+	if opts.password == "" {
+		opts.password = os.Getenv("FETCH_PASSWORD")
+	}
+	if opts.nsec == "" {
+		opts.nsec = os.Getenv("NOSTR_NSEC")
+	}
+	if opts.serveToken == "" {
+		opts.serveToken = os.Getenv("SERVE_TOKEN")
+	}
+	if opts.eventsSecret == "" {
+		opts.eventsSecret = os.Getenv("WEBHOOK_SECRET")
+	}
+	if opts.selftest {
+		os.Exit(runSelftest(opts, os.Stdout))
+	}
+	if err := opts.validate(); err != nil {
+		usage(err.Error())
+	}
+
+	if !opts.noVerify {
+		if _, err := exec.LookPath("git"); err != nil {
+			log.Fatalf("❌ git isn't on PATH; install it so packs can be checked with git index-pack, or pass --no-verify to place them unchecked")
+		}
+	}
+	authHost, _, _ := opts.basicAuthTarget()
+	creds, err := loadCredentials(opts.username, opts.password, authHost, opts.netrc, opts.nsec, opts.insecureAuth)
+	if err != nil {
+		log.Fatalf("❌ credentials: %v", err)
+	}
+
+	f := &fetcher{
+		client:         newClient(opts.maxRedirects, opts.hostRate, opts.dnsCacheTTL, parseHostList(opts.insecureHosts)),
+		creds:          creds,
+		verifyIdx:      opts.verifyIdx,
+		verifyPack:     opts.verifyPack,
+		objectCount:    opts.objectCount,
+		minObjectBytes: opts.minObjectSize,
+		resume:         opts.resume,
+		requireRepo:    opts.requireRepo,
+		initRepo:       opts.initRepo,
+		renameRetries:  opts.renameRetries,
+		maxRetries:     opts.maxRetries,
+		timeout:        opts.timeout,
+		idleTimeout:    opts.idleTimeout,
+		force:          opts.force,
+		localFiles:     opts.serve == "",
+		parallel:       opts.parallel,
+		progress:       !opts.quiet && stderrIsTerminal(),
+		indexPacks:     !opts.noVerify,
+		gitProtocol:    opts.gitProtocol,
+		hardlink:       opts.hardlink,
+		gone:           newNegativeCache(opts.negativeTTL),
+	}
+	if opts.pubkey != "" {
+		if f.sigKey, err = loadMinisignKey(opts.pubkey); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+	if opts.cacheDir != "" {
+		if f.cache, err = openPackCache(opts.cacheDir, cacheHashes[opts.cacheHash]); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+
+	switch {
+	case opts.serve != "":
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		l, err := openLedger(opts.ledger)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		s := &fetchServer{f: f, reposRoot: opts.reposRoot, token: opts.serveToken, canonical: opts.canonicalRepoPath, ledger: l}
+		if opts.eventsWebhook != "" {
+			s.events = &eventsWebhook{url: opts.eventsWebhook, secret: opts.eventsSecret, client: &http.Client{}}
+		}
+		if opts.warmFrom != "" {
+			w := &watcher{
+				f:          f,
+				client:     &http.Client{},
+				url:        opts.warmFrom,
+				sourceTmpl: opts.sourceTmpl,
+				warmer:     newCacheWarmer(f, opts.warmConcurrency),
+			}
+			go w.run(ctx)
+		}
+		if err := runServe(ctx, opts.serve, s); err != nil {
+			log.Fatalf("❌ serve: %v", err)
+		}
+		return
+	case opts.watch != "":
+		runWatch(f, opts)
+		return
+	}
+
+	if opts.canonicalRepoPath {
+		if opts.repoPath, err = canonicalRepoPath(opts.reposRoot, opts.repoPath); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+	res, err := f.fetchFromMirrors(opts.sources, opts.idxSource, opts.sigURL, opts.sha256, opts.repoPath)
+	if err != nil {
+		log.Fatalf("❌ fetch failed: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Fatalf("❌ write result: %v", err)
+	}
+}
+
+// validate checks that the flags needed by the selected mode are present.
+func (o options) validate() error {
+	if o.minObjectSize < 0 {
+		return errors.New("--min-object-bytes must not be negative")
+	}
+	if o.maxRetries < 0 {
+		return errors.New("--max-retries must not be negative")
+	}
+	if o.timeout < 0 || o.idleTimeout < 0 {
+		return errors.New("--timeout and --idle-timeout must not be negative")
+	}
+	if o.parallel < 1 {
+		return errors.New("--parallel must be at least 1")
+	}
+	if o.parallel > 1 && o.resume {
+		return errors.New("--parallel can't be combined with --resume")
+	}
+	if o.hostRate < 0 {
+		return errors.New("--host-rate must not be negative")
+	}
+	if o.idxSource != "" && (o.serve != "" || o.watch != "") {
+		return errors.New("--idx-source only applies to a single fetch")
+	}
+	for _, h := range parseHostList(o.insecureHosts) {
+		if strings.ContainsAny(h, ":/*") {
+			return fmt.Errorf("--insecure-hosts takes bare host names, not %q", h)
+		}
+	}
+	if o.hardlink && o.cacheDir == "" {
+		return errors.New("--hardlink needs --cache-dir")
+	}
+	if _, ok := cacheHashes[o.cacheHash]; !ok {
+		return fmt.Errorf("--cache-hash must be sha256 or sha1, not %q", o.cacheHash)
+	}
+	if o.eventsWebhook != "" && o.serve == "" {
+		return errors.New("--events-webhook only applies to --serve")
+	}
+	if o.warmFrom != "" && o.serve == "" {
+		return errors.New("--warm-from only applies to --serve")
+	}
+	if o.sigURL != "" && (o.serve != "" || o.watch != "") {
+		return errors.New("--sig-url only applies to a single fetch")
+	}
+	if o.sha256 != "" && (o.serve != "" || o.watch != "") {
+		return errors.New("--expected-sha256 only applies to a single fetch")
+	}
+	if o.sha256 != "" && !isHexDigest(strings.ToLower(o.sha256), sha256.Size) {
+		return errors.New("--expected-sha256 must be 64 hex digits")
+	}
+	if o.sigURL != "" && o.pubkey == "" {
+		return errors.New("--sig-url needs --pubkey")
+	}
+	if o.username != "" {
+		host, scheme, err := o.basicAuthTarget()
+		switch {
+		case err != nil:
+			return fmt.Errorf("--auth-host: %w", err)
+		case host == "":
+			return errors.New("--username needs --auth-host when neither --source nor --source-template names the host")
+		case scheme == "http" && !o.insecureAuth:
+			return fmt.Errorf("--username would be sent to %s over plain http; use https or pass --allow-insecure-auth", host)
+		}
+	}
+	switch {
+	case o.serve != "":
+		if o.reposRoot == "" {
+			return errors.New("--serve needs --repos-root")
+		}
+		if o.warmFrom != "" && (o.cacheDir == "" || o.sourceTmpl == "") {
+			return errors.New("--warm-from needs --cache-dir and --source-template")
+		}
+		if o.warmConcurrency < 1 {
+			return errors.New("--warm-concurrency must be at least 1")
+		}
+	case o.watch != "":
+		if o.sourceTmpl == "" || o.repoPathTmpl == "" {
+			return errors.New("--watch needs --source-template and --repo-path-template")
+		}
+	case len(o.sources) == 0 || o.repoPath == "":
+		return errors.New("--source and --repo-path are required")
+	}
+	return nil
+}
+
+// basicAuthTarget is the host --username/--password are scoped to, and the
+// scheme the primary source reaches it with: --auth-host, or else the first
+// --source, or else --source-template.
+func (o options) basicAuthTarget() (host, scheme string, err error) {
+	if o.authHost != "" {
+		return o.authHost, "", nil
+	}
+	primary := strings.ReplaceAll(o.sourceTmpl, "{repo}", "repo")
+	if len(o.sources) > 0 {
+		primary = o.sources[0]
+	}
+	if primary == "" {
+		return "", "", nil
+	}
+	normalized, err := normalizeGitURL(primary)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Hostname(), u.Scheme, nil
+}
+
+// mode names the mode the flags select, for reports.
+func (o options) mode() string {
+	switch {
+	case o.serve != "":
+		return "serve"
+	case o.watch != "":
+		return "watch"
+	}
+	return "fetch"
+}
+
+func usage(msg string) {
+	fmt.Fprintf(os.Stderr, "%s\nusage: blossom-fetch-helper --source <url> --repo-path <dir>\n       blossom-fetch-helper --watch <events-url> --source-template <tmpl> --repo-path-template <tmpl>\n       blossom-fetch-helper --serve <addr> --repos-root <dir> [--cache-dir <dir>]\n", msg)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// runWatch follows the --watch stream until SIGINT/SIGTERM.
+func runWatch(f *fetcher, opts options) {
+	l, err := openLedger(opts.ledger)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	w := &watcher{
+		f:            f,
+		client:       &http.Client{},
+		url:          opts.watch,
+		sourceTmpl:   opts.sourceTmpl,
+		repoPathTmpl: opts.repoPathTmpl,
+		ledger:       l,
+		canonical:    opts.canonicalRepoPath,
+		reposRoot:    opts.reposRoot,
+	}
+	if err := w.run(ctx); err != nil {
+		log.Fatalf("❌ watch: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisigner makes minisign keys and signatures the way the minisign tool
+// does, so the tests don't need it installed.
+type minisigner struct {
+	id  [8]byte
+	sk  ed25519.PrivateKey
+	pub ed25519.PublicKey
+}
+
+func newMinisigner(t *testing.T) *minisigner {
+	t.Helper()
+	pub, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &minisigner{sk: sk, pub: pub}
+	rand.Read(s.id[:])
+	return s
+}
+
+// pubkey is the base64 line of a minisign .pub file.
+func (s *minisigner) pubkey() string {
+	raw := append([]byte("Ed"), s.id[:]...)
+	return base64.StdEncoding.EncodeToString(append(raw, s.pub...))
+}
+
+// sign returns a .minisig for data; prehashed selects "ED" over legacy "Ed".
+func (s *minisigner) sign(data []byte, prehashed bool, comment string) string {
+	alg, msg := "Ed", data
+	if prehashed {
+		sum := blake2b.Sum512(data)
+		alg, msg = "ED", sum[:]
+	}
+	sig := ed25519.Sign(s.sk, msg)
+	raw := append(append([]byte(alg), s.id[:]...), sig...)
+	global := ed25519.Sign(s.sk, append(append([]byte(nil), sig...), comment...))
+	return "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
+func writeTemp(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadMinisignKey(t *testing.T) {
+	s := newMinisigner(t)
+	pubFile := writeTemp(t, "key.pub", []byte("untrusted comment: minisign public key\n"+s.pubkey()+"\n"))
+	pgpFile := writeTemp(t, "key.asc", []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmQINBF...\n-----END PGP PUBLIC KEY BLOCK-----\n"))
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "key line", value: s.pubkey()},
+		{name: ".pub file", value: pubFile},
+		{name: "OpenPGP key", value: pgpFile, wantErr: "OpenPGP keys aren't supported"},
+		{name: "garbage", value: "not-a-key", wantErr: "not a minisign public key"},
+		{name: "wrong algorithm", value: base64.StdEncoding.EncodeToString(append([]byte("XX"), make([]byte, 40)...)), wantErr: "not a minisign public key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := loadMinisignKey(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.key.KeyId != s.id {
+				t.Errorf("key id %X, want %X", k.key.KeyId, s.id)
+			}
+		})
+	}
+}
+
+func TestMinisignVerifyFile(t *testing.T) {
+	signer, other := newMinisigner(t), newMinisigner(t)
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00 some pack bytes")
+	tampered := append([]byte(nil), pack...)
+	tampered[len(tampered)-1] ^= 1
+	key, err := loadMinisignKey(signer.pubkey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := signer.sign(pack, true, "timestamp:1700000000\tfile:x.pack")
+	tests := []struct {
+		name string
+		data []byte
+		sig  string
+		ok   bool
+	}{
+		{"prehashed signature", pack, good, true},
+		{"legacy signature", pack, signer.sign(pack, false, "legacy"), true},
+		{"tampered pack", tampered, good, false},
+		{"signed by another key", pack, other.sign(pack, true, "other"), false},
+		{"altered trusted comment", pack, strings.Replace(good, "file:x.pack", "file:y.pack", 1), false},
+		{"truncated signature", pack, strings.Join(strings.Split(good, "\n")[:2], "\n"), false},
+		{"empty signature", pack, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := key.verifyFile(writeTemp(t, "x.pack", tt.data), []byte(tt.sig))
+			if tt.ok && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, errBadSignature) {
+				t.Fatalf("err = %v, want errBadSignature", err)
+			}
+		})
+	}
+}
+
+// TestFetchVerifiesSignature runs whole fetches against a mirror serving a
+// pack and its .minisig: a signed pack is placed, a tampered one never is.
+func TestFetchVerifiesSignature(t *testing.T) {
+	signer := newMinisigner(t)
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00 signed pack bytes")
+	sig := signer.sign(pack, true, "signed")
+	tests := []struct {
+		name   string
+		served []byte
+		sig    string
+		ok     bool
+	}{
+		{"valid signature", pack, sig, true},
+		{"tampered pack", append(append([]byte(nil), pack...), 'x'), sig, false},
+		{"missing signature", pack, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/x.pack":
+					w.Write(tt.served)
+				case "/x.pack.minisig":
+					if tt.sig == "" {
+						http.NotFound(w, r)
+						return
+					}
+					w.Write([]byte(tt.sig))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			key, err := loadMinisignKey(signer.pubkey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fetcher{client: srv.Client(), sigKey: key}
+			repo := t.TempDir()
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+			placed := filepath.Join(packDir(repo), "x.pack")
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("fetch: %v", err)
+				}
+				if !res.Signed {
+					t.Error("result not marked signed")
+				}
+				if _, err := os.Stat(placed); err != nil {
+					t.Errorf("pack not placed: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("fetch succeeded")
+			}
+			if _, err := os.Stat(placed); !os.IsNotExist(err) {
+				t.Errorf("rejected pack was placed (stat: %v)", err)
+			}
+		})
+	}
+}
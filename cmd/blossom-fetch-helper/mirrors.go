@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+)
+
+// sourceList is the --source flag: repeatable, and each use may itself be
+// a comma-separated list, so the mirrors of one pack can be given either
+// way.
+type sourceList []string
+
+func (l *sourceList) String() string { return strings.Join(*l, ",") }
+
+func (l *sourceList) Set(v string) error {
+	*l = append(*l, parseHostList(v)...)
+	return nil
+}
+
+// localError is a fetch that failed on this side rather than the
+// mirror's: the repository can't take the pack, or the disk is full.
+// Every other mirror would fail the same way.
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string { return e.err.Error() }
+
+func (e *localError) Unwrap() error { return e.err }
+
+// isLocal reports whether err is a localError or a write that ran out of
+// space, wherever it happened.
+func isLocal(err error) bool {
+	var le *localError
+	return errors.As(err, &le) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// fetchFromMirrors runs fetchToRepo with each source in turn until one
+// places the pack. A failed download moves on to the next mirror, one
+// with the wrong SHA-256 included; only when every mirror failed is the
+// fetch an error, listing each mirror's reason. A local failure ends the
+// fetch at once, since no mirror can fix it.
+func (f *fetcher) fetchFromMirrors(sources []string, idxSource, sigSource, wantSHA256, repoPath string) (*fetchResult, error) {
+	if len(sources) == 1 {
+		return f.fetchToRepo(sources[0], idxSource, sigSource, wantSHA256, repoPath)
+	}
+	var errs []error
+	for i, source := range sources {
+		res, err := f.fetchToRepo(source, idxSource, sigSource, wantSHA256, repoPath)
+		if err == nil {
+			log.Printf("🪞 mirror %d of %d served the pack: %s", i+1, len(sources), redactURL(source))
+			return res, nil
+		}
+		if isLocal(err) {
+			return nil, err
+		}
+		log.Printf("⚠️ mirror %s failed: %v", redactURL(source), err)
+		errs = append(errs, fmt.Errorf("%s: %w", redactURL(source), err))
+	}
+	return nil, fmt.Errorf("all %d mirrors failed: %w", len(sources), errors.Join(errs...))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFetchFromMirrors(t *testing.T) {
+	pack, _ := gitPack(t, "mirrors", 2)
+	other, _ := gitPack(t, "another mirror", 2)
+	sum := sha256.Sum256(pack)
+	digest := hex.EncodeToString(sum[:])
+	failing := map[string]int{"/missing.pack": http.StatusNotFound, "/broken.pack": http.StatusInternalServerError}
+	good := &hitCounter{status: failing, body: pack, hits: make(map[string]int)}
+	goodSrv := httptest.NewServer(good)
+	defer goodSrv.Close()
+	wrong := &hitCounter{body: other, hits: make(map[string]int)}
+	wrongSrv := httptest.NewServer(wrong)
+	defer wrongSrv.Close()
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    string
+		// served is the index of the source that places the pack.
+		served int
+		// notBare fetches into a directory that isn't a repository,
+		// with --require-repo.
+		notBare bool
+		// wantErr is a substring of the error when no mirror placed it.
+		wantErr string
+		// untried is a source that must not have been requested.
+		untried string
+	}{
+		{name: "first missing", sources: []string{goodSrv.URL + "/missing.pack", goodSrv.URL + "/ok.pack"}, want: digest, served: 1},
+		{name: "first broken", sources: []string{goodSrv.URL + "/broken.pack", goodSrv.URL + "/ok.pack"}, want: digest, served: 1},
+		{name: "first serves another pack", sources: []string{wrongSrv.URL + "/ok.pack", goodSrv.URL + "/ok.pack"}, want: digest, served: 1},
+		{name: "first serves the pack", sources: []string{goodSrv.URL + "/ok.pack", goodSrv.URL + "/missing.pack"}, untried: "/missing.pack"},
+		{
+			name:    "all fail",
+			sources: []string{goodSrv.URL + "/missing.pack", goodSrv.URL + "/broken.pack"},
+			wantErr: "all 2 mirrors failed",
+		},
+		{
+			// No mirror can make the directory a repository, so the
+			// second isn't asked.
+			name:    "repository refused",
+			sources: []string{goodSrv.URL + "/ok.pack", goodSrv.URL + "/second.pack"},
+			notBare: true,
+			wantErr: errNotBareRepo.Error(),
+			untried: "/second.pack",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, h := range []*hitCounter{good, wrong} {
+				h.mu.Lock()
+				clear(h.hits)
+				h.mu.Unlock()
+			}
+			f := &fetcher{client: goodSrv.Client(), requireRepo: tt.notBare}
+			repo := t.TempDir()
+			res, err := f.fetchFromMirrors(tt.sources, "", "", tt.want, repo)
+			if tt.untried != "" && good.count(tt.untried) != 0 {
+				t.Errorf("%s was requested", tt.untried)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one about %q", err, tt.wantErr)
+				}
+				if entries, _ := os.ReadDir(packDir(repo)); len(entries) != 0 {
+					t.Errorf("objects/pack holds %d files", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := redactURL(tt.sources[tt.served]); res.Source != want {
+				t.Errorf("served by %q, want %q", res.Source, want)
+			}
+			if res.Bytes != int64(len(pack)) {
+				t.Errorf("placed %d bytes, want %d", res.Bytes, len(pack))
+			}
+		})
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not a repository", err: fmt.Errorf("fetch: %w", &localError{errNotBareRepo}), want: true},
+		{name: "disk full while downloading", err: fmt.Errorf("download: %w", &os.PathError{Op: "write", Path: "x.tmp", Err: syscall.ENOSPC}), want: true},
+		{name: "missing on the mirror", err: &statusError{code: http.StatusNotFound, status: "404 Not Found"}},
+		{name: "wrong digest", err: fmt.Errorf("check: %w", errDigestMismatch)},
+		{name: "connection refused", err: syscall.ECONNREFUSED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocal(tt.err); got != tt.want {
+				t.Errorf("isLocal(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
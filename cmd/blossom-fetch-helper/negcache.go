@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// negativeCache remembers sources that recently answered 404 or 410, so in
+// serve and watch mode a source that is gone fails fast instead of hitting
+// the mirror on every request. Entries expire after ttl; successes and
+// other failures are never cached. A nil cache caches nothing.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	gone map[string]goneEntry
+}
+
+type goneEntry struct {
+	err   *statusError
+	until time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{ttl: ttl, gone: make(map[string]goneEntry)}
+}
+
+// check returns the remembered failure for u while it is still fresh.
+func (c *negativeCache) check(u *url.URL) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.gone[sourceKey(u)]
+	if !ok {
+		return nil
+	}
+	left := time.Until(e.until)
+	if left <= 0 {
+		delete(c.gone, sourceKey(u))
+		return nil
+	}
+	return fmt.Errorf("%w (cached, retrying in %s)", e.err, left.Round(time.Second))
+}
+
+// observe records err for u if it says the source is gone.
+func (c *negativeCache) observe(u *url.URL, err error) {
+	var se *statusError
+	if c == nil || !errors.As(err, &se) {
+		return
+	}
+	if se.code != http.StatusNotFound && se.code != http.StatusGone {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.gone {
+		if now.After(e.until) {
+			delete(c.gone, k)
+		}
+	}
+	c.gone[sourceKey(u)] = goneEntry{err: se, until: now.Add(c.ttl)}
+}
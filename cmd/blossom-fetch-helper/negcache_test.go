@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hitCounter is a mirror answering each path with a fixed status and
+// counting the requests per path.
+type hitCounter struct {
+	status map[string]int
+	body   []byte
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (h *hitCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.hits[r.URL.Path]++
+	h.mu.Unlock()
+	if code := h.status[r.URL.Path]; code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	w.Write(h.body)
+}
+
+func (h *hitCounter) count(path string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hits[path]
+}
+
+func TestNegativeCache(t *testing.T) {
+	const ttl = 150 * time.Millisecond
+	pack, _ := gitPack(t, "negative cache", 2)
+	mirror := &hitCounter{
+		status: map[string]int{"/gone.pack": http.StatusGone, "/missing.pack": http.StatusNotFound, "/broken.pack": http.StatusInternalServerError},
+		body:   pack,
+		hits:   make(map[string]int),
+	}
+	srv := httptest.NewServer(mirror)
+	defer srv.Close()
+	f := &fetcher{client: srv.Client(), gone: newNegativeCache(ttl)}
+
+	tests := []struct {
+		path string
+		code int
+		// cached is true when the second fetch must not reach the mirror.
+		cached bool
+	}{
+		{"/missing.pack", http.StatusNotFound, true},
+		{"/gone.pack", http.StatusGone, true},
+		{"/broken.pack", http.StatusInternalServerError, false},
+		{"/ok.pack", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path[1:], func(t *testing.T) {
+			fetch := func() error {
+				_, err := f.fetchToRepo(srv.URL+tt.path, "", "", "", t.TempDir())
+				return err
+			}
+			checkErr := func(err error) {
+				t.Helper()
+				var se *statusError
+				if tt.code == 0 {
+					if err != nil {
+						t.Fatalf("fetch: %v", err)
+					}
+				} else if !errors.As(err, &se) || se.code != tt.code {
+					t.Fatalf("err = %v, want status %d", err, tt.code)
+				}
+			}
+
+			checkErr(fetch())
+			start := time.Now()
+			checkErr(fetch())
+			want := 2
+			if tt.cached {
+				want = 1
+				if took := time.Since(start); took > ttl/2 {
+					t.Errorf("cached failure took %v", took)
+				}
+			}
+			if got := mirror.count(tt.path); got != want {
+				t.Errorf("mirror hit %d times within the TTL, want %d", got, want)
+			}
+			if !tt.cached {
+				return
+			}
+
+			time.Sleep(ttl)
+			checkErr(fetch())
+			if got := mirror.count(tt.path); got != 2 {
+				t.Errorf("mirror hit %d times after the TTL, want 2", got)
+			}
+		})
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	if c := newNegativeCache(0); c != nil {
+		t.Fatal("a zero TTL made a cache")
+	}
+	var c *negativeCache
+	u, _ := url.Parse("https://blossom.example/x.pack")
+	c.observe(u, &statusError{code: http.StatusNotFound})
+	if err := c.check(u); err != nil {
+		t.Errorf("nil cache returned %v", err)
+	}
+}
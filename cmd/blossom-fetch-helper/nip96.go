@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// How a nip96:// source was turned into a download URL; reported in the
+// JSON summary so operators can tell a misbehaving server from a good one.
+const (
+	resolutionDescriptor = "descriptor"
+	resolutionRewrite    = "rewrite"
+)
+
+// maxDescriptorBytes bounds how much of a NIP-96 descriptor we are willing to
+// read; real descriptors are a few hundred bytes.
+const maxDescriptorBytes = 64 << 10
+
+// nip96Descriptor is the subset of /.well-known/nostr/nip96.json we need.
+type nip96Descriptor struct {
+	APIURL      string `json:"api_url"`
+	DownloadURL string `json:"download_url"`
+}
+
+// resolveNIP96 turns nip96://host/<file> into a download URL. It first asks
+// the server for its NIP-96 descriptor and downloads from download_url (or
+// api_url) per the spec; if the descriptor can't be fetched or doesn't look
+// like one, it logs why and falls back to the plain nip96:// -> https://
+// rewrite.
+func (f *fetcher) resolveNIP96(ctx context.Context, source string) (string, string, error) {
+	rewritten, err := normalizeGitURL(source)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := url.Parse(rewritten)
+	if err != nil {
+		return "", "", fmt.Errorf("parse source: %w", err)
+	}
+
+	base, err := f.fetchNIP96Descriptor(ctx, u)
+	if err != nil {
+		log.Printf("⚠️ nip96 descriptor for %s unusable, falling back to rewrite: %v", u.Host, err)
+		return rewritten, resolutionRewrite, nil
+	}
+
+	file := path.Base(u.Path)
+	if file == "." || file == "/" {
+		log.Printf("⚠️ nip96 source %s names no file, falling back to rewrite", redactURL(source))
+		return rewritten, resolutionRewrite, nil
+	}
+	resolved := strings.TrimSuffix(base.String(), "/") + "/" + file
+	log.Printf("🔎 nip96 descriptor resolved %s -> %s", redactURL(source), redactURL(resolved))
+	return resolved, resolutionDescriptor, nil
+}
+
+// fetchNIP96Descriptor returns the base URL files are served from.
+func (f *fetcher) fetchNIP96Descriptor(ctx context.Context, u *url.URL) (*url.URL, error) {
+	wellKnown := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/.well-known/nostr/nip96.json"}
+	req, err := http.NewRequest(http.MethodGet, wellKnown.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	f.creds.apply(req)
+
+	resp, err := f.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var d nip96Descriptor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDescriptorBytes)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("malformed descriptor: %w", err)
+	}
+	raw := d.DownloadURL
+	if raw == "" {
+		raw = d.APIURL
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("descriptor has neither download_url nor api_url")
+	}
+	base, err := wellKnown.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor url %q: %w", raw, err)
+	}
+	if base.Scheme != "https" && base.Scheme != "http" {
+		return nil, fmt.Errorf("descriptor url %q is not http(s)", raw)
+	}
+	return base, nil
+}
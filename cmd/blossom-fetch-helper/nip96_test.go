@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// blossomHost serves a NIP-96 descriptor (unless descriptor is "") and the
+// pack at both /media/x.pack and the rewrite's /x.pack, each marked with the
+// path it came from.
+func blossomHost(t *testing.T, status int, descriptor string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/nostr/nip96.json":
+			w.WriteHeader(status)
+			w.Write([]byte(descriptor))
+		case "/media/x.pack", "/x.pack":
+			w.Write([]byte("PACK from " + r.URL.Path))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveNIP96(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		descriptor string
+		wantPath   string
+		wantRes    string
+	}{
+		{"download_url", 200, `{"api_url":"https://elsewhere.example/api","download_url":"/media"}`, "/media/x.pack", resolutionDescriptor},
+		{"api_url only", 200, `{"api_url":"/media/"}`, "/media/x.pack", resolutionDescriptor},
+		{"malformed descriptor", 200, `{"download_url":`, "/x.pack", resolutionRewrite},
+		{"descriptor without urls", 200, `{"content_types":["*/*"]}`, "/x.pack", resolutionRewrite},
+		{"non-http download_url", 200, `{"download_url":"ftp://files.example/"}`, "/x.pack", resolutionRewrite},
+		{"no descriptor", 404, "not found", "/x.pack", resolutionRewrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := blossomHost(t, tt.status, tt.descriptor)
+			host := strings.TrimPrefix(srv.URL, "https://")
+			f := &fetcher{client: srv.Client()}
+			got, res, err := f.resolveNIP96(context.Background(), "nip96://"+host+"/x.pack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := srv.URL + tt.wantPath; got != want {
+				t.Errorf("resolved to %s, want %s", got, want)
+			}
+			if res != tt.wantRes {
+				t.Errorf("resolution = %q, want %q", res, tt.wantRes)
+			}
+		})
+	}
+}
+
+// TestFetchNIP96Source runs a whole fetch of a nip96:// source and checks
+// the summary reports how it was resolved.
+func TestFetchNIP96Source(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		descriptor string
+		want       string
+	}{
+		{"through the descriptor", `{"download_url":"/media"}`, resolutionDescriptor},
+		{"through the rewrite", `<html>not json</html>`, resolutionRewrite},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := blossomHost(t, 200, tt.descriptor)
+			f := &fetcher{client: srv.Client()}
+			res, err := f.fetchToRepo("nip96://"+strings.TrimPrefix(srv.URL, "https://")+"/x.pack", "", "", "", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Resolution != tt.want {
+				t.Errorf("resolution = %q, want %q", res.Resolution, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// nip98Kind is the kind of a NIP-98 HTTP auth event.
+const nip98Kind = 27235
+
+// signNIP98 sets "Authorization: Nostr <event>" on req: a kind 27235 event
+// signed by key, naming the request's absolute URL and method and created
+// now, which is what Blossom servers holding private packs check. Each
+// request, retries included, gets a fresh event.
+func signNIP98(req *http.Request, key *nostrkey.SecretKey, now time.Time) error {
+	ev := nostr.Event{
+		CreatedAt: now.Unix(),
+		Kind:      nip98Kind,
+		Tags:      [][]string{{"u", req.URL.String()}, {"method", req.Method}},
+	}
+	if err := ev.Sign(key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(data))
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// testNsec is the NIP-19 example key, in both forms --nsec takes.
+const (
+	testNsec    = "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5"
+	testNsecHex = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+)
+
+// nip98Event decodes the event in an "Authorization: Nostr" header.
+func nip98Event(t *testing.T, header string) nostr.Event {
+	t.Helper()
+	b64, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		t.Fatalf("Authorization %q isn't NIP-98", header)
+	}
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestSignNIP98(t *testing.T) {
+	key, err := nostrkey.ParseSecretKey(testNsec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "https://blossom.example/b1/x.pack?sig=1", nil)
+			if err := signNIP98(req, key, now); err != nil {
+				t.Fatal(err)
+			}
+			ev := nip98Event(t, req.Header.Get("Authorization"))
+			if err := ev.Verify(); err != nil {
+				t.Fatalf("event doesn't verify: %v", err)
+			}
+			if ev.Kind != nip98Kind || ev.CreatedAt != now.Unix() || ev.PubKey != hex.EncodeToString(key.PublicKey) {
+				t.Errorf("kind %d, created_at %d, pubkey %s", ev.Kind, ev.CreatedAt, ev.PubKey)
+			}
+			if u := ev.Tag("u"); u != "https://blossom.example/b1/x.pack?sig=1" {
+				t.Errorf("u tag %q", u)
+			}
+			if m := ev.Tag("method"); m != method {
+				t.Errorf("method tag %q, want %s", m, method)
+			}
+		})
+	}
+}
+
+// TestFetchNIP98 fetches with and without --nsec and checks what the
+// server was sent.
+func TestFetchNIP98(t *testing.T) {
+	pack, _ := gitPack(t, "nip98", 2)
+	var (
+		mu   sync.Mutex
+		auth string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = r.Header.Get("Authorization")
+		mu.Unlock()
+		w.Write(pack)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		nsec     string
+		wantAuth string
+	}{
+		{name: "no key", wantAuth: ""},
+		{name: "nsec", nsec: testNsec, wantAuth: "Nostr"},
+		{name: "hex key", nsec: testNsecHex, wantAuth: "Nostr"},
+		// Basic auth for the host wins; one header can't carry both.
+		{name: "basic auth for the host", user: "login", password: "secret", nsec: testNsec, wantAuth: "Basic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := loadCredentials(tt.user, tt.password, strings.Split(host, ":")[0], "", tt.nsec, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fetcher{client: srv.Client(), creds: creds}
+			start := time.Now().Unix()
+			if _, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			got := auth
+			mu.Unlock()
+			if scheme, _, _ := strings.Cut(got, " "); scheme != tt.wantAuth {
+				t.Fatalf("Authorization %q, want scheme %q", got, tt.wantAuth)
+			}
+			if tt.wantAuth != "Nostr" {
+				return
+			}
+			ev := nip98Event(t, got)
+			if err := ev.Verify(); err != nil {
+				t.Fatalf("event doesn't verify: %v", err)
+			}
+			if ev.Tag("u") != srv.URL+"/x.pack" || ev.Tag("method") != http.MethodGet || ev.CreatedAt < start {
+				t.Errorf("event %+v", ev)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// blobPack hand-assembles a version 2 pack of n undeltified blobs, so the
+// expected object count doesn't depend on what git decides to pack.
+func blobPack(t *testing.T, n int) []byte {
+	t.Helper()
+	var p bytes.Buffer
+	p.WriteString("PACK")
+	binary.Write(&p, binary.BigEndian, uint32(2))
+	binary.Write(&p, binary.BigEndian, uint32(n))
+	for i := 0; i < n; i++ {
+		data := []byte(fmt.Sprintf("object %d of %d\n", i, n))
+		// Type 3 (blob) and the size, four bits then seven per byte.
+		size := len(data)
+		b := byte(3<<4 | size&0x0f)
+		for size >>= 4; size > 0; size >>= 7 {
+			p.WriteByte(b | 0x80)
+			b = byte(size & 0x7f)
+		}
+		p.WriteByte(b)
+		zw := zlib.NewWriter(&p)
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := sha1.Sum(p.Bytes())
+	p.Write(sum[:])
+	return p.Bytes()
+}
+
+func TestObjectCount(t *testing.T) {
+	fromGit, _ := gitPack(t, "count", 2)
+	tests := []struct {
+		name string
+		pack []byte
+		// count is --object-count, verify --verify-pack.
+		count, verify bool
+		// want is the reported count; 0 means objects is left out.
+		want uint32
+	}{
+		{name: "hand-built pack", pack: blobPack(t, 3), count: true, want: 3},
+		{name: "hundreds of objects", pack: blobPack(t, 300), count: true, want: 300},
+		{name: "pack from git", pack: fromGit, count: true, want: 5},
+		{name: "not a pack", pack: []byte("<html>mirror error page</html>"), count: true},
+		{name: "counted by --verify-pack", pack: blobPack(t, 4), verify: true, want: 4},
+		{name: "both flags", pack: blobPack(t, 4), count: true, verify: true, want: 4},
+		{name: "flag off", pack: blobPack(t, 3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := packServer(t, tt.pack)
+			ledgerPath := filepath.Join(t.TempDir(), "ledger.jsonl")
+			l, err := openLedger(ledgerPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fetcher{client: srv.Client(), objectCount: tt.count, verifyPack: tt.verify}
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Objects != tt.want {
+				t.Errorf("object count %d, want %d", res.Objects, tt.want)
+			}
+			if err := l.record(res); err != nil {
+				t.Fatal(err)
+			}
+
+			// The count reaches both the stdout JSON and the manifest.
+			out, err := json.Marshal(res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ledgerFile, err := os.Open(ledgerPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ledgerFile.Close()
+			sc := bufio.NewScanner(ledgerFile)
+			if !sc.Scan() {
+				t.Fatal("nothing recorded in the ledger")
+			}
+			for what, line := range map[string][]byte{"JSON output": out, "ledger": sc.Bytes()} {
+				var fields map[string]any
+				if err := json.Unmarshal(line, &fields); err != nil {
+					t.Fatalf("%s: %v", what, err)
+				}
+				got, ok := fields["objects"]
+				switch {
+				case tt.want == 0 && ok:
+					t.Errorf("%s has objects %v, want none", what, got)
+				case tt.want != 0 && got != float64(tt.want):
+					t.Errorf("%s has objects %v, want %d", what, got, tt.want)
+				}
+				if _, ok := fields["object_count"]; ok {
+					t.Errorf("%s still has object_count", what)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Git pack and index layout constants. Both files end in SHA-1 checksums:
+// a pack ends with the checksum of everything before it, and an index ends
+// with the checksum of its pack followed by its own checksum.
+const (
+	packHeaderLen = 12
+	hashLen       = sha1.Size
+	idxV2Magic    = "\377tOc"
+	fanoutEntries = 256
+)
+
+var errIndexMismatch = errors.New("pack index does not match pack")
+
+// minObjectBytes is the smallest an object can be inside a pack: a one-byte
+// type and size header plus the shortest zlib stream (8 bytes, for empty
+// content). Deltas only add to that, so it is a floor no valid pack goes
+// below, and the default for --min-object-bytes.
+const minObjectBytes = 9
+
+// checkPackDensity rejects a pack whose header claims more objects than its
+// body could hold at minBytes each. The count is only trusted from packs
+// that passed the trailer check; others are --verify-pack's business.
+func checkPackDensity(d packDigests, minBytes int) error {
+	if minBytes <= 0 || d.packErr != nil {
+		return nil
+	}
+	body := d.size - packHeaderLen - hashLen
+	if need := int64(d.objects) * int64(minBytes); need > body {
+		return fmt.Errorf("%w: header claims %d objects but only %d bytes follow it", errNotPack, d.objects, body)
+	}
+	return nil
+}
+
+// idxPathFor returns the .idx path that pairs with a .pack path.
+func idxPathFor(packPath string) string {
+	return strings.TrimSuffix(packPath, ".pack") + ".idx"
+}
+
+// readIndexChecksum verifies the index's own trailing SHA-1 and returns the
+// pack checksum it was built for plus the object count from its fanout
+// table. Both v1 and v2 indexes are understood.
+func readIndexChecksum(idxPath string) ([]byte, uint32, error) {
+	data, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < fanoutEntries*4+2*hashLen {
+		return nil, 0, fmt.Errorf("index too short (%d bytes)", len(data))
+	}
+
+	body, own := data[:len(data)-hashLen], data[len(data)-hashLen:]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], own) {
+		return nil, 0, fmt.Errorf("index checksum mismatch")
+	}
+
+	fanout := data
+	if string(data[:4]) == idxV2Magic {
+		if v := binary.BigEndian.Uint32(data[4:8]); v != 2 {
+			return nil, 0, fmt.Errorf("unsupported index version %d", v)
+		}
+		fanout = data[8:]
+		if len(fanout) < fanoutEntries*4+2*hashLen {
+			return nil, 0, fmt.Errorf("index too short (%d bytes)", len(data))
+		}
+	}
+	count := binary.BigEndian.Uint32(fanout[(fanoutEntries-1)*4:])
+	packSum := data[len(data)-2*hashLen : len(data)-hashLen]
+	return packSum, count, nil
+}
+
+// verifyPackIndex cross-checks an .idx against a pack whose digests were
+// taken while it was downloaded: both must be internally consistent, the
+// index must record the pack's checksum, and the object counts must agree.
+func verifyPackIndex(pack packDigests, idxPath string) error {
+	if pack.packErr != nil {
+		return fmt.Errorf("read pack: %w", pack.packErr)
+	}
+	packSum, packCount := pack.packSum, pack.objects
+	idxPackSum, idxCount, err := readIndexChecksum(idxPath)
+	if err != nil {
+		return fmt.Errorf("read index: %w", err)
+	}
+	if !bytes.Equal(packSum, idxPackSum) {
+		return fmt.Errorf("%w: index was built for pack %x, got %x", errIndexMismatch, idxPackSum, packSum)
+	}
+	if packCount != idxCount {
+		return fmt.Errorf("%w: pack has %d objects, index has %d", errIndexMismatch, packCount, idxCount)
+	}
+	return nil
+}
+
+// generatePackIndex builds the .idx for packPath at idxPath with
+// `git index-pack`, which also fully validates the pack's objects. No
+// reverse index is written: git would name it after packPath, which is a
+// temp file that doesn't end in .pack.
+func generatePackIndex(packPath, idxPath string) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("indexing a pack needs git on PATH: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "-c", "pack.writeReverseIndex=false", "index-pack", "-o", idxPath, packPath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git index-pack: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
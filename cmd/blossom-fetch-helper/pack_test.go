@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPackIndex(t *testing.T) {
+	pack, idx := gitPack(t, "", 2)
+	_, idxV1 := gitPack(t, "", 1)
+	_, otherIdx := gitPack(t, "other ", 2)
+	badSum := append([]byte(nil), idx...)
+	badSum[len(badSum)-1] ^= 1
+	tests := []struct {
+		name    string
+		idx     []byte
+		wantErr string
+	}{
+		{name: "matching v2 index", idx: idx},
+		{name: "matching v1 index", idx: idxV1},
+		{name: "index of another pack", idx: otherIdx, wantErr: errIndexMismatch.Error()},
+		{name: "corrupt index checksum", idx: badSum, wantErr: "index checksum mismatch"},
+		{name: "truncated index", idx: idx[:100], wantErr: "index too short"},
+	}
+	d := mustDigest(t, writeTemp(t, "x.pack", pack))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPackIndex(d, writeTemp(t, "x.idx", tt.idx))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("not a pack", func(t *testing.T) {
+		junk := mustDigest(t, writeTemp(t, "x.pack", []byte("<html>a login page</html>")))
+		if err := verifyPackIndex(junk, writeTemp(t, "x.idx", idx)); err == nil {
+			t.Fatal("accepted an index for a non-pack")
+		}
+	})
+}
+
+// TestFetchVerifyIdx places a pack next to an existing .idx with
+// --verify-idx on.
+func TestFetchVerifyIdx(t *testing.T) {
+	pack, idx := gitPack(t, "", 2)
+	_, otherIdx := gitPack(t, "other ", 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pack)
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name     string
+		existing []byte
+		verified bool
+		wantErr  bool
+	}{
+		{name: "matching index", existing: idx, verified: true},
+		{name: "mismatched index", existing: otherIdx, wantErr: true},
+		{name: "no index", existing: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := t.TempDir()
+			dir := packDir(repo)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != nil {
+				if err := os.WriteFile(filepath.Join(dir, "x.idx"), tt.existing, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := &fetcher{client: srv.Client(), verifyIdx: true}
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+			if tt.wantErr {
+				if !errors.Is(err, errIndexMismatch) {
+					t.Fatalf("err = %v, want errIndexMismatch", err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "x.pack")); !os.IsNotExist(err) {
+					t.Errorf("mismatched pack was placed (stat: %v)", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.IndexVerified != tt.verified {
+				t.Errorf("index_verified = %v, want %v", res.IndexVerified, tt.verified)
+			}
+		})
+	}
+}
+
+// claimObjects rewrites pack's header to claim n objects and fixes up the
+// trailer, so the pack still passes every check that doesn't count.
+func claimObjects(pack []byte, n uint32) []byte {
+	out := append([]byte(nil), pack[:len(pack)-sha1.Size]...)
+	binary.BigEndian.PutUint32(out[8:12], n)
+	sum := sha1.Sum(out)
+	return append(out, sum[:]...)
+}
+
+func TestPackDensity(t *testing.T) {
+	honest := blobPack(t, 4)
+	body := len(honest) - packHeaderLen - hashLen
+	// Each of honest's objects takes this many bytes on average.
+	perObject := body / 4
+	tests := []struct {
+		name     string
+		pack     []byte
+		minBytes int
+		rejected bool
+	}{
+		{name: "honest pack", pack: honest, minBytes: minObjectBytes},
+		{name: "inflated count", pack: claimObjects(honest, 1000), minBytes: minObjectBytes, rejected: true},
+		{name: "count past what fits by one", pack: claimObjects(honest, uint32(body/minObjectBytes+1)), minBytes: minObjectBytes, rejected: true},
+		{name: "as many as fit", pack: claimObjects(honest, uint32(body/minObjectBytes)), minBytes: minObjectBytes},
+		{name: "check disabled", pack: claimObjects(honest, 1000), minBytes: 0},
+		{name: "floor at the pack's density", pack: honest, minBytes: perObject},
+		{name: "floor just above it", pack: honest, minBytes: perObject + 1, rejected: true},
+		// Whatever a torn pack's header says isn't trusted either way.
+		{name: "bad trailer", pack: append(claimObjects(honest, 1000)[:len(honest)-1], 0), minBytes: minObjectBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := packServer(t, tt.pack)
+			repo := t.TempDir()
+			f := &fetcher{client: srv.Client(), minObjectBytes: tt.minBytes}
+			_, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+			placed := filepath.Join(packDir(repo), "x.pack")
+			if !tt.rejected {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(placed); err != nil {
+					t.Errorf("pack not placed: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errNotPack) || !strings.Contains(err.Error(), "objects but only") {
+				t.Fatalf("err = %v, want an implausible pack", err)
+			}
+			if _, err := os.Stat(placed); !os.IsNotExist(err) {
+				t.Errorf("implausible pack was placed (stat: %v)", err)
+			}
+		})
+	}
+}
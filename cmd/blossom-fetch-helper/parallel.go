@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// parallelMinPart is the smallest range --parallel splits a pack into;
+// smaller packs use fewer ranges, down to a single stream.
+const parallelMinPart = 1 << 20
+
+// parallelDownload is download for --parallel: a HEAD learns the size, then
+// that many concurrent Range requests each write their share straight to
+// its offset in the temp file, so memory stays bounded whatever the pack
+// size. A server that doesn't advertise byte ranges and a length, or a pack
+// too small to split, gets a single streamDownload instead. The digests are
+// taken over the reassembled file, which costs one read of it.
+func (f *fetcher) parallelDownload(ctx context.Context, u *url.URL, dir string) (*download, error) {
+	source := redactURL(u.String())
+	size, etag, ok := f.probeRanges(ctx, u)
+	parts := int(min(int64(f.parallel), size/parallelMinPart))
+	if !ok || parts < 2 {
+		return f.streamDownload(ctx, u, dir)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".fetch-*.tmp")
+	if err != nil {
+		return nil, &localError{fmt.Errorf("create temp file: %w", err)}
+	}
+	defer tmp.Close()
+	if err := tmp.Truncate(size); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+
+	log.Printf("📥 fetching %s in %d ranges", source, parts)
+	prog := f.newProgress(size, 0)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < parts; i++ {
+		span := byteRange{start: size * int64(i) / int64(parts), end: size*int64(i+1)/int64(parts) - 1}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.fetchRange(ctx, u, etag, span, size, tmp, prog); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	prog.finish()
+	if err := tmp.Close(); firstErr == nil {
+		firstErr = err
+	}
+	if firstErr != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("download: %w", firstErr)
+	}
+	d, err := digestFile(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("digest %s: %w", source, err)
+	}
+	return &download{path: tmp.Name(), packDigests: d}, nil
+}
+
+// probeRanges asks for u's headers, reporting its size and strong ETag when
+// the server accepts byte ranges and states a length.
+func (f *fetcher) probeRanges(ctx context.Context, u *url.URL) (size int64, etag string, ok bool) {
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return 0, "", false
+	}
+	f.creds.apply(req)
+	resp, err := f.send(ctx, req)
+	if err != nil {
+		return 0, "", false
+	}
+	resp.Body.Close()
+	if checkStatus(resp, false) != nil || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return 0, "", false
+	}
+	return resp.ContentLength, strongETag(resp.Header.Get("ETag")), true
+}
+
+// fetchRange downloads span of u into its place in file, counting it in
+// prog. With an ETag, If-Range turns a change of the pack mid-download into
+// a 200, which is refused like any answer that isn't exactly span. Without
+// one, a Content-Range total other than the size the HEAD reported is the
+// sign the pack changed, and is refused too.
+func (f *fetcher) fetchRange(ctx context.Context, u *url.URL, etag string, span byteRange, size int64, file *os.File, prog *progress) error {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	f.creds.apply(req)
+	req.Header.Set("Range", span.String())
+	if etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
+	resp, err := f.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, true); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%w: asked for %s, got %s", errRangeMismatch, span, resp.Status)
+	}
+	_, total, err := checkContentRange(resp.Header.Get("Content-Range"), span)
+	if err != nil {
+		return err
+	}
+	if total >= 0 && total != size {
+		return fmt.Errorf("%w: range %s is of %d bytes, the HEAD said %d", errRangeMismatch, span, total, size)
+	}
+	want := span.end - span.start + 1
+	n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(file, span.start), prog), io.LimitReader(resp.Body, want))
+	if err == nil && n != want {
+		err = fmt.Errorf("%w: range %s ended after %d bytes", io.ErrUnexpectedEOF, span, n)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParallelDownload serves a pack that is, for some cases, replaced
+// between the HEAD and the range requests.
+func TestParallelDownload(t *testing.T) {
+	pack := make([]byte, 3*parallelMinPart+12345)
+	rand.New(rand.NewSource(1)).Read(pack)
+	grown := append(append([]byte(nil), pack...), "appended"...)
+	tests := []struct {
+		name    string
+		get     []byte // what the GETs serve; the HEAD always sees pack
+		etag    string
+		wantErr error
+	}{
+		{name: "unchanged", get: pack},
+		{name: "unchanged with an ETag", get: pack, etag: `"v1"`},
+		// With no ETag for If-Range, only the Content-Range total shows
+		// that every range is cut from a different pack.
+		{name: "grown without an ETag", get: grown, wantErr: errRangeMismatch},
+		{name: "shrunk without an ETag", get: pack[:len(pack)-100], wantErr: errRangeMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.etag != "" {
+					w.Header().Set("ETag", tt.etag)
+				}
+				body := tt.get
+				if r.Method == http.MethodHead {
+					body = pack
+				} else if r.Header.Get("Range") != "" {
+					ranges.Add(1)
+				}
+				http.ServeContent(w, r, "x.pack", time.Time{}, bytes.NewReader(body))
+			}))
+			defer srv.Close()
+			u, _ := url.Parse(srv.URL + "/x.pack")
+			f := &fetcher{client: srv.Client(), parallel: 4}
+			d, err := f.parallelDownload(context.Background(), u, t.TempDir())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(d.path)
+			if n := ranges.Load(); n != 3 {
+				t.Errorf("%d range requests, want 3", n)
+			}
+			got, err := os.ReadFile(d.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pack) {
+				t.Error("reassembled pack differs from the served one")
+			}
+		})
+	}
+}
+
+func TestFetchRangeChecksTotal(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentRange string
+		wantErr      bool
+	}{
+		{"matching total", "bytes 10-19/100", false},
+		{"unknown total", "bytes 10-19/*", false},
+		{"larger total", "bytes 10-19/101", true},
+		{"smaller total", "bytes 10-19/50", true},
+		{"other span", "bytes 11-20/100", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", tt.contentRange)
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(bytes.Repeat([]byte{'p'}, 10))
+			}))
+			defer srv.Close()
+			file, err := os.CreateTemp(t.TempDir(), "part")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			u, _ := url.Parse(srv.URL)
+			f := &fetcher{client: srv.Client()}
+			err = f.fetchRange(context.Background(), u, "", byteRange{start: 10, end: 19}, 100, file, nil)
+			if tt.wantErr != errors.Is(err, errRangeMismatch) {
+				t.Fatalf("err = %v, want errRangeMismatch: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestParallelWrongRange has one part of a parallel fetch answered wrongly.
+// Every case must fail the whole fetch, leaving neither a pack nor a temp
+// file behind.
+func TestParallelWrongRange(t *testing.T) {
+	pack := make([]byte, 4*parallelMinPart)
+	rand.New(rand.NewSource(2)).Read(pack)
+	sum := sha256.Sum256(pack)
+	name := hex.EncodeToString(sum[:]) + ".pack"
+	contentRange := func(w http.ResponseWriter, start, end int) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(pack)))
+	}
+	tests := []struct {
+		name string
+		// part answers the range request for pack[start:end+1].
+		part    func(w http.ResponseWriter, start, end int)
+		wantErr error
+	}{
+		{
+			name: "off by one",
+			part: func(w http.ResponseWriter, start, end int) {
+				contentRange(w, start-1, end-1)
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(pack[start-1 : end])
+			},
+			wantErr: errRangeMismatch,
+		},
+		{
+			name: "whole body instead",
+			part: func(w http.ResponseWriter, start, end int) {
+				w.Write(pack)
+			},
+			wantErr: errRangeMismatch,
+		},
+		{
+			name: "no Content-Range",
+			part: func(w http.ResponseWriter, start, end int) {
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(pack[start : end+1])
+			},
+		},
+		{
+			name: "short part",
+			part: func(w http.ResponseWriter, start, end int) {
+				contentRange(w, start, end)
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(pack[start:end])
+			},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			// The headers all check out; only the digest of the whole
+			// file can tell.
+			name: "right headers, wrong bytes",
+			part: func(w http.ResponseWriter, start, end int) {
+				contentRange(w, start, end)
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(pack[start-1 : end])
+			},
+			wantErr: errDigestMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				from, to, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+				start, _ := strconv.Atoi(from)
+				if !ok || start == 0 {
+					http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(pack))
+					return
+				}
+				end, _ := strconv.Atoi(to)
+				tt.part(w, start, end)
+			}))
+			defer srv.Close()
+			repo := t.TempDir()
+			f := &fetcher{client: srv.Client(), parallel: 4}
+			_, err := f.fetchToRepo(srv.URL+"/"+name, "", "", "", repo)
+			if err == nil {
+				t.Fatal("fetch succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			left, _ := filepath.Glob(filepath.Join(packDir(repo), "*"))
+			if len(left) != 0 {
+				t.Errorf("left in the pack dir: %v", left)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// renameBackoff is the wait before the first rename retry; it doubles on
+// each further attempt.
+const renameBackoff = 50 * time.Millisecond
+
+// rename is os.Rename, swappable so transient failures can be simulated.
+var rename = os.Rename
+
+// placeFile moves src to dst. On NFS and Windows a rename can fail for a
+// moment when dst was just touched (EBUSY, sharing violations), so it is
+// retried up to retries times with backoff; if it still fails the file is
+// copied into place instead and src removed.
+func placeFile(src, dst string, retries int) error {
+	wait := renameBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = rename(src, dst); err == nil {
+			return nil
+		}
+		// No point retrying a source that's gone or a move across
+		// filesystems; the latter goes straight to the copy.
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.EXDEV) || attempt >= retries {
+			break
+		}
+		log.Printf("⚠️ %v, retrying in %s", err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	log.Printf("⚠️ %v, copying into place instead", err)
+	if err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("copy into place: %w", err)
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src over dst and syncs it; a failed copy removes dst
+// rather than leaving a truncated file behind.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
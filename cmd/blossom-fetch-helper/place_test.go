@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fakeRename replaces rename for the test: the first len(fail) calls
+// return those errors, wrapped as os.Rename would, and later calls rename
+// for real. It returns a pointer to the call count.
+func fakeRename(t *testing.T, fail ...error) *int {
+	t.Helper()
+	calls := 0
+	rename = func(src, dst string) error {
+		calls++
+		if calls <= len(fail) {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: fail[calls-1]}
+		}
+		return os.Rename(src, dst)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+	return &calls
+}
+
+func TestPlaceFileRetries(t *testing.T) {
+	busy := syscall.EBUSY
+	tests := []struct {
+		name      string
+		fail      []error
+		retries   int
+		wantCalls int
+		// copied is true when the file must have been copied, not
+		// renamed, into place.
+		copied bool
+	}{
+		{name: "busy once", fail: []error{busy}, retries: 3, wantCalls: 2},
+		{name: "busy twice", fail: []error{busy, busy}, retries: 3, wantCalls: 3},
+		{name: "busy past the retries", fail: []error{busy, busy, busy}, retries: 2, wantCalls: 3, copied: true},
+		{name: "no retries", fail: []error{busy}, retries: 0, wantCalls: 1, copied: true},
+		{name: "across filesystems", fail: []error{syscall.EXDEV}, retries: 3, wantCalls: 1, copied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := []byte("PACK " + tt.name)
+			src := writeTemp(t, ".fetch-1.tmp", data)
+			dst := filepath.Join(dir, "x.pack")
+			srcInfo, err := os.Stat(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := fakeRename(t, tt.fail...)
+
+			if err := placeFile(src, dst, tt.retries); err != nil {
+				t.Fatalf("placeFile: %v", err)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("rename called %d times, want %d", *calls, tt.wantCalls)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("dst holds %q (%v)", got, err)
+			}
+			if _, err := os.Stat(src); !os.IsNotExist(err) {
+				t.Errorf("src still there (stat: %v)", err)
+			}
+			dstInfo, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renamed := os.SameFile(srcInfo, dstInfo); renamed == tt.copied {
+				t.Errorf("renamed = %v, want %v", renamed, !tt.copied)
+			}
+		})
+	}
+}
+
+func TestPlaceFileMissingSource(t *testing.T) {
+	calls := fakeRename(t)
+	dir := t.TempDir()
+	err := placeFile(filepath.Join(dir, "gone.tmp"), filepath.Join(dir, "x.pack"), 3)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("err = %v, want ErrNotExist", err)
+	}
+	if *calls != 1 {
+		t.Errorf("rename called %d times for a missing source", *calls)
+	}
+}
+
+// TestFetchRetriesRename fetches with the final rename failing once, as a
+// Windows share does while an indexer holds the directory.
+func TestFetchRetriesRename(t *testing.T) {
+	pack, _ := gitPack(t, "rename", 2)
+	srv := packServer(t, pack)
+	calls := fakeRename(t, errors.New("The process cannot access the file because it is being used by another process."))
+	repo := t.TempDir()
+	f := &fetcher{client: srv.Client(), renameRetries: 1}
+	res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Errorf("rename called %d times, want 2", *calls)
+	}
+	if got, err := os.ReadFile(res.Pack); err != nil || !bytes.Equal(got, pack) {
+		t.Errorf("placed pack differs (%v)", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(packDir(repo), ".fetch-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 500 * time.Millisecond
+
+// progress is an io.Writer that counts a download's bytes on their way to
+// the temp file and redraws one carriage-return line on stderr with the
+// total so far, the percentage when the size is known, the rate and an ETA.
+// Parallel ranges share one. A nil progress draws nothing.
+type progress struct {
+	w     io.Writer
+	total int64
+	start time.Time
+
+	mu sync.Mutex
+	// done counts every byte on disk; resumed the ones that were already
+	// there, which don't count toward the rate.
+	done    int64
+	resumed int64
+	// drawn is when the line was last drawn, or the start; shown is
+	// whether it ever was.
+	drawn time.Time
+	shown bool
+}
+
+// stderrIsTerminal reports whether stderr is a terminal rather than a file
+// or pipe, where a redrawn line would just pile up.
+func stderrIsTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgress starts a progress line for a download of total bytes (-1 if
+// unknown) of which resumed are already on disk, unless --quiet is set or
+// stderr isn't a terminal.
+func (f *fetcher) newProgress(total, resumed int64) *progress {
+	if !f.progress {
+		return nil
+	}
+	now := time.Now()
+	return &progress{w: os.Stderr, total: total, start: now, drawn: now, done: resumed, resumed: resumed}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	if p == nil {
+		return len(b), nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.drawn) >= progressInterval {
+		p.drawn, p.shown = now, true
+		fmt.Fprintf(p.w, "\r\x1b[K%s", p.line(now))
+	}
+	return len(b), nil
+}
+
+// line renders the progress as of now.
+func (p *progress) line(now time.Time) string {
+	s := "⏬ " + formatBytes(p.done)
+	if p.total > 0 {
+		s += fmt.Sprintf(" / %s (%d%%)", formatBytes(p.total), p.done*100/p.total)
+	}
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return s
+	}
+	rate := float64(p.done-p.resumed) / elapsed
+	s += fmt.Sprintf("  %s/s", formatBytes(int64(rate)))
+	if p.total > 0 && rate > 0 {
+		eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		s += "  ETA " + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// finish clears the progress line so the next log line starts clean.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown {
+		fmt.Fprint(p.w, "\r\x1b[K")
+	}
+}
+
+// formatBytes renders n in binary units, "12.3 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	const mib = 1 << 20
+	start := time.Now()
+	tests := []struct {
+		name                 string
+		total, done, resumed int64
+		elapsed              time.Duration
+		want                 string
+	}{
+		{name: "known size", total: 10 * mib, done: 5 * mib, elapsed: 5 * time.Second, want: "⏬ 5.0 MiB / 10.0 MiB (50%)  1.0 MiB/s  ETA 5s"},
+		{name: "unknown size", total: -1, done: 3 * mib, elapsed: 2 * time.Second, want: "⏬ 3.0 MiB  1.5 MiB/s"},
+		// Bytes already on disk count toward the total, not the rate.
+		{name: "resumed", total: 10 * mib, done: 6 * mib, resumed: 4 * mib, elapsed: 2 * time.Second, want: "⏬ 6.0 MiB / 10.0 MiB (60%)  1.0 MiB/s  ETA 4s"},
+		{name: "nothing yet", total: 10 * mib, elapsed: time.Second, want: "⏬ 0 B / 10.0 MiB (0%)  0 B/s"},
+		{name: "just started", total: 10 * mib, done: mib, want: "⏬ 1.0 MiB / 10.0 MiB (10%)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &progress{total: tt.total, start: start, done: tt.done, resumed: tt.resumed}
+			if got := p.line(start.Add(tt.elapsed)); got != tt.want {
+				t.Errorf("line = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestProgressRedraw checks the line is redrawn in place at most every
+// progressInterval and cleared at the end only if it was ever drawn.
+func TestProgressRedraw(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Now()
+	p := &progress{w: &out, total: 100, start: now, drawn: now}
+	p.Write(make([]byte, 10))
+	if out.Len() != 0 {
+		t.Fatalf("drawn before progressInterval: %q", out.String())
+	}
+	p.finish()
+	if out.Len() != 0 {
+		t.Fatalf("finish cleared a line never drawn: %q", out.String())
+	}
+
+	p.drawn = now.Add(-progressInterval)
+	p.Write(make([]byte, 40))
+	if s := out.String(); !strings.HasPrefix(s, "\r\x1b[K⏬ 50 B / 100 B (50%)") || strings.Contains(s, "\n") {
+		t.Fatalf("drew %q", s)
+	}
+	drawn := out.Len()
+	p.Write(make([]byte, 10))
+	if out.Len() != drawn {
+		t.Errorf("redrawn within progressInterval: %q", out.String()[drawn:])
+	}
+	p.finish()
+	if got := out.String()[drawn:]; got != "\r\x1b[K" {
+		t.Errorf("finish wrote %q, want the line cleared", got)
+	}
+
+	// Off, as with --quiet or a stderr that isn't a terminal.
+	off := (&fetcher{}).newProgress(100, 0)
+	if off != nil {
+		t.Fatal("newProgress drew without progress on")
+	}
+	if n, err := off.Write(make([]byte, 5)); n != 5 || err != nil {
+		t.Errorf("nil progress Write = %d, %v", n, err)
+	}
+	off.finish()
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errRangeMismatch = errors.New("server returned a different range than requested")
+
+// byteRange is an inclusive span of bytes, as in Range and Content-Range.
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) String() string {
+	if r.end < 0 {
+		return fmt.Sprintf("bytes=%d-", r.start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.start, r.end)
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range value.
+// total is -1 when the server sent "*".
+func parseContentRange(v string) (r byteRange, total int64, err error) {
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return r, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	first, last, ok2 := strings.Cut(span, "-")
+	if !ok || !ok2 {
+		return r, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	if r.start, err = strconv.ParseInt(first, 10, 64); err == nil {
+		r.end, err = strconv.ParseInt(last, 10, 64)
+	}
+	total = -1
+	if err == nil && size != "*" {
+		total, err = strconv.ParseInt(size, 10, 64)
+	}
+	if err != nil || r.start < 0 || r.end < r.start || (total >= 0 && r.end >= total) {
+		return byteRange{}, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	return r, total, nil
+}
+
+// checkContentRange verifies that a 206 response covers exactly the bytes
+// asked for. want.end of -1 stands for an open-ended "bytes=start-"
+// request, which must then run to the end of a known total.
+func checkContentRange(v string, want byteRange) (byteRange, int64, error) {
+	got, total, err := parseContentRange(v)
+	if err != nil {
+		return got, total, err
+	}
+	ok := got.start == want.start
+	if want.end < 0 {
+		ok = ok && total >= 0 && got.end == total-1
+	} else {
+		ok = ok && got.end == want.end
+	}
+	if !ok {
+		return got, total, fmt.Errorf("%w: asked for %s, got %q", errRangeMismatch, want, v)
+	}
+	return got, total, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hostLimiter is a token bucket per upstream host, refilled at rate tokens
+// per second and holding at most one, so requests to the same host are
+// spaced 1/rate apart while different hosts don't wait on each other.
+type hostLimiter struct {
+	rate float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newHostLimiter returns nil (no limit) when rate <= 0.
+func newHostLimiter(rate float64) *hostLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &hostLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// wait blocks until host may be sent another request or ctx is done.
+// Callers reserve their token up front, which keeps concurrent waiters in
+// arrival order; a waiter that gives up hands its token back.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	now := time.Now()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: 1, last: now}
+		l.buckets[host] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > 1 {
+		b.tokens = 1
+	}
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		b.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// rateLimitedTransport applies a hostLimiter to every request a client
+// sends, redirects included.
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *hostLimiter
+}
+
+func (t rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// arrivals is a server noting when each request reached it.
+type arrivals struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (a *arrivals) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.times = append(a.times, time.Now())
+	a.mu.Unlock()
+}
+
+func (a *arrivals) gaps() []time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var gaps []time.Duration
+	for i := 1; i < len(a.times); i++ {
+		gaps = append(gaps, a.times[i].Sub(a.times[i-1]))
+	}
+	return gaps
+}
+
+func TestHostRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		hosts int
+		// perHost requests are sent concurrently to each host.
+		perHost int
+		// minGap is the least time allowed between two requests to one
+		// host, maxTotal the most the whole burst may take.
+		minGap   time.Duration
+		maxTotal time.Duration
+	}{
+		{name: "one host throttled", rate: 20, hosts: 1, perHost: 5, minGap: 40 * time.Millisecond, maxTotal: time.Second},
+		{name: "hosts throttled separately", rate: 20, hosts: 3, perHost: 4, minGap: 40 * time.Millisecond, maxTotal: 600 * time.Millisecond},
+		{name: "unlimited", rate: 0, hosts: 1, perHost: 5, maxTotal: 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				servers []*arrivals
+				urls    []string
+			)
+			for i := 0; i < tt.hosts; i++ {
+				a := &arrivals{}
+				srv := httptest.NewServer(a)
+				defer srv.Close()
+				servers = append(servers, a)
+				urls = append(urls, srv.URL+"/x.pack")
+			}
+			client := newClient(10, tt.rate, 0, nil)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.hosts*tt.perHost)
+			for _, u := range urls {
+				for i := 0; i < tt.perHost; i++ {
+					wg.Add(1)
+					go func(u string) {
+						defer wg.Done()
+						resp, err := client.Get(u)
+						if err != nil {
+							errs <- err
+							return
+						}
+						resp.Body.Close()
+					}(u)
+				}
+			}
+			wg.Wait()
+			total := time.Since(start)
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			if total > tt.maxTotal {
+				t.Errorf("burst took %v, want at most %v", total, tt.maxTotal)
+			}
+			for i, a := range servers {
+				gaps := a.gaps()
+				if len(gaps) != tt.perHost-1 {
+					t.Fatalf("host %d saw %d requests, want %d", i, len(gaps)+1, tt.perHost)
+				}
+				for _, gap := range gaps {
+					if gap < tt.minGap {
+						t.Errorf("host %d: requests %v apart, want at least %v", i, gap, tt.minGap)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestHostRateGivesUp cancels a request waiting for its token: it fails
+// with the context's error without reaching the host, and the token it
+// gave back serves the next request on time.
+func TestHostRateGivesUp(t *testing.T) {
+	a := &arrivals{}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	client := newClient(10, 2, 0, nil)
+	get := func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/x.pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the deadline", err)
+	}
+	start := time.Now()
+	if err := get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The first token was spent, so this one comes 1/rate after it, not
+	// 1/rate after the abandoned reservation.
+	if took := time.Since(start); took > 600*time.Millisecond {
+		t.Errorf("next request waited %v", took)
+	}
+	if got := len(a.gaps()) + 1; got != 2 {
+		t.Errorf("host saw %d requests, want 2", got)
+	}
+}
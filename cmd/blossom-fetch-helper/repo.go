@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var errNotBareRepo = errors.New("not a bare git repository")
+
+// checkBareRepo reports whether dir has the minimum layout git needs to
+// treat it as a bare repository: a HEAD file plus objects/ and refs/.
+func checkBareRepo(dir string) error {
+	fi, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w (does not exist)", dir, errNotBareRepo)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: %w (not a directory)", dir, errNotBareRepo)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s: %w (missing HEAD)", dir, errNotBareRepo)
+	}
+	for _, sub := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("%s: %w (missing %s/)", dir, errNotBareRepo, sub)
+		}
+	}
+	return nil
+}
+
+// ensureBareRepo checks that dir is a bare repository before any pack is
+// placed into it. With initRepo, a missing or empty dir is initialized with
+// `git init --bare`; a non-empty dir that isn't a repo is never touched.
+func ensureBareRepo(dir string, initRepo bool) error {
+	err := checkBareRepo(dir)
+	if err == nil || !initRepo {
+		return err
+	}
+
+	entries, rerr := os.ReadDir(dir)
+	switch {
+	case errors.Is(rerr, fs.ErrNotExist):
+	case rerr != nil:
+		return rerr
+	case len(entries) > 0:
+		return fmt.Errorf("%w; refusing to --init a non-empty directory", err)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("--init needs git on PATH: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "init", "--bare", "--quiet", dir)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git init --bare %s: %v: %s", dir, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	log.Printf("🆕 initialized bare repository %s", dir)
+	return checkBareRepo(dir)
+}
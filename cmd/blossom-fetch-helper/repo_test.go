@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureBareRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not on PATH")
+	}
+	bare := func(t *testing.T) string {
+		dir := filepath.Join(t.TempDir(), "bare.git")
+		if out, err := exec.Command("git", "init", "--bare", "-q", dir).CombinedOutput(); err != nil {
+			t.Fatalf("git init: %v: %s", err, out)
+		}
+		return dir
+	}
+	nonRepo := func(t *testing.T) string {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "README"), []byte("not a repo"), 0o644)
+		return dir
+	}
+	file := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), "file")
+		os.WriteFile(path, nil, 0o644)
+		return path
+	}
+	tests := []struct {
+		name    string
+		dir     func(*testing.T) string
+		init    bool
+		wantErr bool
+		created bool
+	}{
+		{name: "bare repo", dir: bare},
+		{name: "bare repo with --init", dir: bare, init: true},
+		{name: "non-repo dir", dir: nonRepo, wantErr: true},
+		{name: "non-repo dir with --init", dir: nonRepo, init: true, wantErr: true},
+		{name: "regular file", dir: file, wantErr: true},
+		{name: "missing dir", dir: func(t *testing.T) string { return filepath.Join(t.TempDir(), "new.git") }, wantErr: true},
+		{name: "missing dir with --init", dir: func(t *testing.T) string { return filepath.Join(t.TempDir(), "new.git") }, init: true, created: true},
+		{name: "empty dir with --init", dir: func(t *testing.T) string { return t.TempDir() }, init: true, created: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tt.dir(t)
+			err := ensureBareRepo(dir, tt.init)
+			if tt.wantErr {
+				if !errors.Is(err, errNotBareRepo) {
+					t.Fatalf("err = %v, want errNotBareRepo", err)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) > 1 {
+					t.Errorf("refused dir was modified: %d entries", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.created {
+				if out, err := exec.Command("git", "--git-dir", dir, "rev-parse", "--is-bare-repository").Output(); err != nil || string(out) != "true\n" {
+					t.Errorf("git doesn't see a bare repository: %q, %v", out, err)
+				}
+			}
+		})
+	}
+}
+
+// TestFetchRequiresRepo checks nothing is placed into a directory that
+// isn't a repository when --require-repo is on.
+func TestFetchRequiresRepo(t *testing.T) {
+	srv := packServer(t, []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00 pack"))
+	dir := t.TempDir()
+	f := &fetcher{client: srv.Client(), requireRepo: true}
+	if _, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", dir); !errors.Is(err, errNotBareRepo) {
+		t.Fatalf("err = %v, want errNotBareRepo", err)
+	}
+	if _, err := os.Stat(packDir(dir)); !os.IsNotExist(err) {
+		t.Errorf("objects/pack was created (stat: %v)", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// canonicalRepoPath turns a repository path into the one form it is placed
+// under (--canonical-repo-path), so "repos/a/", "./repos/a" and a symlink to
+// it all land in, and are recorded in the ledger as, the same directory.
+// The path is cleaned and made absolute, relative to root when one is
+// given, and its symlinks are resolved. With a root, a path that resolves
+// outside root's own resolved location is refused: a symlink inside the
+// repos root must not place packs elsewhere. The repository itself need
+// not exist yet; only its existing ancestors are resolved.
+func canonicalRepoPath(root, p string) (string, error) {
+	if p == "" {
+		return "", errors.New("repo path is empty")
+	}
+	p = filepath.Clean(p)
+	if root != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := evalExisting(p)
+	if err != nil {
+		return "", fmt.Errorf("resolve repo path %s: %w", p, err)
+	}
+	if root == "" {
+		return resolved, nil
+	}
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	resolvedRoot, err := evalExisting(rootAbs)
+	if err != nil {
+		return "", fmt.Errorf("resolve repos root %s: %w", root, err)
+	}
+	if rel, err := filepath.Rel(resolvedRoot, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("repo path %s resolves to %s, outside the repos root", p, resolved)
+	}
+	return resolved, nil
+}
+
+// evalExisting resolves the symlinks of p's longest existing prefix and
+// appends the rest unchanged.
+func evalExisting(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// repoPath resolves a request's repo_path under the repos root, then
+// canonicalizes it when --canonical-repo-path is set.
+func (s *fetchServer) repoPath(rel string) (string, error) {
+	p, err := resolveRepoPath(s.reposRoot, rel)
+	if err != nil || !s.canonical {
+		return p, err
+	}
+	return canonicalRepoPath(s.reposRoot, p)
+}
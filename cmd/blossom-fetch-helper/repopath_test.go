@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalRepoPath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	for _, dir := range []string{"npub1a/r.git", "npub1b"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"npub1a/alias.git": filepath.Join(root, "npub1a/r.git"),
+		"npub1a/rel.git":   "r.git",
+		"npub1c":           filepath.Join(root, "npub1b"),
+		"npub1a/out.git":   outside,
+		"npub1d":           outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(root, "npub1a/r.git")
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "already canonical", path: repo, want: repo},
+		{name: "trailing slash", path: "npub1a/r.git/", want: repo},
+		{name: "dot segments", path: "./npub1a/../npub1a/./r.git", want: repo},
+		{name: "absolute under the root", path: repo + "//", want: repo},
+		{name: "symlink to the repo", path: "npub1a/alias.git", want: repo},
+		{name: "relative symlink", path: "npub1a/rel.git/", want: repo},
+		{name: "not created yet, under a symlinked dir", path: "npub1c/new.git", want: filepath.Join(root, "npub1b/new.git")},
+		{name: "symlink out of the root", path: "npub1a/out.git", wantErr: true},
+		{name: "new repo under a symlink out of the root", path: "npub1d/new.git", wantErr: true},
+		{name: "dot-dot out of the root", path: "../elsewhere.git", wantErr: true},
+		{name: "empty", path: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalRepoPath(root, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("canonicalRepoPath(%q) = %s, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("canonicalRepoPath(%q) = %s, %v; want %s", tt.path, got, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("no root", func(t *testing.T) {
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(root); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chdir(wd)
+		got, err := canonicalRepoPath("", "npub1a/alias.git/")
+		if err != nil || got != repo {
+			t.Errorf("got %s, %v; want %s", got, err, repo)
+		}
+	})
+}
+
+// TestServeCanonicalRepoPath sends several spellings of one repository to
+// /fetch; with --canonical-repo-path they all land in, and report, the
+// same directory.
+func TestServeCanonicalRepoPath(t *testing.T) {
+	pack, _ := gitPack(t, "canonical", 2)
+	upstream := packServer(t, pack)
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "npub1a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("r.git", filepath.Join(root, "npub1a/alias.git")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer((&fetchServer{f: &fetcher{client: upstream.Client()}, reposRoot: root, canonical: true}).routes())
+	defer srv.Close()
+
+	want := filepath.Join(root, "npub1a/r.git")
+	for _, path := range []string{"npub1a/r.git", "npub1a/r.git/", "npub1a/./x/../r.git", "npub1a/alias.git"} {
+		var res fetchResult
+		body := `{"source":"` + upstream.URL + `/x.pack","repo_path":"` + path + `"}`
+		if code := postJSON(t, srv.URL+"/fetch", "", body, &res); code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, code)
+		}
+		if res.RepoPath != want || filepath.Dir(filepath.Dir(filepath.Dir(res.Pack))) != want {
+			t.Errorf("%s: placed %s in %s, want %s", path, res.Pack, res.RepoPath, want)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "npub1a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("npub1a holds %d entries, want r.git and its alias", len(entries))
+	}
+}
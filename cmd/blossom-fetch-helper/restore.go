@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// restoreRequest is the body of POST /restore: the packs to place, one per
+// repository, fetched in order.
+type restoreRequest struct {
+	// ID names the restore in its progress events. Sending the ID of an
+	// interrupted restore again is how it is resumed; one is generated
+	// when empty.
+	ID    string         `json:"id"`
+	Repos []fetchRequest `json:"repos"`
+}
+
+// restoreProgress is the progress object of a restore event, as
+// clone-events-sse carries it.
+type restoreProgress struct {
+	ID     string `json:"id"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Failed int    `json:"failed,omitempty"`
+}
+
+// restoreJob is one repository of a restore with its path resolved.
+type restoreJob struct {
+	fetchRequest
+	path string
+}
+
+// restores tracks the IDs of running restores, so the same one isn't
+// started twice.
+type restores struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func (r *restores) start(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running == nil {
+		r.running = make(map[string]bool)
+	}
+	if r.running[id] {
+		return false
+	}
+	r.running[id] = true
+	return true
+}
+
+func (r *restores) finish(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.running, id)
+}
+
+// handleRestore validates a restore and runs it in the background,
+// answering 202 with its ID right away; progress is followed on the
+// clone-events-sse stream (--events-webhook).
+func (s *fetchServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var req restoreRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Repos) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("repos is required"))
+		return
+	}
+	jobs := make([]restoreJob, len(req.Repos))
+	for i, repo := range req.Repos {
+		if repo.Source == "" || repo.RepoPath == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("repos[%d]: source and repo_path are required", i))
+			return
+		}
+		path, err := s.repoPath(repo.RepoPath)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("repos[%d]: %w", i, err))
+			return
+		}
+		jobs[i] = restoreJob{fetchRequest: repo, path: path}
+	}
+	if req.ID == "" {
+		req.ID = newRestoreID()
+	}
+	if !s.restores.start(req.ID) {
+		writeError(w, http.StatusConflict, fmt.Errorf("restore %s is already running", req.ID))
+		return
+	}
+	go func() {
+		defer s.restores.finish(req.ID)
+		s.runRestore(req.ID, jobs)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": req.ID, "total": len(jobs)})
+}
+
+// runRestore fetches each job in turn, publishing restore_started, a
+// repo_restored per placed repository and restore_complete. Repositories
+// the ledger already has are counted as done without fetching again, which
+// is what makes rerunning an interrupted restore resume it. A failed fetch
+// is logged and counted, and the restore goes on with the next one.
+func (s *fetchServer) runRestore(id string, jobs []restoreJob) {
+	p := restoreProgress{ID: id, Total: len(jobs)}
+	log.Printf("♻️ restore %s: %d repositories", id, len(jobs))
+	s.events.publish("restore_started", jobs[0].RepoPath, p)
+	for _, job := range jobs {
+		if s.ledger.done(job.Source, job.path) {
+			p.Done++
+			continue
+		}
+		res, err := s.f.fetchToRepo(job.Source, job.IdxSource, job.SigURL, "", job.path)
+		if err != nil {
+			log.Printf("❌ restore %s: %s: %v", id, job.RepoPath, err)
+			p.Failed++
+			continue
+		}
+		if err := s.ledger.record(res); err != nil {
+			log.Printf("⚠️ restore %s: ledger: %v", id, err)
+		}
+		p.Done++
+		s.events.publish("repo_restored", job.RepoPath, p)
+	}
+	log.Printf("♻️ restore %s: %d done, %d failed", id, p.Done, p.Failed)
+	s.events.publish("restore_complete", jobs[len(jobs)-1].RepoPath, p)
+}
+
+func newRestoreID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// eventsWebhook posts restore progress to a clone-events-sse webhook,
+// signed the way that server verifies. A nil eventsWebhook drops events.
+type eventsWebhook struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// publish sends one event; failures are logged, never fatal to the
+// restore.
+func (e *eventsWebhook) publish(typ, repo string, p restoreProgress) {
+	if e == nil {
+		return
+	}
+	body, err := json.Marshal(map[string]any{"type": typ, "repo": repo, "progress": p})
+	if err != nil {
+		log.Printf("⚠️ events webhook: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("⚠️ events webhook: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(e.secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("⚠️ events webhook %s: %v", typ, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		log.Printf("⚠️ events webhook %s: %s", typ, resp.Status)
+	}
+}
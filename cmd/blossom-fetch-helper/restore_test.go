@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// progressEvent is a restore event as the webhook receives it.
+type progressEvent struct {
+	Type     string          `json:"type"`
+	Repo     string          `json:"repo"`
+	Progress restoreProgress `json:"progress"`
+}
+
+// progressSink stands in for clone-events-sse's webhook: it checks each
+// post is signed with secret and passes the event on.
+func progressSink(t *testing.T, secret string) (*httptest.Server, <-chan progressEvent) {
+	t.Helper()
+	events := make(chan progressEvent, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Timestamp") + "."))
+		mac.Write(body)
+		if got, _ := hex.DecodeString(r.Header.Get("X-Signature")); !hmac.Equal(got, mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var ev progressEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- ev
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, events
+}
+
+func TestRestoreProgress(t *testing.T) {
+	pack, _ := gitPack(t, "restore", 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone.pack" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(pack)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name  string
+		repos []string
+		// restored were placed by an earlier run and are in the ledger.
+		restored []string
+		want     []string
+	}{
+		{
+			name:  "two repos",
+			repos: []string{"npub1a/one.git", "npub1a/two.git"},
+			want: []string{
+				"restore_started npub1a/one.git 0/2",
+				"repo_restored npub1a/one.git 1/2",
+				"repo_restored npub1a/two.git 2/2",
+				"restore_complete npub1a/two.git 2/2",
+			},
+		},
+		{
+			name:     "resumed after the first",
+			repos:    []string{"npub1a/one.git", "npub1a/two.git"},
+			restored: []string{"npub1a/one.git"},
+			want: []string{
+				"restore_started npub1a/one.git 0/2",
+				"repo_restored npub1a/two.git 2/2",
+				"restore_complete npub1a/two.git 2/2",
+			},
+		},
+		{
+			name:  "one source gone",
+			repos: []string{"npub1a/gone.git", "npub1a/two.git"},
+			want: []string{
+				"restore_started npub1a/gone.git 0/2",
+				"repo_restored npub1a/two.git 1/2 failed 1",
+				"restore_complete npub1a/two.git 1/2 failed 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook, events := progressSink(t, "s3cret")
+			root := t.TempDir()
+			l, err := openLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := func(repo string) string {
+				return upstream.URL + "/" + strings.TrimSuffix(filepath.Base(repo), ".git") + ".pack"
+			}
+			for _, repo := range tt.restored {
+				l.record(&fetchResult{Source: source(repo), RepoPath: filepath.Join(root, repo)})
+			}
+			s := &fetchServer{
+				f:         &fetcher{client: upstream.Client()},
+				reposRoot: root,
+				ledger:    l,
+				events:    &eventsWebhook{url: webhook.URL, secret: "s3cret", client: webhook.Client()},
+			}
+			srv := httptest.NewServer(s.routes())
+			defer srv.Close()
+
+			var repos []fetchRequest
+			for _, repo := range tt.repos {
+				repos = append(repos, fetchRequest{Source: source(repo), RepoPath: repo})
+			}
+			body, _ := json.Marshal(restoreRequest{ID: "r1", Repos: repos})
+			var answer struct {
+				ID    string `json:"id"`
+				Total int    `json:"total"`
+			}
+			if code := postJSON(t, srv.URL+"/restore", "", string(body), &answer); code != http.StatusAccepted {
+				t.Fatalf("status %d", code)
+			}
+			if answer.ID != "r1" || answer.Total != len(tt.repos) {
+				t.Errorf("answered %+v", answer)
+			}
+
+			var got []string
+			for len(got) < len(tt.want) {
+				select {
+				case ev := <-events:
+					if ev.Progress.ID != "r1" {
+						t.Errorf("%s for restore %q", ev.Type, ev.Progress.ID)
+					}
+					line := fmt.Sprintf("%s %s %d/%d", ev.Type, ev.Repo, ev.Progress.Done, ev.Progress.Total)
+					if ev.Progress.Failed > 0 {
+						line += fmt.Sprintf(" failed %d", ev.Progress.Failed)
+					}
+					got = append(got, line)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got %q, then nothing", got)
+				}
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d: %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			select {
+			case ev := <-events:
+				t.Errorf("%s after restore_complete", ev.Type)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resumeCheckpoint is how many bytes a resumable download writes between
+// syncing its .part file and recording the progress in the sidecar.
+const resumeCheckpoint = 8 << 20
+
+// partMeta is the .part.meta sidecar written next to a resumable download.
+// Bytes is only advanced after the .part file has been synced, so a fresh
+// process can trust that many bytes even after a crash.
+type partMeta struct {
+	URL  string `json:"url"`
+	ETag string `json:"etag"`
+	// SHA256 is the digest the finished download must have, when known.
+	SHA256 string `json:"sha256,omitempty"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// resumable reports whether the prefix on disk can be trusted: either the
+// server's ETag can check it hasn't changed, or the digest of the whole
+// download will.
+func (m partMeta) resumable() bool {
+	return m.ETag != "" || m.SHA256 != ""
+}
+
+// sourceKey hashes u without its credentials, giving a stable on-disk name
+// for a source that never leaks a password.
+func sourceKey(u *url.URL) string {
+	clean := *u
+	clean.User = nil
+	sum := sha256.Sum256([]byte(clean.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// partPaths returns the .part file and its sidecar for u inside dir. A
+// download with a known SHA-256 is named after that instead, so the same
+// blob continues from whichever mirror is asked next.
+func partPaths(u *url.URL, dir, want string) (part, meta string) {
+	key := want
+	if key == "" {
+		key = sourceKey(u)
+	}
+	part = filepath.Join(dir, ".fetch-"+key[:16]+".part")
+	return part, part + ".meta"
+}
+
+// loadPartMeta returns the resume state left by an earlier run. Anything
+// that doesn't line up (another URL or digest, nothing to validate the
+// prefix with, a .part shorter than the recorded progress) is discarded and
+// the download starts from zero. A prefix of the wanted digest is kept
+// across mirrors, without the other mirror's ETag.
+func loadPartMeta(part, metaPath, source, want string) partMeta {
+	fresh := partMeta{URL: source, SHA256: want}
+	raw, err := os.ReadFile(metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh
+	}
+	var m partMeta
+	if err == nil {
+		err = json.Unmarshal(raw, &m)
+	}
+	if err == nil && m.URL != source && want != "" && m.SHA256 == want {
+		m.URL, m.ETag = source, ""
+	}
+	if err == nil && (m.URL != source || m.SHA256 != want || !m.resumable() || m.Bytes <= 0) {
+		err = errors.New("stale")
+	}
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(part); err == nil && fi.Size() < m.Bytes {
+			err = errors.New("short part file")
+		}
+	}
+	if err != nil {
+		os.Remove(part)
+		os.Remove(metaPath)
+		return fresh
+	}
+	return m
+}
+
+// checkpointWriter writes a resumable download to its .part file and
+// periodically persists the progress.
+type checkpointWriter struct {
+	file     *os.File
+	meta     partMeta
+	metaPath string
+	saved    int64
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.meta.Bytes += int64(n)
+	if err == nil && w.meta.Bytes-w.saved >= resumeCheckpoint {
+		err = w.checkpoint()
+	}
+	return n, err
+}
+
+// checkpoint syncs the .part file, then records its length. Without a
+// strong ETag or a digest there's nothing to validate a resume against, so
+// no sidecar is written.
+func (w *checkpointWriter) checkpoint() error {
+	if !w.meta.resumable() {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(w.meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.metaPath, data); err != nil {
+		return err
+	}
+	w.saved = w.meta.Bytes
+	return nil
+}
+
+// resumableDownload is download for --resume. The body goes to a .part file
+// named after the source, and progress is checkpointed to a sidecar so that
+// a later run (even in a new process) continues with a Range request
+// instead of starting over. If-Range makes the server send the whole body
+// again if the ETag changed in between; a server ignoring Range does the
+// same, and the .part file is truncated to start over. The result is only
+// returned once every byte promised by Content-Length or Content-Range has
+// arrived.
+func (f *fetcher) resumableDownload(ctx context.Context, u *url.URL, dir, want string) (*download, error) {
+	part, metaPath := partPaths(u, dir, want)
+	if _, busy := f.parts.LoadOrStore(part, struct{}{}); busy {
+		return nil, fmt.Errorf("download of %s already in progress", redactURL(u.String()))
+	}
+	defer f.parts.Delete(part)
+
+	source := redactURL(u.String())
+	meta := loadPartMeta(part, metaPath, source, want)
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	f.creds.apply(req)
+	span := byteRange{start: meta.Bytes, end: -1}
+	if meta.Bytes > 0 {
+		req.Header.Set("Range", span.String())
+		if meta.ETag != "" {
+			req.Header.Set("If-Range", meta.ETag)
+		}
+	}
+
+	log.Printf("📥 fetching %s", source)
+	resp, err := f.send(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp, meta.Bytes > 0); err != nil {
+		return nil, err
+	}
+	// total is the full size promised by Content-Range or Content-Length,
+	// -1 if unknown.
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if _, total, err = checkContentRange(resp.Header.Get("Content-Range"), span); err != nil {
+			os.Remove(part)
+			os.Remove(metaPath)
+			return nil, fmt.Errorf("get %s: %w", source, err)
+		}
+		log.Printf("⏯️ resuming %s at %d of %d bytes", source, meta.Bytes, total)
+	default:
+		if meta.Bytes > 0 {
+			log.Printf("🔄 %s sent the whole body instead of the rest (changed, or Range unsupported), starting over", source)
+		}
+		meta = partMeta{URL: source, ETag: strongETag(resp.Header.Get("ETag")), SHA256: want}
+	}
+
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filepath.Base(part), err)
+	}
+	d := newPackDigester()
+	// The bytes already on disk have to go through the digester too; this
+	// re-reads only the resumed prefix, never the whole pack.
+	err = file.Truncate(meta.Bytes)
+	if err == nil && meta.Bytes > 0 {
+		_, err = io.CopyN(d, file, meta.Bytes)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("prepare %s: %w", filepath.Base(part), err)
+	}
+
+	w := &checkpointWriter{file: file, meta: meta, metaPath: metaPath, saved: meta.Bytes}
+	if err = w.checkpoint(); err == nil {
+		prog := f.newProgress(total, meta.Bytes)
+		_, err = io.Copy(io.MultiWriter(w, d, prog), resp.Body)
+		prog.finish()
+	}
+	if err != nil && w.meta.resumable() && w.checkpoint() == nil {
+		file.Close()
+		log.Printf("💾 kept %d bytes of %s for --resume", w.meta.Bytes, source)
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && w.meta.Bytes == 0 {
+		err = fmt.Errorf("empty response body")
+	}
+	if err == nil && total >= 0 && w.meta.Bytes != total {
+		err = fmt.Errorf("%w: assembled %d bytes, the server promised %d", errRangeMismatch, w.meta.Bytes, total)
+	}
+	os.Remove(metaPath)
+	if err != nil {
+		os.Remove(part)
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	return &download{path: part, packDigests: d.digests()}, nil
+}
+
+// strongETag returns v if it is a strong entity tag; weak tags can't be used
+// with If-Range, so they count as none.
+func strongETag(v string) string {
+	if strings.HasPrefix(v, "W/") {
+		return ""
+	}
+	return v
+}
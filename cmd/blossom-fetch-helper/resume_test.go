@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyMirror serves a pack with http.ServeContent, but drops the first
+// connection after cut bytes, the way a crash or a network drop leaves a
+// half-written .part. It records the Range of every request.
+type flakyMirror struct {
+	mu     sync.Mutex
+	ranges []string
+	// serve returns the body and ETag for the nth request (from 0).
+	serve func(n int) ([]byte, string)
+	cut   int
+}
+
+func (m *flakyMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	n := len(m.ranges)
+	m.ranges = append(m.ranges, r.Header.Get("Range"))
+	m.mu.Unlock()
+	body, etag := m.serve(n)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if n == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body[:m.cut])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+func (m *flakyMirror) requests() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.ranges...)
+}
+
+// TestResumeAfterRestart interrupts a --resume download, then fetches again
+// with a new fetcher, as a restarted process would, with only the .part
+// file and its sidecar carried over.
+func TestResumeAfterRestart(t *testing.T) {
+	pack, _ := gitPack(t, "resume", 2)
+	repacked, _ := gitPack(t, "resume, repacked", 2)
+	cut := len(pack) / 2
+	sum := sha256.Sum256(pack)
+	digest := hex.EncodeToString(sum[:])
+	sameETag := func(int) ([]byte, string) { return pack, `"v1"` }
+
+	tests := []struct {
+		name string
+		path string
+		// serve defaults to sameETag.
+		serve func(n int) ([]byte, string)
+		// tamper runs on the leftovers before the restart.
+		tamper    func(t *testing.T, part, meta string)
+		wantRange string
+		want      []byte
+	}{
+		{
+			name:      "same ETag",
+			path:      "/x.pack",
+			wantRange: "bytes=" + strconv.Itoa(cut) + "-",
+			want:      pack,
+		},
+		{
+			name:      "digest in the URL, no ETag",
+			path:      "/" + digest + ".pack",
+			serve:     func(int) ([]byte, string) { return pack, "" },
+			wantRange: "bytes=" + strconv.Itoa(cut) + "-",
+			want:      pack,
+		},
+		{
+			name: "ETag changed",
+			path: "/x.pack",
+			serve: func(n int) ([]byte, string) {
+				if n == 0 {
+					return pack, `"v1"`
+				}
+				return repacked, `"v2"`
+			},
+			// Asked for the rest, got the new pack whole.
+			wantRange: "bytes=" + strconv.Itoa(cut) + "-",
+			want:      repacked,
+		},
+		{
+			name: "garbage sidecar",
+			path: "/x.pack",
+			tamper: func(t *testing.T, part, meta string) {
+				os.WriteFile(meta, []byte("{"), 0o644)
+			},
+			want: pack,
+		},
+		{
+			name: "part shorter than the sidecar says",
+			path: "/x.pack",
+			tamper: func(t *testing.T, part, meta string) {
+				if err := os.Truncate(part, int64(cut/2)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: pack,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &flakyMirror{serve: tt.serve, cut: cut}
+			if m.serve == nil {
+				m.serve = sameETag
+			}
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+			repo := t.TempDir()
+			u, _ := url.Parse(srv.URL + tt.path)
+			part, meta := partPaths(u, packDir(repo), urlDigest(u))
+
+			first := &fetcher{client: srv.Client(), resume: true}
+			if _, err := first.fetchToRepo(u.String(), "", "", "", repo); err == nil {
+				t.Fatal("interrupted fetch succeeded")
+			}
+			if fi, err := os.Stat(part); err != nil || fi.Size() != int64(cut) {
+				t.Fatalf("after the drop: part %v (%v), want %d bytes", fi, err, cut)
+			}
+			if _, err := os.Stat(meta); err != nil {
+				t.Fatalf("no sidecar after the drop: %v", err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(t, part, meta)
+			}
+
+			restarted := &fetcher{client: srv.Client(), resume: true}
+			res, err := restarted.fetchToRepo(u.String(), "", "", "", repo)
+			if err != nil {
+				t.Fatalf("fetch after restart: %v", err)
+			}
+			if got := m.requests(); len(got) != 2 || got[1] != tt.wantRange {
+				t.Errorf("requests had ranges %q, want the second %q", got, tt.wantRange)
+			}
+			placed, err := os.ReadFile(filepath.Join(packDir(repo), filepath.Base(res.Pack)))
+			if err != nil || !bytes.Equal(placed, tt.want) {
+				t.Errorf("placed pack differs from the served one (%v)", err)
+			}
+			for _, leftover := range []string{part, meta} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s left behind", filepath.Base(leftover))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Download retry backoff: the first wait, doubled per attempt up to the
+// cap, each drawn at random from its upper half so that many fetches
+// failing together don't retry together.
+const (
+	downloadBackoff    = time.Second
+	downloadMaxBackoff = 30 * time.Second
+	// maxRetryAfter bounds how long a server's Retry-After can hold a
+	// fetch.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// retryable reports whether a failed download may succeed when tried
+// again: the connection failed or was cut off, or the server answered 429
+// or 5xx, or the request stalled past --idle-timeout. Other statuses,
+// anything wrong with the body itself, and running out of --timeout fail
+// for good.
+func retryable(err error) bool {
+	switch {
+	case errors.Is(err, errStalled):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusTooManyRequests || se.code >= 500
+	}
+	// Not net.Error: a syscall.Errno satisfies it, which would retry local
+	// failures such as a missing file: source.
+	var ue *url.Error
+	var oe *net.OpError
+	return errors.As(err, &ue) || errors.As(err, &oe) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryDelay is the wait before retrying err: the server's Retry-After if
+// it sent one, otherwise wait with jitter.
+func retryDelay(err error, wait time.Duration) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) && se.retryAfter > 0 {
+		return min(se.retryAfter, maxRetryAfter)
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After value, either delay-seconds or an
+// HTTP date. Anything else, or a time already past, is 0.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	status := func(code int) error { return &statusError{code: code, status: http.StatusText(code)} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", &url.Error{Op: "Get", URL: "https://x", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{"reset mid-body", fmt.Errorf("download: %w", syscall.ECONNRESET), true},
+		{"cut off", fmt.Errorf("download: %w", io.ErrUnexpectedEOF), true},
+		{"stalled", fmt.Errorf("download: %w", errStalled), true},
+		{"429", status(http.StatusTooManyRequests), true},
+		{"500", status(http.StatusInternalServerError), true},
+		{"503", status(http.StatusServiceUnavailable), true},
+		{"404", status(http.StatusNotFound), false},
+		{"403", status(http.StatusForbidden), false},
+		{"redirect not followed", status(http.StatusFound), false},
+		{"wrong digest", fmt.Errorf("check: %w", errDigestMismatch), false},
+		{"not a pack", errNotPack, false},
+		{"out of --timeout", &url.Error{Op: "Get", URL: "https://x", Err: context.DeadlineExceeded}, false},
+		{"missing file: source", fmt.Errorf("download: %w", &os.PathError{Op: "open", Path: "/x.pack", Err: syscall.ENOENT}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, wait := range []time.Duration{time.Second, 8 * time.Second, downloadMaxBackoff} {
+		for i := 0; i < 100; i++ {
+			if d := retryDelay(errors.New("reset"), wait); d < wait/2 || d > wait {
+				t.Fatalf("retryDelay with wait %s = %s, want it in the upper half", wait, d)
+			}
+		}
+	}
+	busy := &statusError{code: http.StatusServiceUnavailable, retryAfter: 7 * time.Second}
+	if d := retryDelay(fmt.Errorf("download: %w", busy), time.Second); d != 7*time.Second {
+		t.Errorf("retryDelay with Retry-After 7s = %s", d)
+	}
+	busy.retryAfter = time.Hour
+	if d := retryDelay(busy, time.Second); d != maxRetryAfter {
+		t.Errorf("retryDelay with Retry-After 1h = %s, want the %s cap", d, maxRetryAfter)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+		{"1.5", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.v, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+// TestDownloadRetries has a server fail the first requests with status,
+// then serve the pack.
+func TestDownloadRetries(t *testing.T) {
+	pack, _ := gitPack(t, "retries", 2)
+	tests := []struct {
+		name    string
+		status  int
+		failing int32
+		retries int
+		// wantHits is how many requests the server sees.
+		wantHits int32
+		wantErr  bool
+	}{
+		// Retry-After: 1 beats the backoff's jitter to a known wait.
+		{name: "busy, then served", status: http.StatusServiceUnavailable, failing: 1, retries: 3, wantHits: 2},
+		{name: "rate limited, then served", status: http.StatusTooManyRequests, failing: 1, retries: 3, wantHits: 2},
+		{name: "retries run out", status: http.StatusServiceUnavailable, failing: 2, retries: 1, wantHits: 2, wantErr: true},
+		{name: "no retries", status: http.StatusServiceUnavailable, failing: 1, wantHits: 1, wantErr: true},
+		{name: "not found is final", status: http.StatusNotFound, failing: 1, retries: 3, wantHits: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) <= tt.failing {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, http.StatusText(tt.status), tt.status)
+					return
+				}
+				w.Write(pack)
+			}))
+			defer srv.Close()
+			f := &fetcher{client: srv.Client(), maxRetries: tt.retries}
+			start := time.Now()
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", t.TempDir())
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("server saw %d requests, want %d", got, tt.wantHits)
+			}
+			if tt.wantErr {
+				var se *statusError
+				if !errors.As(err, &se) || se.code != tt.status {
+					t.Fatalf("err = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Bytes != int64(len(pack)) {
+				t.Errorf("placed %d bytes, want %d", res.Bytes, len(pack))
+			}
+			if took := time.Since(start); took < time.Second {
+				t.Errorf("retried after %s, before the server's Retry-After", took)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// selftestTimeout bounds each reachability probe.
+const selftestTimeout = 10 * time.Second
+
+// selftestRepo is substituted for {repo} when checking --watch templates.
+const selftestRepo = "npub1selftest/selftest"
+
+// selftestCheck is one line of the --selftest report.
+type selftestCheck struct {
+	name string
+	err  error
+	// detail is printed after a passing check.
+	detail string
+}
+
+// runSelftest checks the configuration without fetching or placing
+// anything, writes a pass/fail report to out and returns the exit code.
+// The only thing it writes to disk is a temp file that is removed again,
+// to prove each destination is writable.
+func runSelftest(opts options, out io.Writer) int {
+	var checks []selftestCheck
+	add := func(name string, err error, detail string) {
+		checks = append(checks, selftestCheck{name: name, err: err, detail: detail})
+	}
+
+	add("flags", opts.validate(), opts.mode()+" mode")
+	authHost, _, _ := opts.basicAuthTarget()
+	creds, err := loadCredentials(opts.username, opts.password, authHost, opts.netrc, opts.nsec, opts.insecureAuth)
+	add("credentials", err, "")
+	if !opts.noVerify {
+		path, err := exec.LookPath("git")
+		add("git", err, path+", for index-pack")
+	}
+
+	for _, d := range []struct{ flag, dir string }{
+		{"--repo-path", opts.repoPath},
+		{"--repos-root", opts.reposRoot},
+		{"--cache-dir", opts.cacheDir},
+	} {
+		if d.dir != "" {
+			add(d.flag+" "+d.dir, checkWritableDir(d.dir), "writable")
+		}
+	}
+	if opts.ledger != "" {
+		add("--ledger "+opts.ledger, checkWritableDir(filepath.Dir(opts.ledger)), "writable")
+	}
+	if opts.requireRepo && !opts.initRepo && opts.repoPath != "" {
+		add("--require-repo", checkBareRepo(opts.repoPath), "bare repository")
+	}
+
+	f := &fetcher{client: newClient(opts.maxRedirects, opts.hostRate, opts.dnsCacheTTL, parseHostList(opts.insecureHosts)), creds: creds, localFiles: opts.serve == ""}
+	sources := append([]string(nil), opts.sources...)
+	if opts.idxSource != "" {
+		sources = append(sources, opts.idxSource)
+	}
+	if opts.pubkey != "" {
+		_, err := loadMinisignKey(opts.pubkey)
+		add("--pubkey", err, "minisign key")
+	}
+	if opts.sigURL != "" {
+		sources = append(sources, opts.sigURL)
+	}
+	if opts.sourceTmpl != "" {
+		source, repoPath, err := expandTemplates(opts.sourceTmpl, opts.repoPathTmpl, selftestRepo)
+		add("templates", err, "{repo} = "+selftestRepo+" → "+repoPath)
+		if err == nil {
+			sources = append(sources, source)
+		}
+	}
+	for _, source := range sources {
+		status, err := f.probeSource(source)
+		add("source "+redactURL(source), err, status)
+	}
+	if opts.watch != "" {
+		status, err := probeStream(opts.watch)
+		add("--watch "+opts.watch, err, status)
+	}
+	if opts.warmFrom != "" {
+		status, err := probeStream(opts.warmFrom)
+		add("--warm-from "+opts.warmFrom, err, status)
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.err != nil {
+			failed++
+			fmt.Fprintf(out, "❌ %s: %v\n", c.name, c.err)
+			continue
+		}
+		if c.detail != "" {
+			fmt.Fprintf(out, "✅ %s: %s\n", c.name, c.detail)
+		} else {
+			fmt.Fprintf(out, "✅ %s\n", c.name)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "selftest failed: %d of %d checks\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(out, "selftest passed: %d checks\n", len(checks))
+	return 0
+}
+
+// checkWritableDir reports whether files can be created in dir. A missing
+// dir is fine as long as its nearest existing parent is writable, since
+// the helper creates it on demand.
+func checkWritableDir(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				return err
+			}
+			dir = parent
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		break
+	}
+	tmp, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// probeSource resolves source like a fetch would and sends a HEAD for it,
+// or for a file: source checks the file is there.
+func (f *fetcher) probeSource(source string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	u, _, err := f.resolveSource(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "file" {
+		fi, err := os.Stat(filepath.FromSlash(u.Path))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("readable (%d bytes)", fi.Size()), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	f.creds.apply(req)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp, false); err != nil {
+		return "", err
+	}
+	return "reachable (" + resp.Status + ")", nil
+}
+
+// probeStream opens an SSE stream just long enough to see its headers.
+func probeStream(raw string) (string, error) {
+	if _, err := url.ParseRequestURI(raw); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return "reachable (" + resp.Header.Get("Content-Type") + ")", nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// methodLog is a mirror that serves every pack but /missing.pack, an
+// empty event stream at /events, and records each request as
+// "METHOD /path".
+type methodLog struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (m *methodLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.seen = append(m.seen, r.Method+" "+r.URL.Path)
+	m.mu.Unlock()
+	switch {
+	case r.URL.Path == "/events":
+		w.Header().Set("Content-Type", "text/event-stream")
+	case r.URL.Path == "/missing.pack" || !strings.HasSuffix(r.URL.Path, ".pack"):
+		http.NotFound(w, r)
+	default:
+		w.Write([]byte("PACK"))
+	}
+}
+
+func TestRunSelftest(t *testing.T) {
+	mirror := &methodLog{}
+	srv := httptest.NewServer(mirror)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	pubFile := writeTemp(t, "key.pub", []byte("untrusted comment: minisign public key\n"+newMinisigner(t).pubkey()+"\n"))
+	pgpFile := writeTemp(t, "key.asc", []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmQINBF...\n-----END PGP PUBLIC KEY BLOCK-----\n"))
+	notDir := writeTemp(t, "repos", []byte("a file, not a directory"))
+
+	base := options{parallel: 1, warmConcurrency: 1, cacheHash: "sha256", noVerify: true}
+	tests := []struct {
+		name  string
+		opts  func(o *options)
+		code  int
+		lines []string
+		// absent must still not exist afterwards.
+		absent []string
+	}{
+		{
+			name: "good fetch",
+			opts: func(o *options) {
+				o.sources = sourceList{srv.URL + "/x.pack"}
+				o.repoPath = filepath.Join(dir, "not-yet", "repo.git")
+				o.pubkey = pubFile
+			},
+			code: 0,
+			lines: []string{
+				"✅ flags: fetch mode",
+				"✅ --repo-path " + filepath.Join(dir, "not-yet", "repo.git") + ": writable",
+				"✅ --pubkey: minisign key",
+				"✅ source " + srv.URL + "/x.pack: reachable (200 OK)",
+				"selftest passed: 5 checks",
+			},
+			absent: []string{filepath.Join(dir, "not-yet")},
+		},
+		{
+			name: "good serve",
+			opts: func(o *options) {
+				o.serve = "127.0.0.1:0"
+				o.reposRoot = dir
+				o.cacheDir = filepath.Join(dir, "cache")
+				o.sourceTmpl = srv.URL + "/{repo}.pack"
+				o.warmFrom = srv.URL + "/events"
+			},
+			code: 0,
+			lines: []string{
+				"✅ flags: serve mode",
+				"✅ --repos-root " + dir + ": writable",
+				"✅ templates: {repo} = " + selftestRepo,
+				"✅ source " + srv.URL + "/" + selftestRepo + ".pack: reachable (200 OK)",
+				"✅ --warm-from " + srv.URL + "/events: reachable (text/event-stream)",
+				"selftest passed: 7 checks",
+			},
+			absent: []string{filepath.Join(dir, "cache")},
+		},
+		{
+			name: "broken",
+			opts: func(o *options) {
+				o.sources = sourceList{srv.URL + "/x.pack", srv.URL + "/missing.pack"}
+				o.repoPath = notDir
+				o.pubkey = pgpFile
+				o.parallel = 0
+			},
+			code: 1,
+			lines: []string{
+				"❌ flags: --parallel must be at least 1",
+				"❌ --repo-path " + notDir + ": " + notDir + " is not a directory",
+				"❌ --pubkey: ",
+				"✅ source " + srv.URL + "/x.pack",
+				"❌ source " + srv.URL + "/missing.pack: ",
+				"selftest failed: 4 of 6 checks",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := base
+			tt.opts(&opts)
+			mirror.mu.Lock()
+			mirror.seen = nil
+			mirror.mu.Unlock()
+
+			var out strings.Builder
+			if code := runSelftest(opts, &out); code != tt.code {
+				t.Errorf("exit code %d, want %d", code, tt.code)
+			}
+			report := out.String()
+			for _, line := range tt.lines {
+				if !strings.Contains(report, line) {
+					t.Errorf("report lacks %q:\n%s", line, report)
+				}
+			}
+
+			// Sources are only probed, never downloaded, and nothing is
+			// created on disk.
+			mirror.mu.Lock()
+			defer mirror.mu.Unlock()
+			for _, req := range mirror.seen {
+				if strings.HasSuffix(req, ".pack") && !strings.HasPrefix(req, http.MethodHead+" ") {
+					t.Errorf("selftest sent %s", req)
+				}
+			}
+			for _, path := range tt.absent {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("selftest created %s (stat: %v)", path, err)
+				}
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(dir, ".selftest-*")); len(leftovers) != 0 {
+				t.Errorf("probe files left behind: %v", leftovers)
+			}
+		})
+	}
+}
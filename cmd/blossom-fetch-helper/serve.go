@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxRequestBody caps serve-mode JSON request bodies.
+const maxRequestBody = 64 << 10
+
+// fetchServer exposes the fetcher over HTTP (--serve). Repository paths in
+// requests are relative to reposRoot and may not escape it.
+type fetchServer struct {
+	f         *fetcher
+	reposRoot string
+	token     string
+	// canonical canonicalizes request paths (--canonical-repo-path).
+	canonical bool
+	// ledger and events serve /restore: completed repositories are
+	// skipped on a rerun, and progress goes to clone-events-sse.
+	ledger   *ledger
+	events   *eventsWebhook
+	restores restores
+}
+
+func (s *fetchServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fetch", s.requireAuth(s.handleFetch))
+	mux.HandleFunc("/prefetch", s.requireAuth(s.handlePrefetch))
+	mux.HandleFunc("/restore", s.requireAuth(s.handleRestore))
+	mux.HandleFunc("/repos/", s.requireAuth(s.handleExport))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+// requireAuth enforces the bearer token when --serve-token is set.
+func (s *fetchServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+type fetchRequest struct {
+	Source   string `json:"source"`
+	RepoPath string `json:"repo_path"`
+	// IdxSource optionally names the pack's .idx (see --idx-source).
+	IdxSource string `json:"idx_source"`
+	// SigURL optionally names the pack's minisign signature (see --sig-url).
+	SigURL string `json:"sig_url"`
+}
+
+// handleFetch places a pack into a repository under the repos root.
+func (s *fetchServer) handleFetch(w http.ResponseWriter, r *http.Request) {
+	var req fetchRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Source == "" || req.RepoPath == "" {
+		writeError(w, http.StatusBadRequest, errors.New("source and repo_path are required"))
+		return
+	}
+	repoPath, err := s.repoPath(req.RepoPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := s.f.fetchToRepo(req.Source, req.IdxSource, req.SigURL, "", repoPath)
+	if err != nil {
+		log.Printf("❌ fetch %s: %v", redactURL(req.Source), err)
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handlePrefetch downloads a source into the cache only, so a later
+// /fetch of the same source is a cache hit.
+func (s *fetchServer) handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	var req fetchRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Source == "" {
+		writeError(w, http.StatusBadRequest, errors.New("source is required"))
+		return
+	}
+	if s.f.cache == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("prefetch needs --cache-dir"))
+		return
+	}
+	res, err := s.f.prefetch(req.Source)
+	if err != nil {
+		log.Printf("❌ prefetch %s: %v", redactURL(req.Source), err)
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// resolveRepoPath joins a client-supplied relative path onto root,
+// rejecting absolute paths and anything that climbs out of root.
+func resolveRepoPath(root, rel string) (string, error) {
+	rel = filepath.FromSlash(rel)
+	if filepath.IsAbs(rel) || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("repo_path %q must be relative to the repos root", rel)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// decodeRequest reads a POSTed JSON body into v, writing the error response
+// itself when it returns false.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("⚠️ write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// runServe serves the fetch API until ctx is done.
+func runServe(ctx context.Context, addr string, s *fetchServer) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("🚀 blossom-fetch-helper serving on %s (repos root %s)", addr, s.reposRoot)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
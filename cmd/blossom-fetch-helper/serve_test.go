@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// postJSON POSTs body to url with an optional bearer token and decodes the
+// JSON answer into out.
+func postJSON(t *testing.T, url, token, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s answer: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServePrefetchWarmsCache(t *testing.T) {
+	var origin atomic.Int32
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00 warm me")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.Add(1)
+		w.Write(pack)
+	}))
+	defer upstream.Close()
+
+	cache, err := openPackCache(t.TempDir(), cacheHashes["sha256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	api := &fetchServer{f: &fetcher{client: upstream.Client(), cache: cache}, reposRoot: root, token: "t0ken"}
+	srv := httptest.NewServer(api.routes())
+	defer srv.Close()
+	body := `{"source":"` + upstream.URL + `/x.pack","repo_path":"npub1a/r.git"}`
+
+	var pre prefetchResult
+	if code := postJSON(t, srv.URL+"/prefetch", "t0ken", body, &pre); code != http.StatusOK {
+		t.Fatalf("/prefetch status %d", code)
+	}
+	if pre.CacheHit || pre.Bytes != int64(len(pack)) {
+		t.Errorf("prefetch = %+v, want a miss of %d bytes", pre, len(pack))
+	}
+
+	var res fetchResult
+	if code := postJSON(t, srv.URL+"/fetch", "t0ken", body, &res); code != http.StatusOK {
+		t.Fatalf("/fetch status %d", code)
+	}
+	if !res.CacheHit {
+		t.Error("fetch after prefetch wasn't a cache hit")
+	}
+	if n := origin.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want once", n)
+	}
+	if want := filepath.Join(root, "npub1a", "r.git", "objects", "pack", "x.pack"); res.Pack != want {
+		t.Errorf("placed at %s, want %s", res.Pack, want)
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	upstream := packServer(t, []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00"))
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		body   string
+		cache  bool
+		status int
+	}{
+		{"no token", "/fetch", "", `{"source":"x","repo_path":"r"}`, false, http.StatusUnauthorized},
+		{"wrong token", "/fetch", "nope", `{"source":"x","repo_path":"r"}`, false, http.StatusUnauthorized},
+		{"invalid json", "/fetch", "t0ken", `{"source":`, false, http.StatusBadRequest},
+		{"missing repo_path", "/fetch", "t0ken", `{"source":"x"}`, false, http.StatusBadRequest},
+		{"repo_path escaping the root", "/fetch", "t0ken", `{"source":"x","repo_path":"../etc"}`, false, http.StatusBadRequest},
+		{"absolute repo_path", "/fetch", "t0ken", `{"source":"x","repo_path":"/etc"}`, false, http.StatusBadRequest},
+		{"unreachable source", "/fetch", "t0ken", `{"source":"https://127.0.0.1:1/x.pack","repo_path":"r"}`, false, http.StatusBadGateway},
+		{"prefetch without a cache", "/prefetch", "t0ken", `{"source":"` + upstream.URL + `/x.pack"}`, false, http.StatusNotImplemented},
+		{"prefetch without a source", "/prefetch", "t0ken", `{}`, true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fetcher{client: upstream.Client()}
+			if tt.cache {
+				f.cache, _ = openPackCache(t.TempDir(), cacheHashes["sha256"])
+			}
+			srv := httptest.NewServer((&fetchServer{f: f, reposRoot: t.TempDir(), token: "t0ken"}).routes())
+			defer srv.Close()
+			var answer map[string]any
+			if code := postJSON(t, srv.URL+tt.path, tt.token, tt.body, &answer); code != tt.status {
+				t.Errorf("status %d (%v), want %d", code, answer, tt.status)
+			}
+			if tt.status >= 400 && answer["error"] == "" {
+				t.Errorf("no error message in %v", answer)
+			}
+		})
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		srv := httptest.NewServer((&fetchServer{f: &fetcher{}, reposRoot: t.TempDir()}).routes())
+		defer srv.Close()
+		resp, err := http.Get(srv.URL + "/fetch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("status %s", resp.Status)
+		}
+	})
+}
+
+func TestResolveRepoPath(t *testing.T) {
+	tests := []struct {
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{rel: "npub1a/r.git", want: "/srv/repos/npub1a/r.git"},
+		{rel: "npub1a/./r.git", want: "/srv/repos/npub1a/r.git"},
+		{rel: "npub1a/../r.git", want: "/srv/repos/r.git"},
+		{rel: "../r.git", wantErr: true},
+		{rel: "npub1a/../../r.git", wantErr: true},
+		{rel: "/srv/repos/r.git", wantErr: true},
+		{rel: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveRepoPath("/srv/repos", tt.rel)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveRepoPath(%q) = %s, want an error", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveRepoPath(%q) = %s, %v; want %s", tt.rel, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// packSink is where fetchToRepo puts a downloaded pack, so storage other
+// than a local repository (an object store, say) can be plugged in without
+// touching the transfer code. Nothing is visible under name until Finalize
+// succeeds; Abort discards a staged pack.
+type packSink interface {
+	Create(name string) (io.WriteCloser, error)
+	Finalize(name string) error
+	Abort(name string) error
+}
+
+// fsSink is the default sink: a bare repository's objects/pack directory.
+// Packs are staged as temp files in the same directory and renamed into
+// place on Finalize.
+type fsSink struct {
+	dir     string
+	retries int
+	staged  map[string]string
+}
+
+func newFSSink(repoPath string, renameRetries int) (*fsSink, error) {
+	dir := packDir(repoPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create pack dir: %w", err)
+	}
+	return &fsSink{dir: dir, retries: renameRetries, staged: make(map[string]string)}, nil
+}
+
+// path is where name ends up once finalized.
+func (s *fsSink) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *fsSink) Create(name string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp(s.dir, ".fetch-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	s.staged[name] = tmp.Name()
+	return tmp, nil
+}
+
+// adopt stages a file that was already written inside s.dir, which is how
+// downloads avoid a copy when the default sink is in use.
+func (s *fsSink) adopt(path, name string) {
+	s.staged[name] = path
+}
+
+func (s *fsSink) Finalize(name string) error {
+	tmp, ok := s.staged[name]
+	if !ok {
+		return fmt.Errorf("%s was never staged", name)
+	}
+	delete(s.staged, name)
+	return placeFile(tmp, s.path(name), s.retries)
+}
+
+func (s *fsSink) Abort(name string) error {
+	tmp, ok := s.staged[name]
+	if !ok {
+		return nil
+	}
+	delete(s.staged, name)
+	return os.Remove(tmp)
+}
+
+// placeInSink hands the finished local file at path to sink as name,
+// copying it through Create unless the sink can adopt it directly.
+func placeInSink(sink packSink, path, name string) error {
+	if local, ok := sink.(*fsSink); ok {
+		local.adopt(path, name)
+	} else if err := copyIntoSink(sink, path, name); err != nil {
+		sink.Abort(name)
+		return err
+	}
+	if err := sink.Finalize(name); err != nil {
+		sink.Abort(name)
+		return err
+	}
+	return nil
+}
+
+func copyIntoSink(sink packSink, path, name string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	w, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, in)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
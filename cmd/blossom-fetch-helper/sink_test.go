@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memSink is a packSink keeping everything in memory, standing in for an
+// object store. It logs each call as "op name".
+type memSink struct {
+	staged      map[string]*bytes.Buffer
+	objects     map[string][]byte
+	calls       []string
+	failFinal   error
+	gotRepoPath string
+}
+
+func newMemSink() *memSink {
+	return &memSink{staged: make(map[string]*bytes.Buffer), objects: make(map[string][]byte)}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func (m *memSink) Create(name string) (io.WriteCloser, error) {
+	m.calls = append(m.calls, "create "+name)
+	m.staged[name] = new(bytes.Buffer)
+	return nopCloser{m.staged[name]}, nil
+}
+
+func (m *memSink) Finalize(name string) error {
+	m.calls = append(m.calls, "finalize "+name)
+	if m.failFinal != nil {
+		return m.failFinal
+	}
+	m.objects[name] = m.staged[name].Bytes()
+	delete(m.staged, name)
+	return nil
+}
+
+func (m *memSink) Abort(name string) error {
+	m.calls = append(m.calls, "abort "+name)
+	delete(m.staged, name)
+	return nil
+}
+
+func TestMemorySink(t *testing.T) {
+	pack, idx := gitPack(t, "sink", 2)
+	sum := sha256.Sum256(pack)
+	digest := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name       string
+		want       string
+		indexPacks bool
+		failFinal  error
+		wantCalls  []string
+		wantErr    string
+	}{
+		{
+			name:      "pack",
+			wantCalls: []string{"create x.pack", "finalize x.pack"},
+		},
+		{
+			name:       "pack and generated index, index last",
+			indexPacks: true,
+			wantCalls:  []string{"create x.pack", "finalize x.pack", "create x.idx", "finalize x.idx"},
+		},
+		{
+			name:      "digest mismatch never reaches the sink",
+			want:      strings.Repeat("0", 64),
+			wantCalls: nil,
+			wantErr:   "sha256 mismatch",
+		},
+		{
+			name:      "failed finalize is aborted",
+			failFinal: errors.New("bucket is read-only"),
+			wantCalls: []string{"create x.pack", "finalize x.pack", "abort x.pack"},
+			wantErr:   "bucket is read-only",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := packServer(t, pack)
+			sink := newMemSink()
+			sink.failFinal = tt.failFinal
+			f := &fetcher{
+				client:     srv.Client(),
+				indexPacks: tt.indexPacks,
+				sink: func(repoPath string) (packSink, error) {
+					sink.gotRepoPath = repoPath
+					return sink, nil
+				},
+			}
+			// Without a local repository downloads are staged in the
+			// system temp dir.
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			repo := filepath.Join(t.TempDir(), "bucket-prefix")
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", tt.want, repo)
+			if strings.Join(sink.calls, ", ") != strings.Join(tt.wantCalls, ", ") {
+				t.Errorf("sink calls %q, want %q", sink.calls, tt.wantCalls)
+			}
+			if _, err := os.Stat(repo); !os.IsNotExist(err) {
+				t.Errorf("the local path was touched (stat: %v)", err)
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(tmp, "*")); len(leftovers) != 0 {
+				t.Errorf("staging files left behind: %v", leftovers)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if len(sink.objects) != 0 || len(sink.staged) != 0 {
+					t.Errorf("sink left holding %d objects, %d staged", len(sink.objects), len(sink.staged))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sink.gotRepoPath != repo {
+				t.Errorf("sink opened for %q, want %q", sink.gotRepoPath, repo)
+			}
+			if res.Pack != "x.pack" || res.SHA256 != digest {
+				t.Errorf("result names %s (%s)", res.Pack, res.SHA256)
+			}
+			if !bytes.Equal(sink.objects["x.pack"], pack) {
+				t.Error("sink holds different pack bytes")
+			}
+			if tt.indexPacks && !bytes.Equal(sink.objects["x.idx"], idx) {
+				t.Error("sink holds a different index than git writes")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errStalled is a request abandoned by the --idle-timeout watchdog.
+var errStalled = errors.New("stalled")
+
+// fetchContext bounds one fetch, retries included, by --timeout; 0 leaves
+// it unbounded.
+func (f *fetcher) fetchContext() (context.Context, context.CancelFunc) {
+	if f.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), f.timeout)
+}
+
+// timeoutError names the --timeout when ctx ran out, so a fetch that hit
+// it doesn't just end in "context deadline exceeded".
+func (f *fetcher) timeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("fetch timed out after %s: %w", f.timeout, err)
+	}
+	return err
+}
+
+// send sends req under ctx, watched by --idle-timeout: when no response,
+// and later no body bytes, arrive for that long, the request is cancelled
+// and its error (from Do, or from reading the body) wraps errStalled.
+func (f *fetcher) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if f.idleTimeout <= 0 {
+		return f.client.Do(req.WithContext(ctx))
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stalled := fmt.Errorf("%w: no data for %s", errStalled, f.idleTimeout)
+	timer := time.AfterFunc(f.idleTimeout, func() { cancel(stalled) })
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel(nil)
+		return nil, stallCause(ctx, err)
+	}
+	resp.Body = &idleBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timer: timer, idle: f.idleTimeout}
+	return resp, nil
+}
+
+// stallCause replaces err with the watchdog's error when the watchdog is
+// what ended ctx.
+func stallCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errStalled) {
+		return cause
+	}
+	return err
+}
+
+// idleBody is a response body whose every read rearms the --idle-timeout
+// watchdog.
+type idleBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	idle   time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF {
+		err = stallCause(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingServer serves pack, sending only the first sent bytes before it
+// goes quiet until the client gives up. With every set, it instead sends
+// the whole pack in chunks of that many bytes, pausing pause after each.
+func stallingServer(t *testing.T, pack []byte, sent, every int, pause time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(pack)))
+		if every > 0 {
+			for off := 0; off < len(pack); off += every {
+				w.Write(pack[off:min(off+every, len(pack))])
+				w.(http.Flusher).Flush()
+				time.Sleep(pause)
+			}
+			return
+		}
+		if sent > 0 {
+			w.Write(pack[:sent])
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIdleTimeout(t *testing.T) {
+	pack, _ := gitPack(t, "stall", 2)
+	tests := []struct {
+		name string
+		// sent, every and pause shape the response, see stallingServer.
+		sent, every int
+		pause       time.Duration
+		idle        time.Duration
+		wantStalled bool
+	}{
+		{name: "stalls mid-body", sent: len(pack) / 2, idle: 100 * time.Millisecond, wantStalled: true},
+		{name: "stalls before the headers", sent: 0, idle: 100 * time.Millisecond, wantStalled: true},
+		// Each chunk rearms the watchdog, so a transfer longer than
+		// the idle timeout in total still completes.
+		{name: "slow but steady", every: len(pack)/8 + 1, pause: 50 * time.Millisecond, idle: 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stallingServer(t, pack, tt.sent, tt.every, tt.pause)
+			f := &fetcher{client: srv.Client(), idleTimeout: tt.idle}
+			repo := t.TempDir()
+			start := time.Now()
+			res, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", repo)
+			if !tt.wantStalled {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Bytes != int64(len(pack)) {
+					t.Errorf("placed %d bytes, want %d", res.Bytes, len(pack))
+				}
+				return
+			}
+			if !errors.Is(err, errStalled) {
+				t.Fatalf("err = %v, want one wrapping errStalled", err)
+			}
+			if !strings.Contains(err.Error(), "no data for "+tt.idle.String()) {
+				t.Errorf("err = %v, want it to name the idle timeout", err)
+			}
+			if took := time.Since(start); took > 5*tt.idle {
+				t.Errorf("gave up after %s with --idle-timeout %s", took, tt.idle)
+			}
+			if _, err := os.Stat(filepath.Join(packDir(repo), "x.pack")); !os.IsNotExist(err) {
+				t.Errorf("stalled download was placed (stat: %v)", err)
+			}
+		})
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	pack, _ := gitPack(t, "timeout", 2)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		retries int
+		// inFlight is a timeout that cut off a request, rather than a
+		// wait between two.
+		inFlight bool
+	}{
+		{
+			name: "stalls mid-body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(pack)))
+				w.Write(pack[:len(pack)/2])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			},
+			inFlight: true,
+		},
+		{
+			// --timeout covers the retries and the waits between them.
+			name: "retrying a busy server",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+			},
+			retries: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			f := &fetcher{client: srv.Client(), timeout: 300 * time.Millisecond, maxRetries: tt.retries}
+			start := time.Now()
+			_, err := f.fetchToRepo(srv.URL+"/x.pack", "", "", "", t.TempDir())
+			if err == nil || !strings.HasPrefix(err.Error(), "fetch timed out after 300ms: ") {
+				t.Fatalf("err = %v, want it to start with the timeout", err)
+			}
+			if tt.inFlight && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("err = %v, want one wrapping context.DeadlineExceeded", err)
+			}
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("gave up after %s with --timeout 300ms", took)
+			}
+		})
+	}
+}
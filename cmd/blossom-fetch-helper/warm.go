@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// cacheWarmer prefetches packs into the cache as clone events arrive
+// (--warm-from), so the /fetch that usually follows a clone is a cache hit.
+// A source already being warmed isn't warmed again, and at most
+// cap(slots) downloads run at once; events beyond that queue up.
+type cacheWarmer struct {
+	f     *fetcher
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newCacheWarmer(f *fetcher, concurrency int) *cacheWarmer {
+	return &cacheWarmer{f: f, slots: make(chan struct{}, concurrency), inflight: make(map[string]bool)}
+}
+
+// warm starts prefetching source in the background unless it's already
+// cached or being warmed.
+func (c *cacheWarmer) warm(ctx context.Context, source string) {
+	u, _, err := c.f.resolveSource(ctx, source)
+	if err != nil {
+		log.Printf("⚠️ warm: %v", err)
+		return
+	}
+	if _, _, _, ok := c.f.cache.lookup(u); ok {
+		return
+	}
+	key := sourceKey(u)
+	c.mu.Lock()
+	if c.inflight[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.inflight[key] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+		}()
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-c.slots }()
+
+		res, err := c.f.prefetch(source)
+		if err != nil {
+			log.Printf("❌ warm %s: %v", redactURL(source), err)
+			return
+		}
+		log.Printf("🔥 warmed %s (%s, %d bytes)", res.Source, res.SHA256, res.Bytes)
+	}()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventFeed is a stand-in clone-events-sse: each /events stream gets
+// whatever the test sends on frames.
+type eventFeed struct {
+	frames chan string
+	seq    int
+}
+
+func (e *eventFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-e.frames:
+			e.seq++
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.seq, data)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// gatedMirror serves pack for every path once gate lets it, tracking hits
+// per path and the most downloads it saw running at once.
+type gatedMirror struct {
+	pack []byte
+	gate chan struct{}
+
+	mu      sync.Mutex
+	hits    map[string]int
+	running int
+	peak    int
+}
+
+func (m *gatedMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.hits[r.URL.Path]++
+	m.running++
+	m.peak = max(m.peak, m.running)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.running--
+		m.mu.Unlock()
+	}()
+	select {
+	case <-m.gate:
+	case <-r.Context().Done():
+		return
+	}
+	w.Write(m.pack)
+}
+
+func (m *gatedMirror) stats() (hits map[string]int, peak int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hits = make(map[string]int, len(m.hits))
+	for k, v := range m.hits {
+		hits[k] = v
+	}
+	return hits, m.peak
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+	}
+}
+
+func TestWarmFromEvents(t *testing.T) {
+	pack, _ := gitPack(t, "warm", 2)
+	tests := []struct {
+		name        string
+		concurrency int
+		events      []string
+		// warmed are the repos that end up cached, each downloaded once.
+		warmed []string
+	}{
+		{
+			name:        "one event",
+			concurrency: 2,
+			events:      []string{`{"type":"repo_cloned","repo":"npub1a/r"}`},
+			warmed:      []string{"npub1a/r"},
+		},
+		{
+			name:        "repeats while warming",
+			concurrency: 2,
+			events: []string{
+				`{"type":"repo_cloned","repo":"npub1a/r"}`,
+				`{"type":"repo_cloned","repo":"npub1a/r"}`,
+				`{"type":"repo_cloned","repo":"npub1a/r"}`,
+			},
+			warmed: []string{"npub1a/r"},
+		},
+		{
+			name:        "bounded concurrency",
+			concurrency: 1,
+			events: []string{
+				`{"type":"repo_cloned","repo":"npub1a/one"}`,
+				`{"type":"repo_cloned","repo":"npub1a/two"}`,
+				`{"type":"repo_cloned","repo":"npub1a/three"}`,
+			},
+			warmed: []string{"npub1a/one", "npub1a/two", "npub1a/three"},
+		},
+		{
+			name:        "other events ignored",
+			concurrency: 2,
+			events: []string{
+				`{"type":"repo_pushed","repo":"npub1a/pushed"}`,
+				`{"type":"server_shutdown"}`,
+				`{"type":"repo_cloned","repo":"npub1a/r"}`,
+			},
+			warmed: []string{"npub1a/r"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror := &gatedMirror{pack: pack, gate: make(chan struct{}), hits: make(map[string]int)}
+			upstream := httptest.NewServer(mirror)
+			defer upstream.Close()
+			feed := &eventFeed{frames: make(chan string)}
+			events := httptest.NewServer(feed)
+			defer events.Close()
+			cache, err := openPackCache(t.TempDir(), cacheHashes["sha256"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fetcher{client: upstream.Client(), cache: cache}
+			w := &watcher{
+				f:          f,
+				client:     events.Client(),
+				url:        events.URL + "/events",
+				sourceTmpl: upstream.URL + "/{repo}.pack",
+				warmer:     newCacheWarmer(f, tt.concurrency),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go w.run(ctx)
+
+			for _, ev := range tt.events {
+				feed.frames <- ev
+			}
+			// Every warm is now either downloading or queued for a slot.
+			waitFor(t, func() bool {
+				hits, _ := mirror.stats()
+				return len(hits) == min(len(tt.warmed), tt.concurrency)
+			})
+			close(mirror.gate)
+
+			cached := func(repo string) bool {
+				u, err := url.Parse(upstream.URL + "/" + repo + ".pack")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _, _, ok := cache.lookup(u)
+				return ok
+			}
+			for _, repo := range tt.warmed {
+				waitFor(t, func() bool { return cached(repo) })
+			}
+
+			// The fetch that follows the clone is served from the cache.
+			for _, repo := range tt.warmed {
+				res, err := f.fetchToRepo(upstream.URL+"/"+repo+".pack", "", "", "", t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.CacheHit {
+					t.Errorf("%s: fetch missed the cache", repo)
+				}
+			}
+			hits, peak := mirror.stats()
+			for _, repo := range tt.warmed {
+				if n := hits["/"+repo+".pack"]; n != 1 {
+					t.Errorf("%s downloaded %d times, want once", repo, n)
+				}
+			}
+			if len(hits) != len(tt.warmed) {
+				t.Errorf("mirror saw %v, want only %v", hits, tt.warmed)
+			}
+			if peak > tt.concurrency {
+				t.Errorf("%d warms ran at once, want at most %d", peak, tt.concurrency)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reconnect backoff bounds for --watch.
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = 30 * time.Second
+)
+
+// cloneEvent is the subset of a clone-events-sse event the watcher uses.
+type cloneEvent struct {
+	Type string `json:"type"`
+	Repo string `json:"repo"`
+}
+
+// watcher follows a clone-events-sse /events stream and fetches a pack for
+// every repo_cloned event it sees. With a warmer it only prefetches each
+// pack into the cache instead (serve mode's --warm-from).
+type watcher struct {
+	f            *fetcher
+	client       *http.Client
+	url          string
+	sourceTmpl   string
+	repoPathTmpl string
+	ledger       *ledger
+	warmer       *cacheWarmer
+	// canonical canonicalizes expanded repo paths under reposRoot
+	// (--canonical-repo-path).
+	canonical bool
+	reposRoot string
+
+	// lastEventID is sent as Last-Event-ID when reconnecting.
+	lastEventID string
+}
+
+// run keeps the stream connected until ctx is done, reconnecting with
+// exponential backoff after drops.
+func (w *watcher) run(ctx context.Context) error {
+	backoff := watchMinBackoff
+	for {
+		connected, err := w.stream(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			backoff = watchMinBackoff
+		}
+		log.Printf("🔌 watch stream dropped (%v), reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// stream reads one connection's worth of SSE frames. connected reports
+// whether the server accepted the connection, so run can reset its backoff.
+func (w *watcher) stream(ctx context.Context) (connected bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if w.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", w.lastEventID)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	log.Printf("👀 watching %s", redactURL(w.url))
+
+	var data strings.Builder
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				w.handle(ctx, data.String())
+				data.Reset()
+			}
+		case field == "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		case field == "id":
+			w.lastEventID = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("stream closed by server")
+}
+
+// handle fetches the pack for a single repo_cloned event, skipping work the
+// ledger says is already done.
+func (w *watcher) handle(ctx context.Context, data string) {
+	var ev cloneEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		log.Printf("⚠️ watch: ignoring malformed event: %v", err)
+		return
+	}
+	if ev.Type != "repo_cloned" || ev.Repo == "" {
+		return
+	}
+	if w.warmer != nil {
+		source, _, err := expandTemplates(w.sourceTmpl, "", ev.Repo)
+		if err != nil {
+			log.Printf("⚠️ warm: %v", err)
+			return
+		}
+		w.warmer.warm(ctx, source)
+		return
+	}
+	source, repoPath, err := expandTemplates(w.sourceTmpl, w.repoPathTmpl, ev.Repo)
+	if err != nil {
+		log.Printf("⚠️ watch: %v", err)
+		return
+	}
+	if w.canonical {
+		if repoPath, err = canonicalRepoPath(w.reposRoot, repoPath); err != nil {
+			log.Printf("⚠️ watch: %v", err)
+			return
+		}
+	}
+	if w.ledger.done(source, repoPath) {
+		log.Printf("⏭️ %s already fetched into %s", redactURL(source), repoPath)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	res, err := w.f.fetchToRepo(source, "", "", "", repoPath)
+	if err != nil {
+		log.Printf("❌ watch: fetch %s: %v", ev.Repo, err)
+		return
+	}
+	if err := w.ledger.record(res); err != nil {
+		log.Printf("⚠️ watch: ledger: %v", err)
+	}
+}
+
+// expandTemplates fills {repo} in the source and repo-path templates. Repo
+// names come off the wire, so anything that could escape the repo-path
+// template's directory is rejected.
+func expandTemplates(sourceTmpl, repoPathTmpl, repo string) (string, string, error) {
+	if path.IsAbs(repo) || strings.Contains(repo, "\\") {
+		return "", "", fmt.Errorf("refusing repo name %q", repo)
+	}
+	for _, seg := range strings.Split(repo, "/") {
+		if seg == ".." || seg == "." {
+			return "", "", fmt.Errorf("refusing repo name %q", repo)
+		}
+	}
+	r := strings.NewReplacer("{repo}", repo)
+	return r.Replace(sourceTmpl), r.Replace(repoPathTmpl), nil
+}
+
+// ledger remembers completed (source, repo path) pairs in an append-only
+// JSON-lines file so watch mode doesn't refetch after a restart. Without a
+// file it only remembers for the lifetime of the process.
+type ledger struct {
+	mu   sync.Mutex
+	path string
+	seen map[string]bool
+}
+
+type ledgerEntry struct {
+	Source      string `json:"source"`
+	RepoPath    string `json:"repo_path"`
+	Pack        string `json:"pack"`
+	CompletedAt int64  `json:"completed_at"`
+	// Objects is recorded when the summary has it, with --object-count
+	// or --verify-pack.
+	Objects uint32 `json:"objects,omitempty"`
+}
+
+func ledgerKey(source, repoPath string) string {
+	return redactURL(source) + "\x00" + repoPath
+}
+
+// openLedger loads an existing ledger file; an empty path gives an
+// in-memory ledger.
+func openLedger(path string) (*ledger, error) {
+	l := &ledger{path: path, seen: make(map[string]bool)}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open ledger: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e ledgerEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // a torn final line from a crash is harmless
+		}
+		l.seen[ledgerKey(e.Source, e.RepoPath)] = true
+	}
+	return l, sc.Err()
+}
+
+func (l *ledger) done(source, repoPath string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seen[ledgerKey(source, repoPath)]
+}
+
+func (l *ledger) record(res *fetchResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seen[ledgerKey(res.Source, res.RepoPath)] = true
+	if l.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(ledgerEntry{
+		Source:      res.Source,
+		RepoPath:    res.RepoPath,
+		Pack:        res.Pack,
+		CompletedAt: time.Now().Unix(),
+		Objects:     res.Objects,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxImportBody caps a POST /admin/import body.
+const maxImportBody = 16 << 20
+
+// hubSnapshot is the buffer as moved between instances by /admin/export
+// and /admin/import. Unlike /events/recent it keeps what the hub needs to
+// carry on where the old instance stopped: sequence numbers and expiry.
+type hubSnapshot struct {
+	Seq    int64           `json:"seq"`
+	Events []snapshotEvent `json:"events"`
+}
+
+type snapshotEvent struct {
+	Seq     int64      `json:"seq"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Event   repoEvent  `json:"event"`
+}
+
+var errHubNotEmpty = errors.New("hub has already published events")
+
+// snapshot returns the unexpired buffer and the last sequence number.
+func (h *eventHub) snapshot() hubSnapshot {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	snap := hubSnapshot{Seq: h.seq, Events: []snapshotEvent{}}
+	for _, ev := range h.liveLocked(time.Now()) {
+		se := snapshotEvent{Seq: ev.ID, Event: ev}
+		if !ev.expires.IsZero() {
+			expires := ev.expires
+			se.Expires = &expires
+		}
+		snap.Events = append(snap.Events, se)
+	}
+	return snap
+}
+
+// restore loads a snapshot into a hub that hasn't published anything yet,
+// keeping the sequence numbers so clients of the old instance can resume
+// with their Last-Event-ID. It reports how many events were restored.
+func (h *eventHub) restore(snap hubSnapshot) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seq > 0 {
+		return 0, errHubNotEmpty
+	}
+	now := time.Now()
+	var buf []repoEvent
+	last := int64(0)
+	for _, se := range snap.Events {
+		if se.Seq <= last || se.Seq > snap.Seq {
+			return 0, errors.New("event sequence numbers must increase and not exceed seq")
+		}
+		last = se.Seq
+		ev := se.Event
+		ev.ID = se.Seq
+		if se.Expires != nil {
+			ev.expires = *se.Expires
+		}
+		ev.expires = h.capExpiry(ev)
+		if !ev.expired(now) {
+			buf = append(buf, ev)
+		}
+	}
+	if len(buf) > h.maxBuffer {
+		buf = buf[len(buf)-h.maxBuffer:]
+	}
+	h.buffer = buf
+	h.seq = snap.Seq
+	return len(buf), nil
+}
+
+// requireAdmin checks the ADMIN_TOKEN bearer token.
+func (s *server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleExport hands out the buffer for a successor instance.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snap := s.hub.snapshot()
+	slog.Info("buffer exported", "events", len(snap.Events), "seq", snap.Seq)
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// handleImport seeds a freshly started instance with a predecessor's
+// buffer. It is refused once anything has been published, since the
+// imported sequence numbers would then collide with local ones.
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var snap hubSnapshot
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxImportBody)).Decode(&snap); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	n, err := s.hub.restore(snap)
+	if errors.Is(err, errHubNotEmpty) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("buffer imported", "events", n, "seq", snap.Seq)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "imported", "events": n})
+}
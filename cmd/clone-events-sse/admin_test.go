@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// adminDo sends an admin request to srv with token as the bearer token.
+func adminDo(t *testing.T, srv *httptest.Server, method, path, token string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// TestExportImportRoundTrip moves the buffer from an old instance to a new
+// one the way a blue/green deploy does, then checks a client of the old
+// instance resumes on the new one with its Last-Event-ID.
+func TestExportImportRoundTrip(t *testing.T) {
+	admin := map[string]string{"ADMIN_TOKEN": "t0ken"}
+	old := newTestServer(t, admin)
+	oldSrv := serveTest(t, old)
+	for _, repo := range []string{"npub1a/one", "npub1a/two", "npub1a/three"} {
+		if resp := postSigned(t, oldSrv, []byte(`{"repo":"`+repo+`"}`)); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("webhook: status %d", resp.StatusCode)
+		}
+	}
+
+	resp, snap := adminDo(t, oldSrv, http.MethodGet, "/admin/export", "t0ken", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export: status %d", resp.StatusCode)
+	}
+	next := newTestServer(t, admin)
+	nextSrv := serveTest(t, next)
+	resp, body := adminDo(t, nextSrv, http.MethodPost, "/admin/import", "t0ken", snap)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: status %d: %s", resp.StatusCode, body)
+	}
+
+	want, got := old.hub.recent(), next.hub.recent()
+	if len(got) != len(want) {
+		t.Fatalf("imported %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Repo != want[i].Repo || got[i].Timestamp != want[i].Timestamp {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// A client that saw the first event on the old instance gets the rest
+	// from the new one, followed by its first own event.
+	header := http.Header{"Last-Event-ID": {strconv.FormatInt(want[0].ID, 10)}}
+	_, br := openStream(t, nextSrv.Client(), nextSrv.URL+"/events", header)
+	if resp := postSigned(t, nextSrv, []byte(`{"repo":"npub1a/four"}`)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("webhook: status %d", resp.StatusCode)
+	}
+	for i, repo := range []string{"npub1a/two", "npub1a/three", "npub1a/four"} {
+		f := readFrame(t, br)
+		var ev repoEvent
+		if err := json.Unmarshal([]byte(f.data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Repo != repo || f.id != strconv.FormatInt(want[0].ID+int64(i)+1, 10) {
+			t.Errorf("frame %d: id %s repo %s, want %s", i, f.id, ev.Repo, repo)
+		}
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	snap := func(events ...int64) []byte {
+		s := hubSnapshot{Seq: 5}
+		for _, seq := range events {
+			s.Events = append(s.Events, snapshotEvent{Seq: seq, Event: repoEvent{Type: "repo_cloned", Repo: "npub1a/r"}})
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		token  string // ADMIN_TOKEN; empty disables the endpoints
+		method string
+		path   string
+		auth   string
+		body   []byte
+		// published is true when the target already has an event.
+		published bool
+		status    int
+	}{
+		{name: "export without a token", token: "t0ken", method: http.MethodGet, path: "/admin/export", status: http.StatusUnauthorized},
+		{name: "export with the wrong token", token: "t0ken", method: http.MethodGet, path: "/admin/export", auth: "guess", status: http.StatusUnauthorized},
+		{name: "import with the wrong token", token: "t0ken", method: http.MethodPost, path: "/admin/import", auth: "guess", body: snap(1), status: http.StatusUnauthorized},
+		{name: "export by POST", token: "t0ken", method: http.MethodPost, path: "/admin/export", auth: "t0ken", status: http.StatusMethodNotAllowed},
+		{name: "import into a used hub", token: "t0ken", method: http.MethodPost, path: "/admin/import", auth: "t0ken", body: snap(1), published: true, status: http.StatusConflict},
+		{name: "import of garbage", token: "t0ken", method: http.MethodPost, path: "/admin/import", auth: "t0ken", body: []byte("{"), status: http.StatusBadRequest},
+		{name: "import out of order", token: "t0ken", method: http.MethodPost, path: "/admin/import", auth: "t0ken", body: snap(2, 1), status: http.StatusBadRequest},
+		{name: "import past seq", token: "t0ken", method: http.MethodPost, path: "/admin/import", auth: "t0ken", body: snap(6), status: http.StatusBadRequest},
+		{name: "no ADMIN_TOKEN", method: http.MethodGet, path: "/admin/export", auth: "", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"ADMIN_TOKEN": tt.token})
+			srv := serveTest(t, s)
+			if tt.published {
+				postSigned(t, srv, []byte(`{"repo":"npub1a/local"}`))
+			}
+			before := s.hub.recent()
+			resp, body := adminDo(t, srv, tt.method, tt.path, tt.auth, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if after := s.hub.recent(); len(after) != len(before) {
+				t.Errorf("buffer went from %d to %d events", len(before), len(after))
+			}
+		})
+	}
+}
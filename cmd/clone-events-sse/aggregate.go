@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// upstreamMinBackoff and upstreamMaxBackoff bound the wait between
+	// reconnects to an upstream that dropped or refused the stream.
+	upstreamMinBackoff = time.Second
+	upstreamMaxBackoff = 30 * time.Second
+)
+
+// upstream is one clone-events-sse /events stream an aggregator follows.
+type upstream struct {
+	url string
+	// origin tags the events received from it, so the merged stream still
+	// says where each one came from.
+	origin string
+}
+
+// parseUpstreams parses UPSTREAM_EVENTS: a comma-separated list of /events
+// URLs, each optionally prefixed with "name=" to set its origin tag. The
+// tag defaults to the URL's host.
+func parseUpstreams(entries []string) ([]upstream, error) {
+	var out []upstream
+	for _, entry := range entries {
+		origin, raw, named := strings.Cut(entry, "=")
+		if !named || strings.Contains(origin, "/") {
+			origin, raw = "", entry
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("UPSTREAM_EVENTS: bad url %q", raw)
+		}
+		if origin == "" {
+			origin = u.Host
+		}
+		out = append(out, upstream{url: raw, origin: origin})
+	}
+	return out, nil
+}
+
+// follow feeds up's events into hub until ctx is done, reconnecting with
+// Last-Event-ID so a dropped connection neither loses nor repeats events
+// the upstream still buffers.
+func (up upstream) follow(ctx context.Context, client *http.Client, hub *eventHub) {
+	var lastID string
+	backoff := upstreamMinBackoff
+	for {
+		connected, err := up.stream(ctx, client, hub, &lastID)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = upstreamMinBackoff
+		}
+		slog.Warn("upstream disconnected", "upstream", up.origin, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+}
+
+// stream reads one connection's worth of events. connected reports whether
+// the upstream accepted the stream, which resets the reconnect backoff.
+func (up upstream) stream(ctx context.Context, client *http.Client, hub *eventHub, lastID *string) (connected bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, up.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	slog.Info("following upstream", "upstream", up.origin)
+
+	var id string
+	var data []string
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 64<<10), maxWebhookBody)
+	for sc.Scan() {
+		line := sc.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "id":
+				id = value
+			case "data":
+				data = append(data, value)
+			}
+			continue
+		}
+		// A blank line ends the frame; probes and comments carry no data.
+		if len(data) > 0 {
+			up.publish(hub, strings.Join(data, "\n"))
+		}
+		if id != "" {
+			*lastID = id
+		}
+		id, data = "", nil
+	}
+	if err := sc.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("stream closed")
+}
+
+// publish republishes one upstream frame on the local hub. Events that
+// already carry an origin (from a chained aggregator) keep it.
+func (up upstream) publish(hub *eventHub, data string) {
+	var ev repoEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		slog.Warn("skipping malformed upstream event", "upstream", up.origin)
+		return
+	}
+	// A control message such as server_shutdown is about the upstream
+	// itself; the dropped stream is retried as usual.
+	if ev.control() {
+		slog.Info("upstream control message", "upstream", up.origin, "event", ev.Type)
+		return
+	}
+	if ev.Repo == "" {
+		slog.Warn("skipping malformed upstream event", "upstream", up.origin)
+		return
+	}
+	if ev.Origin == "" {
+		ev.Origin = up.origin
+	}
+	hub.publish(ev)
+	slog.Info("published", "event", ev.Type, "repo", ev.Repo, "origin", ev.Origin, "subscribers", hub.subscriberCount())
+}
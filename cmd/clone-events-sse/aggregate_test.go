@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	tests := []struct {
+		entry   string
+		url     string
+		origin  string
+		wantErr bool
+	}{
+		{entry: "https://eu.gittr.space/events", url: "https://eu.gittr.space/events", origin: "eu.gittr.space"},
+		{entry: "eu=https://eu.gittr.space/events", url: "https://eu.gittr.space/events", origin: "eu"},
+		{entry: "https://eu.gittr.space/events?type=repo_cloned", url: "https://eu.gittr.space/events?type=repo_cloned", origin: "eu.gittr.space"},
+		{entry: "eu=wss://eu.gittr.space/events", wantErr: true},
+		{entry: "eu.gittr.space/events", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			ups, err := parseUpstreams([]string{tt.entry})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed as %+v", ups)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ups[0].url != tt.url || ups[0].origin != tt.origin {
+				t.Errorf("got %+v", ups[0])
+			}
+		})
+	}
+}
+
+// TestAggregatorMerges follows two in-process upstreams and reads the
+// merged stream from the aggregator. One upstream then drops the
+// connection; the aggregator reconnects with Last-Event-ID and picks up
+// what was published meanwhile without repeating anything.
+func TestAggregatorMerges(t *testing.T) {
+	upA := newTestServer(t, nil)
+	upB := newTestServer(t, nil)
+	var (
+		mu      sync.Mutex
+		resumed []string
+	)
+	routesA := upA.routes()
+	srvA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			mu.Lock()
+			resumed = append(resumed, r.Header.Get("Last-Event-ID"))
+			mu.Unlock()
+		}
+		routesA.ServeHTTP(w, r)
+	}))
+	defer srvA.Close()
+	srvB := serveTest(t, upB)
+	hostB := mustHost(t, srvB.URL)
+
+	agg := newTestServer(t, map[string]string{"UPSTREAM_EVENTS": "alpha=" + srvA.URL + "/events," + srvB.URL + "/events"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, up := range agg.cfg.upstreams {
+		go up.follow(ctx, &http.Client{}, agg.hub)
+	}
+	waitFor(t, func() bool { return upA.hub.subscriberCount() == 1 && upB.hub.subscriberCount() == 1 })
+	aggSrv := serveTest(t, agg)
+	_, br := openStream(t, aggSrv.Client(), aggSrv.URL+"/events", nil)
+
+	next := func() repoEvent {
+		t.Helper()
+		for {
+			var ev repoEvent
+			if err := json.Unmarshal([]byte(readFrame(t, br).data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if !ev.control() {
+				return ev
+			}
+		}
+	}
+	post := func(srv *httptest.Server, repo string) {
+		t.Helper()
+		if resp := postSigned(t, srv, []byte(`{"repo":"`+repo+`"}`)); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("upstream answered %d", resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		srv    *httptest.Server
+		repo   string
+		origin string
+	}{
+		{srvA, "npub1a/one", "alpha"},
+		{srvB, "npub1b/two", hostB},
+		{srvA, "npub1a/three", "alpha"},
+		{srvB, "npub1b/four", hostB},
+	}
+	for _, tt := range tests {
+		post(tt.srv, tt.repo)
+		// Waiting for each event keeps the merged order deterministic.
+		if ev := next(); ev.Repo != tt.repo || ev.Origin != tt.origin {
+			t.Fatalf("merged stream has %s from %q, want %s from %q", ev.Repo, ev.Origin, tt.repo, tt.origin)
+		}
+	}
+
+	lastA := strconv.FormatInt(upA.hub.recent()[1].ID, 10)
+	srvA.CloseClientConnections()
+	// The test's own webhook connection went down too.
+	srvA.Client().CloseIdleConnections()
+	waitFor(t, func() bool { return upA.hub.subscriberCount() == 0 })
+	post(srvA, "npub1a/five")
+	if ev := next(); ev.Repo != "npub1a/five" || ev.Origin != "alpha" {
+		t.Fatalf("after the reconnect the merged stream has %s from %q", ev.Repo, ev.Origin)
+	}
+	mu.Lock()
+	if len(resumed) != 2 || resumed[0] != "" || resumed[1] != lastA {
+		t.Errorf("Last-Event-ID per connection %q, want [\"\" %q]", resumed, lastA)
+	}
+	mu.Unlock()
+	if n := len(agg.hub.recent()); n != 5 {
+		t.Errorf("aggregator buffered %d events, want 5", n)
+	}
+}
+
+func mustHost(t *testing.T, raw string) string {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchSuffix is appended to the event type of an aggregate event, so a
+// batch of repo_cloned webhooks is published as one repo_cloned_batch.
+// Consumers that only know the per-repo type skip it rather than reading
+// an empty repo.
+const batchSuffix = "_batch"
+
+// batcher collects webhooks that share an X-Batch-ID and publishes them as
+// one aggregate event listing every repo, so a bulk clone doesn't flood
+// subscribers with hundreds of frames (WEBHOOK_AGGREGATE_WINDOW). A batch
+// is emitted when its window, counted from its first webhook, closes, or
+// as soon as a webhook marks it complete.
+type batcher struct {
+	window time.Duration
+	emit   func(ev repoEvent, ttl time.Duration)
+
+	mu      sync.Mutex
+	pending map[batchKey]*pendingBatch
+}
+
+// batchKey keeps batches from different senders and of different event
+// types apart even if they reuse an ID.
+type batchKey struct {
+	sender, id, typ string
+}
+
+type pendingBatch struct {
+	repos []string
+	seen  map[string]bool
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+// newBatcher returns nil (no aggregation) when window <= 0.
+func newBatcher(window time.Duration, emit func(ev repoEvent, ttl time.Duration)) *batcher {
+	if window <= 0 {
+		return nil
+	}
+	return &batcher{window: window, emit: emit, pending: make(map[batchKey]*pendingBatch)}
+}
+
+// add records repo in its batch, keeping the longest TTL asked for, and
+// emits the batch right away when complete is set.
+func (b *batcher) add(key batchKey, repo string, ttl time.Duration, complete bool) {
+	b.mu.Lock()
+	pb, ok := b.pending[key]
+	if !ok {
+		pb = &pendingBatch{seen: make(map[string]bool)}
+		b.pending[key] = pb
+		pb.timer = time.AfterFunc(b.window, func() { b.close(key, pb) })
+	}
+	if !pb.seen[repo] {
+		pb.seen[repo] = true
+		pb.repos = append(pb.repos, repo)
+	}
+	if ttl > pb.ttl {
+		pb.ttl = ttl
+	}
+	b.mu.Unlock()
+	if complete {
+		b.close(key, pb)
+	}
+}
+
+// close emits pb if it is still pending under key. The window timer and a
+// completing webhook can race; whichever gets here first emits.
+func (b *batcher) close(key batchKey, pb *pendingBatch) {
+	b.mu.Lock()
+	if b.pending[key] != pb {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	pb.timer.Stop()
+	b.mu.Unlock()
+
+	b.emit(repoEvent{Type: key.typ + batchSuffix, BatchID: key.id, Repos: pb.repos}, pb.ttl)
+	slog.Info("batch closed", "batch_id", key.id, "repos", len(pb.repos))
+}
+
+// flush emits every pending batch, so a shutdown doesn't lose them.
+func (b *batcher) flush() {
+	b.mu.Lock()
+	pending := make(map[batchKey]*pendingBatch, len(b.pending))
+	for k, pb := range b.pending {
+		pending[k] = pb
+	}
+	b.mu.Unlock()
+	for k, pb := range pending {
+		b.close(k, pb)
+	}
+}
+
+// batchComplete reports whether X-Batch-Complete marks the last webhook of
+// a batch.
+func batchComplete(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
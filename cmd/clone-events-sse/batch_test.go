@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchPost is one webhook: repo, sent with X-Batch-ID batch (if any) and
+// X-Batch-Complete when complete is set.
+type batchPost struct {
+	repo, batch string
+	complete    bool
+}
+
+func TestWebhookAggregation(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		posts  []batchPost
+		// early is true when everything must be published before the
+		// window closes.
+		early bool
+		// want lists the published events, an aggregate one as
+		// "batch-id: repo,repo".
+		want []string
+	}{
+		{
+			name:   "one batch, window closes",
+			window: "150ms",
+			posts:  []batchPost{{repo: "npub1a/a", batch: "b1"}, {repo: "npub1a/b", batch: "b1"}, {repo: "npub1a/a", batch: "b1"}, {repo: "npub1a/c", batch: "b1"}},
+			want:   []string{"b1: npub1a/a,npub1a/b,npub1a/c"},
+		},
+		{
+			name:   "completed before the window",
+			window: "1m",
+			posts:  []batchPost{{repo: "npub1a/a", batch: "b1"}, {repo: "npub1a/b", batch: "b1", complete: true}},
+			early:  true,
+			want:   []string{"b1: npub1a/a,npub1a/b"},
+		},
+		{
+			name:   "interleaved batches",
+			window: "1m",
+			posts:  []batchPost{{repo: "npub1a/a", batch: "b1"}, {repo: "npub1a/x", batch: "b2"}, {repo: "npub1a/b", batch: "b1", complete: true}, {repo: "npub1a/y", batch: "b2", complete: true}},
+			early:  true,
+			want:   []string{"b1: npub1a/a,npub1a/b", "b2: npub1a/x,npub1a/y"},
+		},
+		{
+			name:   "no batch id",
+			window: "1m",
+			posts:  []batchPost{{repo: "npub1a/a"}, {repo: "npub1a/b"}},
+			early:  true,
+			want:   []string{"npub1a/a", "npub1a/b"},
+		},
+		{
+			name:   "aggregation off",
+			window: "0",
+			posts:  []batchPost{{repo: "npub1a/a", batch: "b1"}, {repo: "npub1a/b", batch: "b1"}},
+			early:  true,
+			want:   []string{"npub1a/a", "npub1a/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"WEBHOOK_AGGREGATE_WINDOW": tt.window, "DEDUP_WINDOW": "0"})
+			h := s.routes()
+			for _, p := range tt.posts {
+				r := signedWebhook(t, "s3cret", []byte(`{"repo":"`+p.repo+`"}`))
+				if p.batch != "" {
+					r.Header.Set("X-Batch-ID", p.batch)
+				}
+				if p.complete {
+					r.Header.Set("X-Batch-Complete", "true")
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusAccepted {
+					t.Fatalf("%s: status %d", p.repo, w.Code)
+				}
+			}
+
+			published := func() []string {
+				var got []string
+				for _, ev := range s.hub.recent() {
+					if ev.BatchID != "" {
+						if ev.Type != "repo_cloned"+batchSuffix || ev.Repo != "" {
+							t.Errorf("aggregate event %+v", ev)
+						}
+						got = append(got, ev.BatchID+": "+strings.Join(ev.Repos, ","))
+					} else {
+						got = append(got, ev.Repo)
+					}
+				}
+				return got
+			}
+			if !tt.early {
+				if got := published(); len(got) != 0 {
+					t.Fatalf("published %q before the window closed", got)
+				}
+				waitFor(t, func() bool { return len(s.hub.recent()) > 0 })
+				// Nothing else is on its way.
+				time.Sleep(50 * time.Millisecond)
+			}
+			if got := published(); !slices.Equal(got, tt.want) {
+				t.Errorf("published %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLoadConfigShutdownGrace covers the settings a grace period depends on.
+func TestLoadConfigShutdownGrace(t *testing.T) {
+	buffer := filepath.Join(t.TempDir(), "buffer.json")
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "no grace", env: map[string]string{}},
+		{name: "grace with a buffer file", env: map[string]string{"SHUTDOWN_GRACE": "10s", "BUFFER_FILE": buffer}},
+		{name: "grace without a buffer file", env: map[string]string{"SHUTDOWN_GRACE": "10s"}, wantErr: "SHUTDOWN_GRACE needs BUFFER_FILE"},
+		{name: "negative grace", env: map[string]string{"SHUTDOWN_GRACE": "-1s", "BUFFER_FILE": buffer}, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_SECRET", "s3cret")
+			t.Setenv("SHUTDOWN_GRACE", "")
+			t.Setenv("BUFFER_FILE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("loadConfig: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("loadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
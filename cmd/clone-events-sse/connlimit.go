@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter counts open /events streams per client IP so one client
+// can't hold all of the server's connections (SSE_MAX_CONNS_PER_IP).
+// Connections without an IP, such as those on EVENTS_UNIX_SOCKET, aren't
+// limited. A nil limiter allows everything.
+type connLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// newConnLimiter returns nil (no limit) when max <= 0.
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+// acquire takes a slot for ip, reporting false if it has none left. Every
+// successful acquire must be paired with a release.
+func (l *connLimiter) acquire(ip string) bool {
+	if l == nil || net.ParseIP(ip) == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	if l == nil || net.ParseIP(ip) == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// connStep opens a stream as the client forwardedFor names (none: the
+// test's own address) expecting status, or with hangUp set closes the
+// stream opened at that step index instead.
+type connStep struct {
+	forwardedFor string
+	status       int
+	hangUp       int
+}
+
+func TestConnLimitPerIP(t *testing.T) {
+	const a, b = "203.0.113.1", "203.0.113.2"
+	tests := []struct {
+		name  string
+		env   map[string]string
+		steps []connStep
+	}{
+		{
+			name: "excess rejected",
+			env:  map[string]string{"SSE_MAX_CONNS_PER_IP": "2"},
+			steps: []connStep{
+				{status: http.StatusOK}, {status: http.StatusOK}, {status: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "a slot frees on disconnect",
+			env:  map[string]string{"SSE_MAX_CONNS_PER_IP": "2"},
+			steps: []connStep{
+				{status: http.StatusOK}, {status: http.StatusOK}, {status: http.StatusTooManyRequests},
+				{hangUp: 1}, {status: http.StatusOK}, {status: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "clients behind a trusted proxy counted apart",
+			env:  map[string]string{"SSE_MAX_CONNS_PER_IP": "2", "TRUSTED_PROXIES": "127.0.0.1"},
+			steps: []connStep{
+				{forwardedFor: a, status: http.StatusOK}, {forwardedFor: a, status: http.StatusOK},
+				{forwardedFor: b, status: http.StatusOK}, {forwardedFor: a, status: http.StatusTooManyRequests},
+				{forwardedFor: b, status: http.StatusOK},
+			},
+		},
+		{
+			name: "X-Forwarded-For from an untrusted peer ignored",
+			env:  map[string]string{"SSE_MAX_CONNS_PER_IP": "2"},
+			steps: []connStep{
+				{forwardedFor: a, status: http.StatusOK}, {forwardedFor: b, status: http.StatusOK},
+				{forwardedFor: "198.51.100.7", status: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "no limit",
+			steps: []connStep{
+				{status: http.StatusOK}, {status: http.StatusOK}, {status: http.StatusOK}, {status: http.StatusOK},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"SSE_MAX_CONNS_PER_IP": "0", "HEARTBEAT_INTERVAL": "0"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			s := newTestServer(t, env)
+			srv := serveTest(t, s)
+
+			hangUps := make(map[int]context.CancelFunc)
+			open := 0
+			// settled reports whether the handlers have caught up, slots
+			// released included.
+			settled := func() bool {
+				if s.hub.subscriberCount() != open {
+					return false
+				}
+				if s.conns == nil {
+					return true
+				}
+				s.conns.mu.Lock()
+				defer s.conns.mu.Unlock()
+				held := 0
+				for _, n := range s.conns.conns {
+					held += n
+				}
+				return held == open
+			}
+			for i, step := range tt.steps {
+				if step.status == 0 {
+					hangUps[step.hangUp]()
+					open--
+					waitFor(t, settled)
+					continue
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if step.forwardedFor != "" {
+					req.Header.Set("X-Forwarded-For", step.forwardedFor)
+				}
+				resp, err := srv.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != step.status {
+					t.Fatalf("step %d: status %d, want %d", i, resp.StatusCode, step.status)
+				}
+				if resp.StatusCode == http.StatusOK {
+					hangUps[i] = cancel
+					open++
+					waitFor(t, settled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dedupKey identifies events that count as the same notification.
+type dedupKey struct {
+	typ, repo string
+}
+
+// dedupWindow drops webhooks repeating an event of the same type for the
+// same repo published less than window ago (DEDUP_WINDOW), which is what a
+// sender retrying a delivery looks like. The window runs from the event
+// that was published, so a steady stream of retries can't hold it open
+// and a genuine second clone after it gets through.
+type dedupWindow struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// seen maps each key to when its event was last published.
+	seen map[dedupKey]time.Time
+}
+
+// newDedupWindow returns nil (nothing deduplicated) when window <= 0.
+func newDedupWindow(window time.Duration) *dedupWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupWindow{window: window, seen: make(map[dedupKey]time.Time)}
+}
+
+// duplicate reports whether typ/repo was published within the window. It
+// records nothing: that waits for record, once the event has really gone
+// out. A nil window reports false.
+func (d *dedupWindow) duplicate(typ, repo string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.within(dedupKey{typ: typ, repo: repo}, now)
+}
+
+// record marks typ/repo as published at now. It reports false, recording
+// nothing, when a concurrent delivery published it within the window after
+// all; that event should then be dropped. A nil window reports true.
+func (d *dedupWindow) record(typ, repo string, now time.Time) bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupKey{typ: typ, repo: repo}
+	if d.within(key, now) {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
+
+func (d *dedupWindow) within(key dedupKey, now time.Time) bool {
+	last, ok := d.seen[key]
+	return ok && now.Sub(last) < d.window
+}
+
+// sweep forgets keys whose window has passed, so repos seen once don't
+// stay in the map forever.
+func (d *dedupWindow) sweep(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, last := range d.seen {
+		if now.Sub(last) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// runSweeper calls sweep every interval until ctx is done.
+func (d *dedupWindow) runSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.sweep(now)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupWindowRecordsOnlyOnPublish(t *testing.T) {
+	d := newDedupWindow(time.Minute)
+	t0 := time.Unix(1_700_000_000, 0)
+
+	// A delivery that was checked but never published (a 503 past the
+	// deadline) must not hold back the sender's retry.
+	if d.duplicate("repo_cloned", "npub1a/r", t0) {
+		t.Fatal("first delivery reported as duplicate")
+	}
+	if d.duplicate("repo_cloned", "npub1a/r", t0.Add(time.Second)) {
+		t.Fatal("retry of an unpublished delivery reported as duplicate")
+	}
+
+	if !d.record("repo_cloned", "npub1a/r", t0.Add(2*time.Second)) {
+		t.Fatal("record refused the first publish")
+	}
+	tests := []struct {
+		name string
+		typ  string
+		repo string
+		at   time.Duration
+		want bool
+	}{
+		{"same event inside the window", "repo_cloned", "npub1a/r", 30 * time.Second, true},
+		{"other type", "repo_deleted", "npub1a/r", 30 * time.Second, false},
+		{"other repo", "repo_cloned", "npub1a/s", 30 * time.Second, false},
+		{"window measured from the publish", "repo_cloned", "npub1a/r", 61 * time.Second, true},
+		{"after the window", "repo_cloned", "npub1a/r", 62 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.duplicate(tt.typ, tt.repo, t0.Add(tt.at)); got != tt.want {
+				t.Errorf("duplicate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupWindowRecordOnceUnderConcurrency(t *testing.T) {
+	d := newDedupWindow(time.Minute)
+	now := time.Now()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		recorded int
+	)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.record("repo_cloned", "npub1a/r", now) {
+				mu.Lock()
+				recorded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if recorded != 1 {
+		t.Errorf("%d concurrent deliveries were recorded, want 1", recorded)
+	}
+}
+
+func TestDedupWindowNil(t *testing.T) {
+	var d *dedupWindow
+	if d.duplicate("repo_cloned", "r", time.Now()) {
+		t.Error("nil window reported a duplicate")
+	}
+	if !d.record("repo_cloned", "r", time.Now()) {
+		t.Error("nil window refused to record")
+	}
+	if newDedupWindow(0) != nil {
+		t.Error("newDedupWindow(0) isn't nil")
+	}
+}
+
+func TestDedupWindowSweep(t *testing.T) {
+	d := newDedupWindow(time.Minute)
+	t0 := time.Unix(1_700_000_000, 0)
+	d.record("repo_cloned", "old", t0)
+	d.record("repo_cloned", "new", t0.Add(50*time.Second))
+	d.sweep(t0.Add(70 * time.Second))
+	if _, ok := d.seen[dedupKey{typ: "repo_cloned", repo: "old"}]; ok {
+		t.Error("expired key survived the sweep")
+	}
+	if _, ok := d.seen[dedupKey{typ: "repo_cloned", repo: "new"}]; !ok {
+		t.Error("live key was swept")
+	}
+}
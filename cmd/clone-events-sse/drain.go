@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// shutdownNoticeWait bounds how long shutdown waits for streams to send
+// the server_shutdown notice; it comes out of shutdownTimeout.
+const shutdownNoticeWait = time.Second
+
+// notifyShutdown starts shutdown: readiness fails, new streams are
+// refused, and every open stream gets a server_shutdown message and is
+// closed, so clients back off and reconnect to another instance instead
+// of finding their connection dropped. It waits up to wait for the
+// streams to write the message and returns how many it was sent to.
+func (s *server) notifyShutdown(wait time.Duration) int {
+	s.draining.Store(true)
+	n := s.hub.broadcastAll(repoEvent{Type: "server_shutdown", Timestamp: time.Now().Unix()})
+	s.hub.closeSubscribers()
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		s.websockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+	return n
+}
+
+// drain is the SHUTDOWN_GRACE phase between notifyShutdown and shutting
+// the listeners. Webhooks from senders that haven't noticed yet are still
+// accepted and published into the buffer, which the final checkpoint
+// writes to BUFFER_FILE. A second signal cuts it short.
+func (s *server) drain(grace time.Duration, sig <-chan os.Signal) {
+	slog.Info("draining, still accepting webhooks", "grace", grace)
+	select {
+	case <-time.After(grace):
+	case <-sig:
+		slog.Info("second signal, ending grace window early")
+	}
+}
+
+// rejectWhileDraining answers 503 to a new stream during drain, so it goes
+// to an instance that will still be there.
+func (s *server) rejectWhileDraining(w http.ResponseWriter) bool {
+	if !s.draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(1))
+	http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// handleReady is /readyz: 200 while the instance takes new streams, 503
+// once shutdown has begun, so load balancers stop routing to it.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShutdownGrace stops a server holding one stream and one buffered
+// event, posts webhooks while it drains, then takes the final checkpoint
+// the way main does. What was accepted during the window must be on disk.
+func TestShutdownGrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace string
+		// during are posted inside the window; after once stop returned.
+		during, after []string
+		// endEarly sends the second signal after the posts.
+		endEarly bool
+	}{
+		{name: "one late webhook", grace: "1m", during: []string{"npub1a/late"}, endEarly: true},
+		{name: "several, in order", grace: "1m", during: []string{"npub1a/x", "npub1a/y", "npub1a/z"}, endEarly: true},
+		{name: "window runs out", grace: "300ms", during: []string{"npub1a/late"}, after: []string{"npub1a/too-late"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.json")
+			s := newTestServer(t, map[string]string{"SHUTDOWN_GRACE": tt.grace, "BUFFER_FILE": path, "DEDUP_WINDOW": "0"})
+			store := newBufferStore(path, 0)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := newHTTPServer(context.Background(), s.cfg, ln.Addr().String(), s.routes())
+			go srv.Serve(ln)
+			t.Cleanup(func() { srv.Close() })
+			base := "http://" + ln.Addr().String()
+			// Without keep-alives no connection is ever dialed ahead of
+			// a request; Shutdown would wait 5s on such a spare.
+			client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+
+			_, br := openStream(t, client, base+"/events", nil)
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+			s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/early"}, 0)
+
+			logs := captureLogs(t)
+			sig := make(chan os.Signal, 1)
+			stopped := make(chan struct{})
+			go func() {
+				s.stop(sig, srv)
+				close(stopped)
+			}()
+			for !strings.Contains(readFrame(t, br).data, "server_shutdown") {
+			}
+			for route, want := range map[string]int{"/readyz": http.StatusServiceUnavailable, "/events": http.StatusServiceUnavailable} {
+				resp, err := client.Get(base + route)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("%s during drain: status %d, want %d", route, resp.StatusCode, want)
+				}
+			}
+
+			post := func(repo string) (*http.Response, error) {
+				body := []byte(`{"repo":"` + repo + `"}`)
+				r := signedWebhook(t, "s3cret", body)
+				req, err := http.NewRequest(http.MethodPost, base+r.URL.Path, strings.NewReader(string(body)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header = r.Header
+				return client.Do(req)
+			}
+			for _, repo := range tt.during {
+				resp, err := post(repo)
+				if err != nil {
+					t.Fatalf("webhook during the window: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("webhook during the window: status %d", resp.StatusCode)
+				}
+			}
+			if tt.endEarly {
+				sig <- os.Interrupt
+			}
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("stop didn't return")
+			}
+			// The summary has what there was when the signal came, not
+			// what the window added or the notice ended.
+			if recs := logs.records("shutdown complete"); len(recs) != 1 || recs[0]["subscribers"] != 1.0 || recs[0]["buffered"] != 1.0 {
+				t.Errorf("shutdown summary %v, want 1 subscriber and 1 buffered event", recs)
+			}
+			for _, repo := range tt.after {
+				if resp, err := post(repo); err == nil {
+					resp.Body.Close()
+					t.Errorf("webhook after the window answered %d", resp.StatusCode)
+				}
+			}
+
+			if err := store.checkpoint(s.hub); err != nil {
+				t.Fatal(err)
+			}
+			snap, ok := readCheckpoint(t, path)
+			if !ok {
+				t.Fatal("no checkpoint written")
+			}
+			var saved []string
+			for _, ev := range snap.Events {
+				saved = append(saved, ev.Event.Repo)
+			}
+			if want := append([]string{"npub1a/early"}, tt.during...); !slices.Equal(saved, want) {
+				t.Errorf("checkpoint holds %q, want %q", saved, want)
+			}
+		})
+	}
+}
+
+// TestNotifyShutdownStreams checks the server_shutdown notice reaches
+// streams of every kind, repo filters notwithstanding, and ends them.
+func TestNotifyShutdownStreams(t *testing.T) {
+	s := newTestServer(t, nil)
+	srv := serveTest(t, s)
+	_, sse := openStream(t, srv.Client(), srv.URL+"/events/repo/npub1a/r", nil)
+	_, ndjson := openStream(t, srv.Client(), srv.URL+"/events?format=ndjson&repo=npub1a/r", nil)
+	resp, ws := dialWS(t, srv, http.MethodGet, "/ws?repo=npub1a/r", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("/ws: status %d", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 3 })
+
+	if n := s.notifyShutdown(5 * time.Second); n != 3 {
+		t.Errorf("notified %d streams, want 3", n)
+	}
+
+	t.Run("sse", func(t *testing.T) {
+		// Past the retry frame every stream opens with, the notice asks
+		// for a reconnect delay of its own.
+		var frames [][]string
+		for len(frames) < 2 {
+			var frame []string
+			for {
+				line, err := sse.ReadString('\n')
+				if err != nil {
+					t.Fatalf("stream ended before the notice: %v", err)
+				}
+				if line = strings.TrimSuffix(line, "\n"); line == "" {
+					break
+				}
+				frame = append(frame, line)
+			}
+			frames = append(frames, frame)
+		}
+		if notice := frames[1]; len(notice) != 2 || !strings.HasPrefix(notice[0], "retry: ") || !strings.Contains(notice[1], `"type":"server_shutdown"`) {
+			t.Errorf("frames %q, want the retry frame and the notice", frames)
+		}
+		if rest, err := io.ReadAll(sse); err != nil || strings.Contains(string(rest), "data:") {
+			t.Errorf("after the notice: %q, %v", rest, err)
+		}
+	})
+	t.Run("ndjson", func(t *testing.T) {
+		line, err := ndjson.ReadString('\n')
+		if err != nil || !strings.Contains(line, `"type":"server_shutdown"`) {
+			t.Fatalf("first line %q, %v", line, err)
+		}
+		if rest, err := io.ReadAll(ndjson); err != nil || strings.TrimSpace(string(rest)) != "" {
+			t.Errorf("after the notice: %q, %v", rest, err)
+		}
+	})
+	t.Run("websocket", func(t *testing.T) {
+		if ev := ws.nextEvent(t); ev.Type != "server_shutdown" {
+			t.Errorf("first message %+v", ev)
+		}
+		if op, payload := ws.next(t); op != wsOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+			t.Errorf("then opcode %#x, payload %q; want a going-away close", op, payload)
+		}
+	})
+	if n := s.hub.bufferedCount(); n != 0 {
+		t.Errorf("notice buffered: %d events", n)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// eventEncoder serializes events for the wire. With an empty key map it is
+// a plain json.Marshal; otherwise top-level keys are renamed per the map
+// (EVENT_KEY_MAP) so consumers can get e.g. "repository" instead of "repo".
+type eventEncoder struct {
+	keys map[string]string
+}
+
+func (e eventEncoder) marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(e.keys) == 0 {
+		return data, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]json.RawMessage, len(obj))
+	for k, v := range obj {
+		if to, ok := e.keys[k]; ok {
+			k = to
+		}
+		renamed[k] = v
+	}
+	return json.Marshal(renamed)
+}
+
+// marshalEvents encodes a slice of events as a JSON array.
+func (e eventEncoder) marshalEvents(evs []repoEvent) ([]byte, error) {
+	if len(e.keys) == 0 {
+		return json.Marshal(evs)
+	}
+	items := make([]json.RawMessage, 0, len(evs))
+	for _, ev := range evs {
+		data, err := e.marshal(ev)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, data)
+	}
+	return json.Marshal(items)
+}
+
+// parseKeyMap parses EVENT_KEY_MAP ("repo=repository,timestamp=ts"). Only
+// fields repoEvent actually emits may be renamed, and no two fields may end
+// up under the same name.
+func parseKeyMap(v string) (map[string]string, error) {
+	known := jsonFieldNames(reflect.TypeOf(repoEvent{}))
+	keys := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("EVENT_KEY_MAP: expected field=name, got %q", part)
+		}
+		if !known[from] {
+			return nil, fmt.Errorf("EVENT_KEY_MAP: unknown event field %q", from)
+		}
+		keys[from] = to
+	}
+
+	final := make(map[string]string)
+	for field := range known {
+		name := field
+		if to, ok := keys[field]; ok {
+			name = to
+		}
+		if other, dup := final[name]; dup {
+			return nil, fmt.Errorf("EVENT_KEY_MAP: %q and %q would both be emitted as %q", other, field, name)
+		}
+		final[name] = field
+	}
+	return keys, nil
+}
+
+// jsonFieldNames returns the JSON keys a struct type marshals to.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
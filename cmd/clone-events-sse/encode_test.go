@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventKeyMapInSSE(t *testing.T) {
+	s := newTestServer(t, map[string]string{"EVENT_KEY_MAP": "repo=repository, timestamp=ts"})
+	srv := serveTest(t, s)
+	_, br := openStream(t, srv.Client(), srv.URL+"/events", nil)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(`{"repo":"npub1a/r"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status %d: %s", w.Code, w.Body)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(readFrame(t, br).data), &got); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"repository": true, "ts": true, "type": true, "repo": false, "timestamp": false} {
+		if _, ok := got[key]; ok != want {
+			t.Errorf("key %q present = %v, want %v (event %v)", key, ok, want, got)
+		}
+	}
+	if got["repository"] != "npub1a/r" {
+		t.Errorf("repository = %v", got["repository"])
+	}
+
+	// /events/recent goes through the same encoder.
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/recent", nil))
+	if !strings.Contains(w.Body.String(), `"repository":"npub1a/r"`) {
+		t.Errorf("/events/recent = %s", w.Body)
+	}
+}
+
+func TestParseKeyMap(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr string
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "repo=repository,timestamp=ts", want: map[string]string{"repo": "repository", "timestamp": "ts"}},
+		{in: " repo = repository , ", want: map[string]string{"repo": "repository"}},
+		// Swapping two names is fine: nothing ends up under one name twice.
+		{in: "repo=type,type=repo", want: map[string]string{"repo": "type", "type": "repo"}},
+		{in: "repository=repo", wantErr: "unknown event field"},
+		{in: "expires=exp", wantErr: "unknown event field"},
+		{in: "repo", wantErr: "expected field=name"},
+		{in: "repo=", wantErr: "expected field=name"},
+		{in: "repo=type", wantErr: "would both be emitted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseKeyMap(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s -> %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// TestSchemaVersionEverywhere reads one event back from each surface that
+// emits it, renamed keys or not, and a control frame too.
+func TestSchemaVersionEverywhere(t *testing.T) {
+	for _, keyMap := range []string{"", "repo=repository,timestamp=ts"} {
+		t.Run("EVENT_KEY_MAP="+keyMap, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"EVENT_KEY_MAP": keyMap})
+			srv := serveTest(t, s)
+			_, sse := openStream(t, srv.Client(), srv.URL+"/events", nil)
+			_, nd := openStream(t, srv.Client(), srv.URL+"/events?format=ndjson", nil)
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 2 })
+			s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"}, 0)
+
+			get := func(path string) string {
+				w := httptest.NewRecorder()
+				s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				return w.Body.String()
+			}
+			ndLine := func() string {
+				for {
+					line, err := nd.ReadString('\n')
+					if err != nil {
+						t.Fatalf("read ndjson stream: %v", err)
+					}
+					if line = strings.TrimSpace(line); line != "" {
+						return line
+					}
+				}
+			}
+			surfaces := []struct {
+				name string
+				read func() string
+			}{
+				{"sse", func() string { return readFrame(t, sse).data }},
+				{"ndjson stream", ndLine},
+				{"/events/recent", func() string { return strings.Trim(strings.TrimSpace(get("/events/recent")), "[]") }},
+				{"/events.ndjson", func() string { return strings.TrimSpace(get("/events.ndjson?since=0")) }},
+				{"control frame", func() string {
+					s.hub.broadcastAll(repoEvent{Type: "server_shutdown"})
+					return readFrame(t, sse).data
+				}},
+			}
+			for _, sf := range surfaces {
+				var got map[string]any
+				raw := sf.read()
+				if err := json.Unmarshal([]byte(raw), &got); err != nil {
+					t.Fatalf("%s: %v in %q", sf.name, err, raw)
+				}
+				if v, ok := got["schema_version"].(float64); !ok || int(v) != eventSchemaVersion {
+					t.Errorf("%s: schema_version = %v, want %d", sf.name, got["schema_version"], eventSchemaVersion)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repoMeta is the extra metadata a lookup can attach to an event.
+type repoMeta struct {
+	Description   string `json:"description"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// repoLookup fetches metadata for a repo. Implementations must honor ctx;
+// the enricher relies on it to bound the webhook's latency.
+type repoLookup interface {
+	Lookup(ctx context.Context, repo string) (repoMeta, error)
+}
+
+// enricher wraps a repoLookup with a per-call timeout and a cache of
+// successful results. Failures aren't cached, so a lookup service that
+// recovers is picked up by the next webhook.
+type enricher struct {
+	lookup  repoLookup
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedMeta
+}
+
+type cachedMeta struct {
+	meta    repoMeta
+	expires time.Time
+}
+
+func newEnricher(lookup repoLookup, timeout, ttl time.Duration) *enricher {
+	return &enricher{lookup: lookup, timeout: timeout, ttl: ttl, cache: make(map[string]cachedMeta)}
+}
+
+// enrich returns the metadata for repo, from the cache when possible. The
+// error is only for logging: callers publish the event un-enriched.
+func (e *enricher) enrich(ctx context.Context, repo string) (repoMeta, error) {
+	now := time.Now()
+	e.mu.Lock()
+	c, ok := e.cache[repo]
+	e.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.meta, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	meta, err := e.lookup.Lookup(ctx, repo)
+	if err != nil {
+		return repoMeta{}, err
+	}
+	if e.ttl > 0 {
+		e.mu.Lock()
+		e.cache[repo] = cachedMeta{meta: meta, expires: now.Add(e.ttl)}
+		// Expired entries are only dropped on a store, which keeps the
+		// cache bounded by the repos seen within one TTL.
+		for k, v := range e.cache {
+			if !now.Before(v.expires) {
+				delete(e.cache, k)
+			}
+		}
+		e.mu.Unlock()
+	}
+	return meta, nil
+}
+
+// httpLookup is the ENRICH_URL lookup: a GET to the URL with {repo}
+// replaced by the repo (each segment escaped, slashes kept), answered
+// with a repoMeta JSON object.
+type httpLookup struct {
+	client *http.Client
+	tmpl   string
+}
+
+func (l httpLookup) Lookup(ctx context.Context, repo string) (repoMeta, error) {
+	u := strings.ReplaceAll(l.tmpl, "{repo}", strings.ReplaceAll(url.PathEscape(repo), "%2F", "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return repoMeta{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return repoMeta{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return repoMeta{}, fmt.Errorf("lookup %s: unexpected status %s", repo, resp.Status)
+	}
+	var meta repoMeta
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookBody)).Decode(&meta); err != nil {
+		return repoMeta{}, fmt.Errorf("lookup %s: %w", repo, err)
+	}
+	return meta, nil
+}
+
+// parseEnrichURL checks an ENRICH_URL template.
+func parseEnrichURL(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if !strings.Contains(v, "{repo}") {
+		return "", fmt.Errorf("ENRICH_URL must contain {repo}")
+	}
+	u, err := url.Parse(strings.ReplaceAll(v, "{repo}", "x"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("ENRICH_URL: bad url %q", v)
+	}
+	return v, nil
+}
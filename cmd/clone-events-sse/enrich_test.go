@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metaService is a fake ENRICH_URL backend. Repos under /known answer
+// with metadata, /slow ones hang until the caller gives up and anything
+// else fails.
+type metaService struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (m *metaService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo := strings.TrimPrefix(r.URL.Path, "/repos/")
+	m.mu.Lock()
+	m.hits[repo]++
+	m.mu.Unlock()
+	switch {
+	case strings.HasSuffix(repo, "/known"):
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"description":"mirrors of ` + repo + `","default_branch":"trunk"}`))
+	case strings.HasSuffix(repo, "/slow"):
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	default:
+		http.Error(w, "no such repo", http.StatusInternalServerError)
+	}
+}
+
+func (m *metaService) count(repo string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hits[repo]
+}
+
+func TestEnrichment(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	meta := &metaService{hits: make(map[string]int)}
+	backend := httptest.NewServer(meta)
+	defer backend.Close()
+
+	tests := []struct {
+		repo          string
+		description   string
+		defaultBranch string
+		// lookups is how often the backend is asked across two webhooks:
+		// 1 when the first answer is cached.
+		lookups int
+	}{
+		{repo: "npub1a/known", description: "mirrors of npub1a/known", defaultBranch: "trunk", lookups: 1},
+		{repo: "npub1a/slow", lookups: 2},
+		{repo: "npub1a/missing", lookups: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{
+				"ENRICH_URL":       backend.URL + "/repos/{repo}",
+				"ENRICH_TIMEOUT":   timeout.String(),
+				"ENRICH_CACHE_TTL": "1m",
+				"DEDUP_WINDOW":     "0",
+			})
+			s.enricher = newEnricher(httpLookup{client: backend.Client(), tmpl: s.cfg.enrichURL}, s.cfg.enrichTimeout, s.cfg.enrichCacheTTL)
+			srv := serveTest(t, s)
+
+			for i := 0; i < 2; i++ {
+				start := time.Now()
+				resp := postSigned(t, srv, []byte(`{"repo":"`+tt.repo+`"}`))
+				if resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("webhook %d: status %d", i, resp.StatusCode)
+				}
+				if took := time.Since(start); took > 10*timeout {
+					t.Errorf("webhook %d took %v with a %v lookup timeout", i, took, timeout)
+				}
+			}
+
+			evs := s.hub.recent()
+			if len(evs) != 2 {
+				t.Fatalf("published %d events, want 2", len(evs))
+			}
+			for _, ev := range evs {
+				if ev.Repo != tt.repo || ev.Description != tt.description || ev.DefaultBranch != tt.defaultBranch {
+					t.Errorf("published %+v", ev)
+				}
+			}
+			if got := meta.count(tt.repo); got != tt.lookups {
+				t.Errorf("backend asked %d times, want %d", got, tt.lookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestEventSignatureDownstream publishes a webhook with EVENT_SIGNING_KEY
+// set and checks the events a downstream reads from /events/recent verify,
+// and stop verifying when a covered field is changed.
+func TestEventSignatureDownstream(t *testing.T) {
+	const key = "event-key"
+	s := newTestServer(t, map[string]string{"EVENT_SIGNING_KEY": key})
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(`{"repo":"npub1a/r","ref":"main"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("webhook status %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/recent", nil))
+	var evs []repoEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &evs); err != nil || len(evs) != 1 {
+		t.Fatalf("decode /events/recent (%v): %s", err, w.Body)
+	}
+	ev := evs[0]
+	if ev.Sig == "" {
+		t.Fatal("event carries no sig")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*repoEvent)
+		key    string
+		want   bool
+	}{
+		{"as received", func(*repoEvent) {}, key, true},
+		{"repo changed", func(ev *repoEvent) { ev.Repo = "npub1a/other" }, key, false},
+		{"timestamp changed", func(ev *repoEvent) { ev.Timestamp++ }, key, false},
+		{"sig changed", func(ev *repoEvent) { ev.Sig = flipHex(ev.Sig) }, key, false},
+		{"sig not hex", func(ev *repoEvent) { ev.Sig = "not hex" }, key, false},
+		{"uncovered field changed", func(ev *repoEvent) { ev.Ref = "evil" }, key, true},
+		{"other key", func(*repoEvent) {}, "other-key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ev
+			tt.tamper(&got)
+			if ok := verifyEventSignature(tt.key, got); ok != tt.want {
+				t.Errorf("verifyEventSignature = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+// flipHex changes the first digit of a hex string.
+func flipHex(s string) string {
+	if s[0] == '0' {
+		return "1" + s[1:]
+	}
+	return "0" + s[1:]
+}
+
+func TestEventSigningPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   repoEvent
+		want string
+	}{
+		{"single event", repoEvent{Timestamp: 1700000000, Repo: "npub1a/r"}, "1700000000\nnpub1a/r"},
+		{"aggregate", repoEvent{Timestamp: 1700000000, Repos: []string{"npub1a/r", "npub1a/s"}}, "1700000000\n\nnpub1a/r\nnpub1a/s"},
+		// A repo containing a newline can't be made to look like another
+		// timestamp: the timestamp always ends at the first newline.
+		{"repo with a newline", repoEvent{Timestamp: 17, Repo: "00\nx"}, "17\n00\nx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(eventSigningPayload(tt.ev)); got != tt.want {
+				t.Errorf("payload = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	agg := repoEvent{Timestamp: 1700000000, Repos: []string{"npub1a/r", "npub1a/s"}}
+	agg.Sig = signEvent("k", agg)
+	agg.Repos = []string{"npub1a/r"}
+	if verifyEventSignature("k", agg) {
+		t.Error("aggregate still verifies with a repo removed")
+	}
+}
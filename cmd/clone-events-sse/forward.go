@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// forwardTimeout bounds one forwarded POST.
+	forwardTimeout = 10 * time.Second
+	// defaultGzipMinBytes is the smallest body a gzip target compresses;
+	// below it the gzip framing costs more than it saves.
+	defaultGzipMinBytes = 256
+)
+
+// forwardTarget is a downstream that accepted webhooks are relayed to, in
+// the same shape and signed the same way as /webhooks/repo-cloned expects.
+type forwardTarget struct {
+	URL string `json:"url"`
+	// Secret signs the forwarded body; Sender is sent as X-Sender.
+	Secret string `json:"secret"`
+	Sender string `json:"sender"`
+	// Gzip compresses bodies of at least GzipMinBytes (default 256).
+	Gzip         bool `json:"gzip"`
+	GzipMinBytes int  `json:"gzip_min_bytes"`
+}
+
+// loadForwardTargets reads the FORWARD_TARGETS_FILE JSON array.
+func loadForwardTargets(file string) ([]forwardTarget, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("FORWARD_TARGETS_FILE: %w", err)
+	}
+	var targets []forwardTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("FORWARD_TARGETS_FILE: %w", err)
+	}
+	for i, t := range targets {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("FORWARD_TARGETS_FILE: target %d: bad url %q", i, t.URL)
+		}
+		if targets[i].GzipMinBytes <= 0 {
+			targets[i].GzipMinBytes = defaultGzipMinBytes
+		}
+	}
+	return targets, nil
+}
+
+// forward relays p to every target in the background. It is a side effect
+// of an already accepted webhook, so it runs detached from the inbound
+// request and its deadline.
+func (s *server) forward(p webhookPayload) {
+	if len(s.cfg.forwardTargets) == 0 {
+		return
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Warn("forward failed", "repo", p.Repo, "err", err)
+		return
+	}
+	for _, t := range s.cfg.forwardTargets {
+		go func(t forwardTarget) {
+			ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+			defer cancel()
+			if err := postForward(ctx, s.forwardClient, t, body); err != nil {
+				slog.Warn("forward failed", "repo", p.Repo, "target", t.URL, "err", err)
+			}
+		}(t)
+	}
+}
+
+// postForward POSTs body to t. The signature always covers the
+// uncompressed JSON, which is what the receiver sees after undoing
+// Content-Encoding, so compressing never changes what gets verified.
+func postForward(ctx context.Context, client *http.Client, t forwardTarget, body []byte) error {
+	payload := body
+	gzipped := t.Gzip && len(body) >= t.GzipMinBytes
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		payload = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if t.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac, err := webhookMAC(t.Secret, ts, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac))
+	}
+	if t.Sender != "" {
+		req.Header.Set("X-Sender", t.Sender)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestForwardToDownstream relays webhooks to a second instance of this
+// server, which checks the signature the way it does for any sender. A
+// gzipped body must verify there just like a plain one.
+func TestForwardToDownstream(t *testing.T) {
+	long := `{"repo":"npub1a/r","ref":"refs/heads/` + strings.Repeat("feature-", 40) + `x"}`
+	short := `{"repo":"npub1a/r"}`
+	tests := []struct {
+		name     string
+		body     string
+		target   forwardTarget
+		encoding string
+		accepted bool
+	}{
+		{"gzipped", long, forwardTarget{Secret: "down", Gzip: true}, "gzip", true},
+		{"too small to gzip", short, forwardTarget{Secret: "down", Gzip: true}, "", true},
+		{"gzip with a lower floor", short, forwardTarget{Secret: "down", Gzip: true, GzipMinBytes: 8}, "gzip", true},
+		{"plain", long, forwardTarget{Secret: "down"}, "", true},
+		{"gzipped, wrong secret", long, forwardTarget{Secret: "not-down", Gzip: true}, "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := newTestServer(t, map[string]string{"WEBHOOK_SECRET": "down"})
+			var (
+				mu       sync.Mutex
+				encoding []string
+				statuses []int
+			)
+			downRoutes := down.routes()
+			downSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rec := httptest.NewRecorder()
+				downRoutes.ServeHTTP(rec, r)
+				mu.Lock()
+				encoding = append(encoding, r.Header.Get("Content-Encoding"))
+				statuses = append(statuses, rec.Code)
+				mu.Unlock()
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+			}))
+			defer downSrv.Close()
+
+			target := tt.target
+			target.URL = downSrv.URL + "/webhooks/repo-cloned"
+			targets, err := json.Marshal([]forwardTarget{target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(t.TempDir(), "targets.json")
+			if err := os.WriteFile(file, targets, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			up := newTestServer(t, map[string]string{"WEBHOOK_SECRET": "s3cret", "FORWARD_TARGETS_FILE": file})
+			w := httptest.NewRecorder()
+			up.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(tt.body)))
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("upstream status %d", w.Code)
+			}
+
+			waitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(statuses) == 1
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if encoding[0] != tt.encoding {
+				t.Errorf("Content-Encoding %q, want %q", encoding[0], tt.encoding)
+			}
+			want := http.StatusUnauthorized
+			if tt.accepted {
+				want = http.StatusAccepted
+			}
+			if statuses[0] != want {
+				t.Fatalf("downstream answered %d, want %d", statuses[0], want)
+			}
+			evs := down.hub.recent()
+			if !tt.accepted {
+				if len(evs) != 0 {
+					t.Errorf("downstream published %d events from a forgery", len(evs))
+				}
+				return
+			}
+			if len(evs) != 1 || evs[0].Repo != "npub1a/r" {
+				t.Fatalf("downstream buffer %+v", evs)
+			}
+			if strings.Contains(tt.body, "feature-") && !strings.HasSuffix(evs[0].Ref, "feature-x") {
+				t.Errorf("ref arrived as %q", evs[0].Ref)
+			}
+		})
+	}
+}
@@ -0,0 +1,927 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// maxWebhookBody is the default WEBHOOK_MAX_BODY.
+const maxWebhookBody = 1 << 20
+
+// server bundles the configuration and hub every handler needs.
+type server struct {
+	cfg           config
+	hub           *eventHub
+	enc           eventEncoder
+	metrics       *metrics
+	forwardClient *http.Client
+	// enricher adds repo metadata to events; nil without ENRICH_URL.
+	enricher *enricher
+	// frames caches encoded /events frames per event and format.
+	frames *frameCache
+	// conns counts open /events streams per client IP; nil without
+	// SSE_MAX_CONNS_PER_IP.
+	conns *connLimiter
+	// batches aggregates X-Batch-ID webhooks; nil without
+	// WEBHOOK_AGGREGATE_WINDOW.
+	batches *batcher
+	// receipts remembers Idempotency-Key outcomes; nil when
+	// IDEMPOTENCY_TTL is 0.
+	receipts *receiptLog
+	// dedup drops repeats within DEDUP_WINDOW; nil when it is 0.
+	dedup *dedupWindow
+	// webhookLimit rate-limits webhooks per client IP; nil without
+	// WEBHOOK_RATE.
+	webhookLimit *webhookLimiter
+	// websockets counts open /ws connections. They are hijacked, so
+	// http.Server.Shutdown doesn't wait for them; main does.
+	websockets sync.WaitGroup
+	// streams counts open /events streams, so shutdown can wait for them
+	// to send the server_shutdown notice.
+	streams sync.WaitGroup
+	// draining is set once shutdown begins, through the SHUTDOWN_GRACE
+	// window.
+	draining atomic.Bool
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.requireEventsToken(s.handleEvents))
+	mux.HandleFunc("/events/repo/", s.requireEventsToken(s.handleRepoEvents))
+	mux.HandleFunc("/events/recent", s.requireEventsToken(s.handleRecent))
+	mux.HandleFunc("/events.ndjson", s.requireEventsToken(s.handlePoll))
+	mux.HandleFunc("/ws", s.requireEventsToken(s.handleWebSocket))
+	mux.Handle("/webhooks/repo-cloned", s.webhookHandler())
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	if s.cfg.adminToken != "" {
+		mux.HandleFunc("/admin/export", s.requireAdmin(s.handleExport))
+		mux.HandleFunc("/admin/import", s.requireAdmin(s.handleImport))
+	}
+	return mux
+}
+
+// webhookHandler bounds the whole webhook request by WEBHOOK_TIMEOUT: a
+// request that takes longer gets a 503 instead of holding the connection.
+func (s *server) webhookHandler() http.Handler {
+	h := http.HandlerFunc(s.handleWebhook)
+	if s.cfg.webhookTimeout <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, s.cfg.webhookTimeout, "webhook processing timed out\n")
+}
+
+// streamRoutes is the read-only subset served on EVENTS_UNIX_SOCKET.
+func (s *server) streamRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.requireEventsToken(s.handleEvents))
+	mux.HandleFunc("/events/repo/", s.requireEventsToken(s.handleRepoEvents))
+	mux.HandleFunc("/events/recent", s.requireEventsToken(s.handleRecent))
+	mux.HandleFunc("/events.ndjson", s.requireEventsToken(s.handlePoll))
+	mux.HandleFunc("/ws", s.requireEventsToken(s.handleWebSocket))
+	return mux
+}
+
+// requireEventsToken guards the event read endpoints with EVENTS_TOKEN,
+// sent as a bearer token or, for EventSource and browser WebSockets, which
+// can't set headers, as ?token=. CORS preflights carry neither and pass.
+// Without EVENTS_TOKEN the endpoints are public.
+func (s *server) requireEventsToken(next http.HandlerFunc) http.HandlerFunc {
+	if s.cfg.eventsToken == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				got = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.eventsToken)) != 1 {
+				setCORS(w, r, s.cfg.allowOrigins)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleEvents streams buffered and then live events as text/event-stream.
+// ?repo= and ?prefix= narrow it to some repos.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.streamEvents(w, r, repoFilter(q["repo"], q["prefix"]))
+}
+
+// repoFilter matches events for any of repos, or for a repo starting with
+// any of prefixes. Empty values are ignored, and with nothing left it
+// returns nil: no filter, every event.
+func repoFilter(repos, prefixes []string) func(repoEvent) bool {
+	exact := make(map[string]bool, len(repos))
+	for _, r := range repos {
+		if r != "" {
+			exact[r] = true
+		}
+	}
+	var pre []string
+	for _, p := range prefixes {
+		if p != "" {
+			pre = append(pre, p)
+		}
+	}
+	if len(exact) == 0 && len(pre) == 0 {
+		return nil
+	}
+	matches := func(repo string) bool {
+		if exact[repo] {
+			return true
+		}
+		for _, p := range pre {
+			if strings.HasPrefix(repo, p) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(ev repoEvent) bool {
+		if ev.Repo != "" && matches(ev.Repo) {
+			return true
+		}
+		for _, r := range ev.Repos {
+			if matches(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// handleRepoEvents serves /events/repo/{repo}: the same stream, limited to
+// one repo's events. The repo is the rest of the path, URL-decoded, so
+// its slashes may be sent as-is or as %2F.
+func (s *server) handleRepoEvents(w http.ResponseWriter, r *http.Request) {
+	repo, err := repoFromPath(r.URL.EscapedPath(), "/events/repo/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.streamEvents(w, r, repoFilter([]string{repo}, nil))
+}
+
+// repoFromPath decodes the repo after prefix in an escaped path. Empty
+// names and "." or ".." segments are refused.
+func repoFromPath(escaped, prefix string) (string, error) {
+	repo, err := url.PathUnescape(strings.TrimPrefix(escaped, prefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid repo in path: %w", err)
+	}
+	if repo == "" {
+		return "", errors.New("missing repo in path")
+	}
+	for _, seg := range strings.Split(repo, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid repo %q in path", repo)
+		}
+	}
+	return repo, nil
+}
+
+// streamEvents is the /events stream. match, when set, picks the events
+// the subscriber gets, in the replay and the live feed alike.
+func (s *server) streamEvents(w http.ResponseWriter, r *http.Request, match func(repoEvent) bool) {
+	setCORS(w, r, s.cfg.allowOrigins)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if s.rejectWhileDraining(w) {
+		return
+	}
+	format, gzipped, err := negotiateStream(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := clientIP(r, s.cfg.trustedProxies)
+	if !s.conns.acquire(ip) {
+		slog.Warn("stream rejected", "path", r.URL.Path, "ip", ip, "reason", "SSE_MAX_CONNS_PER_IP reached")
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer s.conns.release(ip)
+	if !s.admitStream(w, r, ip) {
+		return
+	}
+	defer s.hub.leave()
+
+	// The server-wide read/write deadlines are sized for short requests;
+	// a stream must outlive them, so clear both for this connection.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("clear write deadline", "err", err)
+	}
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		slog.Warn("clear read deadline", "err", err)
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	st := newSubscriberStream(w, rc, format, gzipped)
+	defer st.close()
+	// Sent ahead of the replay so it applies even if the stream drops
+	// during it; the replay's flush pushes it out.
+	if err := st.retry(s.cfg.sseRetryMS); err != nil {
+		return
+	}
+
+	// A reconnecting client (or an aggregator) sends the id of the last
+	// frame it saw; anything unparseable, like an id from the future,
+	// replays the whole buffer.
+	last, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	ch, err := s.hub.subscribe(last, func(backlog []repoEvent) error {
+		for _, ev := range backlog {
+			if match != nil && !match(ev) {
+				continue
+			}
+			if err := s.writeEvent(st, ev); err != nil {
+				return err
+			}
+		}
+		return st.flush()
+	})
+	if err != nil {
+		return
+	}
+	defer s.hub.unsubscribe(ch)
+	s.streams.Add(1)
+	defer s.streams.Done()
+	slog.Debug("subscriber connected", "path", r.URL.Path, "subscribers", s.hub.subscriberCount())
+	if err := st.flush(); err != nil {
+		return
+	}
+
+	var (
+		probe      <-chan time.Time
+		probeTimer *time.Timer
+	)
+	if s.cfg.reapInterval > 0 {
+		probeTimer = time.NewTimer(jitter(s.cfg.reapInterval, s.cfg.reapJitter))
+		defer probeTimer.Stop()
+		probe = probeTimer.C
+	}
+
+	// The heartbeat ticker fires regardless of traffic; a keepalive only
+	// goes out if no event was written since the previous tick.
+	var heartbeat <-chan time.Time
+	if s.cfg.heartbeatInterval > 0 {
+		ticker := time.NewTicker(s.cfg.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	quiet := true
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Debug("subscriber disconnected", "path", r.URL.Path)
+			return
+		case <-heartbeat:
+			if quiet {
+				if err := st.keepalive(); err != nil {
+					return
+				}
+			}
+			quiet = true
+		case <-probe:
+			if err := probeSubscriber(st, s.cfg.reapInterval); err != nil {
+				slog.Info("reaped idle subscriber", "err", err)
+				return
+			}
+			probeTimer.Reset(jitter(s.cfg.reapInterval, s.cfg.reapJitter))
+		case ev, ok := <-ch:
+			if !ok {
+				// Evicted by publish for falling behind, or closed
+				// for shutdown; ending the stream makes the client
+				// reconnect and catch up.
+				return
+			}
+			if match != nil && !ev.control() && !match(ev) {
+				continue
+			}
+			if err := s.writeEvent(st, ev); err != nil {
+				return
+			}
+			if err := st.flush(); err != nil {
+				return
+			}
+			quiet = false
+		}
+	}
+}
+
+// fullRetryAfter is the Retry-After sent while MAX_SUBSCRIBERS streams
+// are open.
+const fullRetryAfter = 5 * time.Second
+
+// admitStream takes a hub slot for a new stream, or answers 503 with
+// Retry-After when MAX_SUBSCRIBERS are already open. When it returns true
+// the caller must call s.hub.leave once the stream ends.
+func (s *server) admitStream(w http.ResponseWriter, r *http.Request, ip string) bool {
+	if s.hub.admit() {
+		return true
+	}
+	slog.Warn("stream rejected", "path", r.URL.Path, "ip", ip, "reason", "MAX_SUBSCRIBERS reached")
+	w.Header().Set("Retry-After", strconv.Itoa(int(fullRetryAfter.Seconds())))
+	http.Error(w, "too many subscribers", http.StatusServiceUnavailable)
+	return false
+}
+
+// jitter spreads d by up to ±frac at random, so streams that connected
+// together don't all probe (and flush) in the same instant.
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + frac*(2*rand.Float64()-1)))
+}
+
+// handleRecent returns the buffered events as a JSON array. Pollers that
+// send back the ETag get a 304 until the buffer changes.
+func (s *server) handleRecent(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, s.cfg.allowOrigins)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	evs := s.hub.recent()
+	etag := recentETag(evs)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := s.enc.marshalEvents(evs)
+	if err != nil {
+		http.Error(w, "encode events", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// handlePoll serves /events.ndjson?since=<id>: the buffered events after
+// since as NDJSON, for clients that poll instead of holding a stream. It
+// never waits; with nothing new it answers 204. X-Last-Event-ID carries
+// the id to pass as since next time, taken under the same lock as the
+// events so nothing published in between is skipped. As with
+// Last-Event-ID, a since this instance hasn't reached gets the whole
+// buffer.
+func (s *server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, s.cfg.allowOrigins)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			http.Error(w, "since must be a non-negative event id", http.StatusBadRequest)
+			return
+		}
+	}
+	evs, last := s.hub.poll(since)
+	w.Header().Set("X-Last-Event-ID", strconv.FormatInt(last, 10))
+	w.Header().Set("Access-Control-Expose-Headers", "X-Last-Event-ID")
+	w.Header().Set("Cache-Control", "no-cache")
+	if len(evs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var buf bytes.Buffer
+	for _, ev := range evs {
+		data, err := s.enc.marshal(ev)
+		if err != nil {
+			http.Error(w, "encode events", http.StatusInternalServerError)
+			return
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	w.Header().Set("Content-Type", formatNDJSON.contentType)
+	w.Write(buf.Bytes())
+}
+
+// recentETag identifies a buffer snapshot by its newest event's sequence
+// number. The count is included too, so events expiring out of the buffer
+// also change the tag.
+func recentETag(evs []repoEvent) string {
+	var last int64
+	if len(evs) > 0 {
+		last = evs[len(evs)-1].ID
+	}
+	return fmt.Sprintf(`"%d-%d"`, last, len(evs))
+}
+
+// etagMatches implements the If-None-Match comparison: a list of tags or
+// "*", compared weakly.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the body accepted by /webhooks/repo-cloned.
+type webhookPayload struct {
+	Repo string `json:"repo"`
+	Type string `json:"type"`
+	// TTLSeconds makes the event transient: it is dropped from the replay
+	// buffer once this many seconds have passed.
+	TTLSeconds int `json:"ttl_seconds"`
+	// Size is the size of the clone in bytes, if the sender knows it.
+	Size int64 `json:"size,omitempty"`
+	// Progress is carried into the event as is.
+	Progress *eventProgress `json:"progress,omitempty"`
+	// Pubkey is the repo owner's key, npub or hex; validate normalizes it
+	// to hex. Ref is the branch or ref involved, as the sender names it.
+	Pubkey string `json:"pubkey,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+}
+
+var (
+	errUnknownField        = errors.New("unknown field")
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	errBodyTooLarge        = errors.New("body too large")
+)
+
+// decodeWebhookPayloads decodes a webhook body: one payload object, or a
+// non-empty array of them from a sender coalescing several operations.
+// Only webhookPayload's fields ever reach an event; anything else is
+// dropped, or with strict set rejected with errUnknownField so a sender
+// notices its typo.
+func decodeWebhookPayloads(body io.Reader, strict bool) ([]webhookPayload, error) {
+	br := bufio.NewReader(body)
+	array := false
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		array = c == '['
+		br.UnreadByte()
+		break
+	}
+	dec := json.NewDecoder(br)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	var payloads []webhookPayload
+	var err error
+	if array {
+		err = dec.Decode(&payloads)
+	} else {
+		payloads = make([]webhookPayload, 1)
+		err = dec.Decode(&payloads[0])
+	}
+	if err != nil {
+		// encoding/json has no typed error for this case.
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return nil, fmt.Errorf("%w %s", errUnknownField, field)
+		}
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after payload")
+	}
+	if len(payloads) == 0 {
+		return nil, errors.New("empty payload array")
+	}
+	return payloads, nil
+}
+
+// validate checks a payload's fields and fills in the default type.
+func (p *webhookPayload) validate() error {
+	switch {
+	case p.Repo == "":
+		return errors.New("missing repo")
+	case p.TTLSeconds < 0:
+		return errors.New("ttl_seconds must not be negative")
+	case p.Size < 0:
+		return errors.New("size must not be negative")
+	}
+	if err := p.Progress.validate(); err != nil {
+		return err
+	}
+	if p.Pubkey != "" {
+		pk, err := nostrkey.ParsePublicKey(p.Pubkey)
+		if err != nil {
+			return errors.New("pubkey must be an npub or 64 hex digits")
+		}
+		p.Pubkey = hex.EncodeToString(pk)
+	}
+	if p.Type == "" {
+		p.Type = "repo_cloned"
+	}
+	return nil
+}
+
+// rejectWebhook answers a webhook with status and reason, and logs the
+// rejection at warn level with attrs for detail.
+func (s *server) rejectWebhook(w http.ResponseWriter, r *http.Request, status int, reason string, attrs ...any) {
+	slog.Warn("webhook rejected", append([]any{"status", status, "reason", reason, "ip", clientIP(r, s.cfg.trustedProxies)}, attrs...)...)
+	http.Error(w, reason, status)
+}
+
+// handleWebhook validates the signature, then publishes the event to the hub.
+func (s *server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.webhookLimit != nil {
+		ip := clientIP(r, s.cfg.trustedProxies)
+		if ok, wait := s.webhookLimit.allow(ip, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.rejectWebhook(w, r, http.StatusTooManyRequests, "too many webhooks")
+			return
+		}
+	}
+	if s.cfg.strictHeaders {
+		if status, err := checkPreface(r, len(s.cfg.senders) > 0); status != 0 {
+			if status == http.StatusUnauthorized {
+				s.metrics.authFailure(err)
+				s.rejectWebhook(w, r, status, "invalid signature", "err", err)
+				return
+			}
+			s.rejectWebhook(w, r, status, err.Error())
+			return
+		}
+	}
+
+	body, err := readWebhookBody(r, s.cfg.maxWebhookBody, s.cfg.spoolThreshold)
+	if errors.Is(err, errUnsupportedEncoding) {
+		s.rejectWebhook(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	if errors.Is(err, errBodyTooLarge) {
+		s.rejectWebhook(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", s.cfg.maxWebhookBody))
+		return
+	}
+	if err != nil {
+		s.rejectWebhook(w, r, http.StatusBadRequest, "read body", "err", err)
+		return
+	}
+	defer body.Close()
+	sender, err := authenticateSender(s.cfg.senders, r.Header.Get("X-Sender"), r.Header.Get("X-Timestamp"), body, r.Header.Get("X-Signature"), s.cfg.maxSkew)
+	if err != nil {
+		s.metrics.authFailure(err)
+		s.rejectWebhook(w, r, http.StatusUnauthorized, "invalid signature", "err", err)
+		return
+	}
+
+	// accept answers 202 with status; with an Idempotency-Key it is also
+	// what a retry of this delivery will be answered with.
+	accept := func(status string) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": status})
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" && s.receipts != nil {
+		if sender != nil {
+			key = sender.Name + "\x00" + key
+		}
+		status, state := s.receipts.claim(key, time.Now())
+		switch state {
+		case receiptDone:
+			slog.Info("webhook retry answered from the receipt log", "status", status)
+			w.Header().Set("Idempotent-Replayed", "true")
+			accept(status)
+			return
+		case receiptPending:
+			s.rejectWebhook(w, r, http.StatusConflict, "a delivery with this Idempotency-Key is in progress")
+			return
+		}
+		var outcome string
+		defer func() { s.receipts.finish(key, outcome, time.Now()) }()
+		accept = func(status string) {
+			outcome = status
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": status})
+		}
+	}
+
+	payloads, err := decodeWebhookPayloads(body.open(), s.cfg.strictFields)
+	if errors.Is(err, errUnknownField) {
+		s.rejectWebhook(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		s.rejectWebhook(w, r, http.StatusBadRequest, "invalid json")
+		return
+	}
+	// An array is checked whole before anything of it is published, so a
+	// bad element rejects the delivery instead of leaving it half done.
+	for i := range payloads {
+		p := &payloads[i]
+		if err := p.validate(); err != nil {
+			if len(payloads) > 1 {
+				err = fmt.Errorf("event %d: %w", i, err)
+			}
+			s.rejectWebhook(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if sender != nil && !sender.allows(p.Type, p.Repo) {
+			s.rejectWebhook(w, r, http.StatusForbidden, "event not allowed for sender", "sender", sender.Name, "event", p.Type, "repo", p.Repo)
+			return
+		}
+	}
+
+	batchID := strings.TrimSpace(r.Header.Get("X-Batch-ID"))
+	if s.batches == nil {
+		batchID = ""
+	}
+	var (
+		statuses []string
+		publish  []webhookPayload
+		events   []repoEvent
+		// pending catches a delivery repeating one of its own events,
+		// which the window can't see before anything is recorded.
+		pending = make(map[dedupKey]bool)
+	)
+	for _, p := range payloads {
+		if reason, ok := s.cfg.emitFilter.suppress(p); ok {
+			s.metrics.suppression(reason)
+			slog.Info("webhook suppressed", "event", p.Type, "repo", p.Repo, "rule", reason)
+			statuses = append(statuses, "suppressed")
+			continue
+		}
+		// Progress updates of one repo differ in their counts, so only
+		// events without progress are compared.
+		if key := (dedupKey{typ: p.Type, repo: p.Repo}); p.Progress == nil && s.dedup != nil {
+			if pending[key] || s.dedup.duplicate(p.Type, p.Repo, time.Now()) {
+				s.metrics.suppression(suppressedDuplicate)
+				slog.Info("webhook suppressed", "event", p.Type, "repo", p.Repo, "rule", suppressedDuplicate)
+				statuses = append(statuses, "duplicate")
+				continue
+			}
+			pending[key] = true
+		}
+		publish = append(publish, p)
+		if batchID != "" {
+			statuses = append(statuses, "batched")
+			continue
+		}
+		ev := repoEvent{Type: p.Type, Repo: p.Repo, Pubkey: p.Pubkey, Ref: p.Ref, Progress: p.Progress}
+		if s.enricher != nil {
+			meta, err := s.enricher.enrich(r.Context(), p.Repo)
+			if err != nil {
+				slog.Warn("enrich failed, publishing without metadata", "repo", p.Repo, "err", err)
+			}
+			ev.Description, ev.DefaultBranch = meta.Description, meta.DefaultBranch
+		}
+		events = append(events, ev)
+		statuses = append(statuses, "accepted")
+	}
+
+	// Past the deadline the client has already been sent a 503, so the
+	// events must not be published behind its back. Anything non-critical
+	// added after publish should run detached from r.Context() so it
+	// doesn't count against the budget.
+	if len(publish) > 0 {
+		if err := r.Context().Err(); err != nil {
+			slog.Warn("webhook dropped", "repo", publish[0].Repo, "err", err)
+			return
+		}
+	}
+	for i, p := range publish {
+		// Only an event that really goes out enters the dedup window, so a
+		// sender retrying a delivery dropped above isn't taken for a
+		// duplicate.
+		if p.Progress == nil && !s.dedup.record(p.Type, p.Repo, time.Now()) {
+			s.metrics.suppression(suppressedDuplicate)
+			slog.Info("webhook suppressed", "event", p.Type, "repo", p.Repo, "rule", suppressedDuplicate)
+			continue
+		}
+		if batchID != "" {
+			key := batchKey{id: batchID, typ: p.Type}
+			if sender != nil {
+				key.sender = sender.Name
+			}
+			s.batches.add(key, p.Repo, s.cfg.eventTTL(p), batchComplete(r.Header.Get("X-Batch-Complete")))
+		} else {
+			s.emit(events[i], s.cfg.eventTTL(p))
+		}
+		s.forward(p)
+	}
+
+	accept(webhookStatus(statuses))
+}
+
+// webhookStatus is the response status for a delivery whose events ended
+// up with statuses: theirs when they all agree, "accepted" for a mix.
+func webhookStatus(statuses []string) string {
+	for _, st := range statuses[1:] {
+		if st != statuses[0] {
+			return "accepted"
+		}
+	}
+	return statuses[0]
+}
+
+// emit stamps, signs and publishes an event built from webhooks; a
+// positive ttl makes it transient.
+func (s *server) emit(ev repoEvent, ttl time.Duration) {
+	now := time.Now()
+	ev.Timestamp = now.Unix()
+	if ttl > 0 {
+		ev.expires = now.Add(ttl)
+	}
+	if s.cfg.eventSigningKey != "" {
+		ev.Sig = signEvent(s.cfg.eventSigningKey, ev)
+	}
+	s.hub.publish(ev)
+	attrs := []any{"event", ev.Type, "repo", ev.Repo}
+	if ev.BatchID != "" {
+		attrs = []any{"event", ev.Type, "batch_id", ev.BatchID, "repos", len(ev.Repos)}
+	}
+	if ev.Origin != "" {
+		attrs = append(attrs, "origin", ev.Origin)
+	}
+	slog.Info("published", append(attrs, "subscribers", s.hub.subscriberCount())...)
+}
+
+// eventTTL picks the TTL for a webhook: an explicit ttl_seconds wins over
+// the per-type default from EVENT_TYPE_TTL.
+func (c config) eventTTL(p webhookPayload) time.Duration {
+	if p.TTLSeconds > 0 {
+		return time.Duration(p.TTLSeconds) * time.Second
+	}
+	return c.typeTTL[p.Type]
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":          "ok",
+		"subscribers":     s.hub.subscriberCount(),
+		"streams":         s.hub.streamCount(),
+		"max_subscribers": s.cfg.maxSubscribers,
+		"buffered":        s.hub.bufferedCount(),
+	})
+}
+
+// signatureAlgorithms are the X-Signature prefixes accepted, GitHub style
+// ("sha256=<hex>"). Unprefixed signatures are sha256.
+var signatureAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// webhookMAC is the HMAC-SHA256 under secret of timestamp, a dot, then
+// body: what X-Signature carries, hex-encoded. Verifying, forwarding and
+// --sign all go through it.
+func webhookMAC(secret, timestamp string, body io.Reader) ([]byte, error) {
+	return hmacOf(sha256.New, secret, timestamp, body)
+}
+
+func hmacOf(newHash func() hash.Hash, secret, timestamp string, body io.Reader) ([]byte, error) {
+	mac := hmac.New(newHash, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	if _, err := io.Copy(mac, body); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// parseSignature splits an X-Signature into its hash and MAC. ok is false
+// for an unknown algorithm prefix or a MAC that isn't hex of that hash's
+// size.
+func parseSignature(sig string) (newHash func() hash.Hash, mac []byte, ok bool) {
+	newHash = sha256.New
+	if alg, rest, found := strings.Cut(sig, "="); found {
+		if newHash, ok = signatureAlgorithms[strings.ToLower(alg)]; !ok {
+			return nil, nil, false
+		}
+		sig = rest
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil || len(mac) != newHash().Size() {
+		return nil, nil, false
+	}
+	return newHash, mac, true
+}
+
+// validSignature reports whether sig is the hex HMAC of timestamp and body
+// under secret, using the hash sig's prefix names (see
+// signatureAlgorithms). The comparison is constant-time.
+func validSignature(secret, timestamp string, body io.Reader, sig string) bool {
+	newHash, got, ok := parseSignature(sig)
+	if !ok {
+		return false
+	}
+	want, err := hmacOf(newHash, secret, timestamp, body)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, want)
+}
+
+// setCORS echoes the request origin when it is in the allow list. A "*"
+// entry allows any origin.
+func setCORS(w http.ResponseWriter, r *http.Request, allowed []string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, a := range allowed {
+		if originMatches(a, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			return
+		}
+	}
+}
+
+// originMatches reports whether origin is allowed by one ALLOW_ORIGINS
+// entry: "*", the exact origin, or scheme://*.domain, which matches any
+// single-label subdomain of domain over that scheme. Wildcard matches
+// parse the origin and insist on nothing but scheme and host, so a query,
+// path, user info or extra label can't pass for the suffix.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	scheme, domain, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Scheme, scheme) || u.Opaque != "" || u.User != nil ||
+		u.Path != "" || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return false
+	}
+	label, rest, ok := strings.Cut(u.Host, ".")
+	return ok && validLabel(label) && strings.EqualFold(rest, domain)
+}
+
+// validLabel reports whether s is a DNS label: letters, digits and
+// hyphens, not starting or ending with a hyphen.
+func validLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("write response", "err", err)
+	}
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// newTestServer builds a server the way main does from env, without the
+// background goroutines a test doesn't need.
+func newTestServer(t *testing.T, env map[string]string) *server {
+	t.Helper()
+	if _, ok := env["WEBHOOK_SECRET"]; !ok {
+		t.Setenv("WEBHOOK_SECRET", "s3cret")
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	hub := newEventHub(cfg.maxBuffer, cfg.subscriberMaxDrops)
+	hub.maxAge = cfg.maxEventAge
+	hub.maxSubscribers = cfg.maxSubscribers
+	s := &server{
+		cfg:           cfg,
+		hub:           hub,
+		enc:           eventEncoder{keys: cfg.keyMap},
+		metrics:       newMetrics(),
+		forwardClient: &http.Client{},
+		frames:        newFrameCache(cfg.maxBuffer, cfg.maxEventBytes),
+		conns:         newConnLimiter(cfg.maxConnsPerIP),
+		receipts:      newReceiptLog(cfg.idempotencyTTL, cfg.idempotencyMaxKeys),
+		dedup:         newDedupWindow(cfg.dedupWindow),
+	}
+	s.batches = newBatcher(cfg.aggregateWindow, s.emit)
+	s.webhookLimit = newWebhookLimiter(cfg.webhookRate, cfg.webhookBurst)
+	return s
+}
+
+// signedWebhook is a POST of body signed with secret, as a sender makes it.
+func signedWebhook(t *testing.T, secret string, body []byte) *http.Request {
+	t.Helper()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac, err := webhookMAC(secret, ts, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/repo-cloned", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Timestamp", ts)
+	r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac))
+	return r
+}
+
+// serveTest serves s.routes() until the test ends. Cleanups run last to
+// first, so streams opened afterwards with openStream are closed first.
+func serveTest(t *testing.T, s *server) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(s.routes())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// openStream GETs url with client and returns the response body for
+// reading frames. The request is canceled when the test ends, or after
+// 10s so a missing event fails the test instead of hanging it.
+func openStream(t *testing.T, client *http.Client, url string, header http.Header) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// sseFrame is one SSE frame with data; probes and keepalives are skipped.
+type sseFrame struct {
+	id, data string
+}
+
+func readFrame(t *testing.T, br *bufio.Reader) sseFrame {
+	t.Helper()
+	var f sseFrame
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if f.data != "" {
+				return f
+			}
+		case strings.HasPrefix(line, "id: "):
+			f.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			f.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// TestWebhookBodyTooLarge checks that a correctly signed body over
+// WEBHOOK_MAX_BODY is a 413, not a signature failure.
+func TestWebhookBodyTooLarge(t *testing.T) {
+	payload := []byte(`{"repo":"npub1a/r","type":"repo_cloned"}`)
+	padded := append(append([]byte(nil), payload[:len(payload)-1]...), []byte(`,"ref":"`+strings.Repeat("x", 200)+`"}`)...)
+	tests := []struct {
+		name   string
+		spool  string
+		body   []byte
+		status int
+	}{
+		{"within the cap", "0", payload, http.StatusAccepted},
+		{"over the cap", "0", padded, http.StatusRequestEntityTooLarge},
+		{"over the cap, spooling", "32", padded, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"WEBHOOK_MAX_BODY": "128", "WEBHOOK_SPOOL_THRESHOLD": tt.spool})
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", tt.body))
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+			s.metrics.mu.Lock()
+			failures := s.metrics.authFailures[errSignatureMismatch.Error()]
+			s.metrics.mu.Unlock()
+			if failures != 0 {
+				t.Errorf("%d signature mismatches counted", failures)
+			}
+		})
+	}
+}
+
+// TestRecentConditional polls /events/recent the way a dashboard does,
+// sending back the last ETag each time.
+func TestRecentConditional(t *testing.T) {
+	s := newTestServer(t, nil)
+	get := func(inm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/events/recent", nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		return w
+	}
+
+	first := get("")
+	if first.Code != http.StatusOK || strings.TrimSpace(first.Body.String()) != "[]" {
+		t.Fatalf("empty buffer: %d %q", first.Code, first.Body.String())
+	}
+	empty := first.Header().Get("ETag")
+
+	s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"}, 0)
+	w := get(empty)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "npub1a/r") {
+		t.Fatalf("stale ETag after a publish: %d %q", w.Code, w.Body.String())
+	}
+	current := w.Header().Get("ETag")
+	if current == empty {
+		t.Fatalf("ETag %s unchanged by a publish", current)
+	}
+
+	tests := []struct {
+		name string
+		inm  string
+		want int
+	}{
+		{"matching", current, http.StatusNotModified},
+		{"weak", "W/" + current, http.StatusNotModified},
+		{"in a list", `"stale", ` + current, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"previous", empty, http.StatusOK},
+		{"unquoted", strings.Trim(current, `"`), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.inm)
+			if w.Code != tt.want {
+				t.Fatalf("If-None-Match %s: status %d, want %d", tt.inm, w.Code, tt.want)
+			}
+			if w.Header().Get("ETag") != current {
+				t.Errorf("ETag %s, want %s", w.Header().Get("ETag"), current)
+			}
+			if tt.want == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with a %d-byte body", w.Body.Len())
+			}
+		})
+	}
+}
+
+// sleepyLookup is a repo lookup that takes delay and, like a badly written
+// hook, ignores its context while it does.
+type sleepyLookup struct {
+	delay time.Duration
+	done  chan struct{}
+}
+
+func (l *sleepyLookup) Lookup(ctx context.Context, repo string) (repoMeta, error) {
+	defer close(l.done)
+	time.Sleep(l.delay)
+	if l.delay > 0 {
+		return repoMeta{}, errors.New("lookup service overloaded")
+	}
+	return repoMeta{Description: "looked up"}, nil
+}
+
+// TestPoll reads /events.ndjson with the buffer holding events 1 to 3 and
+// a newest one, 4, that has already expired.
+func TestPoll(t *testing.T) {
+	s := newTestServer(t, map[string]string{"DEDUP_WINDOW": "0"})
+	for _, repo := range []string{"npub1a/one", "npub1a/two", "npub1a/three"} {
+		s.emit(repoEvent{Type: "repo_cloned", Repo: repo}, 0)
+	}
+	s.hub.publish(repoEvent{Type: "repo_cloning", Repo: "npub1a/gone", expires: time.Now().Add(-time.Second)})
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{name: "without since", status: http.StatusOK, want: []string{"npub1a/one", "npub1a/two", "npub1a/three"}},
+		{name: "since the first", query: "?since=1", status: http.StatusOK, want: []string{"npub1a/two", "npub1a/three"}},
+		{name: "nothing new", query: "?since=3", status: http.StatusNoContent},
+		{name: "since the newest", query: "?since=4", status: http.StatusNoContent},
+		{name: "since an id not reached", query: "?since=99", status: http.StatusOK, want: []string{"npub1a/one", "npub1a/two", "npub1a/three"}},
+		{name: "negative", query: "?since=-1", status: http.StatusBadRequest},
+		{name: "not a number", query: "?since=latest", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events.ndjson"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusBadRequest {
+				return
+			}
+			// The expired event is skipped but still counts, so the
+			// next poll doesn't ask for it again.
+			if got := w.Header().Get("X-Last-Event-ID"); got != "4" {
+				t.Errorf("X-Last-Event-ID %q, want 4", got)
+			}
+			if tt.status == http.StatusNoContent {
+				if w.Body.Len() != 0 {
+					t.Errorf("204 with body %q", w.Body)
+				}
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			var got []string
+			for _, line := range strings.SplitAfter(w.Body.String(), "\n") {
+				if line == "" {
+					continue
+				}
+				var ev repoEvent
+				if !strings.HasSuffix(line, "\n") || json.Unmarshal([]byte(line), &ev) != nil {
+					t.Fatalf("line %q isn't an event", line)
+				}
+				got = append(got, ev.Repo)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("polled %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWebhookTimeout runs a webhook through an enrichment hook slower than
+// WEBHOOK_TIMEOUT. The sender gets a 503 on time and nothing is published
+// behind its back, so its retry isn't taken for a duplicate.
+func TestWebhookTimeout(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	tests := []struct {
+		name    string
+		timeout string
+		delay   time.Duration
+		status  int
+	}{
+		{"fast hook", budget.String(), 0, http.StatusAccepted},
+		{"slow hook", budget.String(), 4 * budget, http.StatusServiceUnavailable},
+		{"slow hook, no budget", "0", 4 * budget, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"WEBHOOK_TIMEOUT": tt.timeout, "DEDUP_WINDOW": "1m"})
+			lookup := &sleepyLookup{delay: tt.delay, done: make(chan struct{})}
+			s.enricher = newEnricher(lookup, time.Minute, time.Minute)
+			srv := serveTest(t, s)
+
+			start := time.Now()
+			resp := postSigned(t, srv, []byte(`{"repo":"npub1a/r"}`))
+			took := time.Since(start)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusServiceUnavailable && took > 3*budget {
+				t.Errorf("503 after %v, want it near the %v budget", took, budget)
+			}
+			<-lookup.done
+			// The abandoned handler finishes right after its hook.
+			time.Sleep(50 * time.Millisecond)
+			published := s.hub.published.Load()
+			if want := tt.status == http.StatusAccepted; (published == 1) != want {
+				t.Fatalf("%d events published, want published = %v", published, want)
+			}
+			if tt.status != http.StatusServiceUnavailable {
+				return
+			}
+
+			lookup.delay, lookup.done = 0, make(chan struct{})
+			if resp := postSigned(t, srv, []byte(`{"repo":"npub1a/r"}`)); resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("retry status %d", resp.StatusCode)
+			}
+			if evs := s.hub.recent(); len(evs) != 1 || evs[0].Description != "looked up" {
+				t.Errorf("after the retry the buffer holds %+v", evs)
+			}
+		})
+	}
+}
+
+// TestWebhookTimeoutSparesForwarding forwards to a target slower than the
+// budget; forwarding is detached, so the webhook is still accepted.
+func TestWebhookTimeoutSparesForwarding(t *testing.T) {
+	got := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		close(got)
+	}))
+	defer target.Close()
+	s := newTestServer(t, map[string]string{"WEBHOOK_TIMEOUT": "100ms"})
+	s.cfg.forwardTargets = []forwardTarget{{URL: target.URL}}
+	srv := serveTest(t, s)
+
+	if resp := postSigned(t, srv, []byte(`{"repo":"npub1a/r"}`)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward never reached the target")
+	}
+}
+
+// postSigned sends a signed webhook to srv.
+func postSigned(t *testing.T, srv *httptest.Server, body []byte) *http.Response {
+	t.Helper()
+	r := signedWebhook(t, "s3cret", body)
+	req, err := http.NewRequest(r.Method, srv.URL+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = r.Header
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// TestWebhookExtraFields sends payloads carrying fields events don't have,
+// some of them event fields a sender must not set. By default they are
+// dropped on the way in; STRICT_FIELDS rejects the delivery with a 422.
+func TestWebhookExtraFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"top level", `{"repo":"npub1a/r","internal_note":"migrated by cron"}`, "internal_note"},
+		{"forged event fields", `{"repo":"npub1a/r","sig":"forged","id":999,"timestamp":1}`, "sig"},
+		{"inside progress", `{"repo":"npub1a/r","progress":{"id":"op","done":1,"total":2,"eta":"5m"}}`, "eta"},
+		{"in an array element", `[{"repo":"npub1a/r"},{"repo":"npub1a/s","mirror":"eu"}]`, "mirror"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("default", func(t *testing.T) {
+				s := newTestServer(t, map[string]string{"STRICT_FIELDS": "false"})
+				w := httptest.NewRecorder()
+				s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(tt.body)))
+				if w.Code != http.StatusAccepted {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				evs := s.hub.recent()
+				if len(evs) == 0 {
+					t.Fatal("nothing published")
+				}
+				for _, ev := range evs {
+					data, err := s.enc.marshal(ev)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if strings.Contains(string(data), `"`+tt.field+`"`) {
+						t.Errorf("%s carried into %s", tt.field, data)
+					}
+					if ev.ID == 999 || ev.Sig != "" || ev.Timestamp == 1 {
+						t.Errorf("sender set event fields: %+v", ev)
+					}
+				}
+			})
+			t.Run("strict", func(t *testing.T) {
+				s := newTestServer(t, map[string]string{"STRICT_FIELDS": "true"})
+				w := httptest.NewRecorder()
+				s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(tt.body)))
+				if w.Code != http.StatusUnprocessableEntity {
+					t.Fatalf("status %d, want 422", w.Code)
+				}
+				if !strings.Contains(w.Body.String(), tt.field) {
+					t.Errorf("422 body %q doesn't name %s", w.Body, tt.field)
+				}
+				if n := s.hub.published.Load(); n != 0 {
+					t.Errorf("%d events published from a rejected delivery", n)
+				}
+			})
+		})
+	}
+}
+
+// TestWebhookBatch checks an array is published whole or, when one of its
+// elements is invalid, not at all: nothing reaches the hub or the dedup
+// window, so the sender can fix the batch and send it again.
+func TestWebhookBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		// reason is in the body of a rejection.
+		reason string
+		want   []string
+	}{
+		{name: "all published", body: `[{"repo":"npub1a/one"},{"repo":"npub1a/two","type":"repo_pushed"}]`, status: http.StatusAccepted, want: []string{"repo_cloned npub1a/one", "repo_pushed npub1a/two"}},
+		{name: "one missing its repo", body: `[{"repo":"npub1a/one"},{"type":"repo_pushed"},{"repo":"npub1a/three"}]`, status: http.StatusBadRequest, reason: "event 1: missing repo"},
+		{name: "last one invalid", body: `[{"repo":"npub1a/one"},{"repo":"npub1a/two","ttl_seconds":-1}]`, status: http.StatusBadRequest, reason: "event 1: ttl_seconds must not be negative"},
+		{name: "bad pubkey", body: `[{"repo":"npub1a/one","pubkey":"nope"},{"repo":"npub1a/two"}]`, status: http.StatusBadRequest, reason: "event 0: pubkey"},
+		{name: "empty", body: `[]`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.reason) {
+				t.Errorf("body %q, want it to say %q", w.Body, tt.reason)
+			}
+			var got []string
+			for _, ev := range s.hub.recent() {
+				got = append(got, ev.Type+" "+ev.Repo)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("published %q, want %q", got, tt.want)
+			}
+			if tt.status == http.StatusAccepted {
+				return
+			}
+			// The valid elements weren't recorded as seen, so they go
+			// out when sent again within DEDUP_WINDOW.
+			w = httptest.NewRecorder()
+			s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(`{"repo":"npub1a/one"}`)))
+			if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"accepted"`) {
+				t.Errorf("resent element: status %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// TestWebhookPubkeyAndRef follows pubkey and ref from a webhook into the
+// event a filtered /events stream sends, and checks senders without them
+// still get through.
+func TestWebhookPubkeyAndRef(t *testing.T) {
+	owner := testNostrKey(t, 7)
+	hexKey := hex.EncodeToString(owner.PublicKey)
+	s := newTestServer(t, map[string]string{"DEDUP_WINDOW": "0"})
+	srv := serveTest(t, s)
+	_, br := openStream(t, srv.Client(), srv.URL+"/events?repo=npub1a/r", nil)
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+
+	tests := []struct {
+		name string
+		body string
+		// want is the event's pubkey and ref fields, absent when empty.
+		want map[string]any
+	}{
+		{name: "npub and ref", body: `{"repo":"npub1a/r","pubkey":"` + nostrkey.EncodeNpub(owner.PublicKey) + `","ref":"refs/heads/main"}`, want: map[string]any{"pubkey": hexKey, "ref": "refs/heads/main"}},
+		{name: "hex pubkey", body: `{"repo":"npub1a/r","pubkey":"` + hexKey + `"}`, want: map[string]any{"pubkey": hexKey}},
+		{name: "neither", body: `{"repo":"npub1a/r"}`, want: map[string]any{}},
+	}
+	// The filter still goes by repo: this one never reaches the stream.
+	if resp := postSigned(t, srv, []byte(`{"repo":"npub1a/other","pubkey":"`+hexKey+`","ref":"npub1a/r"}`)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("webhook: status %d", resp.StatusCode)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := postSigned(t, srv, []byte(tt.body)); resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("webhook: status %d", resp.StatusCode)
+			}
+			var ev map[string]any
+			if err := json.Unmarshal([]byte(readFrame(t, br).data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev["repo"] != "npub1a/r" {
+				t.Fatalf("event %v, want npub1a/r", ev)
+			}
+			for _, field := range []string{"pubkey", "ref"} {
+				if ev[field] != tt.want[field] {
+					t.Errorf("%s = %v, want %v", field, ev[field], tt.want[field])
+				}
+			}
+		})
+	}
+}
+
+func TestRepoFromPath(t *testing.T) {
+	tests := []struct {
+		escaped string
+		repo    string
+		wantErr bool
+	}{
+		{escaped: "/events/repo/npub1a/r", repo: "npub1a/r"},
+		{escaped: "/events/repo/npub1a%2Fr", repo: "npub1a/r"},
+		{escaped: "/events/repo/npub1a/my%20repo", repo: "npub1a/my repo"},
+		{escaped: "/events/repo/", wantErr: true},
+		{escaped: "/events/repo/npub1a/%2E%2E", wantErr: true},
+		{escaped: "/events/repo/npub1a%2F%2Fr", wantErr: true},
+		{escaped: "/events/repo/npub1a/r%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.escaped, func(t *testing.T) {
+			repo, err := repoFromPath(tt.escaped, "/events/repo/")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("accepted as %q", repo)
+				}
+				return
+			}
+			if err != nil || repo != tt.repo {
+				t.Fatalf("got %q, %v; want %q", repo, err, tt.repo)
+			}
+		})
+	}
+}
+
+// TestRepoScopedStream reads /events/repo/{repo} while other repos'
+// events are published around it, in the replay and live.
+func TestRepoScopedStream(t *testing.T) {
+	for _, path := range []string{"/events/repo/npub1a/r", "/events/repo/npub1a%2Fr"} {
+		t.Run(path, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"DEDUP_WINDOW": "0", "HEARTBEAT_INTERVAL": "0"})
+			srv := serveTest(t, s)
+			post := func(repo string) {
+				t.Helper()
+				if resp := postSigned(t, srv, []byte(`{"repo":"`+repo+`"}`)); resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("webhook: status %d", resp.StatusCode)
+				}
+			}
+			for _, repo := range []string{"npub1a/r", "npub1a/r2", "npub1b/r", "npub1a/r"} {
+				post(repo)
+			}
+
+			_, br := openStream(t, srv.Client(), srv.URL+path+"?compress=identity", http.Header{"Last-Event-ID": {"0"}})
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+			for _, repo := range []string{"npub1a/r2", "npub1b/r", "npub1a/r"} {
+				post(repo)
+			}
+			for _, wantID := range []string{"1", "4", "7"} {
+				f := readFrame(t, br)
+				var ev repoEvent
+				if err := json.Unmarshal([]byte(f.data), &ev); err != nil {
+					t.Fatal(err)
+				}
+				if f.id != wantID || ev.Repo != "npub1a/r" {
+					t.Fatalf("got id %s for %s, want id %s for npub1a/r", f.id, ev.Repo, wantID)
+				}
+			}
+		})
+	}
+}
+
+func TestOriginMatches(t *testing.T) {
+	const wildcard = "https://*.gittr.example"
+	tests := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"*", "https://anything.test", true},
+		{"https://gittr.example", "https://gittr.example", true},
+		{"https://gittr.example", "https://dash.gittr.example", false},
+		{wildcard, "https://dash.gittr.example", true},
+		{wildcard, "https://Dash.GITTR.example", true},
+		{wildcard, "https://x-1.gittr.example", true},
+		{wildcard, "https://gittr.example", false},
+		{wildcard, "https://a.b.gittr.example", false},
+		{wildcard, "http://dash.gittr.example", false},
+		{wildcard, "https://dash.gittr.example:8443", false},
+		{wildcard, "https://evil.com?.gittr.example", false},
+		{wildcard, "https://evil.com/.gittr.example", false},
+		{wildcard, "https://evil.com#.gittr.example", false},
+		{wildcard, "https://user@dash.gittr.example", false},
+		{wildcard, "https://dash.gittr.example.evil.com", false},
+		{wildcard, "https://evilgittr.example", false},
+		{wildcard, "https://-dash.gittr.example", false},
+		{wildcard, "https://da_sh.gittr.example", false},
+		{wildcard, "https://.gittr.example", false},
+	}
+	for _, tt := range tests {
+		if got := originMatches(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
+
+// TestSetCORS checks a match echoes the origin itself, never the pattern
+// or "*", and marks the response as varying by Origin.
+func TestSetCORS(t *testing.T) {
+	allowed := []string{"https://gittr.example", "https://*.gittr.example"}
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{origin: "https://gittr.example", want: "https://gittr.example"},
+		{origin: "https://dash.gittr.example", want: "https://dash.gittr.example"},
+		{origin: "https://evil.com?.gittr.example"},
+		{origin: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/events/recent", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			setCORS(w, r, allowed)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.want)
+			}
+			if vary := w.Header().Get("Vary"); (vary == "Origin") != (tt.want != "") {
+				t.Errorf("Vary %q", vary)
+			}
+		})
+	}
+}
+
+// TestMaxSubscribers fills MAX_SUBSCRIBERS with a stream and a WebSocket,
+// checks both kinds are turned away while it's full, and that closing one
+// frees its slot.
+func TestMaxSubscribers(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAX_SUBSCRIBERS": "2"})
+	srv := serveTest(t, s)
+	health := func() map[string]any {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var h map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	ctx, closeFirst := context.WithCancel(context.Background())
+	defer closeFirst()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+	if resp, _ := dialWS(t, srv, http.MethodGet, "/ws", nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("/ws within the limit: status %d", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 2 })
+	if h := health(); h["streams"] != 2.0 || h["max_subscribers"] != 2.0 {
+		t.Errorf("/health %v", h)
+	}
+
+	full := func(path string, resp *http.Response) {
+		t.Helper()
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+			t.Errorf("%s while full: status %d, Retry-After %q", path, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	resp, err := srv.Client().Get(srv.URL + "/events/repo/npub1a/r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full("/events/repo/npub1a/r", resp)
+	resp, _ = dialWS(t, srv, http.MethodGet, "/ws", nil)
+	full("/ws", resp)
+
+	closeFirst()
+	waitFor(t, func() bool { return s.hub.streamCount() == 1 })
+	_, br := openStream(t, srv.Client(), srv.URL+"/events", nil)
+	s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/after"}, 0)
+	if ev := readFrame(t, br); !strings.Contains(ev.data, "npub1a/after") {
+		t.Errorf("stream in the freed slot got %q", ev.data)
+	}
+	if h := health(); h["streams"] != 2.0 {
+		t.Errorf("/health %v", h)
+	}
+}
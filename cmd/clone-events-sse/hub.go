@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriberBuffer is how many events may queue for a slow subscriber before
+// publish starts dropping for it.
+const subscriberBuffer = 10
+
+// maxReplayPasses bounds subscribe's catch-up loop. Each pass replays what
+// was published during the previous one; under a sustained burst that
+// never runs dry, so the last pass attaches the channel before replaying.
+const maxReplayPasses = 4
+
+// eventSchemaVersion is emitted with every event as schema_version. Bump it
+// whenever a field is renamed, removed or changes meaning; purely additive
+// fields don't need a bump.
+const eventSchemaVersion = 1
+
+// repoEvent is what gets buffered and streamed to subscribers.
+type repoEvent struct {
+	SchemaVersion int `json:"schema_version"`
+	// ID is the hub-assigned publish order, strictly increasing; it is
+	// also the SSE frame id a reconnecting client sends back.
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Repo      string `json:"repo"`
+	Timestamp int64  `json:"timestamp"`
+	// Pubkey (hex) and Ref are the repo owner and the branch or ref
+	// involved, when the webhook said; older senders leave them out.
+	Pubkey string `json:"pubkey,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	// Sig is the detached per-event signature over repo and timestamp,
+	// set when EVENT_SIGNING_KEY is configured (see eventsig.go).
+	Sig string `json:"sig,omitempty"`
+	// Description and DefaultBranch come from the ENRICH_URL lookup and
+	// are left out when it isn't configured or didn't answer in time.
+	Description   string `json:"description,omitempty"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	// Origin names the upstream an aggregator received the event from.
+	Origin string `json:"origin,omitempty"`
+	// Truncated is set on a streamed frame whose metadata was dropped to
+	// stay under SSE_MAX_EVENT_BYTES.
+	Truncated bool `json:"truncated,omitempty"`
+	// BatchID and Repos are set on an aggregate event, which stands for
+	// every webhook of an X-Batch-ID batch (see batch.go); Repo is empty.
+	BatchID string   `json:"batch_id,omitempty"`
+	Repos   []string `json:"repos,omitempty"`
+	// Progress is set on the steps of a multi-repo operation such as a
+	// blossom-fetch-helper restore; Repo is the repo the step is about.
+	Progress *eventProgress `json:"progress,omitempty"`
+
+	// expires is when a transient event stops being replayed; zero means
+	// the event only leaves the buffer when pushed out by maxBuffer.
+	expires time.Time
+}
+
+// eventProgress says how far a multi-repo operation has got, so a UI can
+// draw a progress bar from the events alone.
+type eventProgress struct {
+	// ID ties together the events of one operation.
+	ID     string `json:"id"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Failed int    `json:"failed,omitempty"`
+}
+
+// validate accepts a nil progress; a set one needs an ID and counts that
+// add up.
+func (p *eventProgress) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.ID == "" {
+		return errors.New("progress.id is required")
+	}
+	if p.Done < 0 || p.Failed < 0 || p.Done+p.Failed > p.Total {
+		return errors.New("progress counts must be non-negative and done+failed at most total")
+	}
+	return nil
+}
+
+func (ev repoEvent) expired(now time.Time) bool {
+	return !ev.expires.IsZero() && !now.Before(ev.expires)
+}
+
+// control reports whether ev is a message from broadcastAll rather than a
+// published event. It has no ID, so it never moves a client's resume
+// point, and it goes to every subscriber whatever its filter.
+func (ev repoEvent) control() bool {
+	return ev.ID == 0
+}
+
+// eventHub fans published events out to every subscriber and keeps the last
+// maxBuffer events so new subscribers can catch up.
+type eventHub struct {
+	mu sync.RWMutex
+	// subscribers maps each live channel to the number of events in a row
+	// it has missed because it was full.
+	subscribers map[chan repoEvent]int
+	// buffer holds the last maxBuffer events, plus up to maxBuffer older
+	// ones that publish hasn't trimmed yet: trimming is coalesced into
+	// one copy every maxBuffer events instead of a reslice per publish.
+	// Only bufferedLocked is the buffer proper.
+	buffer    []repoEvent
+	maxBuffer int
+	// maxDrops is how many events in a row a subscriber may miss before
+	// it is evicted (SUBSCRIBER_MAX_DROPS); 0 never evicts.
+	maxDrops int
+	// maxSubscribers caps open streams (MAX_SUBSCRIBERS); 0 is
+	// unlimited. Set before the hub is in use.
+	maxSubscribers int
+	// streams counts the slots taken with admit: every open /events
+	// stream and /ws connection, from before its replay until its handler
+	// returns, so it covers connections subscribers doesn't, such as one
+	// just evicted that is still closing.
+	streams int
+	// maxAge, when positive, expires every event that long after its
+	// timestamp (EVENT_TTL), shortening any longer TTL it has. Set before
+	// the hub is in use.
+	maxAge time.Duration
+	// seq is the sequence number of the last published event.
+	seq int64
+	// trimmedSeq is the newest event pushed out of the buffer by newer
+	// ones, for subscribe to notice a replay that was overtaken.
+	trimmedSeq int64
+	// published counts events published since start. Unlike seq it isn't
+	// carried over by restore, and it can be read without the lock.
+	published atomic.Int64
+	// evicted counts subscribers dropped for falling behind.
+	evicted atomic.Int64
+	// replayGaps counts subscribers whose catch-up replay was overtaken
+	// by a burst larger than the buffer, so they missed events.
+	replayGaps atomic.Int64
+	// taps see every published event after its ID is assigned
+	// (EVENT_STDOUT, BUFFER_CHECKPOINT_EVERY). They run under the lock, so
+	// they must not block, and are set before the hub is in use.
+	taps []func(repoEvent)
+}
+
+func newEventHub(maxBuffer, maxDrops int) *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan repoEvent]int),
+		maxBuffer:   maxBuffer,
+		maxDrops:    maxDrops,
+	}
+}
+
+// publish buffers ev and hands it to every subscriber without blocking; a
+// subscriber whose channel is full misses the event. One that has missed
+// maxDrops in a row is evicted: its channel is closed, which ends its
+// stream, and on reconnecting with Last-Event-ID it gets the events it
+// missed replayed from the buffer instead of a silent gap.
+func (h *eventHub) publish(ev repoEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	h.published.Add(1)
+	ev.ID = h.seq
+	ev.SchemaVersion = eventSchemaVersion
+	ev.expires = h.capExpiry(ev)
+	for _, tap := range h.taps {
+		tap(ev)
+	}
+	h.buffer = append(h.buffer, ev)
+	h.dropExpiredHeadLocked(time.Now())
+	if len(h.buffer) > h.maxBuffer {
+		h.trimmedSeq = h.buffer[len(h.buffer)-h.maxBuffer-1].ID
+	}
+	h.trimLocked(h.maxBuffer)
+	for ch, drops := range h.subscribers {
+		select {
+		case ch <- ev:
+			h.subscribers[ch] = 0
+		default:
+			drops++
+			if h.maxDrops > 0 && drops >= h.maxDrops {
+				delete(h.subscribers, ch)
+				close(ch)
+				h.evicted.Add(1)
+				slog.Warn("evicted slow subscriber", "dropped", drops, "subscribers", len(h.subscribers))
+				continue
+			}
+			h.subscribers[ch] = drops
+		}
+	}
+}
+
+// capExpiry returns ev's expiry shortened to maxAge after its timestamp.
+// Events without a timestamp are aged from now.
+func (h *eventHub) capExpiry(ev repoEvent) time.Time {
+	if h.maxAge <= 0 {
+		return ev.expires
+	}
+	born := time.Now()
+	if ev.Timestamp > 0 {
+		born = time.Unix(ev.Timestamp, 0)
+	}
+	if limit := born.Add(h.maxAge); ev.expires.IsZero() || limit.Before(ev.expires) {
+		return limit
+	}
+	return ev.expires
+}
+
+// dropExpiredHeadLocked drops expired events from the old end of the
+// buffer. Events mostly expire in publish order, so this keeps the buffer
+// short between sweeps at the cost of a comparison or two per publish;
+// expired events further in wait for the sweeper.
+func (h *eventHub) dropExpiredHeadLocked(now time.Time) {
+	n := 0
+	for n < len(h.buffer) && h.buffer[n].expired(now) {
+		n++
+	}
+	if n > 0 {
+		clear(h.buffer[:n])
+		h.buffer = h.buffer[n:]
+	}
+}
+
+// trimLocked drops all but the last maxBuffer events once more than slack
+// extra have piled up, copying them to the front of the same array so a
+// steady stream of publishes doesn't keep reallocating it.
+func (h *eventHub) trimLocked(slack int) {
+	if len(h.buffer) <= h.maxBuffer+slack {
+		return
+	}
+	n := copy(h.buffer, h.buffer[len(h.buffer)-h.maxBuffer:])
+	clear(h.buffer[n:])
+	h.buffer = h.buffer[:n]
+}
+
+// bufferedLocked is the buffer proper: the last maxBuffer events, expired
+// ones included.
+func (h *eventHub) bufferedLocked() []repoEvent {
+	if len(h.buffer) > h.maxBuffer {
+		return h.buffer[len(h.buffer)-h.maxBuffer:]
+	}
+	return h.buffer
+}
+
+// subscribe hands the buffered (unexpired) events to replay, then attaches
+// a live channel. The buffer is copied under the lock and replayed outside
+// it; anything published meanwhile is picked up by another pass, and the
+// channel is attached under the same lock that observed no further events.
+// The subscriber therefore sees every event exactly once, in publish order,
+// with no gap or duplicate at the replay/live boundary.
+//
+// A burst that outpaces replay would keep that loop going, so after
+// maxReplayPasses the channel is attached under the lock that copies the
+// last batch, and that batch is replayed while live events queue on the
+// channel (and may be dropped, as for any slow subscriber). If a burst
+// larger than the buffer overtook a pass, the events in between are gone;
+// that is logged and counted rather than hidden.
+//
+// If replay fails the subscriber is never attached. Replay starts after
+// id last, as in since.
+func (h *eventHub) subscribe(last int64, replay func([]repoEvent) error) (chan repoEvent, error) {
+	for pass := 1; ; pass++ {
+		h.mu.Lock()
+		pending := h.sinceLocked(last, time.Now())
+		var ch chan repoEvent
+		if len(pending) == 0 || pass == maxReplayPasses {
+			ch = make(chan repoEvent, subscriberBuffer)
+			h.subscribers[ch] = 0
+		}
+		if pass > 1 && h.trimmedSeq > last {
+			h.replayGaps.Add(1)
+			slog.Warn("subscriber missed events: a burst overran MAX_BUFFER during replay", "from", last+1, "to", h.trimmedSeq)
+		}
+		h.mu.Unlock()
+
+		if len(pending) > 0 {
+			if err := replay(pending); err != nil {
+				if ch != nil {
+					h.unsubscribe(ch)
+				}
+				return nil, err
+			}
+			last = pending[len(pending)-1].ID
+		}
+		if ch != nil {
+			return ch, nil
+		}
+	}
+}
+
+// broadcastAll sends a control message to every live subscriber. It
+// bypasses the buffer, the taps and the sequence, so nothing replays or
+// forwards it. A subscriber whose queue is full doesn't get it and isn't
+// penalized. It returns how many subscribers it reached.
+func (h *eventHub) broadcastAll(ev repoEvent) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ev.SchemaVersion = eventSchemaVersion
+	ev.ID = 0
+	n := 0
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+			n++
+		default:
+		}
+	}
+	return n
+}
+
+// closeSubscribers ends every live subscription, as if each had been
+// evicted, and returns how many there were.
+func (h *eventHub) closeSubscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := len(h.subscribers)
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	return n
+}
+
+func (h *eventHub) unsubscribe(ch chan repoEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// recent returns a copy of the unexpired buffered events, oldest first.
+func (h *eventHub) recent() []repoEvent {
+	return h.since(0)
+}
+
+// since returns the unexpired buffered events with an id above id, oldest
+// first. An id older than the buffer gets everything still held. An id
+// the hub hasn't reached can't have come from it (a client of another
+// instance, or one from before a restart that lost the buffer), so it
+// gets the whole buffer too rather than nothing.
+func (h *eventHub) since(id int64) []repoEvent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sinceLocked(id, time.Now())
+}
+
+// poll is since plus the sequence number it was taken at: the id a poller
+// resumes from, which may be past the last returned event when the newest
+// ones have expired.
+func (h *eventHub) poll(id int64) ([]repoEvent, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sinceLocked(id, time.Now()), h.seq
+}
+
+func (h *eventHub) sinceLocked(id int64, now time.Time) []repoEvent {
+	if id < 0 || id > h.seq {
+		id = 0
+	}
+	return h.afterLocked(id, now)
+}
+
+func (h *eventHub) liveLocked(now time.Time) []repoEvent {
+	return h.afterLocked(0, now)
+}
+
+// afterLocked returns the unexpired buffered events published after seq.
+func (h *eventHub) afterLocked(seq int64, now time.Time) []repoEvent {
+	buf := h.bufferedLocked()
+	out := make([]repoEvent, 0, len(buf))
+	for _, ev := range buf {
+		if ev.ID > seq && !ev.expired(now) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// admit takes a stream slot, reporting false when maxSubscribers are
+// already taken. Every successful admit must be paired with a leave.
+func (h *eventHub) admit() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxSubscribers > 0 && h.streams >= h.maxSubscribers {
+		return false
+	}
+	h.streams++
+	return true
+}
+
+func (h *eventHub) leave() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.streams--
+}
+
+// streamCount is the number of slots taken with admit.
+func (h *eventHub) streamCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.streams
+}
+
+func (h *eventHub) subscriberCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers)
+}
+
+func (h *eventHub) bufferedCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.bufferedLocked())
+}
+
+// sweepExpired drops transient events whose TTL has passed and reports how
+// many were removed. Events without a TTL are never touched here.
+func (h *eventHub) sweepExpired(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.trimLocked(0)
+	kept := h.buffer[:0]
+	for _, ev := range h.buffer {
+		if !ev.expired(now) {
+			kept = append(kept, ev)
+		}
+	}
+	removed := len(h.buffer) - len(kept)
+	for i := len(kept); i < len(h.buffer); i++ {
+		h.buffer[i] = repoEvent{}
+	}
+	h.buffer = kept
+	return removed
+}
+
+// runSweeper calls sweepExpired every interval until ctx is done.
+func (h *eventHub) runSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.sweepExpired(now)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func repos(evs []repoEvent) []string {
+	out := make([]string, len(evs))
+	for i, ev := range evs {
+		out[i] = ev.Repo
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTransientEventsLeaveReplay(t *testing.T) {
+	h := newEventHub(10, 0)
+	now := time.Now()
+	h.publish(repoEvent{Repo: "kept-1"})
+	h.publish(repoEvent{Repo: "ttl-1m", expires: now.Add(time.Minute)})
+	h.publish(repoEvent{Repo: "kept-2"})
+	h.publish(repoEvent{Repo: "ttl-2m", expires: now.Add(2 * time.Minute)})
+
+	tests := []struct {
+		at   time.Duration
+		want []string
+	}{
+		{0, []string{"kept-1", "ttl-1m", "kept-2", "ttl-2m"}},
+		{90 * time.Second, []string{"kept-1", "kept-2", "ttl-2m"}},
+		{3 * time.Minute, []string{"kept-1", "kept-2"}},
+	}
+	for _, tt := range tests {
+		h.mu.RLock()
+		got := repos(h.sinceLocked(0, now.Add(tt.at)))
+		h.mu.RUnlock()
+		if !equalStrings(got, tt.want) {
+			t.Errorf("replay %s on = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	if n := h.sweepExpired(now.Add(90 * time.Second)); n != 1 {
+		t.Errorf("sweep removed %d events, want 1", n)
+	}
+	if n := h.bufferedCount(); n != 3 {
+		t.Errorf("%d events buffered after the sweep, want 3", n)
+	}
+}
+
+func TestEventTTL(t *testing.T) {
+	cfg := config{typeTTL: map[string]time.Duration{"repo_cloning": 30 * time.Second}}
+	tests := []struct {
+		name string
+		p    webhookPayload
+		want time.Duration
+	}{
+		{"no ttl", webhookPayload{Type: "repo_cloned"}, 0},
+		{"type default", webhookPayload{Type: "repo_cloning"}, 30 * time.Second},
+		{"ttl_seconds", webhookPayload{Type: "repo_cloned", TTLSeconds: 5}, 5 * time.Second},
+		{"ttl_seconds beats the type default", webhookPayload{Type: "repo_cloning", TTLSeconds: 90}, 90 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.eventTTL(tt.p); got != tt.want {
+				t.Errorf("eventTTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHubMaxAgeCapsTTL(t *testing.T) {
+	h := newEventHub(10, 0)
+	h.maxAge = time.Minute
+	born := time.Now().Add(-30 * time.Second)
+	h.publish(repoEvent{Repo: "long", Timestamp: born.Unix(), expires: born.Add(time.Hour)})
+	h.publish(repoEvent{Repo: "short", Timestamp: born.Unix(), expires: born.Add(10 * time.Second)})
+	h.publish(repoEvent{Repo: "none", Timestamp: born.Unix()})
+	want := map[string]time.Time{
+		"long":  time.Unix(born.Unix(), 0).Add(time.Minute),
+		"short": born.Add(10 * time.Second),
+		"none":  time.Unix(born.Unix(), 0).Add(time.Minute),
+	}
+	for _, ev := range h.buffer {
+		if !ev.expires.Equal(want[ev.Repo]) {
+			t.Errorf("%s expires %s, want %s", ev.Repo, ev.expires, want[ev.Repo])
+		}
+	}
+}
+
+// TestEventTTLAgesOut checks EVENT_TTL drops events by their timestamp
+// however much room the buffer has, and that without it they stay.
+func TestEventTTLAgesOut(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		// sweepAt is when the sweeper runs, from now.
+		sweepAt time.Duration
+		// published and swept are what's buffered after the publishes
+		// and after the sweep.
+		published, swept []string
+	}{
+		{name: "no EVENT_TTL", sweepAt: time.Hour, published: []string{"2h", "50s", "new"}, swept: []string{"2h", "50s", "new"}},
+		{name: "old on arrival", maxAge: time.Minute, published: []string{"50s", "new"}, swept: []string{"50s", "new"}},
+		{name: "aged by the sweeper", maxAge: time.Minute, sweepAt: 15 * time.Second, published: []string{"50s", "new"}, swept: []string{"new"}},
+		{name: "all aged", maxAge: time.Minute, sweepAt: 2 * time.Minute, published: []string{"50s", "new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newEventHub(10, 0)
+			h.maxAge = tt.maxAge
+			h.publish(repoEvent{Repo: "2h", Timestamp: ago(2 * time.Hour)})
+			h.publish(repoEvent{Repo: "50s", Timestamp: ago(50 * time.Second)})
+			h.publish(repoEvent{Repo: "new", Timestamp: now.Unix()})
+			h.mu.RLock()
+			got := repos(h.bufferedLocked())
+			h.mu.RUnlock()
+			if !equalStrings(got, tt.published) {
+				t.Errorf("buffered %v, want %v", got, tt.published)
+			}
+			h.sweepExpired(now.Add(tt.sweepAt))
+			h.mu.RLock()
+			got = repos(h.bufferedLocked())
+			h.mu.RUnlock()
+			if !equalStrings(got, tt.swept) {
+				t.Errorf("after the sweep %v, want %v", got, tt.swept)
+			}
+		})
+	}
+
+	for _, bad := range []string{"-1m", "ten minutes"} {
+		t.Run("EVENT_TTL="+bad, func(t *testing.T) {
+			t.Setenv("WEBHOOK_SECRET", "s3cret")
+			t.Setenv("EVENT_TTL", bad)
+			if _, err := loadConfig(); err == nil {
+				t.Error("loadConfig accepted it")
+			}
+		})
+	}
+}
+
+// TestBroadcastAll checks a control message reaches subscribers without
+// touching the buffer, the sequence or the taps, and that one whose queue
+// is full is skipped without counting as a drop.
+func TestBroadcastAll(t *testing.T) {
+	h := newEventHub(10, 1)
+	tapped := 0
+	h.taps = append(h.taps, func(repoEvent) { tapped++ })
+	h.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"})
+	idle, err := h.subscribe(1, func([]repoEvent) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := h.subscribe(1, func([]repoEvent) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(busy) < cap(busy) {
+		busy <- repoEvent{Repo: "queued"}
+	}
+
+	if n := h.broadcastAll(repoEvent{Type: "server_shutdown", Repo: "ignored", ID: 42}); n != 1 {
+		t.Errorf("broadcastAll reached %d subscribers, want 1", n)
+	}
+	select {
+	case ev := <-idle:
+		if ev.Type != "server_shutdown" || ev.ID != 0 || ev.SchemaVersion != eventSchemaVersion {
+			t.Errorf("received %+v", ev)
+		}
+	default:
+		t.Fatal("idle subscriber got nothing")
+	}
+	if h.seq != 1 || h.bufferedCount() != 1 || tapped != 1 {
+		t.Errorf("seq %d, %d buffered, %d tapped; want the one published event only", h.seq, h.bufferedCount(), tapped)
+	}
+	if n := h.subscriberCount(); n != 2 {
+		t.Errorf("%d subscribers left, want the busy one kept too", n)
+	}
+	h.mu.RLock()
+	drops := h.subscribers[busy]
+	h.mu.RUnlock()
+	if drops != 0 {
+		t.Errorf("busy subscriber charged %d drops", drops)
+	}
+}
+
+// TestWebhookTTL posts a transient event and checks its expiry is set from
+// ttl_seconds.
+func TestWebhookTTL(t *testing.T) {
+	s := newTestServer(t, nil)
+	before := time.Now()
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, signedWebhook(t, "s3cret", []byte(`{"repo":"npub1a/r","type":"repo_cloning","ttl_seconds":60}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	evs := s.hub.recent()
+	if len(evs) != 1 {
+		t.Fatalf("%d events buffered, want 1", len(evs))
+	}
+	exp := evs[0].expires
+	if exp.Before(before.Add(59*time.Second)) || exp.After(time.Now().Add(61*time.Second)) {
+		t.Errorf("expires %s, want a minute from %s", exp, before)
+	}
+}
+
+// TestSubscribeOrderingUnderConcurrentPublish subscribes while events are
+// being published and checks every subscriber sees each event once, in
+// publish order, across the replay/live boundary. The publisher waits for
+// room in every subscriber channel, so no event is dropped for being slow
+// and any gap or duplicate is subscribe's.
+func TestSubscribeOrderingUnderConcurrentPublish(t *testing.T) {
+	const total = 2000
+	h := newEventHub(total, 0)
+
+	waitForRoom := func() {
+		for {
+			h.mu.RLock()
+			full := false
+			for ch := range h.subscribers {
+				if len(ch) == cap(ch) {
+					full = true
+				}
+			}
+			h.mu.RUnlock()
+			if !full {
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+	published := make(chan int64, total)
+	go func() {
+		for i := 1; i <= total; i++ {
+			waitForRoom()
+			h.publish(repoEvent{Type: "repo_cloned", Repo: fmt.Sprintf("r%d", i)})
+			published <- int64(i)
+		}
+		close(published)
+	}()
+
+	type result struct {
+		from int64
+		ids  []int64
+		err  error
+	}
+	results := make(chan result)
+	subscribers := 0
+	for start := range published {
+		// Subscribe at a spread of points, some from the start of the
+		// buffer and some resuming mid-stream, with replays slow enough
+		// that publishing overtakes them.
+		if start%100 != 0 {
+			continue
+		}
+		subscribers++
+		from := int64(0)
+		if start%200 == 0 {
+			from = start - 50
+		}
+		slow := start%300 == 0
+		go func() {
+			var ids []int64
+			ch, err := h.subscribe(from, func(evs []repoEvent) error {
+				if slow {
+					time.Sleep(time.Millisecond)
+				}
+				for _, ev := range evs {
+					ids = append(ids, ev.ID)
+				}
+				return nil
+			})
+			if err != nil {
+				results <- result{from: from, err: err}
+				return
+			}
+			defer h.unsubscribe(ch)
+			for len(ids) == 0 || ids[len(ids)-1] < total {
+				ev, ok := <-ch
+				if !ok {
+					results <- result{from: from, ids: ids, err: errors.New("channel closed")}
+					return
+				}
+				ids = append(ids, ev.ID)
+			}
+			results <- result{from: from, ids: ids}
+		}()
+	}
+	for i := 0; i < subscribers; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("subscriber from %d: %v", r.from, r.err)
+			continue
+		}
+		for j, id := range r.ids {
+			if want := r.from + int64(j) + 1; id != want {
+				t.Errorf("subscriber from %d: event %d has id %d, want %d", r.from, j, id, want)
+				break
+			}
+		}
+	}
+	if n := h.replayGaps.Load(); n != 0 {
+		t.Errorf("%d replay gaps counted", n)
+	}
+}
+
+// checkRun reports the first way ids isn't a run of consecutive ids
+// starting after after, or "".
+func checkRun(ids []int64, after int64) string {
+	for i, id := range ids {
+		if id != after+int64(i)+1 {
+			return fmt.Sprintf("id %d at %d, want %d", id, i, after+int64(i)+1)
+		}
+	}
+	return ""
+}
+
+// TestBurstPastBufferWithSubscribers publishes a burst many times
+// MAX_BUFFER from several goroutines while subscribers keep joining and
+// snapshots are taken. It is meant for -race: beyond not racing, every
+// snapshot and replay batch must be a consecutive run no longer than the
+// buffer, and every subscriber must see ids strictly increasing, gaps
+// only where it was too slow.
+func TestBurstPastBufferWithSubscribers(t *testing.T) {
+	const (
+		maxBuffer   = 50
+		publishers  = 4
+		perProducer = 5000
+		subscribers = 64
+	)
+	tests := []struct {
+		name     string
+		maxDrops int
+	}{
+		{name: "slow subscribers kept"},
+		{name: "slow subscribers evicted", maxDrops: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newEventHub(maxBuffer, tt.maxDrops)
+			done := make(chan struct{})
+
+			var pubs sync.WaitGroup
+			for p := 0; p < publishers; p++ {
+				pubs.Add(1)
+				go func(p int) {
+					defer pubs.Done()
+					for i := 0; i < perProducer; i++ {
+						h.publish(repoEvent{Type: "repo_cloned", Repo: fmt.Sprintf("npub1a/p%d-%d", p, i)})
+					}
+				}(p)
+			}
+
+			snapshotErr := make(chan string, 1)
+			go func() {
+				defer close(snapshotErr)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					snap := h.recent()
+					if len(snap) > maxBuffer {
+						snapshotErr <- fmt.Sprintf("snapshot of %d events", len(snap))
+						return
+					}
+					if len(snap) > 0 {
+						if msg := checkRun(repoIDs(snap), snap[0].ID-1); msg != "" {
+							snapshotErr <- "snapshot: " + msg
+							return
+						}
+					}
+				}
+			}()
+
+			type result struct {
+				ids    []int64
+				closed bool
+				err    string
+			}
+			results := make(chan result, subscribers)
+			var subs sync.WaitGroup
+			for i := 0; i < subscribers; i++ {
+				_, seq := h.poll(0)
+				from := []int64{0, seq - 10, seq + 1000}[i%3]
+				subs.Add(1)
+				go func() {
+					defer subs.Done()
+					var r result
+					last := int64(0)
+					ch, err := h.subscribe(from, func(evs []repoEvent) error {
+						ids := repoIDs(evs)
+						if len(ids) > maxBuffer {
+							return fmt.Errorf("replay batch of %d events", len(ids))
+						}
+						if msg := checkRun(ids, ids[0]-1); msg != "" {
+							return errors.New("replay batch: " + msg)
+						}
+						if ids[0] <= last {
+							return fmt.Errorf("replay batch starts at %d after %d", ids[0], last)
+						}
+						last = ids[len(ids)-1]
+						r.ids = append(r.ids, ids...)
+						return nil
+					})
+					if err != nil {
+						r.err = err.Error()
+						results <- r
+						return
+					}
+					defer h.unsubscribe(ch)
+					for {
+						var ev repoEvent
+						var ok bool
+						select {
+						case ev, ok = <-ch:
+						case <-done:
+							// Everything is published; take what's queued.
+							select {
+							case ev, ok = <-ch:
+							default:
+								results <- r
+								return
+							}
+						}
+						if !ok {
+							r.closed = true
+							results <- r
+							return
+						}
+						if ev.ID <= last {
+							r.err = fmt.Sprintf("live id %d after %d", ev.ID, last)
+							results <- r
+							return
+						}
+						last = ev.ID
+						r.ids = append(r.ids, ev.ID)
+					}
+				}()
+				runtime.Gosched()
+			}
+
+			pubs.Wait()
+			close(done)
+			subs.Wait()
+			close(results)
+			if msg := <-snapshotErr; msg != "" {
+				t.Error(msg)
+			}
+			closed := 0
+			for r := range results {
+				if r.err != "" {
+					t.Error(r.err)
+				}
+				if r.closed {
+					closed++
+				}
+			}
+
+			const total = publishers * perProducer
+			if n := h.published.Load(); n != total {
+				t.Errorf("published %d, want %d", n, total)
+			}
+			if msg := checkRun(repoIDs(h.recent()), total-maxBuffer); msg != "" || h.bufferedCount() != maxBuffer {
+				t.Errorf("buffer after the burst isn't the last %d events: %s", maxBuffer, msg)
+			}
+			if tt.maxDrops == 0 && closed > 0 {
+				t.Errorf("%d subscribers cut off with eviction off", closed)
+			}
+			if n := h.evicted.Load(); n != int64(closed) {
+				t.Errorf("%d evictions counted, %d subscribers saw their channel closed", n, closed)
+			}
+		})
+	}
+}
+
+func repoIDs(evs []repoEvent) []int64 {
+	ids := make([]int64, len(evs))
+	for i, ev := range evs {
+		ids[i] = ev.ID
+	}
+	return ids
+}
@@ -0,0 +1,774 @@
+// Command clone-events-sse turns "repo cloned" webhooks into a Server-Sent
+// Events stream so dashboards can show clone activity live.
+//
+// Endpoints:
+//
+//	GET  /events                 text/event-stream of buffered + live events
+//	GET  /events/recent          JSON array of buffered events
+//	POST /webhooks/repo-cloned   HMAC-signed webhook that publishes an event
+//	GET  /health                 liveness plus subscriber/buffer counts
+//	GET  /admin/export           buffer snapshot (with ADMIN_TOKEN)
+//	POST /admin/import           seed the buffer from a snapshot
+//
+// Configuration is read from the environment; see README.md. Run with
+// --selftest to check it without starting the server, or with --sign to
+// compute a webhook signature for the payload on stdin.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// shutdownTimeout bounds how long in-flight requests get to finish.
+const shutdownTimeout = 5 * time.Second
+
+type config struct {
+	port          string
+	webhookSecret string
+	// adminToken enables /admin/export and /admin/import for moving the
+	// buffer between instances during a deploy.
+	adminToken string
+	// shutdownGrace keeps accepting webhooks this long after SIGTERM,
+	// with streams already closed (see drain).
+	shutdownGrace time.Duration
+	// nostrRelay, when set, also broadcasts events to this relay, signed
+	// with nostrKey as kind nostrKind events.
+	nostrRelay string
+	nostrKey   *nostrkey.SecretKey
+	nostrKind  int
+	// nostrSource, when set, publishes the events of a Nostr relay
+	// subscription alongside webhooks.
+	nostrSource *nostrSource
+	// eventsToken, when set, is required to read events (see
+	// requireEventsToken).
+	eventsToken string
+	// senders are the tenants allowed to post webhooks, including the
+	// WEBHOOK_SECRET "default" sender.
+	senders []*webhookSender
+	// eventSigningKey, when set, adds a detached signature to every
+	// published event so downstreams can check it end to end.
+	eventSigningKey string
+	allowOrigins    []string
+	maxBuffer       int
+	// subscriberMaxDrops evicts a subscriber that missed that many events
+	// in a row; 0 never does.
+	subscriberMaxDrops int
+	// maxSubscribers caps open streams across all clients; 0 is
+	// unlimited.
+	maxSubscribers int
+	// sseRetryMS is the reconnect delay /events streams ask EventSource
+	// for, in milliseconds; 0 leaves it to the browser.
+	sseRetryMS int
+	// maxEventBytes caps a streamed event's JSON; see frameCache.encode.
+	maxEventBytes int
+	// typeTTL is the default lifetime per event type (EVENT_TYPE_TTL);
+	// types not listed stay buffered until pushed out by maxBuffer.
+	typeTTL map[string]time.Duration
+	// maxEventAge caps every event's lifetime (EVENT_TTL); 0 leaves
+	// events without a TTL to maxBuffer.
+	maxEventAge   time.Duration
+	sweepInterval time.Duration
+	accessLog     bool
+	// strictFields rejects webhooks carrying fields events don't have,
+	// instead of silently dropping them.
+	strictFields bool
+	// strictHeaders rejects webhooks whose headers already show they'd
+	// fail, before reading the body (see preface.go).
+	strictHeaders bool
+	// maxWebhookBody caps a webhook body after decompression; bodies over
+	// spoolThreshold are buffered in a temp file rather than in memory.
+	maxWebhookBody int64
+	spoolThreshold int64
+	// emitFilter drops accepted webhooks that aren't worth publishing.
+	emitFilter emitFilter
+	// dedupWindow drops a webhook repeating a type and repo published
+	// this recently.
+	dedupWindow time.Duration
+	// webhookTimeout bounds the processing of one webhook request.
+	webhookTimeout time.Duration
+	// webhookRate is how many webhooks per second one client IP may send,
+	// with bursts of up to webhookBurst; zero disables the limit.
+	webhookRate  float64
+	webhookBurst int
+	// maxSkew is how far a webhook's X-Timestamp may be from now.
+	maxSkew time.Duration
+	// idempotencyTTL is how long an Idempotency-Key is remembered;
+	// idempotencyMaxKeys bounds how many are.
+	idempotencyTTL     time.Duration
+	idempotencyMaxKeys int
+	// aggregateWindow is how long X-Batch-ID webhooks are collected before
+	// their aggregate event is published; zero publishes each one.
+	aggregateWindow time.Duration
+	// reapInterval is how often an idle stream is probed so connections
+	// whose client silently died are noticed without waiting for an event;
+	// zero disables probing.
+	reapInterval time.Duration
+	// reapJitter randomizes each probe interval by up to this fraction.
+	reapJitter float64
+	// heartbeatInterval is how often a quiet stream gets a keepalive
+	// comment, for proxies that drop idle connections; zero disables it.
+	heartbeatInterval time.Duration
+	// maxConnsPerIP caps concurrent /events streams per client IP; zero
+	// means no cap.
+	maxConnsPerIP int
+	// trustedProxies are the peers whose X-Forwarded-For is believed when
+	// working out a client's IP (see clientIP).
+	trustedProxies []*net.IPNet
+
+	// Server timeouts guard against slowloris-style clients. writeTimeout
+	// applies to ordinary requests only; /events clears it per stream.
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	maxHeaderBytes    int
+
+	// bufferFile persists the buffer across restarts, checkpointed every
+	// checkpointInterval and once more on shutdown.
+	bufferFile         string
+	checkpointInterval time.Duration
+	// checkpointEvery also checkpoints after that many new events.
+	checkpointEvery int
+	// bufferLoad limits which events of BUFFER_FILE are loaded at start.
+	bufferLoad bufferLoadFilter
+
+	// eventsUnixSocket additionally serves the event stream on a Unix
+	// domain socket for co-located consumers.
+	eventsUnixSocket string
+
+	// tlsCertFile and tlsKeyFile serve HTTPS on PORT instead of plain
+	// HTTP.
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsRedirectPort, set with TLS_REDIRECT, also listens for plain HTTP
+	// there and redirects it to https.
+	tlsRedirectPort string
+
+	// upstreams are other instances' /events streams merged into this
+	// hub (aggregator mode, see aggregate.go).
+	upstreams []upstream
+
+	// forwardTargets receive a copy of every accepted webhook.
+	forwardTargets []forwardTarget
+
+	// enrichURL, when set, is looked up for every webhook to add repo
+	// metadata to the event (see enrich.go).
+	enrichURL      string
+	enrichTimeout  time.Duration
+	enrichCacheTTL time.Duration
+
+	// keyMap renames event JSON keys on output (EVENT_KEY_MAP).
+	keyMap map[string]string
+
+	// eventStdout also writes every published event to stdout as a JSON
+	// line.
+	eventStdout bool
+}
+
+func loadConfig() (config, error) {
+	cfg := config{
+		port:             envOr("PORT", "8080"),
+		webhookSecret:    os.Getenv("WEBHOOK_SECRET"),
+		adminToken:       os.Getenv("ADMIN_TOKEN"),
+		eventsToken:      os.Getenv("EVENTS_TOKEN"),
+		eventSigningKey:  os.Getenv("EVENT_SIGNING_KEY"),
+		allowOrigins:     envList("ALLOW_ORIGINS"),
+		accessLog:        envBool("ACCESS_LOG"),
+		strictFields:     envBool("STRICT_FIELDS"),
+		strictHeaders:    envBool("WEBHOOK_STRICT_HEADERS"),
+		eventStdout:      envBool("EVENT_STDOUT"),
+		eventsUnixSocket: os.Getenv("EVENTS_UNIX_SOCKET"),
+		tlsCertFile:      os.Getenv("TLS_CERT_FILE"),
+		tlsKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		bufferFile:       os.Getenv("BUFFER_FILE"),
+	}
+	var err error
+	if cfg.maxBuffer, err = envInt("MAX_BUFFER", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.maxBuffer < 1 {
+		return cfg, fmt.Errorf("MAX_BUFFER must be at least 1")
+	}
+	if cfg.subscriberMaxDrops, err = envInt("SUBSCRIBER_MAX_DROPS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.subscriberMaxDrops < 0 {
+		return cfg, fmt.Errorf("SUBSCRIBER_MAX_DROPS must not be negative")
+	}
+	if cfg.maxSubscribers, err = envInt("MAX_SUBSCRIBERS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.maxSubscribers < 0 {
+		return cfg, fmt.Errorf("MAX_SUBSCRIBERS must not be negative")
+	}
+	if cfg.sseRetryMS, err = envInt("SSE_RETRY_MS", 3000); err != nil {
+		return cfg, err
+	}
+	if cfg.sseRetryMS < 0 {
+		return cfg, fmt.Errorf("SSE_RETRY_MS must not be negative")
+	}
+	if cfg.maxEventBytes, err = envInt("SSE_MAX_EVENT_BYTES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.maxEventBytes < 0 {
+		return cfg, fmt.Errorf("SSE_MAX_EVENT_BYTES must not be negative")
+	}
+	if cfg.typeTTL, err = parseTypeTTLs(os.Getenv("EVENT_TYPE_TTL")); err != nil {
+		return cfg, err
+	}
+	if cfg.maxEventAge, err = envDuration("EVENT_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.maxEventAge < 0 {
+		return cfg, fmt.Errorf("EVENT_TTL must not be negative")
+	}
+	if cfg.sweepInterval, err = envDuration("EVENT_SWEEP_INTERVAL", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.sweepInterval <= 0 {
+		return cfg, fmt.Errorf("EVENT_SWEEP_INTERVAL must be positive")
+	}
+	maxBody, err := envInt("WEBHOOK_MAX_BODY", maxWebhookBody)
+	if err != nil {
+		return cfg, err
+	}
+	if maxBody < 1 {
+		return cfg, fmt.Errorf("WEBHOOK_MAX_BODY must be at least 1")
+	}
+	spool, err := envInt("WEBHOOK_SPOOL_THRESHOLD", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if spool < 0 {
+		return cfg, fmt.Errorf("WEBHOOK_SPOOL_THRESHOLD must not be negative")
+	}
+	cfg.maxWebhookBody, cfg.spoolThreshold = int64(maxBody), int64(spool)
+	minSize, err := envInt("SUPPRESS_MIN_SIZE", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.dedupWindow, err = envDuration("DEDUP_WINDOW", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.dedupWindow < 0 {
+		return cfg, fmt.Errorf("DEDUP_WINDOW must not be negative")
+	}
+	if cfg.emitFilter, err = newEmitFilter(envList("SUPPRESS_REPOS"), int64(minSize)); err != nil {
+		return cfg, err
+	}
+	if cfg.checkpointInterval, err = envDuration("BUFFER_CHECKPOINT_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.checkpointInterval <= 0 {
+		return cfg, fmt.Errorf("BUFFER_CHECKPOINT_INTERVAL must be positive")
+	}
+	if cfg.bufferLoad.since, err = envDuration("EVENT_LOAD_SINCE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.bufferLoad.since < 0 {
+		return cfg, fmt.Errorf("EVENT_LOAD_SINCE must not be negative")
+	}
+	cfg.bufferLoad.types = envList("EVENT_LOAD_TYPES")
+	if cfg.checkpointEvery, err = envInt("BUFFER_CHECKPOINT_EVERY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.checkpointEvery < 0 {
+		return cfg, fmt.Errorf("BUFFER_CHECKPOINT_EVERY must not be negative")
+	}
+	if cfg.webhookTimeout, err = envDuration("WEBHOOK_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.nostrRelay = os.Getenv("NOSTR_RELAY"); cfg.nostrRelay != "" {
+		if u, err := url.Parse(cfg.nostrRelay); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return cfg, fmt.Errorf("NOSTR_RELAY must be a ws:// or wss:// URL")
+		}
+		nsec := os.Getenv("NOSTR_NSEC")
+		if nsec == "" {
+			return cfg, fmt.Errorf("NOSTR_RELAY needs NOSTR_NSEC")
+		}
+		if cfg.nostrKey, err = nostrkey.ParseSecretKey(nsec); err != nil {
+			return cfg, fmt.Errorf("NOSTR_NSEC: %w", err)
+		}
+		if cfg.nostrKind, err = envInt("NOSTR_KIND", 1); err != nil {
+			return cfg, err
+		}
+		if cfg.nostrKind < 0 || cfg.nostrKind > 65535 {
+			return cfg, fmt.Errorf("NOSTR_KIND must be between 0 and 65535")
+		}
+	}
+	if relay := os.Getenv("NOSTR_SOURCE_RELAY"); relay != "" {
+		if cfg.nostrSource, err = parseNostrSource(relay, envList("NOSTR_SOURCE_KINDS"), envList("NOSTR_SOURCE_AUTHORS"), envOr("NOSTR_SOURCE_TYPE", "repo_cloned")); err != nil {
+			return cfg, err
+		}
+	}
+	if (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == "") {
+		return cfg, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if envBool("TLS_REDIRECT") {
+		if cfg.tlsCertFile == "" {
+			return cfg, fmt.Errorf("TLS_REDIRECT needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		cfg.tlsRedirectPort = envOr("TLS_REDIRECT_PORT", "80")
+	}
+	if cfg.shutdownGrace, err = envDuration("SHUTDOWN_GRACE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.shutdownGrace < 0 {
+		return cfg, fmt.Errorf("SHUTDOWN_GRACE must not be negative")
+	}
+	// Streams are closed by then, so only the final checkpoint carries
+	// the webhooks accepted during the grace period to anyone.
+	if cfg.shutdownGrace > 0 && cfg.bufferFile == "" {
+		return cfg, fmt.Errorf("SHUTDOWN_GRACE needs BUFFER_FILE; without it the webhooks it accepts are lost")
+	}
+	if cfg.heartbeatInterval, err = envDuration("HEARTBEAT_INTERVAL", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.heartbeatInterval < 0 {
+		return cfg, fmt.Errorf("HEARTBEAT_INTERVAL must not be negative")
+	}
+	if cfg.maxSkew, err = envDuration("WEBHOOK_MAX_SKEW", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.maxSkew < 0 {
+		return cfg, fmt.Errorf("WEBHOOK_MAX_SKEW must not be negative")
+	}
+	if cfg.webhookRate, err = envFloat("WEBHOOK_RATE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.webhookRate < 0 {
+		return cfg, fmt.Errorf("WEBHOOK_RATE must not be negative")
+	}
+	if cfg.webhookBurst, err = envInt("WEBHOOK_BURST", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.webhookBurst < 1 {
+		return cfg, fmt.Errorf("WEBHOOK_BURST must be at least 1")
+	}
+	if cfg.idempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.idempotencyMaxKeys, err = envInt("IDEMPOTENCY_MAX_KEYS", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.idempotencyMaxKeys < 1 {
+		return cfg, fmt.Errorf("IDEMPOTENCY_MAX_KEYS must be at least 1")
+	}
+	if cfg.aggregateWindow, err = envDuration("WEBHOOK_AGGREGATE_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.aggregateWindow < 0 {
+		return cfg, fmt.Errorf("WEBHOOK_AGGREGATE_WINDOW must not be negative")
+	}
+	if cfg.reapInterval, err = envDuration("SUBSCRIBER_REAP_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.reapInterval < 0 {
+		return cfg, fmt.Errorf("SUBSCRIBER_REAP_INTERVAL must not be negative")
+	}
+	if cfg.reapJitter, err = envFloat("SUBSCRIBER_REAP_JITTER", 0.2); err != nil {
+		return cfg, err
+	}
+	if cfg.reapJitter < 0 || cfg.reapJitter >= 1 {
+		return cfg, fmt.Errorf("SUBSCRIBER_REAP_JITTER must be in [0, 1)")
+	}
+	if cfg.maxConnsPerIP, err = envInt("SSE_MAX_CONNS_PER_IP", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.maxConnsPerIP < 0 {
+		return cfg, fmt.Errorf("SSE_MAX_CONNS_PER_IP must not be negative")
+	}
+	if cfg.trustedProxies, err = parseTrustedProxies(envList("TRUSTED_PROXIES")); err != nil {
+		return cfg, err
+	}
+	if cfg.senders, err = loadSenders(os.Getenv("WEBHOOK_SENDERS_FILE"), cfg.webhookSecret); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreams, err = parseUpstreams(envList("UPSTREAM_EVENTS")); err != nil {
+		return cfg, err
+	}
+	if cfg.forwardTargets, err = loadForwardTargets(os.Getenv("FORWARD_TARGETS_FILE")); err != nil {
+		return cfg, err
+	}
+	if cfg.enrichURL, err = parseEnrichURL(os.Getenv("ENRICH_URL")); err != nil {
+		return cfg, err
+	}
+	if cfg.enrichTimeout, err = envDuration("ENRICH_TIMEOUT", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.enrichTimeout <= 0 {
+		return cfg, fmt.Errorf("ENRICH_TIMEOUT must be positive")
+	}
+	if cfg.enrichCacheTTL, err = envDuration("ENRICH_CACHE_TTL", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.keyMap, err = parseKeyMap(os.Getenv("EVENT_KEY_MAP")); err != nil {
+		return cfg, err
+	}
+	if cfg.readHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.readTimeout, err = envDuration("READ_TIMEOUT", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.writeTimeout, err = envDuration("WRITE_TIMEOUT", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.maxHeaderBytes, err = envInt("MAX_HEADER_BYTES", 16<<10); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func main() {
+	selftest := flag.Bool("selftest", false, "check the configuration, print a report and exit")
+	sign := flag.Bool("sign", false, "print the X-Signature for the payload on stdin and exit")
+	signSecret := flag.String("secret", "", "with --sign: the webhook secret (defaults to $WEBHOOK_SECRET)")
+	signFormat := flag.String("format", "hex", "with --sign: hex, sha256= (prefixed hex) or base64")
+	signTimestamp := flag.String("timestamp", "", "with --sign: the X-Timestamp to sign (defaults to now)")
+	flag.Parse()
+	logger, err := newLogger(os.Stderr, envOr("LOG_FORMAT", "json"), envOr("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	slog.SetDefault(logger)
+	if *selftest {
+		os.Exit(runSelftest(os.Stdout))
+	}
+	if *sign {
+		if *signSecret == "" {
+			*signSecret = os.Getenv("WEBHOOK_SECRET")
+		}
+		os.Exit(runSign(*signSecret, *signTimestamp, *signFormat, os.Stdin, os.Stdout))
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("invalid config", "err", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := newEventHub(cfg.maxBuffer, cfg.subscriberMaxDrops)
+	hub.maxAge = cfg.maxEventAge
+	hub.maxSubscribers = cfg.maxSubscribers
+	enc := eventEncoder{keys: cfg.keyMap}
+	if cfg.eventStdout {
+		hub.taps = append(hub.taps, newStdoutSink(os.Stdout, enc).write)
+	}
+	if cfg.nostrRelay != "" {
+		np := newNostrPublisher(cfg.nostrRelay, cfg.nostrKey, cfg.nostrKind)
+		hub.taps = append(hub.taps, np.enqueue)
+		go np.run(ctx)
+		slog.Info("broadcasting events to nostr relay", "relay", cfg.nostrRelay, "pubkey", hex.EncodeToString(cfg.nostrKey.PublicKey), "kind", cfg.nostrKind)
+	}
+	var store *bufferStore
+	if cfg.bufferFile != "" {
+		store = newBufferStore(cfg.bufferFile, cfg.checkpointEvery)
+		store.load(hub, cfg.bufferLoad)
+		if cfg.checkpointEvery > 0 {
+			hub.taps = append(hub.taps, store.published)
+		}
+		go store.runCheckpoints(ctx, hub, cfg.checkpointInterval)
+	}
+	go hub.runSweeper(ctx, cfg.sweepInterval)
+	for _, up := range cfg.upstreams {
+		go up.follow(ctx, &http.Client{}, hub)
+	}
+
+	s := &server{
+		cfg:           cfg,
+		hub:           hub,
+		enc:           enc,
+		metrics:       newMetrics(),
+		forwardClient: &http.Client{},
+		frames:        newFrameCache(cfg.maxBuffer, cfg.maxEventBytes),
+		conns:         newConnLimiter(cfg.maxConnsPerIP),
+		receipts:      newReceiptLog(cfg.idempotencyTTL, cfg.idempotencyMaxKeys),
+		dedup:         newDedupWindow(cfg.dedupWindow),
+	}
+	if s.dedup != nil {
+		go s.dedup.runSweeper(ctx, cfg.sweepInterval)
+	}
+	s.batches = newBatcher(cfg.aggregateWindow, s.emit)
+	if cfg.nostrSource != nil {
+		go cfg.nostrSource.follow(ctx, s)
+	}
+	if s.webhookLimit = newWebhookLimiter(cfg.webhookRate, cfg.webhookBurst); s.webhookLimit != nil {
+		go s.webhookLimit.runSweeper(ctx, time.Minute)
+	}
+	if cfg.enrichURL != "" {
+		s.enricher = newEnricher(httpLookup{client: &http.Client{}, tmpl: cfg.enrichURL}, cfg.enrichTimeout, cfg.enrichCacheTTL)
+	}
+	var handler http.Handler = s.routes()
+	if cfg.accessLog {
+		handler = accessLog(handler, cfg.trustedProxies)
+	}
+	httpServer := newHTTPServer(ctx, cfg, ":"+cfg.port, handler)
+	httpServer.RegisterOnShutdown(cancel)
+	if cfg.tlsCertFile != "" {
+		if httpServer.TLSConfig, err = loadTLSConfig(cfg.tlsCertFile, cfg.tlsKeyFile); err != nil {
+			fatal("loading TLS certificate", "err", err)
+		}
+	}
+	servers := []*http.Server{httpServer}
+	go serve(httpServer, nil)
+
+	if cfg.tlsRedirectPort != "" {
+		redirectServer := newHTTPServer(ctx, cfg, ":"+cfg.tlsRedirectPort, redirectToHTTPS(cfg.port))
+		servers = append(servers, redirectServer)
+		go serve(redirectServer, nil)
+	}
+
+	if cfg.eventsUnixSocket != "" {
+		ln, err := listenUnix(cfg.eventsUnixSocket)
+		if err != nil {
+			fatal("unix socket", "err", err)
+		}
+		var unixHandler http.Handler = s.streamRoutes()
+		if cfg.accessLog {
+			unixHandler = accessLog(unixHandler, cfg.trustedProxies)
+		}
+		unixServer := newHTTPServer(ctx, cfg, cfg.eventsUnixSocket, unixHandler)
+		servers = append(servers, unixServer)
+		go serve(unixServer, ln)
+	}
+
+	waitForShutdown(s, servers...)
+	// Shutdown canceled ctx, so each WebSocket is sending its close frame.
+	s.websockets.Wait()
+	if s.batches != nil {
+		s.batches.flush()
+	}
+	if store != nil {
+		if err := store.checkpoint(hub); err != nil {
+			slog.Warn("final checkpoint failed", "path", store.path, "err", err)
+		}
+	}
+}
+
+func newHTTPServer(ctx context.Context, cfg config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		MaxHeaderBytes:    cfg.maxHeaderBytes,
+		// Request contexts derive from ctx so open SSE streams end as soon
+		// as shutdown starts instead of holding Shutdown until its timeout.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+}
+
+// serve runs srv on ln, or on its TCP Addr when ln is nil, with TLS if
+// srv has a TLSConfig.
+func serve(srv *http.Server, ln net.Listener) {
+	slog.Info("clone-events-sse listening", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+	var err error
+	switch {
+	case ln != nil:
+		err = srv.Serve(ln)
+	case srv.TLSConfig != nil:
+		err = srv.ListenAndServeTLS("", "")
+	default:
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server failed", "addr", srv.Addr, "err", err)
+	}
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing a stale
+// socket left behind by an unclean exit. Any other kind of file at path is
+// left alone and reported as an error.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// waitForShutdown blocks until SIGINT/SIGTERM, then stops the server.
+func waitForShutdown(s *server, servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	s.stop(sig, servers...)
+}
+
+// stop tells subscribers the server is going away, drains for
+// SHUTDOWN_GRACE if set (cut short by another signal on sig), then shuts
+// servers down and logs a summary.
+func (s *server) stop(sig <-chan os.Signal, servers ...*http.Server) {
+	slog.Info("shutting down")
+	// Counted before anything changes them: the notice ends the streams
+	// and the grace window may buffer more events.
+	subscribers, buffered := s.hub.subscriberCount(), s.hub.bufferedCount()
+	start := time.Now()
+	notified := s.notifyShutdown(shutdownNoticeWait)
+	slog.Info("sent server_shutdown", "notified", notified, "subscribers", subscribers)
+	timeout := shutdownTimeout - time.Since(start)
+	if grace := s.cfg.shutdownGrace; grace > 0 {
+		s.drain(grace, sig)
+	}
+	summary := shutdown(subscribers, buffered, timeout, servers...)
+	slog.Info("shutdown complete", summary.attrs()...)
+}
+
+// shutdownSummary records what a shutdown cut off and whether in-flight
+// requests finished in time.
+type shutdownSummary struct {
+	// subscribers and buffered are counted as shutdown begins.
+	subscribers int
+	buffered    int
+	// drained is false when a server hit the timeout with requests
+	// still running.
+	drained  bool
+	duration time.Duration
+}
+
+func (s shutdownSummary) attrs() []any {
+	return []any{"subscribers", s.subscribers, "buffered", s.buffered, "drained", s.drained, "duration", s.duration.Round(time.Millisecond)}
+}
+
+// shutdown gives in-flight requests on every server timeout to finish.
+// subscribers and buffered are the counts stop took as shutdown began,
+// carried into the summary as they are.
+func shutdown(subscribers, buffered int, timeout time.Duration, servers ...*http.Server) shutdownSummary {
+	start := time.Now()
+	summary := shutdownSummary{
+		subscribers: subscribers,
+		buffered:    buffered,
+		drained:     true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("shutdown", "addr", srv.Addr, "err", err)
+				mu.Lock()
+				summary.drained = false
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	summary.duration = time.Since(start)
+	return summary
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+// envBool treats "1", "true", "yes" and "on" (any case) as true.
+func envBool(key string) bool {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key string) []string {
+	var out []string
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parseTypeTTLs parses "type=duration,type=duration" (EVENT_TYPE_TTL).
+func parseTypeTTLs(v string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		typ, raw, ok := strings.Cut(part, "=")
+		if !ok || typ == "" {
+			return nil, fmt.Errorf("EVENT_TYPE_TTL: expected type=duration, got %q", part)
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("EVENT_TYPE_TTL: invalid duration for %q", typ)
+		}
+		ttls[strings.TrimSpace(typ)] = d
+	}
+	return ttls, nil
+}
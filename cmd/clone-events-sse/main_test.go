@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves s.routes() through newHTTPServer, with its timeouts
+// and header cap, on a loopback port.
+func startServer(t *testing.T, s *server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(context.Background(), s.cfg, ln.Addr().String(), s.routes())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestSlowHeaderClientTimedOut(t *testing.T) {
+	s := newTestServer(t, map[string]string{"READ_HEADER_TIMEOUT": "200ms"})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A slowloris client sends the request line and a header, then
+	// trickles nothing more.
+	io.WriteString(conn, "GET /health HTTP/1.1\r\nHost: test\r\n")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	elapsed := time.Since(start)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the half-sent request open for 5s")
+	}
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("connection closed after %s, before READ_HEADER_TIMEOUT", elapsed)
+	}
+}
+
+func TestHeaderTimeoutSparesPromptClients(t *testing.T) {
+	s := newTestServer(t, map[string]string{"READ_HEADER_TIMEOUT": "200ms"})
+	addr := startServer(t, s)
+	resp, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %s", resp.Status)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAX_HEADER_BYTES": "1024"})
+	addr := startServer(t, s)
+	tests := []struct {
+		name   string
+		header int
+		want   int
+	}{
+		{"small headers", 100, http.StatusOK},
+		// net/http allows 4 KiB of slack over MaxHeaderBytes.
+		{"oversized headers", 16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "GET /health HTTP/1.1\r\nHost: test\r\nX-Padding: "+strings.Repeat("a", tt.header)+"\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventsUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "events.sock")
+	// A socket left by a crashed instance is replaced.
+	if stale, err := net.Listen("unix", sock); err == nil {
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+	}
+
+	s := newTestServer(t, nil)
+	ln, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(context.Background(), s.cfg, sock, s.streamRoutes())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, br := openStream(t, client, "http://unix/events", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	s.hub.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"})
+	f := readFrame(t, br)
+	if f.id != "1" || !strings.Contains(f.data, `"repo":"npub1a/r"`) {
+		t.Errorf("got frame %+v", f)
+	}
+
+	// The socket is read-only: webhooks aren't served on it.
+	post, err := client.Post("http://unix/webhooks/repo-cloned", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusNotFound {
+		t.Errorf("webhook over the socket got %s, want 404", post.Status)
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("the file was replaced")
+	}
+}
+
+// TestShutdownSummary stops a server with two subscribers connected and
+// three events buffered, as the signal handler would.
+func TestShutdownSummary(t *testing.T) {
+	s := newTestServer(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(context.Background(), s.cfg, ln.Addr().String(), s.routes())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	base := "http://" + ln.Addr().String()
+
+	var streams []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		_, br := openStream(t, http.DefaultClient, base+"/events", nil)
+		streams = append(streams, br)
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 2 })
+	for _, repo := range []string{"npub1a/r", "npub1a/s", "npub1b/t"} {
+		s.emit(repoEvent{Type: "repo_cloned", Repo: repo}, 0)
+	}
+	logs := captureLogs(t)
+
+	s.stop(make(chan os.Signal), srv)
+
+	// The three events come first; readFrame fails the test if the
+	// stream ends before the notice.
+	for _, br := range streams {
+		for !strings.Contains(readFrame(t, br).data, "server_shutdown") {
+		}
+	}
+	notice := logs.records("sent server_shutdown")
+	if len(notice) != 1 || notice[0]["notified"] != 2.0 {
+		t.Errorf("server_shutdown notice logged as %v", notice)
+	}
+	recs := logs.records("shutdown complete")
+	if len(recs) != 1 {
+		t.Fatalf("%d shutdown summaries logged", len(recs))
+	}
+	for key, want := range map[string]any{"subscribers": 2.0, "buffered": 3.0, "drained": true} {
+		if got := recs[0][key]; got != want {
+			t.Errorf("summary %s = %v, want %v", key, got, want)
+		}
+	}
+	if _, ok := recs[0]["duration"].(string); !ok {
+		t.Errorf("summary duration = %v", recs[0]["duration"])
+	}
+}
+
+// TestShutdownTimedOut shuts down a server with a request that outlives the
+// timeout; the summary must say it didn't drain.
+func TestShutdownTimedOut(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	defer close(release)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	summary := shutdown(1, 2, 100*time.Millisecond, srv)
+	if summary.subscribers != 1 || summary.buffered != 2 {
+		t.Errorf("summary counts %d subscribers and %d buffered, want the 1 and 2 passed in", summary.subscribers, summary.buffered)
+	}
+	if summary.drained {
+		t.Error("summary says drained with a request still running")
+	}
+	if summary.duration < 100*time.Millisecond || summary.duration > 2*time.Second {
+		t.Errorf("shutdown took %v for a 100ms timeout", summary.duration)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// authFailureReasons are the webhook_auth_failures_total label values,
+// always exported so a reason shows up as 0 before its first failure.
+var authFailureReasons = []error{errSignatureMissing, errSignatureMalformed, errSignatureMismatch, errTimestampMissing, errTimestampSkew}
+
+// metrics holds the counters served on /metrics in the Prometheus text
+// exposition format.
+type metrics struct {
+	mu           sync.Mutex
+	authFailures map[string]uint64
+	suppressed   map[string]uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{authFailures: make(map[string]uint64), suppressed: make(map[string]uint64)}
+	for _, reason := range authFailureReasons {
+		m.authFailures[reason.Error()] = 0
+	}
+	return m
+}
+
+// authFailure counts a webhook rejected by authenticateSender.
+func (m *metrics) authFailure(reason error) {
+	m.mu.Lock()
+	m.authFailures[reason.Error()]++
+	m.mu.Unlock()
+}
+
+// suppression counts a webhook acknowledged but not published.
+func (m *metrics) suppression(reason string) {
+	m.mu.Lock()
+	m.suppressed[reason]++
+	m.mu.Unlock()
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP webhook_auth_failures_total Webhooks rejected for their signature, by reason.")
+	fmt.Fprintln(w, "# TYPE webhook_auth_failures_total counter")
+	for _, reason := range authFailureReasons {
+		fmt.Fprintf(w, "webhook_auth_failures_total{reason=%q} %d\n", reason.Error(), m.authFailures[reason.Error()])
+	}
+	fmt.Fprintln(w, "# HELP webhook_suppressed_total Webhooks accepted but not published, by the rule that matched.")
+	fmt.Fprintln(w, "# TYPE webhook_suppressed_total counter")
+	for _, reason := range suppressReasons {
+		fmt.Fprintf(w, "webhook_suppressed_total{reason=%q} %d\n", reason, m.suppressed[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP gittr_sse_subscribers Connected /events subscribers.")
+	fmt.Fprintln(w, "# TYPE gittr_sse_subscribers gauge")
+	fmt.Fprintf(w, "gittr_sse_subscribers %d\n", s.hub.subscriberCount())
+	fmt.Fprintln(w, "# HELP gittr_sse_subscribers_evicted_total Subscribers disconnected for falling SUBSCRIBER_MAX_DROPS events behind.")
+	fmt.Fprintln(w, "# TYPE gittr_sse_subscribers_evicted_total counter")
+	fmt.Fprintf(w, "gittr_sse_subscribers_evicted_total %d\n", s.hub.evicted.Load())
+	fmt.Fprintln(w, "# HELP gittr_sse_replay_gaps_total Subscribers whose catch-up replay was overrun by a burst larger than MAX_BUFFER.")
+	fmt.Fprintln(w, "# TYPE gittr_sse_replay_gaps_total counter")
+	fmt.Fprintf(w, "gittr_sse_replay_gaps_total %d\n", s.hub.replayGaps.Load())
+	fmt.Fprintln(w, "# HELP gittr_sse_events_published_total Events published since start.")
+	fmt.Fprintln(w, "# TYPE gittr_sse_events_published_total counter")
+	fmt.Fprintf(w, "gittr_sse_events_published_total %d\n", s.hub.published.Load())
+	fmt.Fprintln(w, "# HELP gittr_sse_buffer_size Events held in the replay buffer.")
+	fmt.Fprintln(w, "# TYPE gittr_sse_buffer_size gauge")
+	fmt.Fprintf(w, "gittr_sse_buffer_size %d\n", s.hub.bufferedCount())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape reads /metrics into a map from series (name{labels}) to value.
+func scrape(t *testing.T, h http.Handler) map[string]uint64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	series := make(map[string]uint64)
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("bad metrics line %q", line)
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			t.Fatalf("bad value in %q: %v", line, err)
+		}
+		series[name] = n
+	}
+	return series
+}
+
+// TestAuthFailureMetrics sends one webhook per failure mode, with and
+// without the header preface check, and expects exactly its label to move.
+func TestAuthFailureMetrics(t *testing.T) {
+	body := []byte(`{"repo":"npub1a/r"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	hourAgo := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(secret, ts string) string {
+		mac, err := webhookMAC(secret, ts, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "sha256=" + hex.EncodeToString(mac)
+	}
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		reason    string
+	}{
+		{"no signature", now, "", "missing"},
+		{"not hex", now, "sha256=not-hex", "malformed"},
+		{"unknown algorithm", now, "md5=" + strings.Repeat("ab", 16), "malformed"},
+		{"wrong secret", now, sign("guessed", now), "mismatch"},
+		{"no timestamp", "", sign("s3cret", ""), "missing_timestamp"},
+		{"replayed an hour later", hourAgo, sign("s3cret", hourAgo), "stale_timestamp"},
+		{"valid", now, sign("s3cret", now), ""},
+	}
+	for _, strict := range []string{"false", "true"} {
+		for _, tt := range tests {
+			t.Run(tt.name+"/strict="+strict, func(t *testing.T) {
+				s := newTestServer(t, map[string]string{"WEBHOOK_STRICT_HEADERS": strict})
+				h := s.routes()
+				before := scrape(t, h)
+
+				r := httptest.NewRequest(http.MethodPost, "/webhooks/repo-cloned", bytes.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				if tt.timestamp != "" {
+					r.Header.Set("X-Timestamp", tt.timestamp)
+				}
+				if tt.signature != "" {
+					r.Header.Set("X-Signature", tt.signature)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if tt.reason == "" && w.Code != http.StatusAccepted {
+					t.Fatalf("valid webhook: status %d", w.Code)
+				}
+				if tt.reason != "" && w.Code != http.StatusUnauthorized {
+					t.Fatalf("status %d, want 401", w.Code)
+				}
+
+				after := scrape(t, h)
+				for _, reason := range authFailureReasons {
+					key := `webhook_auth_failures_total{reason="` + reason.Error() + `"}`
+					if _, ok := after[key]; !ok {
+						t.Fatalf("%s not exported", key)
+					}
+					want := before[key]
+					if reason.Error() == tt.reason {
+						want++
+					}
+					if after[key] != want {
+						t.Errorf("%s = %d, want %d", key, after[key], want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseRecorder captures the status and body size written by a handler.
+// It forwards Flush so SSE streaming still works through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// accessLog logs one line per request with method, path, status, bytes,
+// duration, and client IP. SSE streams are long-lived and their byte count
+// says nothing about request size, so they are logged as a stream with
+// their connection lifetime instead.
+func accessLog(next http.Handler, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rr := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rr, r)
+
+		status := rr.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		elapsed := time.Since(start).Round(time.Microsecond)
+		ip := clientIP(r, trusted)
+		if ct := rr.Header().Get("Content-Type"); strings.HasPrefix(ct, formatSSE.contentType) || strings.HasPrefix(ct, formatNDJSON.contentType) {
+			slog.Info("access", "kind", "stream", "method", r.Method, "path", r.URL.Path, "status", status, "lifetime", elapsed, "ip", ip)
+			return
+		}
+		slog.Info("access", "kind", "request", "method", r.Method, "path", r.URL.Path, "status", status, "bytes", rr.bytes, "duration", elapsed, "ip", ip)
+	})
+}
+
+// remoteIP is the peer address of the connection without its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP is the address of the client behind any trusted proxies. When
+// the peer is one of TRUSTED_PROXIES, X-Forwarded-For is walked from the
+// right, skipping trusted hops, and the first address that isn't trusted
+// is the client. Entries further left were written by the client itself
+// and can't be believed. Without trusted proxies it is the peer address.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := remoteIP(r)
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !isTrusted(hop, trusted) {
+			return hop
+		}
+	}
+	return peer
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES: CIDRs or single addresses.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an address or CIDR", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// logCapture collects the records logged through the default logger while
+// a test runs, as the JSON lines newLogger writes.
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// records returns the captured records whose msg is msg.
+func (c *logCapture) records(msg string) []map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []map[string]any
+	for _, line := range bytes.Split(c.buf.Bytes(), []byte("\n")) {
+		var rec map[string]any
+		if json.Unmarshal(line, &rec) == nil && rec["msg"] == msg {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func captureLogs(t *testing.T) *logCapture {
+	t.Helper()
+	c := &logCapture{}
+	logger, err := newLogger(c, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return c
+}
+
+func TestAccessLogWebhook(t *testing.T) {
+	s := newTestServer(t, nil)
+	logs := captureLogs(t)
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status float64
+	}{
+		{"accepted", signedWebhook(t, "s3cret", []byte(`{"repo":"npub1a/r"}`)), http.StatusAccepted},
+		{"bad signature", signedWebhook(t, "wrong", []byte(`{"repo":"npub1a/r"}`)), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(logs.records("access"))
+			w := httptest.NewRecorder()
+			tt.req.RemoteAddr = "192.0.2.7:4711"
+			accessLog(s.routes(), nil).ServeHTTP(w, tt.req)
+			recs := logs.records("access")
+			if len(recs) != before+1 {
+				t.Fatalf("%d access records, want one more than %d", len(recs), before)
+			}
+			rec := recs[len(recs)-1]
+			want := map[string]any{
+				"kind":   "request",
+				"method": "POST",
+				"path":   "/webhooks/repo-cloned",
+				"status": tt.status,
+				"bytes":  float64(w.Body.Len()),
+				"ip":     "192.0.2.7",
+			}
+			for k, v := range want {
+				if rec[k] != v {
+					t.Errorf("%s = %v, want %v", k, rec[k], v)
+				}
+			}
+			if _, ok := rec["duration"].(string); !ok {
+				t.Errorf("duration = %v, want a duration string", rec["duration"])
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"direct client", "198.51.100.9:1000", "", "198.51.100.9"},
+		{"untrusted peer's header is ignored", "198.51.100.9:1000", "203.0.113.5", "198.51.100.9"},
+		{"one trusted proxy", "10.1.2.3:1000", "203.0.113.5", "203.0.113.5"},
+		{"chain of trusted proxies", "192.0.2.1:1000", "203.0.113.5, 10.9.9.9", "203.0.113.5"},
+		{"spoofed entry left of the client", "10.1.2.3:1000", "1.1.1.1, 203.0.113.5", "203.0.113.5"},
+		{"garbage hop stops the walk", "10.1.2.3:1000", "203.0.113.5, nonsense", "10.1.2.3"},
+		{"all hops trusted", "10.1.2.3:1000", "10.4.4.4", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/events", nil)
+			r.RemoteAddr = tt.peer
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
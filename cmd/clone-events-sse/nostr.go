@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+const (
+	// nostrQueueSize is how many events may wait for the relay; past it
+	// new ones are dropped rather than holding up publish.
+	nostrQueueSize = 256
+	// nostrMaxMessage caps a relay message; relays only send short
+	// OK and NOTICE replies to a publisher.
+	nostrMaxMessage  = 1 << 20
+	nostrDialTimeout = 10 * time.Second
+)
+
+// nostrPublisher broadcasts published events to a Nostr relay (NOSTR_RELAY)
+// as events signed with NOSTR_NSEC, so Nostr clients can follow clones
+// without the HTTP endpoints. It is a hub tap: publish only queues, and a
+// single goroutine keeps the relay connection and sends, so a slow or
+// unreachable relay never delays a webhook.
+type nostrPublisher struct {
+	relay string
+	key   *nostrkey.SecretKey
+	kind  int
+	queue chan repoEvent
+}
+
+func newNostrPublisher(relay string, key *nostrkey.SecretKey, kind int) *nostrPublisher {
+	return &nostrPublisher{relay: relay, key: key, kind: kind, queue: make(chan repoEvent, nostrQueueSize)}
+}
+
+// enqueue is the hub tap. It never blocks: with the queue full the event
+// is dropped and logged.
+func (n *nostrPublisher) enqueue(ev repoEvent) {
+	select {
+	case n.queue <- ev:
+	default:
+		slog.Warn("nostr queue full, dropping event", "id", ev.ID)
+	}
+}
+
+// run sends queued events until ctx is done, reconnecting to the relay
+// with backoff. An event whose send failed is retried on the next
+// connection; events still queued at shutdown are not sent.
+func (n *nostrPublisher) run(ctx context.Context) {
+	var pending *nostr.Event
+	backoff := upstreamMinBackoff
+	for {
+		connected, err := n.session(ctx, &pending)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = upstreamMinBackoff
+		}
+		slog.Warn("nostr relay disconnected", "relay", n.relay, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+}
+
+// session sends over one relay connection until it fails. pending is the
+// event to send first, and is left set to the one that couldn't be sent.
+func (n *nostrPublisher) session(ctx context.Context, pending **nostr.Event) (bool, error) {
+	rc, err := dialRelay(ctx, n.relay)
+	if err != nil {
+		return false, err
+	}
+	defer rc.conn.Close()
+	slog.Info("connected to nostr relay", "relay", n.relay)
+
+	gone := make(chan error, 1)
+	go func() { gone <- rc.readReplies() }()
+	for {
+		if *pending != nil {
+			if err := rc.sendEvent(*pending); err != nil {
+				return true, err
+			}
+			*pending = nil
+		}
+		select {
+		case <-ctx.Done():
+			rc.write(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway))
+			return true, ctx.Err()
+		case err := <-gone:
+			return true, err
+		case ev := <-n.queue:
+			nev, err := n.build(ev)
+			if err != nil {
+				slog.Warn("nostr event not built", "id", ev.ID, "err", err)
+				continue
+			}
+			*pending = &nev
+		}
+	}
+}
+
+// build turns a hub event into a signed Nostr event. The content is a
+// readable line, "repo_cloned npub1.../repo"; the type and repos are also
+// tags, so clients can filter on "#t" without parsing it.
+func (n *nostrPublisher) build(ev repoEvent) (nostr.Event, error) {
+	repos := ev.Repos
+	if ev.Repo != "" {
+		repos = []string{ev.Repo}
+	}
+	tags := [][]string{{"t", "gittr"}, {"t", ev.Type}}
+	for _, repo := range repos {
+		tags = append(tags, []string{"repo", repo})
+	}
+	created := ev.Timestamp
+	if created == 0 {
+		created = time.Now().Unix()
+	}
+	nev := nostr.Event{
+		CreatedAt: created,
+		Kind:      n.kind,
+		Tags:      tags,
+		Content:   ev.Type + " " + strings.Join(repos, " "),
+	}
+	err := nev.Sign(n.key)
+	return nev, err
+}
+
+// relayConn is the client side of a WebSocket to a relay. Writes come from
+// session and from readReplies answering pings, so they are serialized.
+type relayConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu sync.Mutex
+}
+
+// dialRelay opens a ws:// or wss:// connection and completes the
+// WebSocket handshake.
+func dialRelay(ctx context.Context, raw string) (*relayConn, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	ctx, cancel := context.WithTimeout(ctx, nostrDialTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	rc := &relayConn{conn: conn, br: bufio.NewReader(conn)}
+	if err := rc.handshake(ctx, u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *relayConn) handshake(ctx context.Context, u *url.URL) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		rc.conn.SetDeadline(deadline)
+		defer rc.conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	fmt.Fprintf(rc.conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		u.RequestURI(), u.Host, key)
+	resp, err := http.ReadResponse(rc.br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("handshake: %s", resp.Status)
+	}
+	accept := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return errors.New("handshake: bad Sec-WebSocket-Accept")
+	}
+	return nil
+}
+
+// write sends one masked frame, as clients must.
+func (rc *relayConn) write(op byte, payload []byte) error {
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame := wsFrame(op, payload)
+	hdr := len(frame) - len(payload)
+	frame[1] |= 0x80
+	masked := append(append(frame[:hdr:hdr], mask[:]...), payload...)
+	for i := range payload {
+		masked[hdr+4+i] ^= mask[i%4]
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := rc.conn.Write(masked)
+	return err
+}
+
+func (rc *relayConn) sendEvent(ev *nostr.Event) error {
+	msg, err := json.Marshal([]any{"EVENT", ev})
+	if err != nil {
+		return err
+	}
+	return rc.write(wsOpText, msg)
+}
+
+// readReplies reads relay messages until the connection fails, logging
+// rejected events and notices.
+func (rc *relayConn) readReplies() error {
+	for {
+		msg, err := rc.readMessage()
+		if err != nil {
+			return err
+		}
+		var reply []json.RawMessage
+		if json.Unmarshal(msg, &reply) != nil || len(reply) == 0 {
+			continue
+		}
+		var typ, id, text string
+		json.Unmarshal(reply[0], &typ)
+		switch {
+		case typ == "OK" && len(reply) == 4:
+			var ok bool
+			json.Unmarshal(reply[1], &id)
+			json.Unmarshal(reply[2], &ok)
+			json.Unmarshal(reply[3], &text)
+			if !ok {
+				slog.Warn("nostr relay rejected event", "nostr_id", id, "reason", text)
+			}
+		case typ == "NOTICE" && len(reply) == 2:
+			json.Unmarshal(reply[1], &text)
+			slog.Info("nostr relay notice", "notice", text)
+		}
+	}
+}
+
+// readMessage returns the next text message, answering pings and
+// reassembling fragments on the way.
+func (rc *relayConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		h, err := readWSHeader(rc.br)
+		if err != nil {
+			return nil, err
+		}
+		if h.length > nostrMaxMessage || uint64(len(msg))+h.length > nostrMaxMessage {
+			return nil, errors.New("relay message too big")
+		}
+		payload, err := h.readPayload(rc.br)
+		if err != nil {
+			return nil, err
+		}
+		switch h.op {
+		case wsOpPing:
+			if err := rc.write(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			rc.write(wsOpClose, payload)
+			return nil, errors.New("closed by relay")
+		}
+		msg = append(msg, payload...)
+		if h.fin {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+func testNostrKey(t *testing.T, b byte) *nostrkey.SecretKey {
+	t.Helper()
+	key, err := nostrkey.NewSecretKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// netPipe is a connected pair of conns, closed when the test ends.
+func netPipe(t *testing.T) (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// relayPeer is the relay's side of one client connection.
+type relayPeer struct {
+	conn *bufio.ReadWriter
+}
+
+// send writes v as a JSON text message.
+func (p *relayPeer) send(v ...any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := p.conn.Write(wsFrame(wsOpText, msg)); err != nil {
+		return err
+	}
+	return p.conn.Flush()
+}
+
+// fakeRelay is an in-process relay: it upgrades each connection and hands
+// every text message a client sends to serve, which answers through the
+// peer. It returns the relay's ws:// URL.
+func fakeRelay(t *testing.T, serve func(p *relayPeer, msg []json.RawMessage)) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+		brw.Flush()
+		p := &relayPeer{conn: brw}
+		for {
+			h, err := readWSHeader(brw)
+			if err != nil {
+				return
+			}
+			payload, err := h.readPayload(brw)
+			if err != nil || h.op == wsOpClose {
+				return
+			}
+			var msg []json.RawMessage
+			if h.op == wsOpText && json.Unmarshal(payload, &msg) == nil {
+				serve(p, msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestNostrBuild(t *testing.T) {
+	key := testNostrKey(t, 7)
+	n := newNostrPublisher("ws://relay.invalid", key, 1)
+	tests := []struct {
+		name        string
+		ev          repoEvent
+		wantTags    [][]string
+		wantContent string
+	}{
+		{
+			name:        "one repo",
+			ev:          repoEvent{ID: 1, Type: "repo_cloned", Repo: "npub1a/r", Timestamp: 1700000000},
+			wantTags:    [][]string{{"t", "gittr"}, {"t", "repo_cloned"}, {"repo", "npub1a/r"}},
+			wantContent: "repo_cloned npub1a/r",
+		},
+		{
+			name:        "aggregate",
+			ev:          repoEvent{ID: 2, Type: "repos_cloned", Repos: []string{"npub1a/x", "npub1b/y"}, Timestamp: 1700000001},
+			wantTags:    [][]string{{"t", "gittr"}, {"t", "repos_cloned"}, {"repo", "npub1a/x"}, {"repo", "npub1b/y"}},
+			wantContent: "repos_cloned npub1a/x npub1b/y",
+		},
+		{
+			name:        "quotes and newlines in the repo",
+			ev:          repoEvent{ID: 3, Type: "repo_cloned", Repo: "npub1a/\"odd\"\nname", Timestamp: 1700000002},
+			wantTags:    [][]string{{"t", "gittr"}, {"t", "repo_cloned"}, {"repo", "npub1a/\"odd\"\nname"}},
+			wantContent: "repo_cloned npub1a/\"odd\"\nname",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nev, err := n.build(tt.ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(nev.Tags, tt.wantTags, slices.Equal[[]string]) {
+				t.Errorf("tags %q, want %q", nev.Tags, tt.wantTags)
+			}
+			if nev.Content != tt.wantContent {
+				t.Errorf("content %q, want %q", nev.Content, tt.wantContent)
+			}
+			if nev.Kind != 1 || nev.CreatedAt != tt.ev.Timestamp || nev.PubKey != hex.EncodeToString(key.PublicKey) {
+				t.Errorf("kind %d, created_at %d, pubkey %s", nev.Kind, nev.CreatedAt, nev.PubKey)
+			}
+			if sum := sha256.Sum256(nev.Serialize()); nev.ID != hex.EncodeToString(sum[:]) {
+				t.Errorf("id %s isn't sha256 of the serialized event", nev.ID)
+			}
+			if err := nev.Verify(); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+
+	t.Run("no timestamp", func(t *testing.T) {
+		before := time.Now().Unix()
+		nev, err := n.build(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nev.CreatedAt < before || nev.CreatedAt > time.Now().Unix() {
+			t.Errorf("created_at %d, want now", nev.CreatedAt)
+		}
+	})
+}
+
+// TestNostrSession publishes over one connection to a relay that answers
+// each EVENT as the case says, and checks what the publisher logged.
+func TestNostrSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply is the relay's answer to an event with id.
+		reply   func(id string) []any
+		wantLog string
+		wantKV  map[string]any
+	}{
+		{
+			name:  "accepted",
+			reply: func(id string) []any { return []any{"OK", id, true, ""} },
+		},
+		{
+			name:    "rejected",
+			reply:   func(id string) []any { return []any{"OK", id, false, "blocked: not on the allow list"} },
+			wantLog: "nostr relay rejected event",
+			wantKV:  map[string]any{"reason": "blocked: not on the allow list"},
+		},
+		{
+			name:    "notice",
+			reply:   func(id string) []any { return []any{"NOTICE", "slow down"} },
+			wantLog: "nostr relay notice",
+			wantKV:  map[string]any{"notice": "slow down"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			key := testNostrKey(t, 9)
+			received := make(chan nostr.Event, 4)
+			relay := fakeRelay(t, func(p *relayPeer, msg []json.RawMessage) {
+				var typ string
+				var ev nostr.Event
+				if len(msg) != 2 || json.Unmarshal(msg[0], &typ) != nil || typ != "EVENT" || json.Unmarshal(msg[1], &ev) != nil {
+					return
+				}
+				received <- ev
+				p.send(tt.reply(ev.ID)...)
+			})
+			n := newNostrPublisher(relay, key, 1)
+			// An event left over from an earlier connection goes first.
+			first, err := n.build(repoEvent{Type: "repo_cloned", Repo: "npub1a/left-over", Timestamp: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := &first
+			n.enqueue(repoEvent{Type: "repo_cloned", Repo: "npub1a/queued", Timestamp: 2})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			type result struct {
+				connected bool
+				err       error
+			}
+			done := make(chan result, 1)
+			go func() {
+				connected, err := n.session(ctx, &pending)
+				done <- result{connected, err}
+			}()
+			for _, want := range []string{"repo_cloned npub1a/left-over", "repo_cloned npub1a/queued"} {
+				select {
+				case ev := <-received:
+					if ev.Content != want {
+						t.Errorf("relay got %q, want %q", ev.Content, want)
+					}
+					if err := ev.Verify(); err != nil {
+						t.Errorf("%q: %v", ev.Content, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("relay never got %q", want)
+				}
+			}
+			if tt.wantLog != "" {
+				waitFor(t, func() bool { return len(logs.records(tt.wantLog)) == 2 })
+				for _, rec := range logs.records(tt.wantLog) {
+					for k, v := range tt.wantKV {
+						if rec[k] != v {
+							t.Errorf("%s: %s = %v, want %v", tt.wantLog, k, rec[k], v)
+						}
+					}
+				}
+			}
+			cancel()
+			select {
+			case res := <-done:
+				if !res.connected || res.err != context.Canceled {
+					t.Errorf("session = %v, %v; want true, context.Canceled", res.connected, res.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("session didn't end with its context")
+			}
+			if pending != nil {
+				t.Errorf("%q still pending after it was sent", pending.Content)
+			}
+			if tt.wantLog == "" {
+				if recs := logs.records("nostr relay rejected event"); len(recs) > 0 {
+					t.Errorf("logged %v", recs)
+				}
+			}
+		})
+	}
+}
+
+// TestNostrSessionRelayCloses checks a relay hanging up ends the session
+// with the unsent event kept for the next one.
+func TestNostrSessionRelayCloses(t *testing.T) {
+	relay := fakeRelay(t, func(p *relayPeer, msg []json.RawMessage) {
+		p.conn.Write(wsFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway)))
+		p.conn.Flush()
+	})
+	n := newNostrPublisher(relay, testNostrKey(t, 3), 1)
+	first, err := n.build(repoEvent{Type: "repo_cloned", Repo: "npub1a/r", Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &first
+	connected, err := n.session(context.Background(), &pending)
+	if !connected || err == nil || err.Error() != "closed by relay" {
+		t.Errorf("session = %v, %v; want true, closed by relay", connected, err)
+	}
+	if pending != nil {
+		t.Errorf("pending %q; it was written before the relay closed", pending.Content)
+	}
+}
+
+func TestDialRelayHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name: "not upgraded",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "no", http.StatusForbidden)
+			},
+			wantErr: "handshake: 403 Forbidden",
+		},
+		{
+			name: "wrong accept key",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Upgrade", "websocket")
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Sec-WebSocket-Accept", "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			wantErr: "handshake: bad Sec-WebSocket-Accept",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			rc, err := dialRelay(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+			if err == nil {
+				rc.conn.Close()
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("dialRelay: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestReadMessage feeds readMessage frames as a relay sends them.
+func TestReadMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	huge := strings.Repeat("y", 70000)
+	fragment := func(fin bool, op byte, payload string) []byte {
+		f := wsFrame(op, []byte(payload))
+		if !fin {
+			f[0] &^= 0x80
+		}
+		return f
+	}
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		want    string
+		wantErr string
+	}{
+		{name: "short", frames: [][]byte{wsFrame(wsOpText, []byte(`["NOTICE","hi"]`))}, want: `["NOTICE","hi"]`},
+		{name: "16-bit length", frames: [][]byte{wsFrame(wsOpText, []byte(long))}, want: long},
+		{name: "64-bit length", frames: [][]byte{wsFrame(wsOpText, []byte(huge))}, want: huge},
+		{
+			name:   "fragments around a ping",
+			frames: [][]byte{fragment(false, wsOpText, "ab"), wsFrame(wsOpPing, []byte("p")), fragment(false, 0, "cd"), fragment(true, 0, "ef")},
+			want:   "abcdef",
+		},
+		{name: "close", frames: [][]byte{wsFrame(wsOpClose, nil)}, wantErr: "closed by relay"},
+		{
+			name:    "too big",
+			frames:  [][]byte{wsFrame(wsOpText, bytes.Repeat([]byte("z"), nostrMaxMessage+1))},
+			wantErr: "relay message too big",
+		},
+		{
+			name:    "too big in fragments",
+			frames:  [][]byte{fragment(false, wsOpText, strings.Repeat("z", nostrMaxMessage)), fragment(true, 0, "z")},
+			wantErr: "relay message too big",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, relay := netPipe(t)
+			go func() {
+				for _, f := range tt.frames {
+					relay.Write(f)
+				}
+			}()
+			// Answers to pings and closes come back masked; drain them.
+			go func() {
+				for {
+					h, err := readWSHeader(relay)
+					if err != nil {
+						return
+					}
+					if h.mask == nil {
+						t.Error("unmasked frame from the client")
+					}
+					if _, err := h.readPayload(relay); err != nil {
+						return
+					}
+				}
+			}()
+			rc := &relayConn{conn: client, br: bufio.NewReader(client)}
+			msg, err := rc.readMessage()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("readMessage: %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || string(msg) != tt.want {
+				t.Errorf("readMessage = %.40q, %v; want %.40q", msg, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// nostrRepoAnnouncement is the NIP-34 kind announcing a git repository,
+// the default NOSTR_SOURCE_KINDS.
+const nostrRepoAnnouncement = 30617
+
+// nostrSource follows a Nostr relay (NOSTR_SOURCE_RELAY) and publishes
+// every matching event on the hub, as a webhook would, for deployments
+// where the repo announcements on Nostr are the signal rather than a
+// sender's POST.
+type nostrSource struct {
+	relay string
+	kinds []int
+	// authors, hex public keys, limits the subscription to those
+	// authors; empty accepts anyone.
+	authors []string
+	// typ is the event type published for each Nostr event.
+	typ string
+}
+
+// parseNostrSource checks the NOSTR_SOURCE_* settings. authors may be npub
+// or hex keys; kinds defaults to repo announcements.
+func parseNostrSource(relay string, kinds, authors []string, typ string) (*nostrSource, error) {
+	u, err := url.Parse(relay)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return nil, fmt.Errorf("NOSTR_SOURCE_RELAY must be a ws:// or wss:// URL")
+	}
+	src := &nostrSource{relay: relay, typ: typ}
+	for _, k := range kinds {
+		n, err := strconv.Atoi(k)
+		if err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("NOSTR_SOURCE_KINDS: bad kind %q", k)
+		}
+		src.kinds = append(src.kinds, n)
+	}
+	if len(src.kinds) == 0 {
+		src.kinds = []int{nostrRepoAnnouncement}
+	}
+	for _, a := range authors {
+		pk, err := nostrkey.ParsePublicKey(a)
+		if err != nil {
+			return nil, fmt.Errorf("NOSTR_SOURCE_AUTHORS: %q: %w", a, err)
+		}
+		src.authors = append(src.authors, hex.EncodeToString(pk))
+	}
+	return src, nil
+}
+
+// follow publishes the relay's matching events through s until ctx is
+// done, reconnecting with backoff. Only events created after startup are
+// asked for, so a restart doesn't republish the relay's history; a
+// reconnect asks again from the newest event seen, and the ids already
+// published from that second are skipped.
+func (src *nostrSource) follow(ctx context.Context, s *server) {
+	cursor := &nostrCursor{since: time.Now().Unix(), seen: make(map[string]bool)}
+	backoff := upstreamMinBackoff
+	for {
+		connected, err := src.session(ctx, s, cursor)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = upstreamMinBackoff
+		}
+		slog.Warn("nostr source disconnected", "relay", src.relay, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+}
+
+// nostrCursor is where a resubscription picks up: the newest created_at
+// seen, and the ids of the events published with it.
+type nostrCursor struct {
+	since int64
+	seen  map[string]bool
+}
+
+// advance records an event, reporting false if it was already handled.
+// The cursor never moves past now, so an event dated in the future can't
+// hide the ones published after it.
+func (c *nostrCursor) advance(id string, createdAt, now int64) bool {
+	if createdAt < c.since || c.seen[id] {
+		return false
+	}
+	if since := min(createdAt, now); since > c.since {
+		c.since = since
+		clear(c.seen)
+	}
+	c.seen[id] = true
+	return true
+}
+
+// session subscribes over one relay connection and handles its messages
+// until it fails.
+func (src *nostrSource) session(ctx context.Context, s *server, cursor *nostrCursor) (bool, error) {
+	rc, err := dialRelay(ctx, src.relay)
+	if err != nil {
+		return false, err
+	}
+	defer rc.conn.Close()
+
+	subID := make([]byte, 8)
+	rand.Read(subID)
+	sub := hex.EncodeToString(subID)
+	filter := map[string]any{"kinds": src.kinds, "since": cursor.since}
+	if len(src.authors) > 0 {
+		filter["authors"] = src.authors
+	}
+	req, _ := json.Marshal([]any{"REQ", sub, filter})
+	if err := rc.write(wsOpText, req); err != nil {
+		return false, err
+	}
+	slog.Info("subscribed to nostr relay", "relay", src.relay, "kinds", src.kinds)
+
+	// The reader below blocks, so this goroutine closes the connection
+	// on shutdown. Relays don't all ping, so it also probes a quiet
+	// connection to notice a dead one; the pong, or anything else, resets
+	// the read deadline.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				rc.write(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway))
+				rc.conn.Close()
+				return
+			case <-ping.C:
+				rc.write(wsOpPing, nil)
+			}
+		}
+	}()
+	for {
+		rc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		msg, err := rc.readMessage()
+		if err != nil {
+			return true, err
+		}
+		var m []json.RawMessage
+		if json.Unmarshal(msg, &m) != nil || len(m) < 2 {
+			continue
+		}
+		var typ, id, text string
+		json.Unmarshal(m[0], &typ)
+		json.Unmarshal(m[1], &id)
+		switch {
+		case typ == "EVENT" && len(m) == 3 && id == sub:
+			var ev nostr.Event
+			if err := json.Unmarshal(m[2], &ev); err != nil {
+				slog.Warn("skipping malformed nostr event", "relay", src.relay)
+				continue
+			}
+			src.handle(s, ev, cursor)
+		case typ == "CLOSED" && id == sub:
+			if len(m) > 2 {
+				json.Unmarshal(m[2], &text)
+			}
+			return true, fmt.Errorf("subscription closed by relay: %s", text)
+		case typ == "NOTICE":
+			slog.Info("nostr source notice", "relay", src.relay, "notice", id)
+		}
+	}
+}
+
+// handle publishes one relay event if it is genuine, matches the
+// subscription and wasn't published already, from this relay or, within
+// DEDUP_WINDOW, by a webhook.
+func (src *nostrSource) handle(s *server, ev nostr.Event, cursor *nostrCursor) {
+	if err := ev.Verify(); err != nil {
+		slog.Warn("dropping nostr event", "relay", src.relay, "nostr_id", ev.ID, "err", err)
+		return
+	}
+	// Relays are trusted to filter, but not blindly.
+	if !slices.Contains(src.kinds, ev.Kind) || (len(src.authors) > 0 && !slices.Contains(src.authors, ev.PubKey)) {
+		return
+	}
+	// Our own broadcasts (NOSTR_RELAY) coming back aren't news.
+	if s.cfg.nostrKey != nil && ev.PubKey == hex.EncodeToString(s.cfg.nostrKey.PublicKey) {
+		return
+	}
+	if !cursor.advance(ev.ID, ev.CreatedAt, time.Now().Unix()) {
+		return
+	}
+	repo, ok := nostrRepo(ev)
+	if !ok {
+		slog.Warn("nostr event names no repo", "relay", src.relay, "nostr_id", ev.ID)
+		return
+	}
+	p := webhookPayload{Type: src.typ, Repo: repo}
+	if reason, ok := s.cfg.emitFilter.suppress(p); ok {
+		s.metrics.suppression(reason)
+		slog.Info("nostr event suppressed", "event", p.Type, "repo", p.Repo, "rule", reason)
+		return
+	}
+	if s.dedup.duplicate(p.Type, p.Repo, time.Now()) {
+		s.metrics.suppression(suppressedDuplicate)
+		slog.Info("nostr event suppressed", "event", p.Type, "repo", p.Repo, "rule", suppressedDuplicate)
+		return
+	}
+	s.emit(repoEvent{Type: p.Type, Repo: repo, Pubkey: ev.PubKey, Description: ev.Tag("description"), Origin: "nostr"}, s.cfg.eventTTL(p))
+}
+
+// repo names the repository an event is about, the way gittr does:
+// "<author npub>/<identifier>", the identifier being the announcement's
+// "d" tag.
+func nostrRepo(e nostr.Event) (string, bool) {
+	d := e.Tag("d")
+	pubkey, err := hex.DecodeString(e.PubKey)
+	if d == "" || err != nil {
+		return "", false
+	}
+	return nostrkey.EncodeNpub(pubkey) + "/" + d, true
+}
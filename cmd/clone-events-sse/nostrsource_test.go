@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostr"
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// announce is a repo announcement signed by key.
+func announce(t *testing.T, key *nostrkey.SecretKey, kind int, createdAt int64, tags ...[]string) nostr.Event {
+	t.Helper()
+	ev := nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: tags}
+	if err := ev.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+// TestNostrSource has a relay answer the subscription with the case's
+// events, then with a last one the test waits for, and checks which were
+// published.
+func TestNostrSource(t *testing.T) {
+	alice, bob, self := testNostrKey(t, 1), testNostrKey(t, 2), testNostrKey(t, 3)
+	npub := func(k *nostrkey.SecretKey) string { return nostrkey.EncodeNpub(k.PublicKey) }
+	tampered := announce(t, alice, nostrRepoAnnouncement, 2000, []string{"d", "forged"})
+	tampered.Tags[0][1] = "other"
+
+	tests := []struct {
+		name    string
+		authors []string
+		events  []nostr.Event
+		want    []string
+	}{
+		{
+			name:   "an announcement",
+			events: []nostr.Event{announce(t, alice, nostrRepoAnnouncement, 2000, []string{"d", "r"}, []string{"description", "a repo"})},
+			want:   []string{npub(alice) + "/r"},
+		},
+		{
+			name: "our own broadcast echoed back",
+			events: []nostr.Event{
+				announce(t, self, nostrRepoAnnouncement, 2000, []string{"d", "mine"}),
+				announce(t, bob, nostrRepoAnnouncement, 2001, []string{"d", "theirs"}),
+			},
+			want: []string{npub(bob) + "/theirs"},
+		},
+		{
+			name:   "forged",
+			events: []nostr.Event{tampered},
+		},
+		{
+			name:   "another kind",
+			events: []nostr.Event{announce(t, alice, 1, 2000, []string{"d", "note"})},
+		},
+		{
+			name:   "no d tag",
+			events: []nostr.Event{announce(t, alice, nostrRepoAnnouncement, 2000, []string{"t", "gittr"})},
+		},
+		{
+			name:   "older than the subscription",
+			events: []nostr.Event{announce(t, alice, nostrRepoAnnouncement, 500, []string{"d", "old"})},
+		},
+		{
+			name: "sent twice",
+			events: func() []nostr.Event {
+				ev := announce(t, alice, nostrRepoAnnouncement, 2000, []string{"d", "twice"})
+				return []nostr.Event{ev, ev}
+			}(),
+			want: []string{npub(alice) + "/twice"},
+		},
+		{
+			name:    "author not followed",
+			authors: []string{npub(bob)},
+			events: []nostr.Event{
+				announce(t, alice, nostrRepoAnnouncement, 2000, []string{"d", "a"}),
+				announce(t, bob, nostrRepoAnnouncement, 2000, []string{"d", "b"}),
+			},
+			want: []string{npub(bob) + "/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.cfg.nostrKey = self
+			last := announce(t, bob, nostrRepoAnnouncement, 3000, []string{"d", "last"})
+			reqs := make(chan map[string]any, 1)
+			relay := fakeRelay(t, func(p *relayPeer, msg []json.RawMessage) {
+				var typ, sub string
+				var filter map[string]any
+				if len(msg) != 3 || json.Unmarshal(msg[0], &typ) != nil || typ != "REQ" || json.Unmarshal(msg[1], &sub) != nil || json.Unmarshal(msg[2], &filter) != nil {
+					return
+				}
+				reqs <- filter
+				for _, ev := range append(tt.events, last) {
+					p.send("EVENT", sub, ev)
+				}
+				p.send("EOSE", sub)
+			})
+			src, err := parseNostrSource(relay, nil, tt.authors, "repo_announced")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				src.session(ctx, s, &nostrCursor{since: 1000, seen: make(map[string]bool)})
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			select {
+			case filter := <-reqs:
+				if filter["since"] != 1000.0 || !slices.Equal(filter["kinds"].([]any), []any{float64(nostrRepoAnnouncement)}) {
+					t.Errorf("REQ filter %v", filter)
+				}
+				if authors, _ := filter["authors"].([]any); len(authors) != len(src.authors) {
+					t.Errorf("REQ authors %v, want %v", authors, src.authors)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no REQ")
+			}
+			waitFor(t, func() bool {
+				evs := s.hub.recent()
+				return len(evs) > 0 && evs[len(evs)-1].Repo == npub(bob)+"/last"
+			})
+			var got []string
+			for _, ev := range s.hub.recent() {
+				if ev.Type != "repo_announced" || ev.Origin != "nostr" {
+					t.Errorf("published %+v", ev)
+				}
+				got = append(got, ev.Repo)
+			}
+			if want := append(tt.want, npub(bob)+"/last"); !slices.Equal(got, want) {
+				t.Errorf("published %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("carries pubkey and description", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		src := &nostrSource{kinds: []int{nostrRepoAnnouncement}, typ: "repo_cloned"}
+		src.handle(s, announce(t, alice, nostrRepoAnnouncement, 2000, []string{"d", "r"}, []string{"description", "a repo"}), &nostrCursor{seen: make(map[string]bool)})
+		evs := s.hub.recent()
+		if len(evs) != 1 || evs[0].Pubkey != hex.EncodeToString(alice.PublicKey) || evs[0].Description != "a repo" {
+			t.Errorf("published %+v", evs)
+		}
+	})
+}
+
+// TestNostrSourceClosed checks a CLOSED for the subscription ends the
+// session with the relay's reason.
+func TestNostrSourceClosed(t *testing.T) {
+	s := newTestServer(t, nil)
+	relay := fakeRelay(t, func(p *relayPeer, msg []json.RawMessage) {
+		var sub string
+		if len(msg) > 1 && json.Unmarshal(msg[1], &sub) == nil {
+			p.send("CLOSED", sub, "auth-required: sign in first")
+		}
+	})
+	src, err := parseNostrSource(relay, nil, nil, "repo_cloned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connected, err := src.session(ctx, s, &nostrCursor{seen: make(map[string]bool)})
+	if !connected || err == nil || err.Error() != "subscription closed by relay: auth-required: sign in first" {
+		t.Errorf("session = %v, %v", connected, err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+)
+
+var errNotJSON = errors.New("Content-Type must be application/json")
+
+// checkPreface is the WEBHOOK_STRICT_HEADERS check: it looks only at the
+// request line and headers, so junk from scanners and misconfigured clients
+// is turned away before the body is read. It returns the status to answer
+// with, or 0 to go on; a missing signature is returned as the auth error it
+// would become after the read.
+func checkPreface(r *http.Request, signed bool) (int, error) {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return http.StatusUnsupportedMediaType, errNotJSON
+	}
+	if signed {
+		if r.Header.Get("X-Signature") == "" {
+			return http.StatusUnauthorized, errSignatureMissing
+		}
+		if r.Header.Get("X-Timestamp") == "" {
+			return http.StatusUnauthorized, errTimestampMissing
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// watchedBody is a request body that records whether the client ever had
+// to send it.
+type watchedBody struct {
+	r    *bytes.Reader
+	read atomic.Bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.r.Read(p)
+}
+
+// TestStrictHeaders sends every webhook with Expect: 100-continue, so the
+// body only leaves the client once the handler starts reading it. A
+// request turned away on its headers alone never sends its body.
+func TestStrictHeaders(t *testing.T) {
+	body := []byte(`{"repo":"npub1a/r"}`)
+	tests := []struct {
+		name        string
+		strict      string
+		contentType string
+		// unsigned drops X-Signature, untimed X-Timestamp.
+		unsigned, untimed bool
+		status            int
+		bodyRead          bool
+	}{
+		{name: "valid", strict: "true", contentType: "application/json", status: http.StatusAccepted, bodyRead: true},
+		{name: "with a charset", strict: "true", contentType: "application/json; charset=utf-8", status: http.StatusAccepted, bodyRead: true},
+		{name: "no Content-Type", strict: "true", status: http.StatusUnsupportedMediaType},
+		{name: "form post", strict: "true", contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{name: "unparsable Content-Type", strict: "true", contentType: "application/json; =", status: http.StatusUnsupportedMediaType},
+		{name: "no signature", strict: "true", contentType: "application/json", unsigned: true, status: http.StatusUnauthorized},
+		{name: "no timestamp", strict: "true", contentType: "application/json", untimed: true, status: http.StatusUnauthorized},
+		{name: "neither", strict: "true", unsigned: true, status: http.StatusUnsupportedMediaType},
+		// Without the check the same request is only refused once the
+		// body has been read to verify it.
+		{name: "no signature, not strict", strict: "false", contentType: "application/json", unsigned: true, status: http.StatusUnauthorized, bodyRead: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"WEBHOOK_STRICT_HEADERS": tt.strict})
+			srv := serveTest(t, s)
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+			defer client.CloseIdleConnections()
+
+			signed := signedWebhook(t, "s3cret", body)
+			wb := &watchedBody{r: bytes.NewReader(body)}
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/webhooks/repo-cloned", wb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = int64(len(body))
+			req.Header.Set("Expect", "100-continue")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if !tt.unsigned {
+				req.Header.Set("X-Signature", signed.Header.Get("X-Signature"))
+			}
+			if !tt.untimed {
+				req.Header.Set("X-Timestamp", signed.Header.Get("X-Timestamp"))
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := wb.read.Load(); got != tt.bodyRead {
+				t.Errorf("body sent: %v, want %v", got, tt.bodyRead)
+			}
+			if published := len(s.hub.recent()) > 0; published != (tt.status == http.StatusAccepted) {
+				t.Errorf("published: %v", published)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// webhookLimiter is a token bucket per client IP for the webhook endpoint
+// (WEBHOOK_RATE, WEBHOOK_BURST): every accepted webhook fans out to all
+// subscribers, so one flooding sender would otherwise load everyone.
+type webhookLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newWebhookLimiter returns nil (no limit) when rate <= 0.
+func newWebhookLimiter(rate float64, burst int) *webhookLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &webhookLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token for ip. When none is left it reports how long until
+// the next one.
+func (l *webhookLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely: they behave
+// exactly like a fresh one, so only idle IPs are dropped.
+func (l *webhookLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// runSweeper calls sweep every interval until ctx is done.
+func (l *webhookLimiter) runSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.sweep(now)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// receiptLog remembers the outcome of webhooks sent with an
+// Idempotency-Key, so a sender retrying a delivery it never saw answered
+// gets the original response instead of publishing the event twice. Keys
+// expire after ttl, and past max keys the oldest are forgotten early.
+type receiptLog struct {
+	ttl time.Duration
+	max int
+
+	mu   sync.Mutex
+	keys map[string]*receipt
+	// order lists keys oldest first; it may hold keys already dropped
+	// from the map, which are skipped when trimming.
+	order []string
+}
+
+type receipt struct {
+	// status is the response's status field; empty while the first
+	// delivery is still being processed.
+	status  string
+	expires time.Time
+}
+
+// receiptState is what claim found for a key.
+type receiptState int
+
+const (
+	receiptNew receiptState = iota
+	receiptPending
+	receiptDone
+)
+
+// newReceiptLog returns nil (keys ignored) when ttl <= 0.
+func newReceiptLog(ttl time.Duration, max int) *receiptLog {
+	if ttl <= 0 {
+		return nil
+	}
+	return &receiptLog{ttl: ttl, max: max, keys: make(map[string]*receipt)}
+}
+
+// claim looks key up. For a new key it records a pending receipt, which
+// the caller must settle with finish.
+func (l *receiptLog) claim(key string, now time.Time) (string, receiptState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rc, ok := l.keys[key]; ok && now.Before(rc.expires) {
+		if rc.status == "" {
+			return "", receiptPending
+		}
+		return rc.status, receiptDone
+	}
+	l.keys[key] = &receipt{expires: now.Add(l.ttl)}
+	l.order = append(l.order, key)
+	l.trimLocked(now)
+	return "", receiptNew
+}
+
+// finish records the response status for a claimed key. An empty status
+// means the delivery failed, so the key is released for a retry.
+func (l *receiptLog) finish(key, status string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if status == "" {
+		delete(l.keys, key)
+		return
+	}
+	if rc, ok := l.keys[key]; ok {
+		rc.status = status
+		rc.expires = now.Add(l.ttl)
+	}
+}
+
+// trimLocked drops expired keys and, past max, the oldest ones.
+func (l *receiptLog) trimLocked(now time.Time) {
+	drop := 0
+	for _, key := range l.order {
+		rc, ok := l.keys[key]
+		if ok && now.Before(rc.expires) && len(l.keys) <= l.max {
+			break
+		}
+		if ok && rc.status != "" {
+			delete(l.keys, key)
+		} else if ok {
+			// Still pending: keep it, the delivery is in flight.
+			break
+		}
+		drop++
+	}
+	l.order = l.order[drop:]
+}
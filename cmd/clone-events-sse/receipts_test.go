@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// delivery is one webhook POST: body with Idempotency-Key key (if any),
+// expected to be answered with code and, for 202s, status.
+type delivery struct {
+	key, body string
+	code      int
+	status    string
+	replayed  bool
+}
+
+func TestIdempotentWebhook(t *testing.T) {
+	const clone, push = `{"repo":"npub1a/r"}`, `{"type":"repo_pushed","repo":"npub1a/r"}`
+	tests := []struct {
+		name       string
+		env        map[string]string
+		deliveries []delivery
+		published  int
+	}{
+		{
+			name: "retry with the same key",
+			deliveries: []delivery{
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted", replayed: true},
+			},
+			published: 1,
+		},
+		{
+			name: "retry answered the original way whatever it carries",
+			deliveries: []delivery{
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+				{key: "k1", body: push, code: http.StatusAccepted, status: "accepted", replayed: true},
+			},
+			published: 1,
+		},
+		{
+			name: "different keys",
+			deliveries: []delivery{
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+				{key: "k2", body: clone, code: http.StatusAccepted, status: "accepted"},
+			},
+			published: 2,
+		},
+		{
+			name: "no key",
+			deliveries: []delivery{
+				{body: clone, code: http.StatusAccepted, status: "accepted"},
+				{body: clone, code: http.StatusAccepted, status: "accepted"},
+			},
+			published: 2,
+		},
+		{
+			name: "a failed delivery frees its key",
+			deliveries: []delivery{
+				{key: "k1", body: `{"repo":`, code: http.StatusBadRequest},
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted", replayed: true},
+			},
+			published: 1,
+		},
+		{
+			name: "a suppressed outcome is replayed too",
+			env:  map[string]string{"SUPPRESS_REPOS": "npub1a/*"},
+			deliveries: []delivery{
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "suppressed"},
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "suppressed", replayed: true},
+			},
+		},
+		{
+			name: "keys ignored with IDEMPOTENCY_TTL=0",
+			env:  map[string]string{"IDEMPOTENCY_TTL": "0"},
+			deliveries: []delivery{
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+				{key: "k1", body: clone, code: http.StatusAccepted, status: "accepted"},
+			},
+			published: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The dedup window would hide a second publish on its own.
+			env := map[string]string{"DEDUP_WINDOW": "0"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			s := newTestServer(t, env)
+			h := s.routes()
+			for i, d := range tt.deliveries {
+				r := signedWebhook(t, "s3cret", []byte(d.body))
+				if d.key != "" {
+					r.Header.Set("Idempotency-Key", d.key)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != d.code {
+					t.Fatalf("delivery %d: status %d, want %d: %s", i, w.Code, d.code, w.Body)
+				}
+				if got := w.Header().Get("Idempotent-Replayed") == "true"; got != d.replayed {
+					t.Errorf("delivery %d: replayed %v, want %v", i, got, d.replayed)
+				}
+				if d.code != http.StatusAccepted {
+					continue
+				}
+				var resp struct{ Status string }
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Status != d.status {
+					t.Errorf("delivery %d: answered %q, want %q", i, resp.Status, d.status)
+				}
+			}
+			if n := len(s.hub.recent()); n != tt.published {
+				t.Errorf("published %d events, want %d", n, tt.published)
+			}
+		})
+	}
+}
+
+func TestReceiptLog(t *testing.T) {
+	t0 := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name string
+		max  int
+		// run drives the log; it returns the keys that must still be
+		// remembered at the end and the ones that must be forgotten.
+		run func(l *receiptLog) (kept, forgotten []string)
+	}{
+		{
+			name: "expires after the ttl",
+			max:  10,
+			run: func(l *receiptLog) ([]string, []string) {
+				l.claim("old", t0.Add(-30*time.Minute))
+				l.finish("old", "accepted", t0.Add(-30*time.Minute))
+				l.claim("new", t0.Add(50*time.Minute))
+				l.finish("new", "accepted", t0.Add(50*time.Minute))
+				return []string{"new"}, []string{"old"}
+			},
+		},
+		{
+			name: "oldest dropped past max",
+			max:  3,
+			run: func(l *receiptLog) ([]string, []string) {
+				for i := 0; i < 5; i++ {
+					key := fmt.Sprint("k", i)
+					l.claim(key, t0)
+					l.finish(key, "accepted", t0)
+				}
+				return []string{"k2", "k3", "k4"}, []string{"k0", "k1"}
+			},
+		},
+		{
+			name: "in-flight keys outlive the bound",
+			max:  1,
+			run: func(l *receiptLog) ([]string, []string) {
+				l.claim("inflight", t0)
+				l.claim("k1", t0)
+				l.finish("k1", "accepted", t0)
+				l.finish("inflight", "accepted", t0)
+				return []string{"inflight", "k1"}, nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newReceiptLog(time.Hour, tt.max)
+			kept, forgotten := tt.run(l)
+			// Checked just before the newest receipts would expire.
+			at := t0.Add(59 * time.Minute)
+			for _, key := range kept {
+				if status, state := l.claim(key, at); state != receiptDone || status != "accepted" {
+					t.Errorf("%s: state %d %q, want it remembered", key, state, status)
+				}
+			}
+			for _, key := range forgotten {
+				if _, state := l.claim(key, at); state != receiptNew {
+					t.Errorf("%s: state %d, want it forgotten", key, state)
+				}
+			}
+		})
+	}
+
+	l := newReceiptLog(time.Hour, 10)
+	l.claim("k", t0)
+	if _, state := l.claim("k", t0.Add(time.Second)); state != receiptPending {
+		t.Errorf("second claim while in flight: state %d, want pending", state)
+	}
+	if newReceiptLog(0, 10) != nil {
+		t.Error("a zero ttl still keeps receipts")
+	}
+}
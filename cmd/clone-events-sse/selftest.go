@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selftestTimeout bounds each reachability probe.
+const selftestTimeout = 5 * time.Second
+
+// runSelftest checks the environment configuration without listening or
+// publishing anything, writes a pass/fail report to out and returns the
+// exit code.
+func runSelftest(out io.Writer) int {
+	type check struct {
+		name   string
+		err    error
+		detail string
+	}
+	var checks []check
+	add := func(name string, err error, detail string) {
+		checks = append(checks, check{name: name, err: err, detail: detail})
+	}
+
+	cfg, err := loadConfig()
+	add("config", err, "")
+	if err == nil {
+		add("PORT "+cfg.port, checkPort(cfg.port), "")
+		for _, origin := range cfg.allowOrigins {
+			add("ALLOW_ORIGINS "+origin, checkOrigin(origin), "")
+		}
+		switch len(cfg.senders) {
+		case 0:
+			add("webhook auth", nil, "no secrets configured, webhooks are accepted unsigned")
+		default:
+			add("webhook auth", nil, fmt.Sprintf("%d sender(s)", len(cfg.senders)))
+		}
+		if cfg.tlsCertFile != "" {
+			_, err := loadTLSConfig(cfg.tlsCertFile, cfg.tlsKeyFile)
+			add("TLS_CERT_FILE "+cfg.tlsCertFile, err, "")
+		}
+		if cfg.tlsRedirectPort != "" {
+			add("TLS_REDIRECT_PORT "+cfg.tlsRedirectPort, checkPort(cfg.tlsRedirectPort), "")
+		}
+		if cfg.eventsUnixSocket != "" {
+			add("EVENTS_UNIX_SOCKET "+cfg.eventsUnixSocket, checkSocketPath(cfg.eventsUnixSocket), "")
+		}
+		for _, t := range cfg.forwardTargets {
+			status, err := probeForwardTarget(t.URL)
+			add("forward "+t.URL, err, status)
+		}
+	}
+
+	failed := 0
+	for _, c := range checks {
+		switch {
+		case c.err != nil:
+			failed++
+			fmt.Fprintf(out, "❌ %s: %v\n", c.name, c.err)
+		case c.detail != "":
+			fmt.Fprintf(out, "✅ %s: %s\n", c.name, c.detail)
+		default:
+			fmt.Fprintf(out, "✅ %s\n", c.name)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "selftest failed: %d of %d checks\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(out, "selftest passed: %d checks\n", len(checks))
+	return 0
+}
+
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("not a TCP port")
+	}
+	return nil
+}
+
+// checkOrigin accepts "*" or a bare scheme://host[:port] origin, which is
+// the only form browsers send and setCORS compares against.
+func checkOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("expected scheme://host[:port]")
+	}
+	if u.Path == "/" {
+		return fmt.Errorf("trailing slash never matches a browser Origin")
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return fmt.Errorf("a wildcard must be the whole first label, as in https://*.example.com")
+	}
+	return nil
+}
+
+// checkSocketPath verifies the socket can be created: any existing file
+// must be a (stale) socket, and its directory must be writable.
+func checkSocketPath(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("exists and is not a socket")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".selftest-*")
+	if err != nil {
+		return fmt.Errorf("directory not writable: %w", err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// probeForwardTarget sends a HEAD to a forward target. Any HTTP answer,
+// even 405, shows the target is reachable.
+func probeForwardTarget(raw string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, raw, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return "", err
+	}
+	resp.Body.Close()
+	return "reachable (" + resp.Status + ")", nil
+}
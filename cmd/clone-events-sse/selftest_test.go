@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunSelftest(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		methods []string
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer target.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	dir := t.TempDir()
+	writeTargets := func(name string, urls ...string) string {
+		var b strings.Builder
+		b.WriteString("[")
+		for i, u := range urls {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(`{"url":"` + u + `/webhooks/repo-cloned","secret":"down"}`)
+		}
+		b.WriteString("]")
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(b.String()), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	notSocket := filepath.Join(dir, "events.sock")
+	if err := os.WriteFile(notSocket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		code int
+		// lines must each appear in the report, in any order.
+		lines []string
+	}{
+		{
+			name: "good",
+			env: map[string]string{
+				"PORT":                 "8090",
+				"ALLOW_ORIGINS":        "https://gittr.space,https://*.gittr.space",
+				"EVENTS_UNIX_SOCKET":   filepath.Join(dir, "fresh.sock"),
+				"FORWARD_TARGETS_FILE": writeTargets("good.json", target.URL),
+			},
+			code: 0,
+			lines: []string{
+				"✅ PORT 8090",
+				"✅ ALLOW_ORIGINS https://gittr.space",
+				"✅ ALLOW_ORIGINS https://*.gittr.space",
+				"✅ webhook auth: 1 sender(s)",
+				"✅ forward " + target.URL + "/webhooks/repo-cloned: reachable (405 Method Not Allowed)",
+				"selftest passed: 7 checks",
+			},
+		},
+		{
+			name: "broken",
+			env: map[string]string{
+				"PORT":                 "99999",
+				"ALLOW_ORIGINS":        "https://gittr.space/",
+				"EVENTS_UNIX_SOCKET":   notSocket,
+				"FORWARD_TARGETS_FILE": writeTargets("broken.json", target.URL, closedURL),
+			},
+			code: 1,
+			lines: []string{
+				"❌ PORT 99999: not a TCP port",
+				"❌ ALLOW_ORIGINS https://gittr.space/: trailing slash never matches a browser Origin",
+				"❌ EVENTS_UNIX_SOCKET " + notSocket + ": exists and is not a socket",
+				"✅ forward " + target.URL + "/webhooks/repo-cloned",
+				"❌ forward " + closedURL + "/webhooks/repo-cloned",
+				"selftest failed: 4 of 7 checks",
+			},
+		},
+		{
+			name:  "unloadable",
+			env:   map[string]string{"MAX_BUFFER": "lots"},
+			code:  1,
+			lines: []string{"❌ config: ", "selftest failed: 1 of 1 checks"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_SECRET", "s3cret")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			mu.Lock()
+			methods = nil
+			mu.Unlock()
+
+			var out strings.Builder
+			if code := runSelftest(&out); code != tt.code {
+				t.Errorf("exit code %d, want %d", code, tt.code)
+			}
+			report := out.String()
+			for _, line := range tt.lines {
+				if !strings.Contains(report, line) {
+					t.Errorf("report lacks %q:\n%s", line, report)
+				}
+			}
+
+			// A selftest probes but never publishes or listens.
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range methods {
+				if m != http.MethodHead {
+					t.Errorf("forward target got a %s", m)
+				}
+			}
+			if sock := tt.env["EVENTS_UNIX_SOCKET"]; sock != "" && sock != notSocket {
+				if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+					t.Errorf("selftest created the socket (stat: %v)", err)
+				}
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(dir, ".selftest-*")); len(leftovers) != 0 {
+				t.Errorf("probe files left behind: %v", leftovers)
+			}
+		})
+	}
+}
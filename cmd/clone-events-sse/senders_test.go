@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSenderEventKinds configures a cloner that may only announce clones
+// and a janitor that may only announce deletions, and checks each is held
+// to its own kinds whichever secret signs the request.
+func TestSenderEventKinds(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "senders.json")
+	os.WriteFile(file, []byte(`[
+		{"name":"cloner","secret":"clone-secret","types":["repo_cloned"]},
+		{"name":"janitor","secret":"janitor-secret","types":["repo_deleted"],"repos":["npub1a/*"]}
+	]`), 0o600)
+	s := newTestServer(t, map[string]string{"WEBHOOK_SECRET": "", "WEBHOOK_SENDERS_FILE": file})
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		status int
+	}{
+		{"cloner announces a clone", "clone-secret", `{"repo":"npub1a/r","type":"repo_cloned"}`, http.StatusAccepted},
+		{"cloner may not delete", "clone-secret", `{"repo":"npub1a/r","type":"repo_deleted"}`, http.StatusForbidden},
+		{"janitor announces a deletion", "janitor-secret", `{"repo":"npub1a/r","type":"repo_deleted"}`, http.StatusAccepted},
+		{"janitor may not clone", "janitor-secret", `{"repo":"npub1a/r","type":"repo_cloned"}`, http.StatusForbidden},
+		{"janitor outside its repos", "janitor-secret", `{"repo":"npub1b/r","type":"repo_deleted"}`, http.StatusForbidden},
+		// The default type is repo_cloned, so it is checked like one.
+		{"janitor with no type", "janitor-secret", `{"repo":"npub1a/r"}`, http.StatusForbidden},
+		{"one forbidden event in a batch", "clone-secret", `[{"repo":"npub1a/r"},{"repo":"npub1a/s","type":"repo_deleted"}]`, http.StatusForbidden},
+		{"unknown secret", "guess", `{"repo":"npub1a/r"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := s.hub.published.Load()
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, signedWebhook(t, tt.secret, []byte(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+			if published := s.hub.published.Load() - before; (tt.status == http.StatusAccepted) != (published > 0) {
+				t.Errorf("%d events published", published)
+			}
+		})
+	}
+}
+
+func TestSenderHint(t *testing.T) {
+	senders := []*webhookSender{{Name: "a", Secret: "sa"}, {Name: "b", Secret: "sb"}}
+	body := []byte(`{"repo":"r"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := "sha256=" + hexMAC(t, "sb", ts, body)
+	tests := []struct {
+		hint string
+		want string
+		err  error
+	}{
+		{"", "b", nil},
+		{"b", "b", nil},
+		// The hint only narrows the search; it can't claim another identity.
+		{"a", "", errSignatureMismatch},
+		{"c", "", errSignatureMismatch},
+	}
+	for _, tt := range tests {
+		got, err := authenticateSender(senders, tt.hint, ts, &webhookBody{mem: body}, sig, time.Minute)
+		if !errors.Is(err, tt.err) || (got != nil && got.Name != tt.want) || (got == nil && tt.want != "") {
+			t.Errorf("hint %q: sender %v, err %v; want %q, %v", tt.hint, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLoadSenders(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		legacy  string
+		want    []string
+		wantErr string
+	}{
+		{name: "legacy secret only", legacy: "s", want: []string{"default"}},
+		{name: "file and legacy secret", file: `[{"name":"a","secret":"x"}]`, legacy: "s", want: []string{"a", "default"}},
+		{name: "missing secret", file: `[{"name":"a"}]`, wantErr: "needs a name and a secret"},
+		{name: "duplicate name", file: `[{"name":"a","secret":"x"},{"name":"a","secret":"y"}]`, wantErr: "duplicate sender"},
+		{name: "clash with the legacy sender", file: `[{"name":"default","secret":"x"}]`, legacy: "s", wantErr: "duplicate sender"},
+		{name: "bad pattern", file: `[{"name":"a","secret":"x","repos":["["]}]`, wantErr: "bad repo pattern"},
+		{name: "not json", file: `{`, wantErr: "WEBHOOK_SENDERS_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "senders.json")
+				os.WriteFile(path, []byte(tt.file), 0o600)
+			}
+			senders, err := loadSenders(path, tt.legacy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, s := range senders {
+				names = append(names, s.Name)
+			}
+			if !equalStrings(names, tt.want) {
+				t.Errorf("senders %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func hexMAC(t *testing.T, secret, ts string, body []byte) string {
+	t.Helper()
+	mac, err := webhookMAC(secret, ts, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(mac)
+}
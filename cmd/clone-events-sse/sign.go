@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runSign implements --sign: it writes the signature of the payload read
+// from in to out, computed exactly as the webhook handler verifies it,
+// and returns the exit code. The payload is signed byte for byte, so a
+// trailing newline from e.g. `echo` is part of it. The timestamp goes to
+// stderr as the X-Timestamp header to send along.
+func runSign(secret, timestamp, format string, in io.Reader, out io.Writer) int {
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "--sign needs --secret or $WEBHOOK_SECRET")
+		return 2
+	}
+	if timestamp == "" {
+		timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	fmt.Fprintf(os.Stderr, "X-Timestamp: %s\n", timestamp)
+	mac, err := webhookMAC(secret, timestamp, in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read payload: %v\n", err)
+		return 1
+	}
+	switch format {
+	case "hex":
+		fmt.Fprintln(out, hex.EncodeToString(mac))
+	case "sha256=":
+		fmt.Fprintln(out, "sha256="+hex.EncodeToString(mac))
+	case "base64":
+		fmt.Fprintln(out, base64.StdEncoding.EncodeToString(mac))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown --format %q (want hex, sha256= or base64)\n", format)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSign(t *testing.T) {
+	const ts = "1700000000"
+	payload := `{"repo":"npub1a/r","ref":"refs/heads/main"}`
+	tests := []struct {
+		name   string
+		secret string
+		format string
+		// signed is what the sender pipes in, checked is the body the
+		// signature is verified against.
+		signed  string
+		checked string
+		code    int
+		valid   bool
+	}{
+		{name: "hex", secret: "s3cret", format: "hex", signed: payload, checked: payload, valid: true},
+		{name: "prefixed", secret: "s3cret", format: "sha256=", signed: payload, checked: payload, valid: true},
+		{name: "base64", secret: "s3cret", format: "base64", signed: payload, checked: payload, valid: true},
+		{name: "echo's trailing newline is signed too", secret: "s3cret", format: "hex", signed: payload + "\n", checked: payload},
+		{name: "no secret", format: "hex", signed: payload, code: 2},
+		{name: "unknown format", secret: "s3cret", format: "sha1=", signed: payload, code: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := runSign(tt.secret, ts, tt.format, strings.NewReader(tt.signed), &out); code != tt.code {
+				t.Fatalf("exit code %d, want %d", code, tt.code)
+			}
+			if tt.code != 0 {
+				if out.Len() != 0 {
+					t.Errorf("printed %q on failure", out.String())
+				}
+				return
+			}
+			sig := strings.TrimSuffix(out.String(), "\n")
+			if tt.format == "base64" {
+				mac, err := base64.StdEncoding.DecodeString(sig)
+				if err != nil {
+					t.Fatalf("not base64: %q", sig)
+				}
+				sig = hex.EncodeToString(mac)
+			}
+			if got := validSignature(tt.secret, ts, strings.NewReader(tt.checked), sig); got != tt.valid {
+				t.Errorf("validSignature = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+// TestSignedWithRunSign sends a webhook signed by --sign to the handler.
+func TestSignedWithRunSign(t *testing.T) {
+	s := newTestServer(t, nil)
+	body := `{"repo":"npub1a/signed"}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	var out bytes.Buffer
+	if code := runSign("s3cret", ts, "sha256=", strings.NewReader(body), &out); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/repo-cloned", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Timestamp", ts)
+	r.Header.Set("X-Signature", strings.TrimSpace(out.String()))
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
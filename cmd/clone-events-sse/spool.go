@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// webhookBody is a webhook request body, held in memory or, past
+// WEBHOOK_SPOOL_THRESHOLD, in a temp file. Signature checking and decoding
+// read it through open, so a spooled body is never loaded whole.
+type webhookBody struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// open returns a reader over the whole body; each call starts over.
+func (b *webhookBody) open() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.mem)
+}
+
+// Close removes the spool file, if any.
+func (b *webhookBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// readWebhookBody reads a webhook body, undoing a gzip Content-Encoding so
+// that signatures are always checked against the uncompressed JSON. The
+// size cap (maxBody) applies after decompression; a body past it is
+// errBodyTooLarge rather than cut short, which would only surface later as
+// a bad signature. Bodies larger than threshold are spooled to a temp file;
+// a threshold of 0 never spools. The caller must Close the result.
+func readWebhookBody(r *http.Request, maxBody, threshold int64) (*webhookBody, error) {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	// One byte past the cap tells a body that is exactly maxBody from one
+	// that is longer.
+	body = io.LimitReader(body, maxBody+1)
+	if threshold <= 0 || threshold >= maxBody {
+		data, err := io.ReadAll(body)
+		if err == nil && int64(len(data)) > maxBody {
+			err = errBodyTooLarge
+		}
+		return &webhookBody{mem: data, size: int64(len(data))}, err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, threshold+1))
+	if err != nil || int64(len(head)) <= threshold {
+		return &webhookBody{mem: head, size: int64(len(head))}, err
+	}
+	f, err := os.CreateTemp("", "webhook-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	b := &webhookBody{file: f}
+	b.size, err = io.Copy(f, io.MultiReader(bytes.NewReader(head), body))
+	if err == nil && b.size > maxBody {
+		err = errBodyTooLarge
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	slog.Debug("spooled webhook to disk", "bytes", b.size)
+	return b, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadWebhookBodySizeCap(t *testing.T) {
+	const maxBody = 64
+	tests := []struct {
+		name      string
+		size      int
+		threshold int64
+		gzip      bool
+		tooLarge  bool
+		spooled   bool
+	}{
+		{name: "under the cap", size: maxBody - 1},
+		{name: "exactly the cap", size: maxBody},
+		{name: "one byte over", size: maxBody + 1, tooLarge: true},
+		{name: "spooled, exactly the cap", size: maxBody, threshold: 16, spooled: true},
+		{name: "spooled, one byte over", size: maxBody + 1, threshold: 16, tooLarge: true},
+		{name: "spooled, far over", size: 10 * maxBody, threshold: 16, tooLarge: true},
+		{name: "under the spool threshold", size: 16, threshold: 16},
+		// The cap counts decompressed bytes, however small the wire body.
+		{name: "gzip within the cap", size: maxBody, gzip: true},
+		{name: "gzip over the cap", size: 4 * maxBody, gzip: true, tooLarge: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{'a'}, tt.size)
+			wire := data
+			if tt.gzip {
+				wire = gzipped(t, data)
+			}
+			r := httptest.NewRequest("POST", "/webhooks/repo-cloned", bytes.NewReader(wire))
+			if tt.gzip {
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			b, err := readWebhookBody(r, maxBody, tt.threshold)
+			if tt.tooLarge {
+				if !errors.Is(err, errBodyTooLarge) {
+					t.Fatalf("err = %v, want errBodyTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if got := b.file != nil; got != tt.spooled {
+				t.Errorf("spooled = %v, want %v", got, tt.spooled)
+			}
+			got, _ := io.ReadAll(b.open())
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, want the %d sent", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestReadWebhookBodyRemovesRejectedSpool(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	r := httptest.NewRequest("POST", "/webhooks/repo-cloned", bytes.NewReader(make([]byte, 200)))
+	if _, err := readWebhookBody(r, 100, 10); !errors.Is(err, errBodyTooLarge) {
+		t.Fatalf("err = %v, want errBodyTooLarge", err)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("spool file left behind: %v", left[0].Name())
+	}
+}
+
+func TestReadWebhookBodyUnsupportedEncoding(t *testing.T) {
+	r := httptest.NewRequest("POST", "/webhooks/repo-cloned", bytes.NewReader([]byte("{}")))
+	r.Header.Set("Content-Encoding", "br")
+	if _, err := readWebhookBody(r, 100, 0); !errors.Is(err, errUnsupportedEncoding) {
+		t.Fatalf("err = %v, want errUnsupportedEncoding", err)
+	}
+}
+
+// spoolSpy is a request body that, once fully read, notes whether the
+// handler had a spool file open in dir.
+type spoolSpy struct {
+	r       io.Reader
+	dir     string
+	spooled bool
+}
+
+func (s *spoolSpy) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		files, _ := filepath.Glob(filepath.Join(s.dir, "webhook-spool-*"))
+		s.spooled = len(files) > 0
+	}
+	return n, err
+}
+
+// TestSpooledWebhookSignature posts a large batch through the handler. The
+// signature is checked over the spooled bytes like over an in-memory body,
+// and the spool file is gone once the handler returns.
+func TestSpooledWebhookSignature(t *testing.T) {
+	const n = 200
+	var b strings.Builder
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"repo":"npub1batch/repo-%03d","ref":"refs/heads/%s"}`, i, strings.Repeat("b", 200))
+	}
+	b.WriteString("]")
+	body := []byte(b.String())
+	tampered := bytes.Replace(body, []byte("repo-199"), []byte("repo-666"), 1)
+
+	tests := []struct {
+		name      string
+		threshold string
+		sent      []byte
+		status    int
+		spooled   bool
+	}{
+		{name: "spooled", threshold: "4096", sent: body, status: http.StatusAccepted, spooled: true},
+		{name: "in memory", threshold: "0", sent: body, status: http.StatusAccepted},
+		{name: "spooled, tampered", threshold: "4096", sent: tampered, status: http.StatusUnauthorized, spooled: true},
+		{name: "in memory, tampered", threshold: "0", sent: tampered, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+			s := newTestServer(t, map[string]string{"WEBHOOK_SPOOL_THRESHOLD": tt.threshold, "DEDUP_WINDOW": "0", "MAX_BUFFER": strconv.Itoa(n)})
+
+			r := signedWebhook(t, "s3cret", body)
+			spy := &spoolSpy{r: bytes.NewReader(tt.sent), dir: dir}
+			r.Body = io.NopCloser(spy)
+			r.ContentLength = int64(len(tt.sent))
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if spy.spooled != tt.spooled {
+				t.Errorf("spooled = %v, want %v", spy.spooled, tt.spooled)
+			}
+			if left, _ := os.ReadDir(dir); len(left) != 0 {
+				t.Errorf("spool file left behind: %v", left[0].Name())
+			}
+			want := 0
+			if tt.status == http.StatusAccepted {
+				want = n
+			}
+			if got := len(s.hub.recent()); got != want {
+				t.Errorf("published %d events, want %d", got, want)
+			}
+		})
+	}
+}
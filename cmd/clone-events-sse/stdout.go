@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// stdoutSink writes every published event as one JSON line (EVENT_STDOUT),
+// so a log-shipping sidecar can tail the event stream without an HTTP
+// client. Logs go to stderr, so the two never interleave on a line.
+type stdoutSink struct {
+	out io.Writer
+	enc eventEncoder
+}
+
+func newStdoutSink(out io.Writer, enc eventEncoder) *stdoutSink {
+	return &stdoutSink{out: out, enc: enc}
+}
+
+// write is a hub tap, called in publish order under the hub's lock. It
+// encodes ev the way /events does, key map included; a failed write is
+// logged and the event still reaches subscribers.
+func (s *stdoutSink) write(ev repoEvent) {
+	data, err := s.enc.marshal(ev)
+	if err != nil {
+		slog.Warn("stdout event failed", "id", ev.ID, "err", err)
+		return
+	}
+	if _, err := s.out.Write(append(data, '\n')); err != nil {
+		slog.Warn("stdout event failed", "id", ev.ID, "err", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// captureStdout points os.Stdout at a pipe until the returned function is
+// called, which restores it and returns everything written meanwhile.
+func captureStdout(t *testing.T) func() []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	return func() []byte {
+		os.Stdout = orig
+		w.Close()
+		return <-out
+	}
+}
+
+func TestEventStdout(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		payloads []string
+		// want are the keys and values every line must carry, one map
+		// per published event.
+		want []map[string]any
+	}{
+		{
+			name:     "one event",
+			payloads: []string{`{"repo":"npub1a/r","size":42}`},
+			want:     []map[string]any{{"id": 1.0, "type": "repo_cloned", "repo": "npub1a/r"}},
+		},
+		{
+			name:     "in publish order",
+			payloads: []string{`{"repo":"npub1a/one"}`, `{"type":"repo_pushed","repo":"npub1a/two"}`, `[{"repo":"npub1a/three"},{"repo":"npub1a/four"}]`},
+			want: []map[string]any{
+				{"id": 1.0, "repo": "npub1a/one"},
+				{"id": 2.0, "type": "repo_pushed", "repo": "npub1a/two"},
+				{"id": 3.0, "repo": "npub1a/three"},
+				{"id": 4.0, "repo": "npub1a/four"},
+			},
+		},
+		{
+			name:     "keys renamed like the stream's",
+			env:      map[string]string{"EVENT_KEY_MAP": "repo=repository"},
+			payloads: []string{`{"repo":"npub1a/r"}`},
+			want:     []map[string]any{{"repository": "npub1a/r", "repo": nil}},
+		},
+		{
+			name:     "suppressed events stay off stdout",
+			env:      map[string]string{"SUPPRESS_REPOS": "npub1a/quiet"},
+			payloads: []string{`{"repo":"npub1a/quiet"}`, `{"repo":"npub1a/loud"}`},
+			want:     []map[string]any{{"repo": "npub1a/loud"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"EVENT_STDOUT": "1", "DEDUP_WINDOW": "0"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			s := newTestServer(t, env)
+			if !s.cfg.eventStdout {
+				t.Fatal("EVENT_STDOUT=1 not picked up")
+			}
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+			stdout := captureStdout(t)
+			s.hub.taps = append(s.hub.taps, newStdoutSink(os.Stdout, s.enc).write)
+			srv := serveTest(t, s)
+			for _, p := range tt.payloads {
+				if resp := postSigned(t, srv, []byte(p)); resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("post %s: status %d", p, resp.StatusCode)
+				}
+			}
+			out := stdout()
+
+			var lines []map[string]any
+			sc := bufio.NewScanner(bytes.NewReader(out))
+			for sc.Scan() {
+				var line map[string]any
+				if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+					t.Fatalf("stdout line %q isn't JSON: %v", sc.Text(), err)
+				}
+				if _, isLog := line["msg"]; isLog {
+					t.Errorf("log record on stdout: %s", sc.Text())
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("stdout has %d lines, want %d:\n%s", len(lines), len(tt.want), out)
+			}
+			for i, want := range tt.want {
+				for k, v := range want {
+					if lines[i][k] != v {
+						t.Errorf("line %d: %s = %v, want %v", i, k, lines[i][k], v)
+					}
+				}
+			}
+			if logs.Len() == 0 {
+				t.Error("nothing logged; the webhooks should still be")
+			}
+		})
+	}
+}
+
+// TestEventStdoutWriteFails checks a stdout nobody reads doesn't keep
+// events from subscribers.
+func TestEventStdoutWriteFails(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	defer w.Close()
+	hub := newEventHub(10, 0)
+	hub.taps = append(hub.taps, newStdoutSink(w, eventEncoder{}).write)
+	hub.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"})
+	if got := hub.recent(); len(got) != 1 || got[0].Repo != "npub1a/r" {
+		t.Errorf("buffered %+v after a failed stdout write", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferStore keeps the hub's buffer in BUFFER_FILE so a restart doesn't
+// lose it. The file is a hubSnapshot, the same JSON /admin/export serves,
+// and is only ever replaced atomically: a crash leaves either the previous
+// checkpoint or the new one, never a mix.
+type bufferStore struct {
+	path string
+	// every, when positive, also checkpoints once that many events have
+	// been published since the last checkpoint (BUFFER_CHECKPOINT_EVERY).
+	every int64
+	kick  chan struct{}
+
+	mu sync.Mutex
+	// savedSeq and savedLen describe the last checkpoint, so an idle hub
+	// isn't rewritten every interval. savedSeq is also read by published
+	// without the lock.
+	savedSeq atomic.Int64
+	savedLen int
+}
+
+func newBufferStore(path string, every int) *bufferStore {
+	return &bufferStore{path: path, every: int64(every), kick: make(chan struct{}, 1), savedLen: -1}
+}
+
+// bufferLoadFilter picks the events of BUFFER_FILE worth loading:
+// published within since (EVENT_LOAD_SINCE) and of one of types
+// (EVENT_LOAD_TYPES). Zero values let everything through.
+type bufferLoadFilter struct {
+	since time.Duration
+	types []string
+}
+
+// apply drops the snapshot's events the filter doesn't keep. Seq is left
+// alone, so ids still continue after the newest event on file.
+func (f bufferLoadFilter) apply(snap hubSnapshot, now time.Time) hubSnapshot {
+	if f.since == 0 && len(f.types) == 0 {
+		return snap
+	}
+	cutoff := now.Add(-f.since).Unix()
+	kept := make([]snapshotEvent, 0, len(snap.Events))
+	for _, se := range snap.Events {
+		if f.since > 0 && se.Event.Timestamp < cutoff {
+			continue
+		}
+		if len(f.types) > 0 && !slices.Contains(f.types, se.Event.Type) {
+			continue
+		}
+		kept = append(kept, se)
+	}
+	snap.Events = kept
+	return snap
+}
+
+// load restores the hub from the file, keeping what filter lets through. A
+// missing file is a first start; a corrupt one is logged and ignored, since
+// refusing to boot over a lost buffer would be worse than starting empty.
+func (s *bufferStore) load(hub *eventHub, filter bufferLoadFilter) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var snap hubSnapshot
+	if err == nil {
+		err = json.Unmarshal(data, &snap)
+	}
+	var n int
+	if err == nil {
+		n, err = hub.restore(filter.apply(snap, time.Now()))
+	}
+	if err != nil {
+		slog.Warn("BUFFER_FILE unreadable, starting with an empty buffer", "path", s.path, "err", err)
+		return
+	}
+	s.savedSeq.Store(snap.Seq)
+	s.savedLen = len(snap.Events)
+	// skipped counts events that expired, were filtered out or didn't
+	// fit MAX_BUFFER.
+	slog.Info("buffer restored", "path", s.path, "events", n, "seq", snap.Seq, "skipped", len(snap.Events)-n)
+}
+
+// checkpoint writes the hub's current buffer if it changed since the last
+// checkpoint.
+func (s *bufferStore) checkpoint(hub *eventHub) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := hub.snapshot()
+	if snap.Seq == s.savedSeq.Load() && len(snap.Events) == s.savedLen {
+		return nil
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.savedSeq.Store(snap.Seq)
+	s.savedLen = len(snap.Events)
+	return nil
+}
+
+// published is the hub's tap. Once every events have piled up since the
+// last checkpoint it wakes runCheckpoints; the write itself happens there,
+// off the publish path, and covers whatever was published by then.
+func (s *bufferStore) published(ev repoEvent) {
+	if ev.ID-s.savedSeq.Load() < s.every {
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// runCheckpoints checkpoints the hub every interval, and whenever published
+// asks for it, until ctx is done.
+func (s *bufferStore) runCheckpoints(ctx context.Context, hub *eventHub, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		if err := s.checkpoint(hub); err != nil {
+			slog.Warn("checkpoint failed", "path", s.path, "err", err)
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data via a synced temp file and a
+// rename in the same directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
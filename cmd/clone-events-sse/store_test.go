@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readCheckpoint returns the snapshot in path, or ok=false while there is
+// none.
+func readCheckpoint(t *testing.T, path string) (snap hubSnapshot, ok bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snap, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatalf("checkpoint isn't a snapshot: %v", err)
+	}
+	return snap, true
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		every    int
+		// published events are followed by a checkpoint; held ones are
+		// published after it and only make it to disk with every.
+		published int
+		held      int
+		saved     int
+	}{
+		{name: "on the interval", interval: 30 * time.Millisecond, published: 3, saved: 3},
+		{name: "every 2 events", interval: time.Hour, every: 2, published: 2, held: 1, saved: 2},
+		{name: "every 2 events, second batch", interval: time.Hour, every: 2, published: 4, held: 1, saved: 4},
+		{name: "more than fits", interval: 30 * time.Millisecond, published: 7, saved: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.json")
+			hub := newEventHub(5, 0)
+			store := newBufferStore(path, tt.every)
+			store.load(hub, bufferLoadFilter{})
+			if tt.every > 0 {
+				hub.taps = append(hub.taps, store.published)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				store.runCheckpoints(ctx, hub, tt.interval)
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			publish := func(i int) {
+				hub.publish(repoEvent{Type: "repo_cloned", Repo: fmt.Sprintf("npub1a/r%d", i), Timestamp: time.Now().Unix()})
+			}
+			for i := 1; i <= tt.published; i++ {
+				publish(i)
+			}
+			waitFor(t, func() bool {
+				snap, ok := readCheckpoint(t, path)
+				return ok && snap.Seq == int64(tt.published)
+			})
+			for i := 1; i <= tt.held; i++ {
+				publish(tt.published + i)
+			}
+			if tt.held > 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			snap, _ := readCheckpoint(t, path)
+			if len(snap.Events) != tt.saved || snap.Seq != int64(tt.published) {
+				t.Fatalf("checkpoint holds %d events up to %d, want %d up to %d", len(snap.Events), snap.Seq, tt.saved, tt.published)
+			}
+			if leftovers, _ := filepath.Glob(path + ".*.tmp"); len(leftovers) != 0 {
+				t.Errorf("temp files left behind: %v", leftovers)
+			}
+
+			// A restart picks up exactly the checkpoint and numbers on.
+			restarted := newEventHub(5, 0)
+			newBufferStore(path, tt.every).load(restarted, bufferLoadFilter{})
+			got := restarted.recent()
+			if len(got) != tt.saved {
+				t.Fatalf("restored %d events, want %d", len(got), tt.saved)
+			}
+			for i, ev := range got {
+				if want := fmt.Sprintf("npub1a/r%d", tt.published-tt.saved+i+1); ev.Repo != want || ev.ID != int64(tt.published-tt.saved+i+1) {
+					t.Errorf("restored event %d is %d %s, want %s", i, ev.ID, ev.Repo, want)
+				}
+			}
+			restarted.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/after"})
+			if last := restarted.recent()[len(restarted.recent())-1]; last.ID != int64(tt.published)+1 {
+				t.Errorf("first event after the restart has id %d, want %d", last.ID, tt.published+1)
+			}
+		})
+	}
+}
+
+// TestCheckpointIdle checks an unchanged hub isn't rewritten.
+func TestCheckpointIdle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+	hub := newEventHub(5, 0)
+	hub.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/r", Timestamp: time.Now().Unix()})
+	store := newBufferStore(path, 0)
+	if err := store.checkpoint(hub); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.checkpoint(hub); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("idle checkpoint replaced the file")
+	}
+}
+
+func TestLoadCorruptCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+	if err := os.WriteFile(path, []byte(`{"seq":3,"events":[{"seq":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hub := newEventHub(5, 0)
+	newBufferStore(path, 0).load(hub, bufferLoadFilter{})
+	if n := len(hub.recent()); n != 0 {
+		t.Errorf("loaded %d events from a torn file", n)
+	}
+	hub.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"})
+	if id := hub.recent()[0].ID; id != 1 {
+		t.Errorf("first event has id %d, want 1", id)
+	}
+}
+
+// TestLoadFilter restores a buffer file of events of mixed ages and types
+// through EVENT_LOAD_SINCE and EVENT_LOAD_TYPES.
+func TestLoadFilter(t *testing.T) {
+	now := time.Now()
+	stored := []struct {
+		typ, repo string
+		age       time.Duration
+	}{
+		{"repo_cloned", "npub1a/last-week", 7 * 24 * time.Hour},
+		{"repo_pushed", "npub1a/yesterday-push", 26 * time.Hour},
+		{"repo_cloned", "npub1a/this-morning", 5 * time.Hour},
+		{"clone_progress", "npub1a/an-hour-ago", time.Hour},
+		{"repo_pushed", "npub1a/just-pushed", time.Minute},
+		{"repo_cloned", "npub1a/just-cloned", time.Second},
+	}
+	snap := hubSnapshot{Seq: 9}
+	for i, ev := range stored {
+		snap.Events = append(snap.Events, snapshotEvent{
+			Seq:   int64(i + 4),
+			Event: repoEvent{Type: ev.typ, Repo: ev.repo, Timestamp: now.Add(-ev.age).Unix()},
+		})
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		since     string
+		types     string
+		maxBuffer string
+		want      []string
+	}{
+		{
+			name: "no filter",
+			want: []string{"npub1a/last-week", "npub1a/yesterday-push", "npub1a/this-morning", "npub1a/an-hour-ago", "npub1a/just-pushed", "npub1a/just-cloned"},
+		},
+		{
+			name:  "recent only",
+			since: "24h",
+			want:  []string{"npub1a/this-morning", "npub1a/an-hour-ago", "npub1a/just-pushed", "npub1a/just-cloned"},
+		},
+		{
+			name:  "clones only",
+			types: "repo_cloned",
+			want:  []string{"npub1a/last-week", "npub1a/this-morning", "npub1a/just-cloned"},
+		},
+		{
+			name:  "recent clones and pushes",
+			since: "6h",
+			types: "repo_cloned, repo_pushed",
+			want:  []string{"npub1a/this-morning", "npub1a/just-pushed", "npub1a/just-cloned"},
+		},
+		{
+			name:      "filtered before the buffer is capped",
+			types:     "repo_pushed",
+			maxBuffer: "1",
+			want:      []string{"npub1a/just-pushed"},
+		},
+		{
+			name:  "nothing left",
+			since: "1h",
+			types: "server_shutdown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.json")
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			env := map[string]string{"BUFFER_FILE": path, "EVENT_LOAD_SINCE": tt.since, "EVENT_LOAD_TYPES": tt.types}
+			if tt.maxBuffer != "" {
+				env["MAX_BUFFER"] = tt.maxBuffer
+			}
+			s := newTestServer(t, env)
+			newBufferStore(path, 0).load(s.hub, s.cfg.bufferLoad)
+
+			var got []string
+			for _, ev := range s.hub.recent() {
+				got = append(got, ev.Repo)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("buffer holds %q, want %q", got, tt.want)
+			}
+			// Ids go on from the file's, whatever was left out.
+			s.hub.publish(repoEvent{Type: "repo_cloned", Repo: "npub1a/next"})
+			if evs := s.hub.recent(); evs[len(evs)-1].ID != snap.Seq+1 {
+				t.Errorf("next event has id %d, want %d", evs[len(evs)-1].ID, snap.Seq+1)
+			}
+		})
+	}
+}
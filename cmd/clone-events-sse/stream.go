@@ -0,0 +1,276 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamFormat is one way of framing events on /events.
+type streamFormat struct {
+	name        string
+	contentType string
+	// frame wraps an encoded event; probe and keepalive are frames
+	// clients ignore.
+	frame     func(ev repoEvent, data []byte) []byte
+	probe     string
+	keepalive string
+}
+
+var (
+	formatSSE = streamFormat{
+		name:        "sse",
+		contentType: "text/event-stream",
+		frame: func(ev repoEvent, data []byte) []byte {
+			if ev.control() {
+				// No id, so the client's Last-Event-ID stays put. The
+				// retry spreads EventSource reconnects out.
+				return []byte(fmt.Sprintf("retry: %d\ndata: %s\n\n", jitter(controlRetry, 0.5).Milliseconds(), data))
+			}
+			return []byte(fmt.Sprintf("id: %d\ndata: %s\n\n", ev.ID, data))
+		},
+		probe:     ": probe\n\n",
+		keepalive: ": keepalive\n\n",
+	}
+	// formatNDJSON is one event JSON per line, for consumers that aren't
+	// EventSource clients. Probes and keepalives are empty lines.
+	formatNDJSON = streamFormat{
+		name:        "ndjson",
+		contentType: "application/x-ndjson",
+		frame: func(ev repoEvent, data []byte) []byte {
+			return append(append([]byte(nil), data...), '\n')
+		},
+		probe:     "\n",
+		keepalive: "\n",
+	}
+)
+
+// controlRetry is the reconnect delay an SSE control message asks for,
+// ±50% per stream.
+const controlRetry = 5 * time.Second
+
+var errUnknownFormat = errors.New("unknown stream format")
+
+// negotiateStream picks a subscriber's format and compression. The format
+// comes from ?format= or, failing that, the Accept header; SSE is the
+// default. The stream is gzipped when the client accepts it; ?compress=
+// overrides that either way, since identity is the only way for a client
+// whose Accept-Encoding it can't change, like EventSource, to opt out.
+func negotiateStream(r *http.Request) (format streamFormat, gzipped bool, err error) {
+	q := r.URL.Query()
+	switch q.Get("format") {
+	case "":
+		format = formatSSE
+		if strings.Contains(r.Header.Get("Accept"), formatNDJSON.contentType) {
+			format = formatNDJSON
+		}
+	case formatSSE.name:
+		format = formatSSE
+	case formatNDJSON.name:
+		format = formatNDJSON
+	default:
+		return format, false, fmt.Errorf("%w %q", errUnknownFormat, q.Get("format"))
+	}
+	switch q.Get("compress") {
+	case "":
+		gzipped = acceptsGzip(r.Header)
+	case "identity":
+	case "gzip":
+		gzipped = true
+	default:
+		return format, false, fmt.Errorf("%w: compress=%q", errUnsupportedEncoding, q.Get("compress"))
+	}
+	return format, gzipped, nil
+}
+
+// acceptsGzip reports whether Accept-Encoding lists gzip with a non-zero
+// quality.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+			if !ok {
+				return true
+			}
+			if w, err := strconv.ParseFloat(q, 64); err == nil && w > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscriberStream is the write side of one /events connection: frames go
+// to out, which is the response itself or a gzip writer on top of it.
+type subscriberStream struct {
+	out    io.Writer
+	zw     *gzip.Writer
+	rc     *http.ResponseController
+	format streamFormat
+}
+
+func newSubscriberStream(w http.ResponseWriter, rc *http.ResponseController, format streamFormat, gzipped bool) *subscriberStream {
+	st := &subscriberStream{out: w, rc: rc, format: format}
+	if gzipped {
+		st.zw = gzip.NewWriter(w)
+		st.out = st.zw
+	}
+	return st
+}
+
+// flush pushes everything written so far to the client.
+func (st *subscriberStream) flush() error {
+	if st.zw != nil {
+		if err := st.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	return st.rc.Flush()
+}
+
+// close ends a gzip stream cleanly; the connection is going away anyway,
+// so its error is of no interest.
+func (st *subscriberStream) close() {
+	if st.zw != nil {
+		st.zw.Close()
+	}
+}
+
+// frameCache holds encoded frames so an event going out to many
+// subscribers in the same format is encoded once, not once per stream.
+// Compression is per connection and happens after the cache.
+type frameCache struct {
+	// maxEventBytes is SSE_MAX_EVENT_BYTES; 0 means no limit.
+	maxEventBytes int
+
+	mu     sync.Mutex
+	frames map[frameKey][]byte
+	// keep is how many sequence numbers behind the newest cached frame an
+	// entry survives; older ones can only be needed for a replay.
+	keep int64
+	max  int64
+}
+
+type frameKey struct {
+	seq    int64
+	format string
+}
+
+func newFrameCache(keep, maxEventBytes int) *frameCache {
+	return &frameCache{frames: make(map[frameKey][]byte), keep: int64(keep), maxEventBytes: maxEventBytes}
+}
+
+func (c *frameCache) get(enc eventEncoder, format streamFormat, ev repoEvent) ([]byte, error) {
+	// Control messages are rare and framed per stream.
+	if ev.control() {
+		data, err := c.encode(enc, ev)
+		if err != nil {
+			return nil, err
+		}
+		return format.frame(ev, data), nil
+	}
+	key := frameKey{ev.ID, format.name}
+	c.mu.Lock()
+	frame, ok := c.frames[key]
+	c.mu.Unlock()
+	if ok {
+		return frame, nil
+	}
+
+	data, err := c.encode(enc, ev)
+	if err != nil {
+		return nil, err
+	}
+	frame = format.frame(ev, data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames[key] = frame
+	if ev.ID > c.max {
+		c.max = ev.ID
+		for k := range c.frames {
+			if k.seq <= c.max-c.keep {
+				delete(c.frames, k)
+			}
+		}
+	}
+	return frame, nil
+}
+
+// encode marshals ev, dropping its enrichment metadata when the result
+// would exceed maxEventBytes. The core fields are always sent, even if
+// they alone are over the limit.
+func (c *frameCache) encode(enc eventEncoder, ev repoEvent) ([]byte, error) {
+	data, err := enc.marshal(ev)
+	if err != nil || c.maxEventBytes <= 0 || len(data) <= c.maxEventBytes {
+		return data, err
+	}
+	size := len(data)
+	ev.Description, ev.DefaultBranch = "", ""
+	ev.Truncated = true
+	if data, err = enc.marshal(ev); err != nil {
+		return nil, err
+	}
+	slog.Warn("event over SSE_MAX_EVENT_BYTES, sent without metadata", "id", ev.ID, "repo", ev.Repo, "bytes", size, "sent_bytes", len(data))
+	return data, nil
+}
+
+// probeSubscriber writes a frame clients ignore and flushes it. A dead
+// peer surfaces as a write error, or as a missed deadline once the socket
+// buffer is full, instead of lingering until the next event.
+func probeSubscriber(st *subscriberStream, timeout time.Duration) error {
+	if err := st.rc.SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := fmt.Fprint(st.out, st.format.probe); err != nil {
+		return err
+	}
+	if err := st.flush(); err != nil {
+		return err
+	}
+	if err := st.rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// retry asks an SSE client to wait ms milliseconds before reconnecting,
+// as a frame holding only the retry field, which EventSource applies
+// without dispatching an event. Other formats have no such field.
+func (st *subscriberStream) retry(ms int) error {
+	if st.format.name != formatSSE.name || ms <= 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(st.out, "retry: %d\n\n", ms)
+	return err
+}
+
+// keepalive writes and flushes a frame clients ignore, so proxies that
+// close silent connections see traffic.
+func (st *subscriberStream) keepalive() error {
+	if _, err := io.WriteString(st.out, st.format.keepalive); err != nil {
+		return err
+	}
+	return st.flush()
+}
+
+// writeEvent writes ev as one frame in the subscriber's format.
+func (s *server) writeEvent(st *subscriberStream, ev repoEvent) error {
+	frame, err := s.frames.get(s.enc, st.format, ev)
+	if err != nil {
+		return err
+	}
+	_, err = st.out.Write(frame)
+	return err
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ghostWriter is a stream whose client can vanish without a RST: once dead
+// every write fails, as it would when the kernel gives up on the peer.
+type ghostWriter struct {
+	header http.Header
+	dead   atomic.Bool
+	mu     sync.Mutex
+	writes int
+}
+
+func (g *ghostWriter) Header() http.Header { return g.header }
+func (g *ghostWriter) WriteHeader(int)     {}
+
+func (g *ghostWriter) Write(p []byte) (int, error) {
+	if g.dead.Load() {
+		return 0, errors.New("write: broken pipe")
+	}
+	g.mu.Lock()
+	g.writes++
+	g.mu.Unlock()
+	return len(p), nil
+}
+
+func (g *ghostWriter) Flush() {}
+
+func (g *ghostWriter) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.writes
+}
+
+// TestReaperDropsDeadSubscriber publishes nothing: the probe alone must
+// notice the dead client within one reap interval and free its slot.
+func TestReaperDropsDeadSubscriber(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		kill   bool
+	}{
+		{name: "dead sse", kill: true},
+		{name: "dead ndjson", query: "?format=ndjson", kill: true},
+		{name: "dead gzipped", header: http.Header{"Accept-Encoding": {"gzip"}}, kill: true},
+		{name: "live client kept"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{
+				"SUBSCRIBER_REAP_INTERVAL": interval.String(),
+				"SUBSCRIBER_REAP_JITTER":   "0",
+				"HEARTBEAT_INTERVAL":       "0",
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil).WithContext(ctx)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := &ghostWriter{header: http.Header{}}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.streamEvents(w, r, nil)
+			}()
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+
+			if tt.kill {
+				w.dead.Store(true)
+			}
+			start := time.Now()
+			select {
+			case <-done:
+				if !tt.kill {
+					t.Fatal("live subscriber was reaped")
+				}
+				if took := time.Since(start); took > interval+interval/2 {
+					t.Errorf("reaped after %v, want within %v", took, interval)
+				}
+				if n := s.hub.subscriberCount(); n != 0 {
+					t.Errorf("%d subscribers left after the reap", n)
+				}
+			case <-time.After(3 * interval):
+				if tt.kill {
+					t.Fatal("dead subscriber not reaped")
+				}
+				// The live client stays, and keeps being probed.
+				before := w.count()
+				time.Sleep(interval + interval/2)
+				if w.count() <= before {
+					t.Error("no probe written to the live client")
+				}
+				cancel()
+				<-done
+			}
+		})
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+	}
+}
+
+// probeTimes reads n probe frames from br, returning when each arrived.
+func probeTimes(br *bufio.Reader, n int) ([]time.Time, error) {
+	var at []time.Time
+	for len(at) < n {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return at, err
+		}
+		if line == ": probe\n" {
+			at = append(at, time.Now())
+		}
+	}
+	return at, nil
+}
+
+// TestProbeJitterSpreadsStreams opens two streams together and checks
+// their probes drift apart instead of flushing in lockstep.
+func TestProbeJitterSpreadsStreams(t *testing.T) {
+	const (
+		interval = 80 * time.Millisecond
+		probes   = 4
+	)
+	s := newTestServer(t, map[string]string{
+		"SUBSCRIBER_REAP_INTERVAL": interval.String(),
+		"SUBSCRIBER_REAP_JITTER":   "0.5",
+		"HEARTBEAT_INTERVAL":       "0",
+	})
+	srv := serveTest(t, s)
+	var (
+		wg    sync.WaitGroup
+		times [2][]time.Time
+	)
+	for i := range times {
+		_, br := openStream(t, srv.Client(), srv.URL+"/events?compress=identity", nil)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if times[i], err = probeTimes(br, probes); err != nil {
+				t.Errorf("stream %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	var spread time.Duration
+	for k := 0; k < probes; k++ {
+		d := times[0][k].Sub(times[1][k])
+		if d < 0 {
+			d = -d
+		}
+		spread = max(spread, d)
+	}
+	if spread < interval/10 {
+		t.Errorf("probes of the two streams at most %v apart over %d intervals", spread, probes)
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	const d = time.Second
+	if got := jitter(d, 0); got != d {
+		t.Fatalf("jitter(%v, 0) = %v", d, got)
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		got := jitter(d, 0.2)
+		if got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Fatalf("jitter(%v, 0.2) = %v, outside ±20%%", d, got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("only %d distinct intervals in 1000 draws", len(seen))
+	}
+}
+
+// TestNegotiatedSubscribers has subscribers pick different formats and
+// compression for the same event. Each must decode it intact, and the
+// event is framed once per format however many streams share it.
+func TestNegotiatedSubscribers(t *testing.T) {
+	s := newTestServer(t, map[string]string{"HEARTBEAT_INTERVAL": "0"})
+	srv := serveTest(t, s)
+	// The test decompresses itself, to see what was on the wire.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	subscribers := []struct {
+		name     string
+		query    string
+		header   http.Header
+		format   string
+		encoding string
+	}{
+		{name: "sse, gzip by Accept-Encoding", header: http.Header{"Accept-Encoding": {"gzip"}}, format: "sse", encoding: "gzip"},
+		{name: "sse, identity by query", query: "?compress=identity", header: http.Header{"Accept-Encoding": {"gzip"}}, format: "sse"},
+		{name: "ndjson by Accept", header: http.Header{"Accept": {"application/x-ndjson"}}, format: "ndjson"},
+		{name: "ndjson and gzip by query", query: "?format=ndjson&compress=gzip", format: "ndjson", encoding: "gzip"},
+	}
+	readers := make([]*bufio.Reader, len(subscribers))
+	for i, sub := range subscribers {
+		resp, br := openStream(t, client, srv.URL+"/events"+sub.query, sub.header)
+		if got := resp.Header.Get("Content-Encoding"); got != sub.encoding {
+			t.Fatalf("%s: Content-Encoding %q, want %q", sub.name, got, sub.encoding)
+		}
+		if sub.encoding == "gzip" {
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				t.Fatalf("%s: %v", sub.name, err)
+			}
+			br = bufio.NewReader(zr)
+		}
+		readers[i] = br
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == len(subscribers) })
+
+	if resp := postSigned(t, srv, []byte(`{"repo":"npub1a/negotiated","ref":"refs/heads/main"}`)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("webhook: status %d", resp.StatusCode)
+	}
+	want := s.hub.recent()[0]
+
+	for i, sub := range subscribers {
+		var data string
+		switch sub.format {
+		case "sse":
+			data = readFrame(t, readers[i]).data
+		case "ndjson":
+			for data == "" {
+				line, err := readers[i].ReadString('\n')
+				if err != nil {
+					t.Fatalf("%s: %v", sub.name, err)
+				}
+				data = strings.TrimSuffix(line, "\n")
+			}
+		}
+		var got repoEvent
+		if err := json.Unmarshal([]byte(data), &got); err != nil {
+			t.Fatalf("%s: %v in %q", sub.name, err, data)
+		}
+		if got.ID != want.ID || got.Repo != want.Repo || got.Ref != want.Ref || got.Timestamp != want.Timestamp {
+			t.Errorf("%s: got %+v, want %+v", sub.name, got, want)
+		}
+	}
+
+	s.frames.mu.Lock()
+	defer s.frames.mu.Unlock()
+	var formats []string
+	for key := range s.frames.frames {
+		if key.seq == want.ID {
+			formats = append(formats, key.format)
+		}
+	}
+	if len(formats) != 2 {
+		t.Errorf("event framed for %q, want once each for sse and ndjson", formats)
+	}
+}
+
+// staticLookup enriches every repo with the same metadata.
+type staticLookup repoMeta
+
+func (l staticLookup) Lookup(ctx context.Context, repo string) (repoMeta, error) {
+	return repoMeta(l), nil
+}
+
+// TestOversizedEventTruncated streams events whose enrichment pushes them
+// past SSE_MAX_EVENT_BYTES. The metadata goes, the core fields stay.
+func TestOversizedEventTruncated(t *testing.T) {
+	huge := strings.Repeat("a very long description ", 100)
+	longRef := "refs/heads/" + strings.Repeat("x", 1000)
+	tests := []struct {
+		name      string
+		limit     string
+		meta      repoMeta
+		ref       string
+		truncated bool
+	}{
+		{name: "fits", limit: "512", meta: repoMeta{Description: "short", DefaultBranch: "main"}, ref: "refs/heads/main"},
+		{name: "metadata dropped", limit: "512", meta: repoMeta{Description: huge, DefaultBranch: "main"}, ref: "refs/heads/main", truncated: true},
+		{name: "core fields over the limit alone", limit: "512", meta: repoMeta{Description: "short"}, ref: longRef, truncated: true},
+		{name: "no limit", limit: "0", meta: repoMeta{Description: huge, DefaultBranch: "main"}, ref: "refs/heads/main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"SSE_MAX_EVENT_BYTES": tt.limit, "HEARTBEAT_INTERVAL": "0"})
+			s.enricher = newEnricher(staticLookup(tt.meta), time.Second, 0)
+			srv := serveTest(t, s)
+			_, br := openStream(t, srv.Client(), srv.URL+"/events?compress=identity", nil)
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+
+			body := `{"repo":"npub1a/big","ref":"` + tt.ref + `"}`
+			if resp := postSigned(t, srv, []byte(body)); resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("webhook: status %d", resp.StatusCode)
+			}
+			f := readFrame(t, br)
+			var ev map[string]any
+			if err := json.Unmarshal([]byte(f.data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range map[string]any{"type": "repo_cloned", "repo": "npub1a/big", "ref": tt.ref} {
+				if ev[field] != want {
+					t.Errorf("%s = %v, want %v", field, ev[field], want)
+				}
+			}
+			if _, ok := ev["id"]; !ok {
+				t.Error("id missing")
+			}
+			if _, ok := ev["timestamp"]; !ok {
+				t.Error("timestamp missing")
+			}
+			if got := ev["truncated"] == true; got != tt.truncated {
+				t.Errorf("truncated = %v, want %v", ev["truncated"], tt.truncated)
+			}
+			_, hasMeta := ev["description"]
+			if hasMeta == tt.truncated {
+				t.Errorf("description present = %v with truncated = %v", hasMeta, tt.truncated)
+			}
+			// The buffer keeps the full event; only the frame was cut.
+			if got := s.hub.recent()[0].Description; got != tt.meta.Description {
+				t.Errorf("buffered description is %d bytes, want %d", len(got), len(tt.meta.Description))
+			}
+		})
+	}
+}
+
+// TestSSERetry checks the first thing on an SSE stream is the retry field
+// SSE_RETRY_MS sets, alone in its frame, ahead of the replayed events.
+func TestSSERetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		retry  string
+		path   string
+		header http.Header
+		// want is the stream's first frame.
+		want string
+	}{
+		{name: "default", path: "/events", want: "retry: 3000\n\n"},
+		{name: "configured", retry: "30000", path: "/events", want: "retry: 30000\n\n"},
+		{name: "repo stream", retry: "30000", path: "/events/repo/npub1a/r", want: "retry: 30000\n\n"},
+		{name: "disabled", retry: "0", path: "/events", want: "id: 1\n"},
+		{name: "ndjson", retry: "30000", path: "/events", header: http.Header{"Accept": {"application/x-ndjson"}}, want: `{"schema`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"HEARTBEAT_INTERVAL": "0"}
+			if tt.retry != "" {
+				env["SSE_RETRY_MS"] = tt.retry
+			}
+			s := newTestServer(t, env)
+			srv := serveTest(t, s)
+			s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"}, 0)
+			_, br := openStream(t, srv.Client(), srv.URL+tt.path, tt.header)
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(br, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("stream starts with %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"-1", "3s"} {
+		t.Run("SSE_RETRY_MS="+bad, func(t *testing.T) {
+			t.Setenv("WEBHOOK_SECRET", "s3cret")
+			t.Setenv("SSE_RETRY_MS", bad)
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "SSE_RETRY_MS") {
+				t.Errorf("loadConfig error = %v, want one about SSE_RETRY_MS", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Reasons a webhook is suppressed; each is a label value of
+// webhook_suppressed_total.
+const (
+	suppressedRepo      = "repo"
+	suppressedSize      = "size"
+	suppressedDuplicate = "duplicate"
+)
+
+var suppressReasons = []string{suppressedRepo, suppressedSize, suppressedDuplicate}
+
+// emitFilter decides which accepted webhooks are actually published. The
+// zero value publishes everything.
+type emitFilter struct {
+	// ignoreRepos are path.Match patterns (SUPPRESS_REPOS).
+	ignoreRepos []string
+	// minSize suppresses payloads reporting fewer bytes (SUPPRESS_MIN_SIZE);
+	// payloads without a size are never suppressed for it.
+	minSize int64
+}
+
+func newEmitFilter(ignoreRepos []string, minSize int64) (emitFilter, error) {
+	for _, pattern := range ignoreRepos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return emitFilter{}, fmt.Errorf("SUPPRESS_REPOS: bad pattern %q", pattern)
+		}
+	}
+	if minSize < 0 {
+		return emitFilter{}, fmt.Errorf("SUPPRESS_MIN_SIZE must not be negative")
+	}
+	return emitFilter{ignoreRepos: ignoreRepos, minSize: minSize}, nil
+}
+
+// suppress reports whether p should be acknowledged without publishing,
+// and why.
+func (f emitFilter) suppress(p webhookPayload) (string, bool) {
+	for _, pattern := range f.ignoreRepos {
+		if ok, _ := path.Match(pattern, p.Repo); ok {
+			return suppressedRepo, true
+		}
+	}
+	if f.minSize > 0 && p.Size > 0 && p.Size < f.minSize {
+		return suppressedSize, true
+	}
+	return "", false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEmitPredicate(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		body string
+		// reason is the suppression rule expected to match; empty means
+		// the event is published.
+		reason string
+	}{
+		{name: "default emits all", body: `{"repo":"npub1a/test-repo","size":1}`},
+		{name: "glob suppresses", env: map[string]string{"SUPPRESS_REPOS": "*/test-*"}, body: `{"repo":"npub1a/test-repo"}`, reason: suppressedRepo},
+		{name: "glob emits others", env: map[string]string{"SUPPRESS_REPOS": "*/test-*"}, body: `{"repo":"npub1a/prod-repo"}`},
+		{name: "second glob suppresses", env: map[string]string{"SUPPRESS_REPOS": "npub1bot/*,*/test-*"}, body: `{"repo":"npub1bot/anything"}`, reason: suppressedRepo},
+		{name: "small clone suppressed", env: map[string]string{"SUPPRESS_MIN_SIZE": "1024"}, body: `{"repo":"npub1a/r","size":1023}`, reason: suppressedSize},
+		{name: "clone at the threshold emitted", env: map[string]string{"SUPPRESS_MIN_SIZE": "1024"}, body: `{"repo":"npub1a/r","size":1024}`},
+		{name: "unknown size emitted", env: map[string]string{"SUPPRESS_MIN_SIZE": "1024"}, body: `{"repo":"npub1a/r"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env)
+			h := s.routes()
+			before := scrape(t, h)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, signedWebhook(t, "s3cret", []byte(tt.body)))
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status %d, want 202 either way", w.Code)
+			}
+			want := 1
+			if tt.reason != "" {
+				want = 0
+			}
+			if got := len(s.hub.recent()); got != want {
+				t.Errorf("published %d events, want %d", got, want)
+			}
+
+			after := scrape(t, h)
+			for _, reason := range suppressReasons {
+				key := `webhook_suppressed_total{reason="` + reason + `"}`
+				want := before[key]
+				if reason == tt.reason {
+					want++
+				}
+				if after[key] != want {
+					t.Errorf("%s = %d, want %d", key, after[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewEmitFilterRejects(t *testing.T) {
+	if _, err := newEmitFilter([]string{"npub1a/[test"}, 0); err == nil {
+		t.Error("accepted a malformed glob")
+	}
+	if _, err := newEmitFilter(nil, -1); err == nil {
+		t.Error("accepted a negative size")
+	}
+}
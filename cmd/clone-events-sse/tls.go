@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// loadTLSConfig reads the certificate chain and key for HTTPS
+// (TLS_CERT_FILE, TLS_KEY_FILE) at startup, so a bad pair fails fast
+// rather than on the first handshake.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// redirectToHTTPS answers every request with a 308 to the same URL over
+// https on port, which is left out of the URL when it is 443. Unlike a
+// 301, a 308 keeps the method, so a POST stays a POST.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a certificate for 127.0.0.1 and its key as PEM files
+// and returns their paths with a pool that trusts the certificate.
+func selfSigned(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "clone-events-sse test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeHTTPS(t *testing.T) {
+	certFile, keyFile, pool := selfSigned(t)
+	s := newTestServer(t, nil)
+	cfg, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(s.routes())
+	srv.TLS = cfg
+	// The refused handshakes are the point here, not worth a log line.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		client  *tls.Config
+		wantErr string
+	}{
+		{name: "trusted", client: &tls.Config{RootCAs: pool}},
+		{name: "TLS 1.1 refused", client: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, wantErr: "protocol version"},
+		{name: "unknown certificate", client: &tls.Config{}, wantErr: "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.client}}
+			defer client.CloseIdleConnections()
+			resp, err := client.Get(srv.URL + "/health")
+			if tt.wantErr != "" {
+				if err == nil {
+					resp.Body.Close()
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GET: %v, want an error about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+				t.Errorf("status %d, TLS %v", resp.StatusCode, resp.TLS != nil)
+			}
+		})
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	certFile, keyFile, _ := selfSigned(t)
+	_, otherKey, _ := selfSigned(t)
+	tests := []struct {
+		name       string
+		cert, key  string
+		wantLoaded bool
+	}{
+		{name: "pair", cert: certFile, key: keyFile, wantLoaded: true},
+		{name: "key of another certificate", cert: certFile, key: otherKey},
+		{name: "missing certificate", cert: filepath.Join(t.TempDir(), "nope.pem"), key: keyFile},
+		{name: "key and cert swapped", cert: keyFile, key: certFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTLSConfig(tt.cert, tt.key)
+			if (err == nil) != tt.wantLoaded {
+				t.Fatalf("loadTLSConfig: %v", err)
+			}
+			if tt.wantLoaded && (len(cfg.Certificates) != 1 || cfg.MinVersion != tls.VersionTLS12) {
+				t.Errorf("config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name, method, host, target, port string
+		status                           int
+		location                         string
+	}{
+		{name: "path and query kept", method: http.MethodGet, host: "events.example", target: "/events?repo=npub1a/r&prefix=x", port: "443", status: http.StatusPermanentRedirect, location: "https://events.example/events?repo=npub1a/r&prefix=x"},
+		{name: "plain port dropped", method: http.MethodGet, host: "events.example:80", target: "/health", port: "443", status: http.StatusPermanentRedirect, location: "https://events.example/health"},
+		{name: "other https port", method: http.MethodGet, host: "events.example:8080", target: "/events/recent", port: "8443", status: http.StatusPermanentRedirect, location: "https://events.example:8443/events/recent"},
+		{name: "IPv6", method: http.MethodGet, host: "[::1]:80", target: "/", port: "443", status: http.StatusPermanentRedirect, location: "https://[::1]/"},
+		{name: "IPv6, other port", method: http.MethodGet, host: "[::1]", target: "/", port: "8443", status: http.StatusPermanentRedirect, location: "https://[::1]:8443/"},
+		{name: "POST keeps its method", method: http.MethodPost, host: "events.example", target: "/webhooks/repo-cloned", port: "443", status: http.StatusPermanentRedirect, location: "https://events.example/webhooks/repo-cloned"},
+		{name: "no host", method: http.MethodGet, target: "/", port: "443", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader("{}"))
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			redirectToHTTPS(tt.port).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+// TestRedirectListener follows a redirect from a plain HTTP listener to
+// the HTTPS one, the way both are started with TLS_REDIRECT.
+func TestRedirectListener(t *testing.T) {
+	certFile, keyFile, pool := selfSigned(t)
+	s := newTestServer(t, map[string]string{"DEDUP_WINDOW": "0"})
+	cfg, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure := httptest.NewUnstartedServer(s.routes())
+	secure.TLS = cfg
+	secure.StartTLS()
+	defer secure.Close()
+	_, port, _ := net.SplitHostPort(secure.Listener.Addr().String())
+	plain := httptest.NewServer(redirectToHTTPS(port))
+	defer plain.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	defer client.CloseIdleConnections()
+	s.emit(repoEvent{Type: "repo_cloned", Repo: "npub1a/r"}, 0)
+	resp, err := client.Get(plain.URL + "/events/recent?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Fatalf("status %d, TLS %v", resp.StatusCode, resp.TLS != nil)
+	}
+	if want := secure.URL + "/events/recent?limit=1"; resp.Request.URL.String() != want {
+		t.Errorf("ended at %s, want %s", resp.Request.URL, want)
+	}
+
+	// A webhook sent to http:// is repeated, body and all, over https.
+	body := []byte(`{"repo":"npub1a/redirected"}`)
+	signed := signedWebhook(t, "s3cret", body)
+	req, err := http.NewRequest(http.MethodPost, plain.URL+signed.URL.Path, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = signed.Header
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("webhook through the redirect: status %d", resp.StatusCode)
+	}
+	if evs := s.hub.recent(); evs[len(evs)-1].Repo != "npub1a/redirected" {
+		t.Errorf("last event %+v", evs[len(evs)-1])
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket keepalive: a ping goes out every wsPingInterval, and a
+// connection that sends nothing, not even the pong, for wsPongWait is
+// considered dead.
+const (
+	wsPingInterval = 20 * time.Second
+	wsPongWait     = 2 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+	// wsMaxMessage caps what a client may send; it has nothing to say
+	// but control frames.
+	wsMaxMessage = 4 << 10
+)
+
+// wsGUID is the fixed key suffix of the RFC 6455 handshake.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes and close codes used here.
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsCloseGoingAway = 1001
+	wsCloseTooBig    = 1009
+	wsCloseTryLater  = 1013
+)
+
+// formatWebSocket frames an event as one unfragmented text message, so
+// the frame cache can share it between WebSocket subscribers.
+var formatWebSocket = streamFormat{
+	name: "ws",
+	frame: func(ev repoEvent, data []byte) []byte {
+		return wsFrame(wsOpText, data)
+	},
+}
+
+// handleWebSocket serves /ws: the /events stream as WebSocket text
+// messages, one event JSON each, for clients that can't use SSE. It
+// honours ?repo=, ?prefix=, ?last_event_id= (there is no header to resume
+// with), the origin allow list and the per-IP cap.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !originAllowed(r, s.cfg.allowOrigins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if s.rejectWhileDraining(w) {
+		return
+	}
+	q := r.URL.Query()
+	match := repoFilter(q["repo"], q["prefix"])
+	ip := clientIP(r, s.cfg.trustedProxies)
+	if !s.conns.acquire(ip) {
+		slog.Warn("stream rejected", "path", r.URL.Path, "ip", ip, "reason", "SSE_MAX_CONNS_PER_IP reached")
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer s.conns.release(ip)
+	if !s.admitStream(w, r, ip) {
+		return
+	}
+	defer s.hub.leave()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	s.websockets.Add(1)
+	defer s.websockets.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	ws := &wsConn{conn: conn, brw: brw}
+	accept := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	last, _ := strconv.ParseInt(q.Get("last_event_id"), 10, 64)
+	ch, err := s.hub.subscribe(last, func(backlog []repoEvent) error {
+		for _, ev := range backlog {
+			if match != nil && !match(ev) {
+				continue
+			}
+			if err := s.writeWebSocketEvent(ws, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	defer s.hub.unsubscribe(ch)
+	slog.Debug("subscriber connected", "path", r.URL.Path, "subscribers", s.hub.subscriberCount())
+
+	// The reader answers pings and notices closes and dead peers; the
+	// writer below owns everything else.
+	gone := make(chan error, 1)
+	go func() { gone <- ws.readLoop() }()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			ws.close(wsCloseGoingAway, "server shutting down")
+			return
+		case err := <-gone:
+			if errors.Is(err, errWSTooBig) {
+				ws.close(wsCloseTooBig, "message too big")
+			}
+			slog.Debug("subscriber disconnected", "path", r.URL.Path, "err", err)
+			return
+		case <-ping.C:
+			if err := ws.write(wsOpPing, nil); err != nil {
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				// Evicted for falling behind, as on /events, or
+				// closed for shutdown.
+				if s.draining.Load() {
+					ws.close(wsCloseGoingAway, "server shutting down")
+				} else {
+					ws.close(wsCloseTryLater, "fell behind, reconnect with last_event_id")
+				}
+				return
+			}
+			if match != nil && !ev.control() && !match(ev) {
+				continue
+			}
+			if err := s.writeWebSocketEvent(ws, ev); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *server) writeWebSocketEvent(ws *wsConn, ev repoEvent) error {
+	frame, err := s.frames.get(s.enc, formatWebSocket, ev)
+	if err != nil {
+		return err
+	}
+	return ws.writeRaw(frame)
+}
+
+// originAllowed lets through requests without an Origin (not a browser),
+// same-origin requests and origins on the ALLOW_ORIGINS list. A WebSocket
+// isn't covered by CORS, so the check has to happen here.
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, a := range allowed {
+		if originMatches(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errWSTooBig = errors.New("message too big")
+
+// wsConn is the server side of one hijacked WebSocket connection. Writes
+// come from the stream loop and the reader's pongs, so they are
+// serialized.
+type wsConn struct {
+	conn net.Conn
+	brw  *bufio.ReadWriter
+
+	mu sync.Mutex
+}
+
+// wsFrame builds an unmasked, unfragmented server frame.
+func wsFrame(op byte, payload []byte) []byte {
+	n := len(payload)
+	frame := make([]byte, 0, n+10)
+	frame = append(frame, 0x80|op)
+	switch {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	return append(frame, payload...)
+}
+
+func (ws *wsConn) write(op byte, payload []byte) error {
+	return ws.writeRaw(wsFrame(op, payload))
+}
+
+// writeRaw sends a prebuilt frame. A peer that doesn't take it within
+// wsWriteTimeout is treated as gone.
+func (ws *wsConn) writeRaw(frame []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := ws.brw.Write(frame); err != nil {
+		return err
+	}
+	return ws.brw.Flush()
+}
+
+// close sends a close frame; the connection is torn down right after, so
+// the peer's answer isn't waited for.
+func (ws *wsConn) close(code uint16, reason string) {
+	ws.write(wsOpClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// readLoop reads client frames until the connection fails, closes or goes
+// quiet for wsPongWait. Pings are answered; everything else the client
+// sends is read and ignored.
+func (ws *wsConn) readLoop() error {
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsOpPing:
+			if err := ws.write(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpClose:
+			ws.write(wsOpClose, payload)
+			return errors.New("closed by client")
+		}
+	}
+}
+
+// readFrame reads one client frame and unmasks it. Fragments are read as
+// frames of their own, which is fine since their content is ignored.
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	h, err := readWSHeader(ws.brw)
+	if err != nil {
+		return 0, nil, err
+	}
+	if h.mask == nil {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	if h.length > wsMaxMessage {
+		return 0, nil, errWSTooBig
+	}
+	payload, err := h.readPayload(ws.brw)
+	return h.op, payload, err
+}
+
+// wsHeader is a parsed frame header.
+type wsHeader struct {
+	fin    bool
+	op     byte
+	length uint64
+	// mask is the masking key, nil for an unmasked frame.
+	mask []byte
+}
+
+// readWSHeader reads a frame header up to the payload: the 7-bit length
+// or its 16- or 64-bit extension, and the masking key if there is one.
+// /ws and the relay client both read frames through it.
+func readWSHeader(r io.Reader) (wsHeader, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return wsHeader{}, err
+	}
+	h := wsHeader{fin: hdr[0]&0x80 != 0, op: hdr[0] & 0x0F, length: uint64(hdr[1] & 0x7F)}
+	switch h.length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return h, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return h, err
+		}
+		h.length = binary.BigEndian.Uint64(ext[:])
+	}
+	if hdr[1]&0x80 != 0 {
+		h.mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, h.mask); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// readPayload reads the frame's payload and unmasks it. The caller checks
+// length against its limit first.
+func (h wsHeader) readPayload(r io.Reader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if h.mask != nil {
+		for i := range payload {
+			payload[i] ^= h.mask[i%4]
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// wsSampleKey and wsSampleAccept are the handshake example of RFC 6455
+// section 1.3.
+const (
+	wsSampleKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsSampleAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// wsClient is the test's end of a /ws connection. It writes masked frames
+// through relayConn, which is a WebSocket client already.
+type wsClient struct {
+	*relayConn
+}
+
+// dialWS sends an upgrade request for path with header on top of the
+// usual handshake headers and returns the server's answer. Past a 101
+// the connection stays open for frames.
+func dialWS(t *testing.T, srv *httptest.Server, method, path string, header http.Header) (*http.Response, *wsClient) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n", method, path, srv.Listener.Addr())
+	h := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-Websocket-Key":     {wsSampleKey},
+		"Sec-Websocket-Version": {"13"},
+	}
+	for k, v := range header {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			req += k + ": " + v + "\r\n"
+		}
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+	}
+	return resp, &wsClient{&relayConn{conn: conn, br: br}}
+}
+
+// next reads the next server frame, skipping pings.
+func (c *wsClient) next(t *testing.T) (byte, []byte) {
+	t.Helper()
+	for {
+		h, err := readWSHeader(c.br)
+		if err != nil {
+			t.Fatalf("reading a frame: %v", err)
+		}
+		if h.mask != nil {
+			t.Error("masked server frame")
+		}
+		payload, err := h.readPayload(c.br)
+		if err != nil {
+			t.Fatalf("reading a frame: %v", err)
+		}
+		if h.op != wsOpPing {
+			return h.op, payload
+		}
+	}
+}
+
+// nextEvent reads the next frame, which must be a text message holding an
+// event.
+func (c *wsClient) nextEvent(t *testing.T) repoEvent {
+	t.Helper()
+	op, payload := c.next(t)
+	if op != wsOpText {
+		t.Fatalf("opcode %#x, want a text frame (payload %q)", op, payload)
+	}
+	var ev repoEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatalf("text frame %q isn't an event: %v", payload, err)
+	}
+	return ev
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+	}{
+		{name: "upgraded", status: http.StatusSwitchingProtocols},
+		{name: "header tokens in lists", header: http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"WebSocket"}}, status: http.StatusSwitchingProtocols},
+		{name: "allowed origin", header: http.Header{"Origin": {"https://gittr.space"}}, status: http.StatusSwitchingProtocols},
+		{name: "wildcard origin", header: http.Header{"Origin": {"https://app.example.org"}}, status: http.StatusSwitchingProtocols},
+		{name: "disallowed origin", header: http.Header{"Origin": {"https://evil.test"}}, status: http.StatusForbidden},
+		{name: "lookalike origin", header: http.Header{"Origin": {"https://gittr.space.evil.test"}}, status: http.StatusForbidden},
+		{name: "no upgrade", header: http.Header{"Upgrade": {"h2c"}}, status: http.StatusUpgradeRequired},
+		{name: "old version", header: http.Header{"Sec-Websocket-Version": {"8"}}, status: http.StatusUpgradeRequired},
+		{name: "POST", method: http.MethodPost, status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"ALLOW_ORIGINS": "https://gittr.space,https://*.example.org"})
+			srv := serveTest(t, s)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			resp, _ := dialWS(t, srv, method, "/ws", tt.header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusSwitchingProtocols {
+				return
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsSampleAccept {
+				t.Errorf("Sec-WebSocket-Accept %q, want %q", got, wsSampleAccept)
+			}
+			if !headerHasToken(resp.Header, "Upgrade", "websocket") || !headerHasToken(resp.Header, "Connection", "upgrade") {
+				t.Errorf("101 without the upgrade headers: %v", resp.Header)
+			}
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+		})
+	}
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// buffered are published before the client connects, live after.
+		buffered, live []string
+		want           []string
+	}{
+		{
+			name:     "whole buffer, then live",
+			buffered: []string{"npub1a/one", "npub1a/two"},
+			live:     []string{"npub1a/three"},
+			want:     []string{"npub1a/one", "npub1a/two", "npub1a/three"},
+		},
+		{
+			name:     "resumed with last_event_id",
+			query:    "?last_event_id=2",
+			buffered: []string{"npub1a/one", "npub1a/two", "npub1a/three"},
+			live:     []string{"npub1a/four"},
+			want:     []string{"npub1a/three", "npub1a/four"},
+		},
+		{
+			name:     "resumed at the newest",
+			query:    "?last_event_id=2",
+			buffered: []string{"npub1a/one", "npub1a/two"},
+			live:     []string{"npub1a/three"},
+			want:     []string{"npub1a/three"},
+		},
+		{
+			name:     "filtered by repo",
+			query:    "?repo=npub1b/mine&last_event_id=1",
+			buffered: []string{"npub1b/mine", "npub1a/other", "npub1b/mine"},
+			live:     []string{"npub1a/other", "npub1b/mine"},
+			want:     []string{"npub1b/mine", "npub1b/mine"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"DEDUP_WINDOW": "0"})
+			srv := serveTest(t, s)
+			for _, repo := range tt.buffered {
+				s.emit(repoEvent{Type: "repo_cloned", Repo: repo}, 0)
+			}
+			resp, c := dialWS(t, srv, http.MethodGet, "/ws"+tt.query, nil)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+			for _, repo := range tt.live {
+				s.emit(repoEvent{Type: "repo_cloned", Repo: repo}, 0)
+			}
+			var got []string
+			var lastID int64
+			for len(got) < len(tt.want) {
+				ev := c.nextEvent(t)
+				if ev.ID <= lastID {
+					t.Errorf("event %d after %d", ev.ID, lastID)
+				}
+				lastID = ev.ID
+				got = append(got, ev.Repo)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWebSocketClientFrames checks what the reader does with frames from
+// the client: pings are answered, anything over wsMaxMessage ends the
+// connection with 1009, a close is echoed.
+func TestWebSocketClientFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      byte
+		payload []byte
+		wantOp  byte
+		// wantCode is the close code expected with a close frame.
+		wantCode uint16
+	}{
+		{name: "ping", op: wsOpPing, payload: []byte("are you there"), wantOp: wsOpPong},
+		{name: "at the limit", op: wsOpText, payload: make([]byte, wsMaxMessage), wantOp: wsOpPong},
+		{name: "one byte over", op: wsOpText, payload: make([]byte, wsMaxMessage+1), wantOp: wsOpClose, wantCode: wsCloseTooBig},
+		{name: "64-bit length", op: wsOpText, payload: make([]byte, 70000), wantOp: wsOpClose, wantCode: wsCloseTooBig},
+		{name: "close", op: wsOpClose, payload: binary.BigEndian.AppendUint16(nil, 1000), wantOp: wsOpClose, wantCode: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			srv := serveTest(t, s)
+			resp, c := dialWS(t, srv, http.MethodGet, "/ws", nil)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+			if err := c.write(tt.op, tt.payload); err != nil {
+				t.Fatal(err)
+			}
+			// A ping after an accepted frame shows the connection lives.
+			if tt.wantOp == wsOpPong && tt.op != wsOpPing {
+				if err := c.write(wsOpPing, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			op, payload := c.next(t)
+			if op != tt.wantOp {
+				t.Fatalf("opcode %#x, want %#x", op, tt.wantOp)
+			}
+			if tt.op == wsOpPing && string(payload) != string(tt.payload) {
+				t.Errorf("pong %q, want the ping's payload", payload)
+			}
+			if tt.wantOp != wsOpClose {
+				return
+			}
+			if len(payload) < 2 || binary.BigEndian.Uint16(payload) != tt.wantCode {
+				t.Errorf("close payload %q, want code %d", payload, tt.wantCode)
+			}
+			waitFor(t, func() bool { return s.hub.subscriberCount() == 0 })
+		})
+	}
+}
+
+// TestWebSocketUnmasked checks a client frame without a mask ends the
+// connection, as RFC 6455 requires.
+func TestWebSocketUnmasked(t *testing.T) {
+	s := newTestServer(t, nil)
+	srv := serveTest(t, s)
+	resp, c := dialWS(t, srv, http.MethodGet, "/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 1 })
+	if _, err := c.conn.Write(wsFrame(wsOpText, []byte("hi"))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.hub.subscriberCount() == 0 })
+	if _, err := readWSHeader(c.br); err == nil {
+		t.Errorf("read after an unmasked frame: %v, want the connection closed", err)
+	}
+}
@@ -1,3 +1,17 @@
 module github.com/arbadacarbaYK/gittr-helper-tools
 
 go 1.21.5
+
+require (
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
+	github.com/decred/dcrd/bech32 v1.1.3
+	github.com/jedisct1/go-minisign v0.0.0-20230811132847-661be99b8267
+	golang.org/x/crypto v0.24.0
+)
+
+require (
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1 // indirect
+	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
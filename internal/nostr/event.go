@@ -0,0 +1,121 @@
+// Package nostr holds the NIP-01 event both commands build and check: its
+// JSON form, the serialization its id is the hash of, and signing and
+// verifying it with the keys of internal/nostrkey.
+package nostr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+// Event is a NIP-01 event.
+type Event struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// Sign sets the event's pubkey to key's, then its id and signature.
+func (e *Event) Sign(key *nostrkey.SecretKey) error {
+	e.PubKey = hex.EncodeToString(key.PublicKey)
+	id := sha256.Sum256(e.Serialize())
+	sig, err := key.Sign(id[:])
+	if err != nil {
+		return err
+	}
+	e.ID = hex.EncodeToString(id[:])
+	e.Sig = hex.EncodeToString(sig)
+	return nil
+}
+
+// Verify checks that the event's id is the hash of its content and that
+// its signature is by its pubkey.
+func (e Event) Verify() error {
+	id, err := hex.DecodeString(e.ID)
+	if err != nil || len(id) != sha256.Size {
+		return errors.New("bad id")
+	}
+	sum := sha256.Sum256(e.Serialize())
+	if !bytes.Equal(sum[:], id) {
+		return errors.New("id doesn't match content")
+	}
+	pubkey, err1 := hex.DecodeString(e.PubKey)
+	sig, err2 := hex.DecodeString(e.Sig)
+	if err1 != nil || err2 != nil || !nostrkey.Verify(pubkey, id, sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// Tag returns the first value of the event's tag name, or "".
+func (e Event) Tag(name string) string {
+	for _, t := range e.Tags {
+		if len(t) > 1 && t[0] == name {
+			return t[1]
+		}
+	}
+	return ""
+}
+
+// Serialize is NIP-01's [0,pubkey,created_at,kind,tags,content], whose
+// SHA-256 is the event id. Strings are escaped exactly as NIP-01 says,
+// which encoding/json doesn't do (it escapes U+2028 and writes \u0008).
+func (e Event) Serialize() []byte {
+	b := []byte(`[0,`)
+	b = quote(b, e.PubKey)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, e.CreatedAt, 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(e.Kind), 10)
+	b = append(b, ",["...)
+	for i, tag := range e.Tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		for j, v := range tag {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = quote(b, v)
+		}
+		b = append(b, ']')
+	}
+	b = append(b, "],"...)
+	b = quote(b, e.Content)
+	return append(b, ']')
+}
+
+func quote(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			b = append(b, `\n`...)
+		case '"':
+			b = append(b, `\"`...)
+		case '\\':
+			b = append(b, `\\`...)
+		case '\r':
+			b = append(b, `\r`...)
+		case '\t':
+			b = append(b, `\t`...)
+		case '\b':
+			b = append(b, `\b`...)
+		case '\f':
+			b = append(b, `\f`...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
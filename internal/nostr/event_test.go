@@ -0,0 +1,129 @@
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/arbadacarbaYK/gittr-helper-tools/internal/nostrkey"
+)
+
+func TestSerialize(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   Event
+		want string
+	}{
+		{
+			name: "no tags",
+			ev:   Event{PubKey: "ab", CreatedAt: 1700000000, Kind: 1, Content: "hi"},
+			want: `[0,"ab",1700000000,1,[],"hi"]`,
+		},
+		{
+			name: "tags",
+			ev:   Event{PubKey: "ab", CreatedAt: 1, Kind: 30617, Tags: [][]string{{"d", "repo"}, {"t", "gittr", "x"}}},
+			want: `[0,"ab",1,30617,[["d","repo"],["t","gittr","x"]],""]`,
+		},
+		{
+			name: "NIP-01 escapes",
+			ev:   Event{Content: "a\"b\\c\nd\re\tf\bg\fh"},
+			want: `[0,"",0,0,[],"a\"b\\c\nd\re\tf\bg\fh"]`,
+		},
+		{
+			// encoding/json would escape <, > and & and write \u0001.
+			name: "left as they are",
+			ev:   Event{Content: "<a>& \x01é"},
+			want: "[0,\"\",0,0,[],\"<a>& \x01é\"]",
+		},
+		{
+			// The id is over the content alone; id and sig don't take part.
+			name: "id and sig left out",
+			ev:   Event{ID: "ff", Sig: "ee", PubKey: "ab", Kind: 1},
+			want: `[0,"ab",0,1,[],""]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tt.ev.Serialize()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	key, err := nostrkey.ParseSecretKey(strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := nostrkey.ParseSecretKey(strings.Repeat("02", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func() Event {
+		ev := Event{CreatedAt: 1700000000, Kind: 30617, Tags: [][]string{{"d", "repo"}}, Content: "line\none"}
+		if err := ev.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	ev := signed()
+	if ev.PubKey != hex.EncodeToString(key.PublicKey) {
+		t.Errorf("pubkey %s, want the key's", ev.PubKey)
+	}
+	if sum := sha256.Sum256(ev.Serialize()); ev.ID != hex.EncodeToString(sum[:]) {
+		t.Errorf("id %s isn't the hash of the serialization", ev.ID)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*Event)
+		want   string
+	}{
+		{name: "untouched"},
+		{name: "content changed", tamper: func(e *Event) { e.Content = "other" }, want: "id doesn't match content"},
+		{name: "tag added", tamper: func(e *Event) { e.Tags = append(e.Tags, []string{"t", "x"}) }, want: "id doesn't match content"},
+		{name: "id not hex", tamper: func(e *Event) { e.ID = "zz" }, want: "bad id"},
+		{name: "id short", tamper: func(e *Event) { e.ID = e.ID[:32] }, want: "bad id"},
+		{
+			name: "signed by another key",
+			tamper: func(e *Event) {
+				o := Event{CreatedAt: e.CreatedAt, Kind: e.Kind, Tags: e.Tags, Content: e.Content}
+				if err := o.Sign(other); err != nil {
+					t.Fatal(err)
+				}
+				e.Sig = o.Sig
+			},
+			want: "bad signature",
+		},
+		{name: "sig not hex", tamper: func(e *Event) { e.Sig = "zz" }, want: "bad signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := signed()
+			if tt.tamper != nil {
+				tt.tamper(&ev)
+			}
+			err := ev.Verify()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Verify: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Verify: %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTag(t *testing.T) {
+	ev := Event{Tags: [][]string{{"t"}, {"d", "first"}, {"d", "second"}}}
+	for name, want := range map[string]string{"d": "first", "t": "", "x": ""} {
+		if got := ev.Tag(name); got != want {
+			t.Errorf("Tag(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
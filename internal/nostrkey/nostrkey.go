@@ -0,0 +1,105 @@
+// Package nostrkey holds the Nostr key handling both commands share: BIP-340
+// Schnorr signing and verification on secp256k1, and the NIP-19 nsec/npub
+// encodings. The curve arithmetic is btcec's, which is constant-time where
+// the secret key is involved.
+package nostrkey
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/decred/dcrd/bech32"
+)
+
+// SecretKey is a secret key ready for BIP-340 signing.
+type SecretKey struct {
+	priv *btcec.PrivateKey
+	// PublicKey is the 32-byte x-only public key.
+	PublicKey []byte
+}
+
+// NewSecretKey wraps a 32-byte secret key, refusing zero and values not
+// below the curve order instead of reducing them.
+func NewSecretKey(secret []byte) (*SecretKey, error) {
+	var d btcec.ModNScalar
+	if len(secret) != 32 || d.SetByteSlice(secret) || d.IsZero() {
+		return nil, errors.New("secret key out of range")
+	}
+	priv := btcec.PrivKeyFromScalar(&d)
+	return &SecretKey{priv: priv, PublicKey: schnorr.SerializePubKey(priv.PubKey())}, nil
+}
+
+// ParseSecretKey accepts a secret key as an nsec1 bech32 string or as 64
+// hex digits.
+func ParseSecretKey(v string) (*SecretKey, error) {
+	secret, err := parseKey(v, "nsec")
+	if err != nil {
+		return nil, err
+	}
+	return NewSecretKey(secret)
+}
+
+// Sign returns the 64-byte BIP-340 signature of the 32-byte msg, with fresh
+// auxiliary randomness for the nonce.
+func (k *SecretKey) Sign(msg []byte) ([]byte, error) {
+	var aux [32]byte
+	if _, err := rand.Read(aux[:]); err != nil {
+		return nil, err
+	}
+	sig, err := schnorr.Sign(k.priv, msg, schnorr.CustomNonce(aux))
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// Verify reports whether sig is a valid BIP-340 signature of the 32-byte
+// msg by the x-only pubkey.
+func Verify(pubkey, msg, sig []byte) bool {
+	pub, err := schnorr.ParsePubKey(pubkey)
+	if err != nil {
+		return false
+	}
+	s, err := schnorr.ParseSignature(sig)
+	return err == nil && s.Verify(msg, pub)
+}
+
+// ParsePublicKey accepts a public key as an npub1 bech32 string or as 64
+// hex digits.
+func ParsePublicKey(v string) ([]byte, error) {
+	return parseKey(v, "npub")
+}
+
+// EncodeNpub is the NIP-19 npub form of a public key, as gittr uses in repo
+// names.
+func EncodeNpub(pubkey []byte) string {
+	s, err := bech32.EncodeFromBase256("npub", pubkey)
+	if err != nil {
+		// Only an invalid HRP or data longer than bech32 allows fail,
+		// neither of which a 32-byte key can be.
+		panic(err)
+	}
+	return s
+}
+
+func parseKey(v, hrp string) ([]byte, error) {
+	if strings.HasPrefix(strings.ToLower(v), hrp+"1") {
+		got, data, err := bech32.DecodeToBase256(v)
+		if err != nil {
+			return nil, err
+		}
+		if got != hrp || len(data) != 32 {
+			return nil, errors.New("not an " + hrp + " key")
+		}
+		return data, nil
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("expected " + hrp + "1... or 64 hex digits")
+	}
+	return b, nil
+}
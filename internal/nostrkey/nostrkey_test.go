@@ -0,0 +1,201 @@
+package nostrkey
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Vectors from BIP-340's test-vectors.csv.
+func TestVerifyBIP340Vectors(t *testing.T) {
+	tests := []struct {
+		name   string
+		pubkey string
+		msg    string
+		sig    string
+		want   bool
+	}{
+		{
+			name:   "vector 0",
+			pubkey: "F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			msg:    "0000000000000000000000000000000000000000000000000000000000000000",
+			sig:    "E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+			want:   true,
+		},
+		{
+			name:   "vector 1",
+			pubkey: "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			msg:    "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig:    "6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+			want:   true,
+		},
+		{
+			name:   "vector 5, public key not on the curve",
+			pubkey: "EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34",
+			msg:    "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig:    "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+			want:   false,
+		},
+		{
+			name:   "vector 1 with a flipped signature bit",
+			pubkey: "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			msg:    "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig:    "6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0B",
+			want:   false,
+		},
+		{
+			name:   "short signature",
+			pubkey: "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			msg:    "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig:    "6896BD60",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Verify(mustHex(t, tt.pubkey), mustHex(t, tt.msg), mustHex(t, tt.sig))
+			if got != tt.want {
+				t.Errorf("Verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicKeyDerivation(t *testing.T) {
+	tests := []struct {
+		secret string
+		pubkey string
+	}{
+		// BIP-340 vectors 0 and 1.
+		{"0000000000000000000000000000000000000000000000000000000000000003", "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"},
+		{"b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef", "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659"},
+		// NIP-19's example key, given as nsec.
+		{"nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5", "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"},
+	}
+	for _, tt := range tests {
+		k, err := ParseSecretKey(tt.secret)
+		if err != nil {
+			t.Fatalf("ParseSecretKey(%s): %v", tt.secret, err)
+		}
+		if got := hex.EncodeToString(k.PublicKey); got != tt.pubkey {
+			t.Errorf("public key of %s = %s, want %s", tt.secret, got, tt.pubkey)
+		}
+	}
+}
+
+func TestSignVerifies(t *testing.T) {
+	k, err := ParseSecretKey("nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte{0x42}, 32)
+	sig, err := k.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("signature is %d bytes, want 64", len(sig))
+	}
+	if !Verify(k.PublicKey, msg, sig) {
+		t.Error("signature doesn't verify")
+	}
+	other := bytes.Repeat([]byte{0x43}, 32)
+	if Verify(k.PublicKey, other, sig) {
+		t.Error("signature verifies for another message")
+	}
+	again, err := k.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sig, again) {
+		t.Error("two signatures share a nonce; aux randomness isn't used")
+	}
+}
+
+func TestNewSecretKeyRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"zero", strings.Repeat("00", 32)},
+		{"curve order", "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141"},
+		{"above the order", strings.Repeat("ff", 32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSecretKey(mustHex(t, tt.secret)); err == nil {
+				t.Error("accepted an out-of-range secret")
+			}
+		})
+	}
+	if _, err := NewSecretKey(make([]byte, 31)); err == nil {
+		t.Error("accepted a 31-byte secret")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		public  bool
+		want    string
+		wantErr bool
+	}{
+		{name: "npub", in: "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg", public: true, want: "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"},
+		{name: "hex public", in: "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e", public: true, want: "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"},
+		{name: "nsec where npub expected", in: "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5", public: true, wantErr: true},
+		{name: "bad checksum", in: "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptq", public: true, wantErr: true},
+		{name: "short hex", in: "7e7e9c42", public: true, wantErr: true},
+		{name: "npub where nsec expected", in: "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got []byte
+				err error
+			)
+			if tt.public {
+				got, err = ParsePublicKey(tt.in)
+			} else {
+				var k *SecretKey
+				if k, err = ParseSecretKey(tt.in); err == nil {
+					got = k.PublicKey
+				}
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsed %s", tt.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("got %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeNpubRoundTrip(t *testing.T) {
+	pub := mustHex(t, "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e")
+	npub := EncodeNpub(pub)
+	if npub != "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg" {
+		t.Errorf("EncodeNpub = %s", npub)
+	}
+	back, err := ParsePublicKey(npub)
+	if err != nil || !bytes.Equal(back, pub) {
+		t.Errorf("ParsePublicKey(EncodeNpub) = %x, %v", back, err)
+	}
+}